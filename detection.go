@@ -0,0 +1,76 @@
+package tcpdumper
+
+import (
+	"github.com/google/gopacket/reassembly"
+)
+
+// DefaultDetectThreshold 默认的协议检测阈值，得分必须大于此值才会被选中
+const DefaultDetectThreshold = 50
+
+// ConflictPolicy 多个检测器同时超过阈值时的冲突处理策略
+type ConflictPolicy int
+
+const (
+	// ConflictHighestScore 得分最高者胜出；得分相同时优先级高者胜出，仍相同时先注册者胜出
+	ConflictHighestScore ConflictPolicy = iota
+	// ConflictHighestPriority 优先级最高者胜出；优先级相同时得分高者胜出，仍相同时先注册者胜出
+	ConflictHighestPriority
+)
+
+// String 返回策略名称
+func (cp ConflictPolicy) String() string {
+	switch cp {
+	case ConflictHighestScore:
+		return "highest-score"
+	case ConflictHighestPriority:
+		return "highest-priority"
+	}
+	return "unknown"
+}
+
+// DetectorScore 单个检测器在一次检测中的得分
+type DetectorScore struct {
+	Name       string // 协议名称
+	Confidence int    // 检测器返回的原始置信度
+	PortBoost  int    // 命中首选端口带来的加成
+	Score      int    // 最终得分（原始置信度+端口加成，最高100）
+	Priority   int    // 检测器优先级
+}
+
+// DetectionResult 一次协议检测的详细结果，用于解释协议识别过程
+type DetectionResult struct {
+	StreamInfo StreamInfo                  // 流信息
+	Dir        reassembly.TCPFlowDirection // 触发检测的数据方向
+	Attempt    int                         // 该流的第几次检测（从1开始，仅调试回调中有效）
+	Threshold  int                         // 检测时使用的阈值
+	Policy     ConflictPolicy              // 检测时使用的冲突策略
+	Scores     []DetectorScore             // 所有检测器的得分，按注册顺序排列
+	Selected   string                      // 选中的协议名称，为空表示没有选中
+	Fallback   bool                        // 是否通过兜底端口选中
+	Pending    bool                        // 未选中协议且流将等待更多数据后重新检测
+}
+
+// DetectionDebugHandler 协议检测调试回调
+// 启用后每个流的每次检测都会回调一次，包含所有检测器的得分
+type DetectionDebugHandler func(result *DetectionResult)
+
+// candidate 超过阈值的候选检测器
+type candidate struct {
+	entry *detectorEntry
+	score int
+	index int
+}
+
+// better 按冲突策略判断候选c是否优于other
+func (c candidate) better(other candidate, policy ConflictPolicy) bool {
+	if policy == ConflictHighestPriority && c.entry.priority != other.entry.priority {
+		return c.entry.priority > other.entry.priority
+	}
+	if c.score != other.score {
+		return c.score > other.score
+	}
+	if c.entry.priority != other.entry.priority {
+		return c.entry.priority > other.entry.priority
+	}
+	return c.index < other.index
+}
@@ -0,0 +1,370 @@
+package tcpdumper
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxDetectBytes 每个方向为协议检测缓存的最大字节数
+// 超过此长度仍无法识别协议时，放弃检测并使用默认处理器
+const maxDetectBytes = 4096
+
+// maxProtocolSwitches 单个流允许的最大协议切换次数，防止处理器之间反复切换
+const maxProtocolSwitches = 8
+
+// ProtocolSwitch 协议切换请求
+// 处理器在 ProcessData 中返回此错误（可以被包装），表示流的剩余数据不再由自己处理：
+// 当前处理器会被关闭，剩余数据交给指定名称的协议，Protocol为空时交给注册表重新检测。
+// 用于 HTTP CONNECT 隧道、WebSocket/h2c Upgrade、STARTTLS 等场景
+type ProtocolSwitch struct {
+	Protocol   string // 目标协议名称，为空表示重新检测
+	ClientData []byte // 处理器已收到但属于新协议的客户端到服务器数据
+	ServerData []byte // 处理器已收到但属于新协议的服务器到客户端数据
+}
+
+func (ps *ProtocolSwitch) Error() string {
+	if ps.Protocol == "" {
+		return "switch protocol: re-detect"
+	}
+	return "switch protocol: " + ps.Protocol
+}
+
+// SwitchProtocol 创建协议切换请求，供处理器在 ProcessData 中返回
+// protocol为空表示重新检测；clientData/serverData 是已收到但属于新协议的数据，会先交给新协议
+func SwitchProtocol(protocol string, clientData, serverData []byte) error {
+	return &ProtocolSwitch{Protocol: protocol, ClientData: clientData, ServerData: serverData}
+}
+
+// Dispatcher 协议分发器
+// 对一个流进行协议检测，并把数据交给识别出的协议处理器；处理器可以通过返回 ProtocolSwitch 切换协议。
+// 在识别出协议之前，每个方向最多缓存 maxDetectBytes 字节用于检测，识别完成后缓存的数据按原始顺序交给处理器。
+// Dispatcher 本身实现了 ProtocolProcessor，可以嵌套使用，例如把隧道或解密后的数据重新交给注册表识别
+type Dispatcher struct {
+	registry                *ProtocolRegistry
+	streamInfo              StreamInfo
+	defaultProcessorFactory DefaultProcessorFactory
+	onUnknown               func() // 使用默认处理器时回调，用于统计
+
+	mu             sync.Mutex
+	processor      ProtocolProcessor
+	detected       bool
+	detectAttempts int // 已进行的协议检测次数
+	switches       int // 已进行的协议切换次数
+	sawSYN         bool
+	closed         bool
+
+	// 协议检测阶段缓存的数据
+	detectData [2][]byte      // 每个方向已观察到的初始数据，最多maxDetectBytes
+	pending    []pendingChunk // 检测完成前收到的数据块，检测完成后按顺序交给处理器
+
+	debugResults []*DetectionResult // 持锁期间产生的检测结果，释放锁后交给调试回调
+}
+
+// pendingChunk 协议检测完成前缓存的数据块
+type pendingChunk struct {
+	data       []byte
+	dir        reassembly.TCPFlowDirection
+	start, end bool
+	ts         time.Time
+}
+
+// dirIndex 将方向转换为数组下标
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+// processTimedData 把数据交给处理器，处理器实现了 TimedProcessor 时同时传递时间戳
+func processTimedData(processor ProtocolProcessor, data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if tp, ok := processor.(TimedProcessor); ok {
+		return tp.ProcessTimedData(data, dir, start, end, ts)
+	}
+	return processor.ProcessData(data, dir, start, end)
+}
+
+// NewDispatcher 创建协议分发器
+// defaultProcessorFactory 为没有协议匹配时使用的默认处理器工厂，可以为nil
+func NewDispatcher(registry *ProtocolRegistry, streamInfo StreamInfo, defaultProcessorFactory DefaultProcessorFactory) *Dispatcher {
+	return &Dispatcher{
+		registry:                registry,
+		streamInfo:              streamInfo,
+		defaultProcessorFactory: defaultProcessorFactory,
+	}
+}
+
+// SetSawSYN 设置是否观察到了SYN，供协议检测参考
+func (d *Dispatcher) SetSawSYN(sawSYN bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sawSYN = sawSYN
+}
+
+// SetProtocol 在收到数据之前指定协议，跳过内容检测，用于已通过其他方式（如TLS的ALPN）得知协议的场景
+// 协议未注册或已经开始检测时返回false，此时仍按内容检测
+func (d *Dispatcher) SetProtocol(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.detected || d.closed || len(d.pending) > 0 {
+		return false
+	}
+	detector := d.registry.Lookup(name)
+	if detector == nil {
+		return false
+	}
+	d.processor = detector.CreateProcessor(d.streamInfo)
+	d.detected = true
+	return true
+}
+
+// ProcessData 处理流数据：检测协议或交给已识别的协议处理器
+// 处理器返回的 ProtocolSwitch 在内部处理，不会返回给调用者
+func (d *Dispatcher) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return d.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理带时间戳的流数据，时间戳会传给实现了 TimedProcessor 的处理器
+func (d *Dispatcher) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	d.mu.Lock()
+	defer d.unlock()
+	if d.closed || len(data) == 0 {
+		return nil
+	}
+	return d.handle(pendingChunk{data: data, dir: dir, start: start, end: end, ts: ts})
+}
+
+// unlock 释放d.mu，然后把持锁期间产生的检测结果交给调试回调，回调不会在持锁时执行
+func (d *Dispatcher) unlock() {
+	results := d.debugResults
+	d.debugResults = nil
+	d.mu.Unlock()
+
+	if len(results) == 0 {
+		return
+	}
+	if debugHandler := d.registry.debug(); debugHandler != nil {
+		for _, result := range results {
+			debugHandler(result)
+		}
+	}
+}
+
+// handle 处理一个数据块，调用者需持有d.mu
+func (d *Dispatcher) handle(chunk pendingChunk) error {
+	if d.detected {
+		return d.deliver(chunk)
+	}
+
+	// 协议检测（在识别出协议或放弃检测之前，数据先缓存起来）
+	// 调用者的数据在返回后可能被复用（如重组器的页面），需要拷贝
+	data, dir, end := chunk.data, chunk.dir, chunk.end
+	chunk.data = append([]byte(nil), data...)
+	d.pending = append(d.pending, chunk)
+	idx := dirIndex(dir)
+	if room := maxDetectBytes - len(d.detectData[idx]); room > 0 {
+		if room > len(data) {
+			room = len(data)
+		}
+		d.detectData[idx] = append(d.detectData[idx], data[:room]...)
+	}
+
+	d.detect(dir, end)
+	if !d.detected {
+		// 等待更多数据后再检测
+		return nil
+	}
+	return d.flushPending()
+}
+
+// flushPending 把检测阶段缓存的数据按顺序交给处理器，调用者需持有d.mu
+// 如果处理过程中发生了协议切换，剩余的数据会进入新一轮检测
+func (d *Dispatcher) flushPending() error {
+	pending := d.pending
+	d.pending = nil
+
+	var errs []error
+	for _, chunk := range pending {
+		if err := d.handle(chunk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver 将数据交给协议处理器，并处理协议切换请求，调用者需持有d.mu
+func (d *Dispatcher) deliver(chunk pendingChunk) error {
+	if d.processor == nil {
+		return nil
+	}
+
+	err := processTimedData(d.processor, chunk.data, chunk.dir, chunk.start, chunk.end, chunk.ts)
+	var ps *ProtocolSwitch
+	if errors.As(err, &ps) {
+		return d.switchProtocol(ps, chunk.ts)
+	}
+	return err
+}
+
+// switchProtocol 关闭当前处理器，把剩余数据交给指定协议或重新检测，调用者需持有d.mu
+// ts 为触发切换的数据块的时间戳，用作剩余数据的时间戳
+func (d *Dispatcher) switchProtocol(ps *ProtocolSwitch, ts time.Time) error {
+	// 剩余数据可能引用调用者的缓冲区，先拷贝
+	leftover := [2][]byte{
+		append([]byte(nil), ps.ClientData...),
+		append([]byte(nil), ps.ServerData...),
+	}
+
+	var errs []error
+	from := d.processor.GetProtocolName()
+	if err := d.processor.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	d.processor = nil
+
+	d.switches++
+	if d.switches > maxProtocolSwitches {
+		// 丢弃该流剩余的数据
+		d.detected = true
+		return errors.Join(append(errs, fmt.Errorf("too many protocol switches (last from %s)", from))...)
+	}
+
+	d.detected = false
+	d.detectData = [2][]byte{}
+	d.pending = nil
+	if ps.Protocol != "" {
+		if detector := d.registry.Lookup(ps.Protocol); detector != nil {
+			d.processor = detector.CreateProcessor(d.streamInfo)
+			d.detected = true
+		} else {
+			errs = append(errs, fmt.Errorf("switch from %s to unknown protocol %q, re-detecting", from, ps.Protocol))
+		}
+	}
+
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		if len(leftover[i]) == 0 || d.closed {
+			continue
+		}
+		if err := d.handle(pendingChunk{data: leftover[i], dir: dir, ts: ts}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// detect 使用已缓存的数据进行协议检测，调用者需持有d.mu
+// 没有检测器匹配时，如果还可能获得更多上下文（对端尚未发送数据且缓存未满），则继续等待；
+// 否则放弃内容检测，按端口兜底或使用默认处理器
+func (d *Dispatcher) detect(dir reassembly.TCPFlowDirection, end bool) {
+	ctx := &DetectContext{
+		StreamInfo: d.streamInfo,
+		Dir:        dir,
+		ClientData: d.detectData[0],
+		ServerData: d.detectData[1],
+		SawSYN:     d.sawSYN,
+	}
+
+	// 调试模式下记录所有检测器的得分
+	var result *DetectionResult
+	if d.registry.debug() != nil {
+		result = &DetectionResult{}
+		d.debugResults = append(d.debugResults, result)
+	}
+	d.detectAttempts++
+
+	detector := d.registry.detectContent(ctx, result)
+	if result != nil {
+		result.Attempt = d.detectAttempts
+	}
+	if detector != nil {
+		d.processor = detector.CreateProcessor(d.streamInfo)
+		d.detected = true
+		if result != nil {
+			result.Selected = detector.Name()
+		}
+		return
+	}
+
+	idx := dirIndex(dir)
+	peerSeen := len(d.detectData[1-idx]) > 0
+	if !end && !peerSeen && len(d.detectData[idx]) < maxDetectBytes {
+		if result != nil {
+			result.Pending = true
+		}
+		return
+	}
+
+	d.giveUpDetection(result)
+}
+
+// giveUpDetection 内容检测失败，按端口兜底，仍未命中则使用默认处理器，调用者需持有d.mu
+func (d *Dispatcher) giveUpDetection(result *DetectionResult) {
+	d.detected = true // 标记为已检测，避免重复检测
+
+	if detector := d.registry.PortFallback(d.streamInfo); detector != nil {
+		d.processor = detector.CreateProcessor(d.streamInfo)
+		if result != nil {
+			result.Selected = detector.Name()
+			result.Fallback = true
+		}
+		return
+	}
+
+	if d.defaultProcessorFactory != nil {
+		d.processor = d.defaultProcessorFactory(d.streamInfo)
+		// 协议切换后的数据无法识别时不重复计入未知流
+		if d.onUnknown != nil && d.switches == 0 {
+			d.onUnknown()
+		}
+	}
+}
+
+// Close 结束流：仍未完成检测时放弃检测并把缓存的数据交给兜底/默认处理器，然后关闭处理器
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	defer d.unlock()
+	if d.closed {
+		return nil
+	}
+
+	var errs []error
+	if !d.detected && len(d.pending) > 0 {
+		var result *DetectionResult
+		if d.registry.debug() != nil {
+			d.detectAttempts++
+			result = &DetectionResult{
+				StreamInfo: d.streamInfo,
+				Attempt:    d.detectAttempts,
+				Threshold:  d.registry.Threshold(),
+			}
+			d.debugResults = append(d.debugResults, result)
+		}
+		d.giveUpDetection(result)
+		if err := d.flushPending(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	d.closed = true
+
+	// 关闭协议处理器
+	if d.processor != nil {
+		if err := d.processor.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetProtocolName 获取当前协议处理器的协议名称，尚未识别时返回空字符串
+func (d *Dispatcher) GetProtocolName() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.processor == nil {
+		return ""
+	}
+	return d.processor.GetProtocolName()
+}
@@ -0,0 +1,274 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// connectProcessor 测试用的CONNECT处理器，收到2xx响应后把剩余数据交给注册表重新检测
+type connectProcessor struct {
+	recordProcessor
+	established bool
+}
+
+func (cp *connectProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	cp.recordProcessor.ProcessData(data, dir, start, end)
+	if dir != reassembly.TCPDirServerToClient || !bytes.HasPrefix(data, []byte("HTTP/1.1 200")) {
+		return nil
+	}
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil
+	}
+	cp.established = true
+	return SwitchProtocol("", nil, data[i+4:])
+}
+
+// registerTunnelProtocols 注册CONNECT和TLS两个测试协议，返回创建的处理器
+func registerTunnelProtocols(registry *ProtocolRegistry) (connects *[]*connectProcessor, tlss *[]*recordProcessor) {
+	connects = &[]*connectProcessor{}
+	tlss = &[]*recordProcessor{}
+	RegisterSimpleProtocol(registry, "CONNECT", "CONNECT ", func(streamInfo StreamInfo) ProtocolProcessor {
+		cp := &connectProcessor{recordProcessor: recordProcessor{name: "CONNECT"}}
+		*connects = append(*connects, cp)
+		return cp
+	})
+	RegisterSignatureProtocol(registry, Signature{
+		Name:  "TLS",
+		Rules: []SignatureRule{{Hex: "16 03 0?"}},
+	}, func(streamInfo StreamInfo) ProtocolProcessor {
+		rp := &recordProcessor{name: "TLS"}
+		*tlss = append(*tlss, rp)
+		return rp
+	})
+	return connects, tlss
+}
+
+// 测试处理器返回 ProtocolSwitch 后剩余数据交给注册表重新检测
+func TestDispatcherSwitchRedetect(t *testing.T) {
+	registry := NewProtocolRegistry()
+	connects, tlss := registerTunnelProtocols(registry)
+
+	d := NewDispatcher(registry, StreamInfo{DstPort: "8080"}, nil)
+	assert.NoError(t, d.ProcessData([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, d.ProcessData([]byte("HTTP/1.1 200 OK\r\n\r\n"), reassembly.TCPDirServerToClient, false, false))
+	assert.Equal(t, "", d.GetProtocolName())
+
+	assert.NoError(t, d.ProcessData([]byte("\x16\x03\x01hello"), reassembly.TCPDirClientToServer, false, false))
+	assert.Equal(t, "TLS", d.GetProtocolName())
+	assert.NoError(t, d.ProcessData([]byte("\x16\x03\x03server"), reassembly.TCPDirServerToClient, false, false))
+	assert.NoError(t, d.Close())
+
+	if assert.Len(t, *connects, 1) && assert.Len(t, *tlss, 1) {
+		assert.True(t, (*connects)[0].established)
+		assert.True(t, (*connects)[0].closed)
+		assert.Equal(t, []string{"client->server:\x16\x03\x01hello", "server->client:\x16\x03\x03server"}, (*tlss)[0].chunks)
+		assert.True(t, (*tlss)[0].closed)
+	}
+}
+
+// 测试切换时携带的剩余数据会先交给新协议
+func TestDispatcherSwitchLeftoverData(t *testing.T) {
+	registry := NewProtocolRegistry()
+	_, tlss := registerTunnelProtocols(registry)
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	d.ProcessData([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"), reassembly.TCPDirClientToServer, false, false)
+	d.ProcessData([]byte("HTTP/1.1 200 OK\r\n\r\n\x16\x03\x03server"), reassembly.TCPDirServerToClient, false, false)
+	assert.Equal(t, "TLS", d.GetProtocolName())
+	d.Close()
+
+	if assert.Len(t, *tlss, 1) {
+		assert.Equal(t, []string{"server->client:\x16\x03\x03server"}, (*tlss)[0].chunks)
+	}
+}
+
+// 测试切换到指定名称的协议
+func TestDispatcherSwitchNamedProtocol(t *testing.T) {
+	registry := NewProtocolRegistry()
+	var ws *recordProcessor
+	RegisterSimpleProtocol(registry, "HTTP", "GET ", func(streamInfo StreamInfo) ProtocolProcessor {
+		return &switchingProcessor{name: "HTTP", target: "WebSocket", trigger: "HTTP/1.1 101"}
+	})
+	RegisterProtocol(registry, "WebSocket", fixedConfidence(0), func(streamInfo StreamInfo) ProtocolProcessor {
+		ws = &recordProcessor{name: "WebSocket"}
+		return ws
+	})
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	d.ProcessData([]byte("GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n\r\n"), reassembly.TCPDirClientToServer, false, false)
+	assert.NoError(t, d.ProcessData([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"), reassembly.TCPDirServerToClient, false, false))
+	assert.Equal(t, "WebSocket", d.GetProtocolName())
+	d.ProcessData([]byte("\x81\x05hello"), reassembly.TCPDirClientToServer, false, false)
+	d.Close()
+
+	if assert.NotNil(t, ws) {
+		assert.Equal(t, []string{"client->server:\x81\x05hello"}, ws.chunks)
+	}
+
+	// 目标协议不存在时返回错误并重新检测
+	d = NewDispatcher(registry, StreamInfo{}, nil)
+	registry.Unregister("WebSocket")
+	d.ProcessData([]byte("GET /chat HTTP/1.1\r\n\r\n"), reassembly.TCPDirClientToServer, false, false)
+	err := d.ProcessData([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"), reassembly.TCPDirServerToClient, false, false)
+	assert.ErrorContains(t, err, `unknown protocol "WebSocket"`)
+	assert.Equal(t, "", d.GetProtocolName())
+}
+
+// switchingProcessor 收到以trigger开头的数据时切换到target协议
+type switchingProcessor struct {
+	name    string
+	target  string
+	trigger string
+	forward bool // 是否把触发切换的数据交给新协议
+}
+
+func (sp *switchingProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	if strings.HasPrefix(string(data), sp.trigger) {
+		var leftover []byte
+		if sp.forward {
+			leftover = data
+		}
+		// 包装后的切换请求同样有效
+		return fmt.Errorf("upgrade: %w", SwitchProtocol(sp.target, leftover, nil))
+	}
+	return nil
+}
+
+func (sp *switchingProcessor) Close() error            { return nil }
+func (sp *switchingProcessor) GetProtocolName() string { return sp.name }
+
+// 测试协议切换次数有上限
+func TestDispatcherTooManySwitches(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "Loop", "x", func(streamInfo StreamInfo) ProtocolProcessor {
+		return &switchingProcessor{name: "Loop", target: "Loop", trigger: "x", forward: true}
+	})
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	err := d.ProcessData([]byte("x"), reassembly.TCPDirClientToServer, false, false)
+	assert.ErrorContains(t, err, "too many protocol switches")
+	assert.NoError(t, d.ProcessData([]byte("x"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, d.Close())
+}
+
+// 测试预先指定协议时跳过内容检测
+func TestDispatcherSetProtocol(t *testing.T) {
+	registry := NewProtocolRegistry()
+	var rp *recordProcessor
+	RegisterProtocol(registry, "HTTP2", fixedConfidence(0), func(streamInfo StreamInfo) ProtocolProcessor {
+		rp = &recordProcessor{name: "HTTP2"}
+		return rp
+	})
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	assert.False(t, d.SetProtocol("SPDY"))
+	assert.True(t, d.SetProtocol("HTTP2"))
+	assert.False(t, d.SetProtocol("HTTP2"))
+	assert.Equal(t, "HTTP2", d.GetProtocolName())
+	assert.NoError(t, d.ProcessData([]byte("\x00\x00\x00\x04"), reassembly.TCPDirServerToClient, false, false))
+	assert.NoError(t, d.Close())
+	if assert.NotNil(t, rp) {
+		assert.Equal(t, []string{"server->client:\x00\x00\x00\x04"}, rp.chunks)
+		assert.True(t, rp.closed)
+	}
+
+	// 已开始检测后不能再指定
+	d = NewDispatcher(registry, StreamInfo{}, nil)
+	assert.NoError(t, d.ProcessData([]byte("abc"), reassembly.TCPDirClientToServer, false, false))
+	assert.False(t, d.SetProtocol("HTTP2"))
+}
+
+// 测试调试回调在释放锁之后执行，回调中可以访问分发器
+func TestDispatcherDebugHandlerUnlocked(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "SSH", "SSH-", newTestProcessorFactory())
+
+	var d *Dispatcher
+	var selected []string
+	registry.SetDebugHandler(func(result *DetectionResult) {
+		selected = append(selected, result.Selected+"/"+d.GetProtocolName())
+	})
+
+	d = NewDispatcher(registry, StreamInfo{}, nil)
+	assert.NoError(t, d.ProcessData([]byte("SSH-2.0\r\n"), reassembly.TCPDirClientToServer, false, false))
+	assert.Equal(t, []string{"SSH/Test"}, selected)
+
+	// 关闭时放弃检测
+	d = NewDispatcher(registry, StreamInfo{}, nil)
+	assert.NoError(t, d.ProcessData([]byte("x"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, d.Close())
+	assert.Equal(t, []string{"SSH/Test", "/", "/"}, selected)
+}
+
+// 回归测试：CONNECT隧道中的TLS流量被重新识别
+func TestConnectTunnelPcap(t *testing.T) {
+	dumper := NewFileDumper("pcap_data/connect_https.pcapng")
+	connects, tlss := registerTunnelProtocols(dumper.Registry())
+	dumper.SetDefaultProcessor(func(streamInfo StreamInfo) ProtocolProcessor {
+		return &recordProcessor{name: "Unknown"}
+	})
+
+	assert.NoError(t, dumper.Start())
+	dumper.Wait()
+
+	_, tcpStreams, _, unknownFlows := dumper.GetStats()
+	assert.Equal(t, uint64(1), tcpStreams)
+	assert.Equal(t, uint64(0), unknownFlows)
+	if assert.Len(t, *connects, 1) && assert.Len(t, *tlss, 1) {
+		connect := (*connects)[0]
+		assert.True(t, connect.established)
+		assert.Len(t, connect.chunks, 2)
+		assert.True(t, strings.HasPrefix(connect.chunks[0], "client->server:CONNECT ip.bmh.im:443 HTTP/1.1\r\n"))
+
+		tls := (*tlss)[0]
+		assert.True(t, tls.closed)
+		if assert.NotEmpty(t, tls.chunks) {
+			assert.True(t, strings.HasPrefix(tls.chunks[0], "client->server:\x16\x03\x01"), "first TLS chunk should be the ClientHello")
+		}
+		for _, chunk := range tls.chunks {
+			assert.False(t, strings.Contains(chunk, "HTTP/1.1"))
+		}
+	}
+}
+
+// 回归测试：从CONNECT响应之后开始的抓包不会产生未知流或错误
+func TestConnectTunnelFromResponsePcap(t *testing.T) {
+	dumper := NewFileDumper("pcap_data/connect_https_from_response.pcapng")
+	registerTunnelProtocols(dumper.Registry())
+
+	assert.NoError(t, dumper.Start())
+	dumper.Wait()
+
+	_, tcpStreams, errs, unknownFlows := dumper.GetStats()
+	assert.Equal(t, uint64(1), tcpStreams)
+	assert.Equal(t, uint64(0), errs)
+	assert.Equal(t, uint64(0), unknownFlows)
+}
+
+// 测试处理器返回的普通错误原样返回
+func TestDispatcherProcessorError(t *testing.T) {
+	registry := NewProtocolRegistry()
+	boom := errors.New("boom")
+	RegisterSimpleProtocol(registry, "Err", "e", func(streamInfo StreamInfo) ProtocolProcessor {
+		return &errorProcessor{err: boom}
+	})
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	assert.ErrorIs(t, d.ProcessData([]byte("e"), reassembly.TCPDirClientToServer, false, false), boom)
+}
+
+// errorProcessor 总是返回错误的测试处理器
+type errorProcessor struct{ err error }
+
+func (ep *errorProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return ep.err
+}
+func (ep *errorProcessor) Close() error            { return nil }
+func (ep *errorProcessor) GetProtocolName() string { return "Err" }
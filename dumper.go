@@ -23,6 +23,10 @@ type TCPDumper struct {
 	assembler *reassembly.Assembler
 	factory   *tcpStreamFactory
 
+	// UDP流跟踪，使用单独的注册表
+	udpRegistry *ProtocolRegistry
+	udp         *udpTracker
+
 	// 默认处理器
 	defaultProcessorFactory DefaultProcessorFactory
 
@@ -36,6 +40,8 @@ type TCPDumper struct {
 		tcpStreams   uint64
 		errors       uint64
 		unknownFlows uint64 // 未知协议流的数量
+		udpDatagrams uint64 // 交给UDP流跟踪的数据报数量
+		udpFlows     uint64
 	}
 	mu sync.RWMutex
 }
@@ -49,10 +55,12 @@ func NewTCPDumper(options *CaptureOptions) *TCPDumper {
 	}
 
 	dumper := &TCPDumper{
-		registry: NewProtocolRegistry(),
-		options:  options,
-		stopChan: make(chan struct{}),
+		registry:    NewProtocolRegistry(),
+		udpRegistry: NewProtocolRegistry(),
+		options:     options,
+		stopChan:    make(chan struct{}),
 	}
+	dumper.udp = newUDPTracker(dumper.udpRegistry, dumper, options.UDPIdleTimeout)
 
 	// 创建TCP流工厂
 	dumper.factory = &tcpStreamFactory{
@@ -69,22 +77,77 @@ func NewTCPDumper(options *CaptureOptions) *TCPDumper {
 }
 
 // RegisterProtocolDetector 注册协议检测器
-func (td *TCPDumper) RegisterProtocolDetector(detector ProtocolDetector) {
-	td.registry.Register(detector)
+func (td *TCPDumper) RegisterProtocolDetector(detector ProtocolDetector, opts ...RegisterOption) {
+	td.registry.Register(detector, opts...)
+}
+
+// RegisterUDPProtocolDetector 注册UDP协议检测器
+// UDP检测器与TCP检测器使用相同的接口，但在单独的注册表中：每个数据报作为一个数据块交给检测器和处理器。
+// 注册了UDP检测器后才会跟踪UDP流
+func (td *TCPDumper) RegisterUDPProtocolDetector(detector ProtocolDetector, opts ...RegisterOption) {
+	td.udpRegistry.Register(detector, opts...)
 }
 
 // RegisterSimpleProtocol 注册简单协议（基于字符串前缀匹配）
-func (td *TCPDumper) RegisterSimpleProtocol(name, pattern string, processorFactory func(StreamInfo) ProtocolProcessor) {
-	RegisterSimpleProtocol(td.registry, name, pattern, processorFactory)
+func (td *TCPDumper) RegisterSimpleProtocol(name, pattern string, processorFactory func(StreamInfo) ProtocolProcessor, opts ...RegisterOption) {
+	RegisterSimpleProtocol(td.registry, name, pattern, processorFactory, opts...)
 }
 
 // RegisterPatternProtocol 注册方向敏感的协议
-func (td *TCPDumper) RegisterPatternProtocol(name, clientPattern, serverPattern string, processorFactory func(StreamInfo) ProtocolProcessor) {
-	RegisterPatternProtocol(td.registry, name, clientPattern, serverPattern, processorFactory)
+func (td *TCPDumper) RegisterPatternProtocol(name, clientPattern, serverPattern string, processorFactory func(StreamInfo) ProtocolProcessor, opts ...RegisterOption) {
+	RegisterPatternProtocol(td.registry, name, clientPattern, serverPattern, processorFactory, opts...)
+}
+
+// RegisterSignatureProtocol 注册基于签名的协议（正则表达式、十六进制字节模式等）
+func (td *TCPDumper) RegisterSignatureProtocol(sig Signature, processorFactory func(StreamInfo) ProtocolProcessor, opts ...RegisterOption) error {
+	return RegisterSignatureProtocol(td.registry, sig, processorFactory, opts...)
+}
+
+// LoadSignatureFile 从YAML/JSON文件加载协议签名，内置处理器输出到标准输出
+func (td *TCPDumper) LoadSignatureFile(path string) error {
+	return LoadSignatureFile(td.registry, path, nil)
+}
+
+// ReloadSignatureFile 重新加载签名文件，原子地替换之前从该文件加载的签名
+// 已经识别出协议的流继续使用原来的处理器，新的流使用新的签名
+func (td *TCPDumper) ReloadSignatureFile(path string) error {
+	return ReloadSignatureFile(td.registry, path, nil)
+}
+
+// UnregisterProtocol 注销指定名称的协议检测器，返回注销的数量
+func (td *TCPDumper) UnregisterProtocol(name string) int {
+	return td.registry.Unregister(name)
+}
+
+// Registry 获取协议注册表，用于替换检测器等高级操作
+func (td *TCPDumper) Registry() *ProtocolRegistry {
+	return td.registry
+}
+
+// UDPRegistry 获取UDP协议注册表
+func (td *TCPDumper) UDPRegistry() *ProtocolRegistry {
+	return td.udpRegistry
+}
+
+// SetDetectThreshold 设置协议检测阈值（默认50），得分必须大于阈值才会被选中
+func (td *TCPDumper) SetDetectThreshold(threshold int) {
+	td.registry.SetThreshold(threshold)
+}
+
+// SetConflictPolicy 设置多个协议同时匹配时的冲突处理策略
+func (td *TCPDumper) SetConflictPolicy(policy ConflictPolicy) {
+	td.registry.SetConflictPolicy(policy)
+}
+
+// SetDetectionDebug 设置协议检测调试回调，为nil时关闭调试
+// 启用后每个流的每次检测都会回调所有检测器的得分，便于分析误识别；
+// 回调在抓包goroutine中、释放流的锁之后执行
+func (td *TCPDumper) SetDetectionDebug(handler DetectionDebugHandler) {
+	td.registry.SetDebugHandler(handler)
 }
 
 // SetDefaultProcessor 设置默认处理器工厂
-// 当没有任何协议匹配时，将使用此工厂创建处理器来处理TCP流
+// 当没有任何协议匹配时，将使用此工厂创建处理器来处理TCP流和UDP流（UDP的每个数据块是一个数据报）
 func (td *TCPDumper) SetDefaultProcessor(factory DefaultProcessorFactory) {
 	td.defaultProcessorFactory = factory
 	if td.factory != nil {
@@ -147,17 +210,27 @@ func (td *TCPDumper) Wait() {
 	// 强制清理所有TCP流，确保ReassemblyComplete被调用
 	td.assembler.FlushAll()
 
+	// 关闭所有UDP流
+	td.udp.flushAll()
+
 	// 等待所有TCP流处理完成
 	td.factory.WaitGoRoutines()
 }
 
-// GetStats 获取统计信息
+// GetStats 获取统计信息，errors和unknownFlows包括UDP流
 func (td *TCPDumper) GetStats() (packets, tcpStreams, errors, unknownFlows uint64) {
 	td.mu.RLock()
 	defer td.mu.RUnlock()
 	return td.stats.packets, td.stats.tcpStreams, td.stats.errors, td.stats.unknownFlows
 }
 
+// GetUDPStats 获取UDP统计信息：交给UDP流跟踪的数据报数量和UDP流数量
+func (td *TCPDumper) GetUDPStats() (datagrams, flows uint64) {
+	td.mu.RLock()
+	defer td.mu.RUnlock()
+	return td.stats.udpDatagrams, td.stats.udpFlows
+}
+
 // GetRegisteredProtocols 获取已注册的协议列表
 func (td *TCPDumper) GetRegisteredProtocols() []string {
 	return td.registry.GetRegisteredProtocols()
@@ -192,6 +265,10 @@ func (td *TCPDumper) packetLoop() {
 			if defragger != nil {
 				defragger.DiscardOlderThan(time.Now().Add(-10 * time.Second))
 			}
+			// 实时抓包时按当前时间清理空闲的UDP流，读取文件时按数据报的时间清理（见 udpTracker.datagram）
+			if td.options.PcapFile == "" {
+				td.udp.expire(time.Now().Add(-td.udp.timeout))
+			}
 
 		case packet := <-packets:
 			if packet == nil {
@@ -246,6 +323,11 @@ func (td *TCPDumper) processPacket(packet gopacket.Packet, defragger *ip4defrag.
 				&Context{CaptureInfo: packet.Metadata().CaptureInfo},
 			)
 		}
+	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil && td.udp.enabled() {
+		// 处理UDP层
+		if netLayer := packet.NetworkLayer(); netLayer != nil {
+			td.udp.datagram(netLayer.NetworkFlow(), udpLayer.(*layers.UDP), packet.Metadata().Timestamp)
+		}
 	}
 }
 
@@ -7,6 +7,9 @@ require (
 	github.com/google/gopacket v1.1.20-0.20250319234736-b7d9dbd15ae4
 )
 
-require golang.org/x/sys v0.0.0-20200217220822-9197077df867 // indirect
+require (
+	golang.org/x/sys v0.41.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
 
 replace github.com/LubyRuffy/tcpdumper => ../../
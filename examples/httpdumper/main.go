@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -12,20 +11,22 @@ import (
 	"time"
 
 	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http2"
+	"github.com/LubyRuffy/tcpdumper/protocols/tls"
 	"github.com/google/gopacket/reassembly"
 )
 
 // HTTPProcessor HTTP协议处理器实现
 type HTTPProcessor struct {
-	ident     string
-	isConnect bool
+	ident      string
+	isConnect  bool
+	tunnelData []byte // CONNECT响应之前客户端已发送的隧道数据
 
 	mutex    sync.Mutex
 	requests []*http.Request // 请求列表
 	reqIndex int             // 当前读取的偏移
 
-	requestBuf  *bytes.Buffer
-	responseBuf *bytes.Buffer
+	reader *tcpdumper.ReaderProcessor // 把两个方向转换为io.Reader交给net/http解析
 }
 
 func (hp *HTTPProcessor) appendRequest(req *http.Request) {
@@ -54,31 +55,38 @@ func (hp *HTTPProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirectio
 	// 检查是否是CONNECT方法
 	if dir == reassembly.TCPDirClientToServer && strings.HasPrefix(dataStr, "CONNECT ") {
 		hp.isConnect = true
-		fmt.Printf("HTTP/%s [%s]: CONNECT method detected, switching to tunnel mode\n", hp.ident, dir)
+		fmt.Printf("HTTP/%s [%s]: CONNECT method detected, waiting for response\n", hp.ident, dir)
 		return nil
 	}
 
-	// 如果是CONNECT模式，跳过HTTP解析
+	// 如果是CONNECT模式，收到响应后把隧道交给注册表重新识别内层协议
 	if hp.isConnect {
-		fmt.Printf("HTTP/%s [%s]: Tunnel data (%d bytes)\n", hp.ident, dir, len(data))
+		if dir == reassembly.TCPDirClientToServer {
+			hp.tunnelData = append(hp.tunnelData, data...)
+			return nil
+		}
+		if i := strings.Index(dataStr, "\r\n\r\n"); i >= 0 && strings.HasPrefix(dataStr, "HTTP/1.") {
+			fmt.Printf("HTTP/%s [%s]: %s, switching to tunnel mode\n", hp.ident, dir, strings.SplitN(dataStr, "\r\n", 2)[0])
+			return tcpdumper.SwitchProtocol("", hp.tunnelData, data[i+4:])
+		}
 		return nil
 	}
 
-	// 正常HTTP处理
-	if dir == reassembly.TCPDirClientToServer {
-		hp.mutex.Lock()
-		hp.requestBuf.Write(data)
-		hp.mutex.Unlock()
-	} else {
-		hp.mutex.Lock()
-		hp.responseBuf.Write(data)
-		hp.mutex.Unlock()
+	// 101 Switching Protocols（WebSocket、h2c等）之后的数据交给注册表重新识别
+	if dir == reassembly.TCPDirServerToClient && strings.HasPrefix(dataStr, "HTTP/1.1 101 ") {
+		if i := strings.Index(dataStr, "\r\n\r\n"); i >= 0 {
+			fmt.Printf("HTTP/%s [%s]: Upgrade accepted, switching protocol\n", hp.ident, dir)
+			return tcpdumper.SwitchProtocol("", nil, data[i+4:])
+		}
 	}
 
-	return nil
+	// 正常HTTP处理
+	return hp.reader.ProcessData(data, dir, start, end)
 }
 
 func (hp *HTTPProcessor) Close() error {
+	// 等待请求和响应解析完成
+	hp.reader.Close()
 	fmt.Printf("HTTP/%s: Connection closed\n", hp.ident)
 	return nil
 }
@@ -87,15 +95,16 @@ func (hp *HTTPProcessor) GetProtocolName() string {
 	return "HTTP"
 }
 
-func (hp *HTTPProcessor) Run() {
-	go func() {
-		buf := bufio.NewReader(hp.requestBuf)
-		for {
-			_, err := buf.Peek(1)
-			if err != nil {
-				return
-			}
+// handle 解析一个方向的HTTP消息，在读取器适配器的goroutine中运行
+func (hp *HTTPProcessor) handle(streamInfo tcpdumper.StreamInfo, dir reassembly.TCPFlowDirection, r io.Reader) {
+	buf := bufio.NewReader(r)
+	for {
+		_, err := buf.Peek(1)
+		if err != nil {
+			return
+		}
 
+		if dir == reassembly.TCPDirClientToServer {
 			req, err := http.ReadRequest(buf)
 			if err != nil {
 				log.Println("ReadRequest error:", err)
@@ -106,17 +115,7 @@ func (hp *HTTPProcessor) Run() {
 
 			hp.appendRequest(req)
 			fmt.Println(req)
-		}
-	}()
-
-	go func() {
-		buf := bufio.NewReader(hp.responseBuf)
-		for {
-			_, err := buf.Peek(1)
-			if err != nil {
-				return
-			}
-
+		} else {
 			req := hp.getLastRequest()
 
 			resp, err := http.ReadResponse(buf, req)
@@ -129,7 +128,7 @@ func (hp *HTTPProcessor) Run() {
 
 			fmt.Println(resp)
 		}
-	}()
+	}
 }
 
 // HTTPDetector HTTP协议检测器
@@ -157,7 +156,8 @@ func (hd *HTTPDetector) Detect(data []byte, dir reassembly.TCPFlowDirection) int
 		}
 	} else {
 		// 检测HTTP响应
-		if strings.HasPrefix(dataStr, "HTTP/1.") || strings.HasPrefix(dataStr, "HTTP/2") {
+		// HTTP/2不使用文本状态行，由 protocols/http2 通过连接前言识别
+		if strings.HasPrefix(dataStr, "HTTP/1.") {
 			return 90
 		}
 	}
@@ -171,11 +171,9 @@ func (hd *HTTPDetector) Name() string {
 
 func (hd *HTTPDetector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
 	hp := &HTTPProcessor{
-		ident:       streamInfo.Ident,
-		requestBuf:  &bytes.Buffer{},
-		responseBuf: &bytes.Buffer{},
+		ident: streamInfo.Ident,
 	}
-	hp.Run()
+	hp.reader = tcpdumper.NewReaderProcessor("HTTP", streamInfo, tcpdumper.ReaderConfig{}, hp.handle)
 	return hp
 }
 
@@ -190,6 +188,11 @@ func main() {
 
 	// 注册HTTP协议检测器
 	dumper.RegisterProtocolDetector(&HTTPDetector{})
+	// 注册h2c，识别prior knowledge连接和Upgrade: h2c之后的HTTP/2流量
+	http2.Register(dumper.Registry(), http2.Config{})
+
+	// 注册TLS，识别CONNECT隧道中的HTTPS流量并输出握手信息
+	tls.Register(dumper.Registry(), tls.Config{})
 
 	// 显示已注册的协议
 	protocols := dumper.GetRegisteredProtocols()
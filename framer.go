@@ -0,0 +1,213 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+// ErrFrameTooLarge 消息超过最大长度，无法再同步消息边界
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Framer 消息分帧器，从字节流中切分出完整的消息
+// 与 bufio.SplitFunc 类似：返回消费的字节数和一条消息，数据不足时返回 (0, nil, nil)；
+// atEOF为true表示该方向不会再有数据；返回错误表示无法再同步消息边界。
+// Framer 不应保存状态，同一个 Framer 可以被多个流和两个方向共用
+type Framer interface {
+	Frame(data []byte, atEOF bool) (advance int, message []byte, err error)
+}
+
+// LengthPrefixFramer 长度前缀分帧器，消息包含长度字段（格式见 LengthPrefixConfig）
+type LengthPrefixFramer struct {
+	config LengthPrefixConfig
+}
+
+// NewLengthPrefixFramer 创建长度前缀分帧器，配置无效时返回错误
+func NewLengthPrefixFramer(config LengthPrefixConfig) (*LengthPrefixFramer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &LengthPrefixFramer{config: config}, nil
+}
+
+func (lf *LengthPrefixFramer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	total, ok, err := lf.config.messageLength(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrFrameTooLarge, err)
+	}
+	if !ok {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	return total, data[:total], nil
+}
+
+// DelimiterFramer 分隔符分帧器，消息不包含分隔符；流结束时没有分隔符结尾的剩余数据作为最后一条消息
+type DelimiterFramer struct {
+	delimiter []byte
+	maxSize   int
+}
+
+// NewDelimiterFramer 创建分隔符分帧器，maxSize为单条消息的最大长度（0为默认4096）
+func NewDelimiterFramer(delimiter []byte, maxSize int) (*DelimiterFramer, error) {
+	if len(delimiter) == 0 {
+		return nil, fmt.Errorf("empty delimiter")
+	}
+	if maxSize < 0 {
+		return nil, fmt.Errorf("negative max size %d", maxSize)
+	}
+	if maxSize == 0 {
+		maxSize = defaultMaxLineLength
+	}
+	return &DelimiterFramer{delimiter: append([]byte(nil), delimiter...), maxSize: maxSize}, nil
+}
+
+func (df *DelimiterFramer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.Index(data, df.delimiter); i >= 0 {
+		if i > df.maxSize {
+			return 0, nil, ErrFrameTooLarge
+		}
+		return i + len(df.delimiter), data[:i], nil
+	}
+	if len(data) > df.maxSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// FixedSizeFramer 固定长度分帧器
+type FixedSizeFramer struct {
+	size int
+}
+
+// NewFixedSizeFramer 创建固定长度分帧器
+func NewFixedSizeFramer(size int) (*FixedSizeFramer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid frame size %d", size)
+	}
+	return &FixedSizeFramer{size: size}, nil
+}
+
+func (ff *FixedSizeFramer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) >= ff.size {
+		return ff.size, data[:ff.size], nil
+	}
+	if atEOF && len(data) > 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return 0, nil, nil
+}
+
+// FramedProcessor 分帧处理器，按 Framer 切分每个方向的数据，每次只把一条完整消息交给内部处理器
+// 消息跨越多个数据块或一个数据块包含多条消息时，内部处理器都只会收到完整的消息。
+// 交给内部处理器的消息在返回后可能被复用，需要保留时请拷贝。
+// 某个方向分帧失败后，该方向后续的数据被丢弃
+type FramedProcessor struct {
+	processor ProtocolProcessor
+	framer    Framer
+	buf       [2][]byte // 每个方向未完成的消息
+	started   [2]bool   // 该方向是否已交付过消息
+	broken    [2]bool   // 该方向是否已无法继续分帧
+}
+
+// NewFramedProcessor 创建分帧处理器
+func NewFramedProcessor(processor ProtocolProcessor, framer Framer) *FramedProcessor {
+	return &FramedProcessor{processor: processor, framer: framer}
+}
+
+// Framed 包装处理器工厂，使创建的处理器收到完整的消息
+func Framed(framer Framer, processorFactory func(StreamInfo) ProtocolProcessor) func(StreamInfo) ProtocolProcessor {
+	return func(streamInfo StreamInfo) ProtocolProcessor {
+		return NewFramedProcessor(processorFactory(streamInfo), framer)
+	}
+}
+
+func (fp *FramedProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return fp.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理带时间戳的数据，消息的时间戳为其最后一个数据块的时间戳
+func (fp *FramedProcessor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	idx := dirIndex(dir)
+	if fp.broken[idx] {
+		return nil
+	}
+	return fp.drain(dir, append(fp.buf[idx], data...), end, ts)
+}
+
+// drain 切分并交付缓冲区中所有完整的消息，剩余数据保留到下次
+func (fp *FramedProcessor) drain(dir reassembly.TCPFlowDirection, buf []byte, atEOF bool, ts time.Time) error {
+	idx := dirIndex(dir)
+	var errs []error
+	for len(buf) > 0 {
+		advance, message, err := fp.framer.Frame(buf, atEOF)
+		if err != nil {
+			// 无法再同步消息边界，放弃该方向后续数据
+			fp.broken[idx] = true
+			fp.buf[idx] = nil
+			return errors.Join(append(errs, fmt.Errorf("%s framing: %w", fp.processor.GetProtocolName(), err))...)
+		}
+		if advance <= 0 {
+			break
+		}
+
+		buf = buf[advance:]
+		start := !fp.started[idx]
+		fp.started[idx] = true
+		err = processTimedData(fp.processor, message, dir, start, atEOF && len(buf) == 0, ts)
+
+		var ps *ProtocolSwitch
+		if errors.As(err, &ps) {
+			// 尚未分帧的数据属于新协议
+			return fp.switchProtocol(ps, dir, buf)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	fp.buf[idx] = append(fp.buf[idx][:0], buf...)
+	return errors.Join(errs...)
+}
+
+// switchProtocol 把两个方向尚未交付的数据追加到协议切换请求中
+func (fp *FramedProcessor) switchProtocol(ps *ProtocolSwitch, dir reassembly.TCPFlowDirection, rest []byte) error {
+	leftover := fp.buf
+	leftover[dirIndex(dir)] = rest
+	fp.buf = [2][]byte{}
+	return &ProtocolSwitch{
+		Protocol:   ps.Protocol,
+		ClientData: append(append([]byte(nil), ps.ClientData...), leftover[0]...),
+		ServerData: append(append([]byte(nil), ps.ServerData...), leftover[1]...),
+	}
+}
+
+func (fp *FramedProcessor) Close() error {
+	// 流结束，交付没有结束标记的剩余数据（如最后一行）
+	var errs []error
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		if fp.broken[i] || len(fp.buf[i]) == 0 {
+			continue
+		}
+		if err := fp.drain(dir, fp.buf[i], true, time.Time{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := fp.processor.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (fp *FramedProcessor) GetProtocolName() string {
+	return fp.processor.GetProtocolName()
+}
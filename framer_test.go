@@ -0,0 +1,97 @@
+package tcpdumper
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试长度前缀分帧：消息跨越数据块、多条消息合并在一个数据块中
+func TestFramedProcessorLengthPrefix(t *testing.T) {
+	framer, err := NewLengthPrefixFramer(LengthPrefixConfig{LengthSize: 2, ByteOrder: binary.BigEndian})
+	assert.NoError(t, err)
+	inner := &recordProcessor{name: "DNS"}
+	fp := NewFramedProcessor(inner, framer)
+
+	assert.NoError(t, fp.ProcessData([]byte{0, 3, 'a'}, reassembly.TCPDirClientToServer, true, false))
+	assert.Empty(t, inner.chunks)
+	assert.NoError(t, fp.ProcessData([]byte{'b', 'c', 0, 1, 'd', 0}, reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, fp.ProcessData([]byte{0, 2, 'e'}, reassembly.TCPDirServerToClient, false, false))
+	assert.NoError(t, fp.ProcessData([]byte{2, 'x', 'y'}, reassembly.TCPDirClientToServer, false, false))
+	assert.Equal(t, []string{
+		"client->server:\x00\x03abc",
+		"client->server:\x00\x01d",
+		"client->server:\x00\x02xy",
+	}, inner.chunks)
+
+	// 服务器方向不完整的消息在流结束时报告错误
+	assert.ErrorIs(t, fp.Close(), io.ErrUnexpectedEOF)
+	assert.True(t, inner.closed)
+	assert.Equal(t, "DNS", fp.GetProtocolName())
+}
+
+// 测试分隔符分帧
+func TestFramedProcessorDelimiter(t *testing.T) {
+	framer, err := NewDelimiterFramer([]byte("\r\n"), 8)
+	assert.NoError(t, err)
+	inner := &recordProcessor{name: "Line"}
+	fp := NewFramedProcessor(inner, framer)
+
+	fp.ProcessData([]byte("PING\r"), reassembly.TCPDirClientToServer, false, false)
+	fp.ProcessData([]byte("\nQUIT\r\nlast"), reassembly.TCPDirClientToServer, false, false)
+	assert.NoError(t, fp.Close())
+	assert.Equal(t, []string{"client->server:PING", "client->server:QUIT", "client->server:last"}, inner.chunks)
+
+	// 超过最大长度仍没有分隔符时放弃该方向
+	inner = &recordProcessor{name: "Line"}
+	fp = NewFramedProcessor(inner, framer)
+	assert.ErrorIs(t, fp.ProcessData([]byte("0123456789"), reassembly.TCPDirServerToClient, false, false), ErrFrameTooLarge)
+	assert.NoError(t, fp.ProcessData([]byte("ok\r\n"), reassembly.TCPDirServerToClient, false, false))
+	assert.Empty(t, inner.chunks)
+
+	_, err = NewDelimiterFramer(nil, 0)
+	assert.Error(t, err)
+}
+
+// 测试固定长度分帧
+func TestFramedProcessorFixedSize(t *testing.T) {
+	framer, err := NewFixedSizeFramer(3)
+	assert.NoError(t, err)
+	inner := &recordProcessor{name: "Fixed"}
+	fp := NewFramedProcessor(inner, framer)
+
+	fp.ProcessData([]byte("abcde"), reassembly.TCPDirServerToClient, false, false)
+	fp.ProcessData([]byte("f"), reassembly.TCPDirServerToClient, false, true)
+	assert.Equal(t, []string{"server->client:abc", "server->client:def"}, inner.chunks)
+	assert.NoError(t, fp.Close())
+
+	_, err = NewFixedSizeFramer(0)
+	assert.Error(t, err)
+}
+
+// 测试内部处理器切换协议时，尚未分帧的数据交给新协议
+func TestFramedProcessorSwitchProtocol(t *testing.T) {
+	framer, _ := NewDelimiterFramer([]byte("\r\n"), 0)
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "SMTP", "EHLO", Framed(framer, func(streamInfo StreamInfo) ProtocolProcessor {
+		return &switchingProcessor{name: "SMTP", target: "TLS", trigger: "220 Ready"}
+	}))
+	var tls *recordProcessor
+	RegisterProtocol(registry, "TLS", fixedConfidence(0), func(streamInfo StreamInfo) ProtocolProcessor {
+		tls = &recordProcessor{name: "TLS"}
+		return tls
+	})
+
+	d := NewDispatcher(registry, StreamInfo{}, nil)
+	d.ProcessData([]byte("EHLO x\r\nSTARTTLS\r\n"), reassembly.TCPDirClientToServer, false, false)
+	d.ProcessData([]byte("220 Ready\r\n\x16\x03\x03"), reassembly.TCPDirServerToClient, false, false)
+	assert.Equal(t, "TLS", d.GetProtocolName())
+	d.Close()
+
+	if assert.NotNil(t, tls) {
+		assert.Equal(t, []string{"server->client:\x16\x03\x03"}, tls.chunks)
+	}
+}
@@ -3,13 +3,17 @@ module github.com/LubyRuffy/tcpdumper
 go 1.24.2
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/google/gopacket v1.1.20-0.20250319234736-b7d9dbd15ae4
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.48.0
+	golang.org/x/net v0.50.0
+	google.golang.org/protobuf v1.36.9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20200217220822-9197077df867 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.41.0 // indirect
 )
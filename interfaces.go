@@ -10,6 +10,7 @@ import (
 
 // ProtocolProcessor TCP协议处理器接口
 // 上层应用需要实现此接口来处理特定协议的数据
+// 所有方法都在抓包goroutine中调用，处理器及其回调不应长时间阻塞，否则会拖慢抓包并导致丢包
 type ProtocolProcessor interface {
 	// ProcessData 处理TCP流数据
 	// data: 数据内容
@@ -25,12 +26,24 @@ type ProtocolProcessor interface {
 	GetProtocolName() string
 }
 
+// TimedProcessor 需要数据时间戳的协议处理器接口（可选扩展）
+// 实现此接口的处理器会收到 ProcessTimedData 调用代替 ProcessData，
+// ts 为数据块第一个数据包的抓包时间，用于计算请求耗时等
+type TimedProcessor interface {
+	ProtocolProcessor
+
+	// ProcessTimedData 处理带时间戳的TCP流数据，参数含义与 ProcessData 相同
+	ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error
+}
+
 // ProtocolDetector 协议检测器接口
 // 用于检测TCP流中的应用层协议
 type ProtocolDetector interface {
 	// Detect 检测协议，返回置信度 (0-100)
 	// 置信度越高表示越可能是该协议
 	// 只有置信度>50才会被选中
+	// data 可能来自任一方向，客户端先发送数据的协议可以只检测客户端方向，对服务器方向返回0
+	// 需要双向数据或流信息的检测器可以额外实现 ContextProtocolDetector
 	Detect(data []byte, dir reassembly.TCPFlowDirection) int
 
 	// Name 获取协议名称
@@ -40,6 +53,38 @@ type ProtocolDetector interface {
 	CreateProcessor(streamInfo StreamInfo) ProtocolProcessor
 }
 
+// ContextProtocolDetector 支持检测上下文的协议检测器接口（可选扩展）
+// 实现此接口的检测器在检测时会收到双向的初始数据、流信息等上下文，
+// 适用于服务器先发言的协议（SMTP、FTP、MySQL、SSH）或需要对端响应才能确认的协议
+type ContextProtocolDetector interface {
+	ProtocolDetector
+
+	// DetectWithContext 基于检测上下文检测协议，返回置信度 (0-100)
+	DetectWithContext(ctx *DetectContext) int
+}
+
+// DetectContext 协议检测上下文
+type DetectContext struct {
+	StreamInfo StreamInfo                  // 流信息
+	Dir        reassembly.TCPFlowDirection // 触发本次检测的数据方向
+	ClientData []byte                      // 已观察到的客户端到服务器方向的初始数据
+	ServerData []byte                      // 已观察到的服务器到客户端方向的初始数据
+	SawSYN     bool                        // 是否观察到了SYN包（为false时方向可能是根据第一个数据包推断的）
+}
+
+// Data 获取指定方向已观察到的初始数据
+func (ctx *DetectContext) Data(dir reassembly.TCPFlowDirection) []byte {
+	if dir == reassembly.TCPDirClientToServer {
+		return ctx.ClientData
+	}
+	return ctx.ServerData
+}
+
+// CurrentData 获取触发本次检测方向的初始数据
+func (ctx *DetectContext) CurrentData() []byte {
+	return ctx.Data(ctx.Dir)
+}
+
 // StreamInfo TCP流信息
 type StreamInfo struct {
 	SrcIP   string // 源IP地址
@@ -61,6 +106,8 @@ type CaptureOptions struct {
 	Promiscuous bool          // 是否启用混杂模式
 	Timeout     time.Duration // pcap读取超时时间
 	BPFFilter   string        // BPF过滤器表达式，如 "tcp port 80"
+
+	UDPIdleTimeout time.Duration // UDP流的空闲超时，0为默认30秒
 }
 
 // DefaultCaptureOptions 返回默认的抓包配置
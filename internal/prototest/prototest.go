@@ -0,0 +1,43 @@
+// Package prototest 提供协议处理器测试共用的辅助函数，只在测试中使用
+package prototest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// Start Feed 输入第一条数据的时间
+var Start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Step 同一方向上按顺序输入的若干条数据
+type Step struct {
+	Dir  reassembly.TCPFlowDirection
+	Data [][]byte
+}
+
+// C2S 客户端发出的数据，每个参数是一次输入
+func C2S(data ...[]byte) Step {
+	return Step{Dir: reassembly.TCPDirClientToServer, Data: data}
+}
+
+// S2C 服务器发出的数据，每个参数是一次输入
+func S2C(data ...[]byte) Step {
+	return Step{Dir: reassembly.TCPDirServerToClient, Data: data}
+}
+
+// Feed 按顺序输入数据，时间从 Start 开始，每条间隔1ms；处理器返回错误时测试失败
+func Feed(t *testing.T, p tcpdumper.TimedProcessor, steps ...Step) {
+	t.Helper()
+	ts := Start
+	for _, step := range steps {
+		for _, data := range step.Data {
+			if err := p.ProcessTimedData(data, step.Dir, false, false, ts); err != nil {
+				t.Errorf("%s data at %v: %v", step.Dir, ts.Sub(Start), err)
+			}
+			ts = ts.Add(time.Millisecond)
+		}
+	}
+}
@@ -1,7 +1,14 @@
 package tcpdumper
 
-import "io"
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
 
+// RWPipe 基于io.Pipe的同步管道，Write会阻塞直到读取方读取完数据
 type RWPipe struct {
 	r *io.PipeReader
 	w *io.PipeWriter
@@ -17,6 +24,16 @@ func (p *RWPipe) Close() error {
 	return nil
 }
 
+// CloseWithError 关闭写入端，读取端读完已写入的数据后返回err（err为nil时返回io.EOF）
+func (p *RWPipe) CloseWithError(err error) error {
+	return p.w.CloseWithError(err)
+}
+
+// CloseRead 关闭读取端，之后的Write返回io.ErrClosedPipe
+func (p *RWPipe) CloseRead() error {
+	return p.r.Close()
+}
+
 func (p *RWPipe) Write(data []byte) (n int, err error) {
 	return p.w.Write(data)
 }
@@ -32,3 +49,275 @@ func NewRWPipe() *RWPipe {
 		w: w,
 	}
 }
+
+// defaultPipeLimit 有界管道默认最多缓冲的字节数
+const defaultPipeLimit = 1024 * 1024
+
+var (
+	// ErrPipeFull 缓冲区已满，数据被丢弃（OverflowDropNewest）
+	ErrPipeFull = errors.New("pipe buffer full, data dropped")
+	// ErrPipeOverflow 缓冲区溢出，管道后续的所有数据被丢弃（OverflowDropStream）
+	ErrPipeOverflow = errors.New("pipe buffer overflow, stream data dropped")
+)
+
+// OverflowPolicy 有界管道缓冲区满时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 阻塞写入直到读取方消费数据或写入超时
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest 丢弃放不下的数据块，Write返回 ErrPipeFull，之后的数据块照常写入
+	OverflowDropNewest
+	// OverflowDropStream 丢弃溢出时及之后的所有数据，读取方读完已缓冲的数据后收到 ErrPipeOverflow
+	OverflowDropStream
+)
+
+// String 返回策略名称
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropStream:
+		return "drop-stream"
+	}
+	return "unknown"
+}
+
+// PipeStats 有界管道的统计信息
+type PipeStats struct {
+	Buffered      int   // 当前缓冲的字节数
+	WrittenBytes  int64 // 写入缓冲区的字节数
+	ReadBytes     int64 // 已被读取的字节数
+	DroppedBytes  int64 // 因缓冲区满被丢弃的字节数
+	DroppedWrites int64 // 因缓冲区满被丢弃（或部分丢弃）的写入次数
+}
+
+// BufferedPipe 有界缓冲管道
+// 与 RWPipe 不同，写入的数据先进入缓冲区，读取方未及时读取时写入方不会被阻塞，
+// 缓冲区满时按 OverflowPolicy 阻塞或丢弃数据。读写两端都支持超时
+type BufferedPipe struct {
+	limit  int
+	policy OverflowPolicy
+
+	mu       sync.Mutex
+	buf      []byte
+	off      int           // buf中未读数据的起始位置
+	notify   chan struct{} // 状态变化时关闭并替换，用于唤醒等待者
+	wclosed  bool
+	werr     error
+	rclosed  bool
+	overflow bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	stats         PipeStats
+}
+
+// NewBufferedPipe 创建有界缓冲管道，limit为最多缓冲的字节数（0为默认1MB）
+func NewBufferedPipe(limit int, policy OverflowPolicy) *BufferedPipe {
+	if limit <= 0 {
+		limit = defaultPipeLimit
+	}
+	return &BufferedPipe{
+		limit:  limit,
+		policy: policy,
+		notify: make(chan struct{}),
+	}
+}
+
+// broadcast 唤醒所有等待者，调用者需持有p.mu
+func (p *BufferedPipe) broadcast() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// wait 等待状态变化或超时，调用者需持有p.mu，等待期间会释放锁
+func (p *BufferedPipe) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	notify := p.notify
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// buffered 当前缓冲的字节数，调用者需持有p.mu
+func (p *BufferedPipe) buffered() int {
+	return len(p.buf) - p.off
+}
+
+// push 追加数据到缓冲区，调用者需持有p.mu
+func (p *BufferedPipe) push(data []byte) {
+	// 已读部分超过一半时整理缓冲区，避免无限增长
+	if p.off > 0 && p.off >= len(p.buf)/2 {
+		n := copy(p.buf, p.buf[p.off:])
+		p.buf = p.buf[:n]
+		p.off = 0
+	}
+	p.buf = append(p.buf, data...)
+	p.stats.WrittenBytes += int64(len(data))
+	p.broadcast()
+}
+
+// drop 记录被丢弃的数据，调用者需持有p.mu
+func (p *BufferedPipe) drop(n int) {
+	p.stats.DroppedBytes += int64(n)
+	p.stats.DroppedWrites++
+}
+
+// Write 写入数据，数据会被拷贝到缓冲区
+// 缓冲区满时：OverflowBlock 等待空间（超过单次可缓冲大小的数据会分段写入）；
+// OverflowDropNewest 丢弃整个数据块并返回 ErrPipeFull；OverflowDropStream 返回 ErrPipeOverflow
+func (p *BufferedPipe) Write(data []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for n < len(data) {
+		if p.rclosed || p.wclosed {
+			return n, io.ErrClosedPipe
+		}
+		if p.overflow {
+			p.drop(len(data) - n)
+			return n, ErrPipeOverflow
+		}
+
+		room := p.limit - p.buffered()
+		remaining := len(data) - n
+		if remaining <= room {
+			p.push(data[n:])
+			return len(data), nil
+		}
+
+		switch p.policy {
+		case OverflowDropNewest:
+			p.drop(remaining)
+			return n, ErrPipeFull
+		case OverflowDropStream:
+			p.overflow = true
+			p.drop(remaining)
+			p.broadcast()
+			return n, ErrPipeOverflow
+		}
+
+		if room > 0 {
+			p.push(data[n : n+room])
+			n += room
+			continue
+		}
+		if err := p.wait(p.writeDeadline); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Read 读取数据，缓冲区为空时阻塞直到有数据、写入端关闭或超时
+func (p *BufferedPipe) Read(data []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buffered() == 0 {
+		switch {
+		case p.rclosed:
+			return 0, io.ErrClosedPipe
+		case p.overflow:
+			return 0, ErrPipeOverflow
+		case p.wclosed:
+			return 0, p.werr
+		}
+		if err := p.wait(p.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(data, p.buf[p.off:])
+	p.off += n
+	if p.off == len(p.buf) {
+		p.buf = p.buf[:0]
+		p.off = 0
+	}
+	p.stats.ReadBytes += int64(n)
+	p.broadcast()
+	return n, nil
+}
+
+// CloseWithError 关闭写入端，读取端读完已缓冲的数据后返回err（err为nil时返回io.EOF）
+func (p *BufferedPipe) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.wclosed {
+		p.wclosed = true
+		p.werr = err
+		p.broadcast()
+	}
+	return nil
+}
+
+// CloseRead 关闭读取端，丢弃已缓冲的数据，之后的Write返回io.ErrClosedPipe
+func (p *BufferedPipe) CloseRead() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rclosed = true
+	p.buf = nil
+	p.off = 0
+	p.broadcast()
+	return nil
+}
+
+// Close 关闭管道的读写两端
+func (p *BufferedPipe) Close() error {
+	p.CloseWithError(nil)
+	return p.CloseRead()
+}
+
+// SetReadDeadline 设置读取超时，零值表示不超时，超时后Read返回os.ErrDeadlineExceeded
+func (p *BufferedPipe) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	p.broadcast()
+	return nil
+}
+
+// SetWriteDeadline 设置写入超时（仅OverflowBlock会等待），超时后Write返回已写入的字节数和os.ErrDeadlineExceeded
+func (p *BufferedPipe) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeDeadline = t
+	p.broadcast()
+	return nil
+}
+
+// SetDeadline 同时设置读取和写入超时
+func (p *BufferedPipe) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+// Stats 获取统计信息
+func (p *BufferedPipe) Stats() PipeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Buffered = p.buffered()
+	return stats
+}
@@ -0,0 +1,120 @@
+package tcpdumper
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试缓冲区未满时写入不阻塞，关闭写入端后读取方读完数据收到EOF
+func TestBufferedPipe(t *testing.T) {
+	p := NewBufferedPipe(16, OverflowBlock)
+	n, err := p.Write([]byte("hello "))
+	assert.Equal(t, 6, n)
+	assert.NoError(t, err)
+	p.Write([]byte("world"))
+	p.CloseWithError(nil)
+
+	_, err = p.Write([]byte("!"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	data, err := io.ReadAll(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	stats := p.Stats()
+	assert.Equal(t, int64(11), stats.WrittenBytes)
+	assert.Equal(t, int64(11), stats.ReadBytes)
+	assert.Equal(t, 0, stats.Buffered)
+}
+
+// 测试丢弃最新数据策略
+func TestBufferedPipeDropNewest(t *testing.T) {
+	p := NewBufferedPipe(8, OverflowDropNewest)
+	p.Write([]byte("abcdef"))
+	n, err := p.Write([]byte("ghij"))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, ErrPipeFull)
+	_, err = p.Write([]byte("gh"))
+	assert.NoError(t, err)
+	p.CloseWithError(nil)
+
+	data, err := io.ReadAll(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(data))
+	assert.Equal(t, PipeStats{WrittenBytes: 8, ReadBytes: 8, DroppedBytes: 4, DroppedWrites: 1}, p.Stats())
+}
+
+// 测试丢弃整个流策略
+func TestBufferedPipeDropStream(t *testing.T) {
+	p := NewBufferedPipe(4, OverflowDropStream)
+	p.Write([]byte("abc"))
+	_, err := p.Write([]byte("de"))
+	assert.ErrorIs(t, err, ErrPipeOverflow)
+	_, err = p.Write([]byte("f"))
+	assert.ErrorIs(t, err, ErrPipeOverflow)
+
+	data, err := io.ReadAll(p)
+	assert.ErrorIs(t, err, ErrPipeOverflow)
+	assert.Equal(t, "abc", string(data))
+	assert.Equal(t, int64(3), p.Stats().DroppedBytes)
+	assert.Equal(t, int64(2), p.Stats().DroppedWrites)
+}
+
+// 测试阻塞策略下超过缓冲区大小的数据分段写入
+func TestBufferedPipeBlockLargeWrite(t *testing.T) {
+	p := NewBufferedPipe(4, OverflowBlock)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := p.Write([]byte("0123456789"))
+		assert.Equal(t, 10, n)
+		assert.NoError(t, err)
+		p.CloseWithError(nil)
+	}()
+
+	data, err := io.ReadAll(p)
+	<-done
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+}
+
+// 测试读写超时
+func TestBufferedPipeDeadline(t *testing.T) {
+	p := NewBufferedPipe(4, OverflowBlock)
+
+	p.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := p.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	p.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := p.Write([]byte("abcdef"))
+	assert.Equal(t, 4, n)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// 清除超时后可以继续读取
+	p.SetDeadline(time.Time{})
+	buf := make([]byte, 8)
+	n, err = p.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(buf[:n]))
+}
+
+// 测试关闭读取端后写入失败，阻塞中的写入被唤醒
+func TestBufferedPipeCloseRead(t *testing.T) {
+	p := NewBufferedPipe(2, OverflowBlock)
+	errc := make(chan error)
+	go func() {
+		_, err := p.Write([]byte("abcd"))
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	p.CloseRead()
+	assert.ErrorIs(t, <-errc, io.ErrClosedPipe)
+	_, err := p.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,85 @@
+package tcpdumper
+
+import "strconv"
+
+// defaultPortBoost 流的端口命中首选端口时默认增加的置信度
+const defaultPortBoost = 20
+
+// PortRange 端口范围（包含两端）
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// Contains 判断端口是否在范围内
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// WithPreferredPorts 设置协议的首选端口
+// 流的端口命中首选端口且检测器返回的置信度大于0时，置信度会额外增加（默认20，最高100）
+func WithPreferredPorts(ports ...uint16) RegisterOption {
+	return func(entry *detectorEntry) {
+		for _, port := range ports {
+			entry.preferredPorts = append(entry.preferredPorts, PortRange{Low: port, High: port})
+		}
+	}
+}
+
+// WithPreferredPortRange 设置协议的首选端口范围
+func WithPreferredPortRange(low, high uint16) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.preferredPorts = append(entry.preferredPorts, PortRange{Low: low, High: high})
+	}
+}
+
+// WithPortBoost 设置命中首选端口时增加的置信度
+func WithPortBoost(boost int) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.portBoost = boost
+	}
+}
+
+// WithFallbackPorts 设置协议的兜底端口
+// 当没有任何检测器基于内容识别出协议时，命中兜底端口的流会直接使用该协议
+func WithFallbackPorts(ports ...uint16) RegisterOption {
+	return func(entry *detectorEntry) {
+		for _, port := range ports {
+			entry.fallbackPorts = append(entry.fallbackPorts, PortRange{Low: port, High: port})
+		}
+	}
+}
+
+// WithFallbackPortRange 设置协议的兜底端口范围
+func WithFallbackPortRange(low, high uint16) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.fallbackPorts = append(entry.fallbackPorts, PortRange{Low: low, High: high})
+	}
+}
+
+// PortNumbers 获取数值形式的源端口和目标端口，无法解析时返回0
+func (si StreamInfo) PortNumbers() (src, dst uint16) {
+	return parsePort(si.SrcPort), parsePort(si.DstPort)
+}
+
+// parsePort 解析端口字符串
+func parsePort(s string) uint16 {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(port)
+}
+
+// portInRanges 判断端口是否命中任意一个端口范围
+func portInRanges(port uint16, ranges []PortRange) bool {
+	if port == 0 {
+		return false
+	}
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+/*
+ * 内置的通用协议处理器
+ * 主要用于签名配置文件中无需编写Go代码即可输出流内容
+ */
+
+// rawPreviewSize 原始数据处理器每个数据块输出的最大字节数
+const rawPreviewSize = 32
+
+// defaultMaxLineLength 行处理器单行的默认最大长度
+const defaultMaxLineLength = 4096
+
+// defaultMaxMessageSize 长度前缀处理器单条消息的默认最大长度
+const defaultMaxMessageSize = 16 * 1024 * 1024
+
+// outputOrStdout 为nil时返回标准输出
+func outputOrStdout(w io.Writer) io.Writer {
+	if w == nil {
+		return os.Stdout
+	}
+	return w
+}
+
+// RawProcessor 原始数据处理器，输出每个数据块的长度和十六进制预览
+type RawProcessor struct {
+	name       string
+	ident      string
+	w          io.Writer
+	chunks     int64
+	totalBytes int64
+}
+
+// NewRawProcessor 创建原始数据处理器，w为nil时输出到标准输出
+func NewRawProcessor(name string, streamInfo StreamInfo, w io.Writer) *RawProcessor {
+	return &RawProcessor{
+		name:  name,
+		ident: streamInfo.Ident,
+		w:     outputOrStdout(w),
+	}
+}
+
+func (rp *RawProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	rp.chunks++
+	rp.totalBytes += int64(len(data))
+
+	preview := data
+	if len(preview) > rawPreviewSize {
+		preview = preview[:rawPreviewSize]
+	}
+	_, err := fmt.Fprintf(rp.w, "%s/%s [%s]: %d bytes\n%s", rp.name, rp.ident, dir, len(data), hex.Dump(preview))
+	return err
+}
+
+func (rp *RawProcessor) Close() error {
+	_, err := fmt.Fprintf(rp.w, "%s/%s: Connection closed, %d chunks, %d bytes\n", rp.name, rp.ident, rp.chunks, rp.totalBytes)
+	return err
+}
+
+func (rp *RawProcessor) GetProtocolName() string {
+	return rp.name
+}
+
+// LineProcessor 行处理器，按行输出文本协议（SMTP、FTP、POP3、Redis inline等）的内容
+type LineProcessor struct {
+	name    string
+	ident   string
+	w       io.Writer
+	maxLine int
+	buf     [2][]byte // 每个方向未完成的行
+}
+
+// NewLineProcessor 创建行处理器，maxLine为单行最大长度（0为默认4096），超长的行会被截断输出
+func NewLineProcessor(name string, streamInfo StreamInfo, w io.Writer, maxLine int) *LineProcessor {
+	if maxLine <= 0 {
+		maxLine = defaultMaxLineLength
+	}
+	return &LineProcessor{
+		name:    name,
+		ident:   streamInfo.Ident,
+		w:       outputOrStdout(w),
+		maxLine: maxLine,
+	}
+}
+
+func (lp *LineProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	idx := dirIndex(dir)
+	buf := append(lp.buf[idx], data...)
+
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := lp.emit(dir, buf[:i]); err != nil {
+			return err
+		}
+		buf = buf[i+1:]
+	}
+
+	// 超长的行截断输出，剩余部分作为新行继续处理
+	for len(buf) > lp.maxLine {
+		if err := lp.emit(dir, buf[:lp.maxLine]); err != nil {
+			return err
+		}
+		buf = buf[lp.maxLine:]
+	}
+
+	lp.buf[idx] = append(lp.buf[idx][:0], buf...)
+	if end && len(lp.buf[idx]) > 0 {
+		err := lp.emit(dir, lp.buf[idx])
+		lp.buf[idx] = lp.buf[idx][:0]
+		return err
+	}
+	return nil
+}
+
+// emit 输出一行（去掉行尾的\r）
+func (lp *LineProcessor) emit(dir reassembly.TCPFlowDirection, line []byte) error {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	_, err := fmt.Fprintf(lp.w, "%s/%s [%s]: %s\n", lp.name, lp.ident, dir, line)
+	return err
+}
+
+func (lp *LineProcessor) Close() error {
+	// 输出没有换行结尾的剩余数据
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		if len(lp.buf[i]) > 0 {
+			if err := lp.emit(dir, lp.buf[i]); err != nil {
+				return err
+			}
+			lp.buf[i] = nil
+		}
+	}
+	_, err := fmt.Fprintf(lp.w, "%s/%s: Connection closed\n", lp.name, lp.ident)
+	return err
+}
+
+func (lp *LineProcessor) GetProtocolName() string {
+	return lp.name
+}
+
+// LengthPrefixConfig 长度前缀消息格式
+type LengthPrefixConfig struct {
+	LengthOffset int              // 长度字段在消息中的偏移量
+	LengthSize   int              // 长度字段的字节数：1、2、4或8
+	ByteOrder    binary.ByteOrder // 长度字段的字节序，nil为大端
+	// LengthAdjust 长度字段值的修正量：消息总长度 = LengthOffset + LengthSize + 长度值 + LengthAdjust
+	// 例如长度值包含了长度字段本身时设为 -LengthSize
+	LengthAdjust int
+	MaxMessage   int // 单条消息的最大长度，0为默认16MB
+}
+
+// Validate 检查配置是否有效
+func (c LengthPrefixConfig) Validate() error {
+	switch c.LengthSize {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("invalid length size %d, must be 1, 2, 4 or 8", c.LengthSize)
+	}
+	if c.LengthOffset < 0 {
+		return fmt.Errorf("negative length offset %d", c.LengthOffset)
+	}
+	if c.MaxMessage < 0 {
+		return fmt.Errorf("negative max message size %d", c.MaxMessage)
+	}
+	return nil
+}
+
+// messageLength 从缓冲区解析消息总长度，数据不足时返回ok=false
+func (c LengthPrefixConfig) messageLength(buf []byte) (total int, ok bool, err error) {
+	header := c.LengthOffset + c.LengthSize
+	if len(buf) < header {
+		return 0, false, nil
+	}
+
+	order := c.ByteOrder
+	if order == nil {
+		order = binary.BigEndian
+	}
+	field := buf[c.LengthOffset:header]
+	var length uint64
+	switch c.LengthSize {
+	case 1:
+		length = uint64(field[0])
+	case 2:
+		length = uint64(order.Uint16(field))
+	case 4:
+		length = uint64(order.Uint32(field))
+	case 8:
+		length = order.Uint64(field)
+	}
+
+	maxMessage := c.MaxMessage
+	if maxMessage == 0 {
+		maxMessage = defaultMaxMessageSize
+	}
+	if length > uint64(maxMessage) {
+		return 0, false, fmt.Errorf("message length %d exceeds limit %d", length, maxMessage)
+	}
+	total = header + int(length) + c.LengthAdjust
+	if total < header {
+		return 0, false, fmt.Errorf("invalid message length %d", length)
+	}
+	return total, len(buf) >= total, nil
+}
+
+// messagePrinter 输出每条完整消息的长度和预览，由 FramedProcessor 包装
+type messagePrinter struct {
+	name  string
+	ident string
+	w     io.Writer
+}
+
+// NewLengthPrefixedProcessor 创建长度前缀处理器，按长度前缀切分消息并输出每条消息的长度和预览，配置无效时返回错误
+func NewLengthPrefixedProcessor(name string, streamInfo StreamInfo, w io.Writer, config LengthPrefixConfig) (*FramedProcessor, error) {
+	framer, err := NewLengthPrefixFramer(config)
+	if err != nil {
+		return nil, err
+	}
+	printer := &messagePrinter{name: name, ident: streamInfo.Ident, w: outputOrStdout(w)}
+	return NewFramedProcessor(printer, framer), nil
+}
+
+func (mp *messagePrinter) ProcessData(msg []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	preview := msg
+	if len(preview) > rawPreviewSize {
+		preview = preview[:rawPreviewSize]
+	}
+	_, err := fmt.Fprintf(mp.w, "%s/%s [%s]: message (%d bytes)\n%s", mp.name, mp.ident, dir, len(msg), hex.Dump(preview))
+	return err
+}
+
+func (mp *messagePrinter) Close() error {
+	_, err := fmt.Fprintf(mp.w, "%s/%s: Connection closed\n", mp.name, mp.ident)
+	return err
+}
+
+func (mp *messagePrinter) GetProtocolName() string {
+	return mp.name
+}
@@ -0,0 +1,59 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试原始数据处理器
+func TestRawProcessor(t *testing.T) {
+	var out bytes.Buffer
+	processor := NewRawProcessor("RAW", StreamInfo{Ident: "s"}, &out)
+	assert.Equal(t, "RAW", processor.GetProtocolName())
+	assert.NoError(t, processor.ProcessData([]byte("hello"), reassembly.TCPDirClientToServer, true, false))
+	assert.NoError(t, processor.Close())
+	assert.Contains(t, out.String(), "RAW/s [client->server]: 5 bytes\n00000000  68 65 6c 6c 6f")
+	assert.Contains(t, out.String(), "RAW/s: Connection closed, 1 chunks, 5 bytes")
+}
+
+// 测试行处理器截断超长的行
+func TestLineProcessorMaxLine(t *testing.T) {
+	var out bytes.Buffer
+	processor := NewLineProcessor("Line", StreamInfo{Ident: "s"}, &out, 4)
+	assert.NoError(t, processor.ProcessData([]byte("abcdefg\nhi"), reassembly.TCPDirServerToClient, true, false))
+	assert.NoError(t, processor.ProcessData([]byte("jklmn"), reassembly.TCPDirServerToClient, false, true))
+	assert.Equal(t, "Line/s [server->client]: abcdefg\n"+
+		"Line/s [server->client]: hijk\n"+
+		"Line/s [server->client]: lmn\n", out.String())
+}
+
+// 测试长度前缀处理器
+func TestLengthPrefixedProcessor(t *testing.T) {
+	_, err := NewLengthPrefixedProcessor("LP", StreamInfo{}, nil, LengthPrefixConfig{LengthSize: 3})
+	assert.Error(t, err)
+
+	var out bytes.Buffer
+	// 长度字段的值包含长度字段本身
+	processor, err := NewLengthPrefixedProcessor("LP", StreamInfo{Ident: "s"}, &out, LengthPrefixConfig{
+		LengthSize:   4,
+		ByteOrder:    binary.BigEndian,
+		LengthAdjust: -4,
+		MaxMessage:   16,
+	})
+	assert.NoError(t, err)
+
+	// 两条消息合并在一个数据块中
+	data := []byte{0, 0, 0, 6, 'a', 'b', 0, 0, 0, 5, 'c'}
+	assert.NoError(t, processor.ProcessData(data, reassembly.TCPDirClientToServer, true, false))
+	assert.Equal(t, 2, bytes.Count(out.Bytes(), []byte("message (")))
+
+	// 超过最大长度后该方向停止解析
+	err = processor.ProcessData([]byte{0, 0, 1, 0}, reassembly.TCPDirServerToClient, true, false)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.NoError(t, processor.ProcessData([]byte{0, 0, 0, 4}, reassembly.TCPDirServerToClient, false, false))
+	assert.Equal(t, 2, bytes.Count(out.Bytes(), []byte("message (")))
+}
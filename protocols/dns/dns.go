@@ -0,0 +1,303 @@
+// Package dns 提供DNS over TCP和DNS over UDP的检测器和处理器
+// TCP按2字节长度前缀重组跨越分段的消息，UDP每个数据报是一条消息；消息用 layers.DNS 解码，按ID把查询和响应配对，
+// 每次查询以 Exchange 事件的形式交给回调，包含问题、回答、响应码和延迟
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "DNS"
+
+const (
+	headerLen     = 12
+	lengthLen     = 2 // DNS over TCP的长度前缀
+	maxMessageLen = 65535
+)
+
+// Question 查询的问题
+type Question struct {
+	Name  string
+	Type  layers.DNSType
+	Class layers.DNSClass
+}
+
+func (q Question) String() string {
+	return fmt.Sprintf("%s %s", q.Type, q.Name)
+}
+
+// Record 资源记录
+type Record struct {
+	Name  string
+	Type  layers.DNSType
+	Class layers.DNSClass
+	TTL   uint32
+	Data  string // 记录数据的文本形式，如A记录的地址、CNAME的目标
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %s %s", r.Name, r.Type, r.Data)
+}
+
+// Message 一条DNS消息
+type Message struct {
+	ID                 uint16
+	Response           bool
+	OpCode             layers.DNSOpCode
+	ResponseCode       layers.DNSResponseCode
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+
+	Questions   []Question
+	Answers     []Record
+	Authorities []Record
+	Additionals []Record
+
+	Size int       // 消息长度，不含TCP的长度前缀
+	Time time.Time // 消息所在数据的时间
+
+	Layer *layers.DNS // 解码后的完整消息
+}
+
+// Exchange 一次查询和它的响应
+// 抓包从连接中途开始时Query为nil；连接关闭时仍没有响应的，Response为nil
+type Exchange struct {
+	StreamInfo tcpdumper.StreamInfo
+	ID         uint16
+	Query      *Message
+	Response   *Message
+}
+
+// Questions 查询的问题，没有查询时使用响应中的问题
+func (e *Exchange) Questions() []Question {
+	if e.Query != nil {
+		return e.Query.Questions
+	}
+	if e.Response != nil {
+		return e.Response.Questions
+	}
+	return nil
+}
+
+// Answers 响应中的回答
+func (e *Exchange) Answers() []Record {
+	if e.Response == nil {
+		return nil
+	}
+	return e.Response.Answers
+}
+
+// ResponseCode 响应码，没有响应时为NOERROR
+func (e *Exchange) ResponseCode() layers.DNSResponseCode {
+	if e.Response == nil {
+		return layers.DNSResponseCodeNoErr
+	}
+	return e.Response.ResponseCode
+}
+
+// Latency 从查询到响应的时间
+func (e *Exchange) Latency() time.Duration {
+	if e.Query == nil || e.Response == nil {
+		return 0
+	}
+	return e.Response.Time.Sub(e.Query.Time)
+}
+
+// String 返回查询的摘要
+func (e *Exchange) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id=%d", e.ID)
+	for _, q := range e.Questions() {
+		fmt.Fprintf(&b, " %s", q)
+	}
+	if e.Query == nil {
+		b.WriteString(" <no query>")
+	}
+	if e.Response == nil {
+		b.WriteString(" -> <no response>")
+		return b.String()
+	}
+	fmt.Fprintf(&b, " -> %s", RCodeName(e.Response.ResponseCode))
+	for _, r := range e.Response.Answers {
+		fmt.Fprintf(&b, " [%s]", r)
+	}
+	if e.Query != nil {
+		fmt.Fprintf(&b, " (%v)", e.Latency())
+	}
+	return b.String()
+}
+
+// rcodeNames 响应码的助记符（RFC 1035、RFC 2136、RFC 6891）
+var rcodeNames = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeYXDomain: "YXDOMAIN",
+	layers.DNSResponseCodeYXRRSet:  "YXRRSET",
+	layers.DNSResponseCodeNXRRSet:  "NXRRSET",
+	layers.DNSResponseCodeNotAuth:  "NOTAUTH",
+	layers.DNSResponseCodeNotZone:  "NOTZONE",
+	layers.DNSResponseCodeBadVers:  "BADVERS",
+}
+
+// RCodeName 返回响应码的助记符，如 "NXDOMAIN"
+func RCodeName(rcode layers.DNSResponseCode) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// Config DNS处理器配置
+type Config struct {
+	// OnExchange 收到响应、查询ID被新的查询复用或连接（UDP流空闲超时）关闭时的回调，为nil时把摘要输出到Output
+	OnExchange func(*Exchange)
+	Output     io.Writer // 默认回调的输出，nil为标准输出
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	if c.OnExchange == nil {
+		w := c.Output
+		if w == nil {
+			w = os.Stdout
+		}
+		c.OnExchange = func(e *Exchange) {
+			fmt.Fprintf(w, "DNS/%s: %s\n", e.StreamInfo.Ident, e)
+		}
+	}
+	return c
+}
+
+// Detector DNS over TCP检测器
+// 检查长度前缀和消息头：QR位与方向一致、操作码已定义、保留位为0、只有一个问题；
+// 数据包含完整的消息且能解码时置信度更高
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建DNS over TCP检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if len(data) < lengthLen+headerLen {
+		return 0
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if !plausibleHeader(data[lengthLen:], length, dir == reassembly.TCPDirServerToClient) {
+		return 0
+	}
+	if len(data) < lengthLen+length {
+		return 60
+	}
+	return detectMessage(data[lengthLen:lengthLen+length], dir)
+}
+
+// detectMessage 解码一条完整的消息，查询的置信度为90，响应为80
+func detectMessage(msg []byte, dir reassembly.TCPFlowDirection) int {
+	if _, err := decode(msg); err != nil {
+		return 0
+	}
+	if dir == reassembly.TCPDirServerToClient {
+		return 80
+	}
+	return 90
+}
+
+// plausibleHeader 检查消息头是否像一条DNS消息
+func plausibleHeader(header []byte, length int, response bool) bool {
+	if length < headerLen {
+		return false
+	}
+	flags := binary.BigEndian.Uint16(header[2:])
+	if (flags&0x8000 != 0) != response || flags&0x0040 != 0 {
+		return false
+	}
+	switch layers.DNSOpCode(flags >> 11 & 0xf) {
+	case layers.DNSOpCodeQuery, layers.DNSOpCodeIQuery, layers.DNSOpCodeStatus, layers.DNSOpCodeNotify, layers.DNSOpCodeUpdate:
+	default:
+		return false
+	}
+	return binary.BigEndian.Uint16(header[4:]) == 1
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+// messageFramer 按2字节大端长度前缀切分消息
+var messageFramer, _ = tcpdumper.NewLengthPrefixFramer(tcpdumper.LengthPrefixConfig{
+	LengthSize: lengthLen,
+	MaxMessage: maxMessageLen,
+})
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config, true), messageFramer)
+}
+
+// NewProcessor 创建DNS over TCP处理器，返回的处理器会先按长度前缀切分消息
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册DNS over TCP协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
+
+// UDPDetector DNS over UDP检测器，检查规则与 Detector 相同，每个数据报是一条完整的消息
+// 需要注册到UDP注册表（如 TCPDumper.UDPRegistry）
+type UDPDetector struct {
+	config Config
+}
+
+// NewUDPDetector 创建DNS over UDP检测器
+func NewUDPDetector(config Config) *UDPDetector {
+	return &UDPDetector{config: config.withDefaults()}
+}
+
+func (d *UDPDetector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if len(data) < headerLen || !plausibleHeader(data, len(data), dir == reassembly.TCPDirServerToClient) {
+		return 0
+	}
+	return detectMessage(data, dir)
+}
+
+func (d *UDPDetector) Name() string {
+	return ProtocolName
+}
+
+func (d *UDPDetector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, d.config, false)
+}
+
+// NewUDPProcessor 创建DNS over UDP处理器，每次调用必须是一个完整的数据报
+func NewUDPProcessor(streamInfo tcpdumper.StreamInfo, config Config) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, config.withDefaults(), false)
+}
+
+// RegisterUDP 向UDP注册表注册DNS over UDP协议
+func RegisterUDP(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewUDPDetector(config), opts...)
+}
@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// encode 序列化DNS消息并加上TCP的长度前缀
+func encode(t *testing.T, dns *layers.DNS) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	return append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func query(t *testing.T, id uint16, name string, typ layers.DNSType) []byte {
+	return encode(t, &layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: typ, Class: layers.DNSClassIN}},
+	})
+}
+
+func response(t *testing.T, id uint16, name string, rcode layers.DNSResponseCode, answers ...layers.DNSResourceRecord) []byte {
+	return encode(t, &layers.DNS{
+		ID:           id,
+		QR:           true,
+		RD:           true,
+		RA:           true,
+		ResponseCode: rcode,
+		Questions:    []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers:      answers,
+	})
+}
+
+func a(name, ip string) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.ParseIP(ip).To4()}
+}
+
+func collect(config *Config) *[]*Exchange {
+	var exchanges []*Exchange
+	config.OnExchange = func(e *Exchange) {
+		exchanges = append(exchanges, e)
+	}
+	return &exchanges
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	q := query(t, 1, "example.com", layers.DNSTypeA)
+	r := response(t, 1, "example.com", layers.DNSResponseCodeNoErr, a("example.com", "1.2.3.4"))
+	assert.Equal(t, 90, d.Detect(q, c2s))
+	assert.Equal(t, 80, d.Detect(r, s2c))
+	// 只有消息头时按较低置信度识别
+	assert.Equal(t, 60, d.Detect(q[:14], c2s))
+	// QR位与方向不一致
+	assert.Equal(t, 0, d.Detect(q, s2c))
+	assert.Equal(t, 0, d.Detect(r, c2s))
+	// 长度合理但不是DNS
+	assert.Equal(t, 0, d.Detect([]byte("\x00\x20GET / HTTP/1.1\r\nHost: x\r\n\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect(append([]byte{0, 12}, make([]byte, 12)...), c2s))
+	// 完整的消息无法解码
+	bad := append([]byte(nil), q...)
+	bad[len(bad)-5] = 0x3f
+	assert.Equal(t, 0, d.Detect(bad, c2s))
+	assert.Equal(t, 0, d.Detect(q[:10], c2s))
+}
+
+func TestExchange(t *testing.T) {
+	config := Config{}
+	exchanges := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := query(t, 0x1234, "example.com", layers.DNSTypeA)
+	// 逐字节输入，消息跨越多个分段
+	for i := range q {
+		assert.NoError(t, p.ProcessTimedData(q[i:i+1], c2s, i == 0, false, ts))
+	}
+	assert.Empty(t, *exchanges)
+	r := response(t, 0x1234, "example.com", layers.DNSResponseCodeNoErr, a("example.com", "93.184.216.34"))
+	assert.NoError(t, p.ProcessTimedData(r, s2c, true, false, ts.Add(15*time.Millisecond)))
+	if !assert.Len(t, *exchanges, 1) {
+		return
+	}
+
+	e := (*exchanges)[0]
+	assert.Equal(t, "test", e.StreamInfo.Ident)
+	assert.Equal(t, uint16(0x1234), e.ID)
+	assert.Equal(t, []Question{{Name: "example.com", Type: layers.DNSTypeA, Class: layers.DNSClassIN}}, e.Questions())
+	assert.Equal(t, []Record{{Name: "example.com", Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, Data: "93.184.216.34"}}, e.Answers())
+	assert.Equal(t, layers.DNSResponseCodeNoErr, e.ResponseCode())
+	assert.Equal(t, 15*time.Millisecond, e.Latency())
+	assert.True(t, e.Query.RecursionDesired)
+	assert.True(t, e.Response.RecursionAvailable)
+	assert.Equal(t, len(q)-2, e.Query.Size)
+	assert.NotNil(t, e.Response.Layer)
+	assert.Equal(t, "id=4660 A example.com -> NOERROR [example.com A 93.184.216.34] (15ms)", e.String())
+	assert.NoError(t, p.Close())
+	assert.Len(t, *exchanges, 1)
+}
+
+// 同一连接上的多个查询，响应按ID配对
+func TestPipelined(t *testing.T) {
+	config := Config{}
+	exchanges := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	// 多条消息在同一个分段中
+	data := append(query(t, 1, "a.example", layers.DNSTypeA), query(t, 2, "b.example", layers.DNSTypeAAAA)...)
+	data = append(data, query(t, 3, "c.example", layers.DNSTypeA)...)
+	assert.NoError(t, p.ProcessData(data, c2s, true, false))
+	assert.NoError(t, p.ProcessData(response(t, 2, "b.example", layers.DNSResponseCodeNXDomain), s2c, true, false))
+	// 没有对应查询的响应
+	assert.NoError(t, p.ProcessData(response(t, 9, "x.example", layers.DNSResponseCodeServFail), s2c, false, false))
+	// ID被复用，之前的查询按没有响应回调
+	assert.NoError(t, p.ProcessData(query(t, 1, "d.example", layers.DNSTypeA), c2s, false, false))
+	assert.NoError(t, p.Close())
+
+	if !assert.Len(t, *exchanges, 5) {
+		return
+	}
+	e := *exchanges
+	assert.Equal(t, "b.example", e[0].Questions()[0].Name)
+	assert.Equal(t, layers.DNSResponseCodeNXDomain, e[0].ResponseCode())
+	assert.Empty(t, e[0].Answers())
+	assert.Nil(t, e[1].Query)
+	assert.Equal(t, "id=9 A x.example <no query> -> SERVFAIL", e[1].String())
+	assert.Equal(t, "a.example", e[2].Questions()[0].Name)
+	assert.Nil(t, e[2].Response)
+	assert.Equal(t, "id=1 A a.example -> <no response>", e[2].String())
+	assert.Equal(t, "c.example", e[3].Questions()[0].Name)
+	assert.Equal(t, "d.example", e[4].Questions()[0].Name)
+}
+
+func TestDecodeError(t *testing.T) {
+	config := Config{}
+	exchanges := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	assert.Error(t, p.ProcessData([]byte{0, 4, 1, 2, 3, 4}, c2s, true, false))
+	assert.NoError(t, p.Close())
+	assert.Empty(t, *exchanges)
+}
+
+func TestRecordData(t *testing.T) {
+	r := encode(t, &layers.DNS{
+		ID:        7,
+		QR:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeMX, Class: layers.DNSClassIN}},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("example.com"), Type: layers.DNSTypeMX, Class: layers.DNSClassIN, MX: layers.DNSMX{Preference: 10, Name: []byte("mail.example.com")}},
+			{Name: []byte("example.com"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TXTs: [][]byte{[]byte("v=spf1 -all"), []byte("x")}},
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, CNAME: []byte("example.com")},
+			{Name: []byte("example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, IP: net.ParseIP("2001:db8::1")},
+		},
+		Authorities: []layers.DNSResourceRecord{
+			{Name: []byte("example.com"), Type: layers.DNSTypeSOA, Class: layers.DNSClassIN, SOA: layers.DNSSOA{MName: []byte("ns.example.com"), RName: []byte("admin.example.com"), Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5}},
+		},
+	})
+	msg, err := decode(r[2:])
+	if !assert.NoError(t, err) {
+		return
+	}
+	var data []string
+	for _, rr := range msg.Answers {
+		data = append(data, rr.Data)
+	}
+	assert.Equal(t, []string{"10 mail.example.com", `"v=spf1 -all" "x"`, "example.com", "2001:db8::1"}, data)
+	if assert.Len(t, msg.Authorities, 1) {
+		assert.Equal(t, "ns.example.com admin.example.com 1 2 3 4 5", msg.Authorities[0].Data)
+	}
+	assert.Equal(t, "RCODE23", RCodeName(23))
+}
+
+// 通过注册表识别并输出默认摘要
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:53"}, nil)
+	assert.NoError(t, d.ProcessData(query(t, 5, "example.org", layers.DNSTypeA), c2s, true, false))
+	assert.NoError(t, d.ProcessData(response(t, 5, "example.org", layers.DNSResponseCodeNoErr, a("example.org", "10.0.0.1")), s2c, true, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^DNS/a:1-b:53: id=5 A example.org -> NOERROR \[example.org A 10.0.0.1\] \(.*\)\n$`, out.String())
+}
+
+func TestUDP(t *testing.T) {
+	d := NewUDPDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	q := query(t, 1, "example.com", layers.DNSTypeA)[2:]
+	r := response(t, 1, "example.com", layers.DNSResponseCodeNoErr, a("example.com", "1.2.3.4"))[2:]
+	assert.Equal(t, 90, d.Detect(q, c2s))
+	assert.Equal(t, 80, d.Detect(r, s2c))
+	assert.Equal(t, 0, d.Detect(q, s2c))
+	assert.Equal(t, 0, d.Detect(q[:12], c2s))
+	// 带长度前缀的TCP消息不是UDP消息
+	assert.Equal(t, 0, d.Detect(query(t, 1, "example.com", layers.DNSTypeA), c2s))
+
+	// 每个数据报是一条消息
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	RegisterUDP(registry, Config{Output: &out})
+	dispatcher := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:53"}, nil)
+	assert.NoError(t, dispatcher.ProcessData(q, c2s, true, false))
+	assert.NoError(t, dispatcher.ProcessData(query(t, 2, "example.net", layers.DNSTypeA)[2:], c2s, false, false))
+	assert.NoError(t, dispatcher.ProcessData(r, s2c, true, false))
+	assert.NoError(t, dispatcher.Close())
+	assert.Regexp(t, `^DNS/a:1-b:53: id=1 A example.com -> NOERROR \[example.com A 1.2.3.4\] \(.*\)\nDNS/a:1-b:53: id=2 A example.net -> <no response>\n$`, out.String())
+
+	config := Config{}
+	exchanges := collect(&config)
+	p := NewUDPProcessor(tcpdumper.StreamInfo{}, config)
+	assert.NoError(t, p.ProcessData(r, s2c, true, false))
+	assert.Len(t, *exchanges, 1)
+}
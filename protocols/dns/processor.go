@@ -0,0 +1,174 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxPending 等待响应的查询数上限，超过时最早的查询按没有响应回调
+const maxPending = 1024
+
+// processor DNS处理器，每次调用必须是一条完整的消息：TCP的消息带长度前缀，由 FramedProcessor 包装；UDP为一个数据报
+// 同一连接上可以有多个未完成的查询（RFC 7766），响应按ID与等待中的查询配对
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	tcp        bool        // 消息带有2字节长度前缀
+	pending    []*Exchange // 按查询顺序排列的等待响应的查询
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config, tcp bool) *processor {
+	return &processor{streamInfo: streamInfo, config: config, tcp: tcp}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一条带时间戳的消息，没有时间戳时使用当前时间
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if p.tcp {
+		if len(data) < lengthLen {
+			return nil
+		}
+		data = data[lengthLen:]
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	msg, err := decode(data)
+	if err != nil {
+		return fmt.Errorf("decode message: %w", err)
+	}
+	msg.Time = ts
+	p.message(msg)
+	return nil
+}
+
+// message 把查询加入等待列表，响应与等待中的同ID查询配对
+func (p *processor) message(msg *Message) {
+	i := p.find(msg.ID)
+	if !msg.Response {
+		if i >= 0 {
+			// 查询ID被复用，之前的查询不会再有响应
+			p.emit(i)
+		} else if len(p.pending) >= maxPending {
+			p.emit(0)
+		}
+		p.pending = append(p.pending, &Exchange{StreamInfo: p.streamInfo, ID: msg.ID, Query: msg})
+		return
+	}
+	if i < 0 {
+		p.config.OnExchange(&Exchange{StreamInfo: p.streamInfo, ID: msg.ID, Response: msg})
+		return
+	}
+	p.pending[i].Response = msg
+	p.emit(i)
+}
+
+// find 返回等待中的查询的下标，没有时返回-1
+func (p *processor) find(id uint16) int {
+	for i, e := range p.pending {
+		if e.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// emit 从等待列表中移除查询并回调
+func (p *processor) emit(i int) {
+	e := p.pending[i]
+	p.pending = append(p.pending[:i], p.pending[i+1:]...)
+	p.config.OnExchange(e)
+}
+
+func (p *processor) Close() error {
+	for len(p.pending) > 0 {
+		p.emit(0)
+	}
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
+
+// decode 用 layers.DNS 解码一条不含长度前缀的消息
+func decode(data []byte) (*Message, error) {
+	// 解码后的记录引用原始数据，拷贝一份避免数据被复用
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(append([]byte(nil), data...), gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		ID:                 dns.ID,
+		Response:           dns.QR,
+		OpCode:             dns.OpCode,
+		ResponseCode:       dns.ResponseCode,
+		Authoritative:      dns.AA,
+		Truncated:          dns.TC,
+		RecursionDesired:   dns.RD,
+		RecursionAvailable: dns.RA,
+		Answers:            records(dns.Answers),
+		Authorities:        records(dns.Authorities),
+		Additionals:        records(dns.Additionals),
+		Size:               len(data),
+		Layer:              dns,
+	}
+	for _, q := range dns.Questions {
+		msg.Questions = append(msg.Questions, Question{Name: string(q.Name), Type: q.Type, Class: q.Class})
+	}
+	return msg, nil
+}
+
+// records 转换资源记录
+func records(rrs []layers.DNSResourceRecord) []Record {
+	var out []Record
+	for i := range rrs {
+		rr := &rrs[i]
+		out = append(out, Record{Name: string(rr.Name), Type: rr.Type, Class: rr.Class, TTL: rr.TTL, Data: recordData(rr)})
+	}
+	return out
+}
+
+// recordData 返回记录数据的文本形式，未解析的类型为十六进制
+func recordData(rr *layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, rr.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", rr.SOA.MName, rr.SOA.RName, rr.SOA.Serial, rr.SOA.Refresh, rr.SOA.Retry, rr.SOA.Expire, rr.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			txts[i] = strconv.Quote(string(txt))
+		}
+		return strings.Join(txts, " ")
+	case layers.DNSTypeOPT:
+		opts := make([]string, len(rr.OPT))
+		for i, opt := range rr.OPT {
+			opts[i] = opt.String()
+		}
+		return strings.Join(opts, ",")
+	}
+	return hex.EncodeToString(rr.Data)
+}
@@ -0,0 +1,227 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/gopacket/reassembly"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported grpc-encoding")
+	errUnknownMethod       = errors.New("method not found in descriptors")
+)
+
+// LoadDescriptorSet 加载 protoc --descriptor_set_out 生成的描述符集合文件
+// 生成时需要使用 --include_imports，使依赖的文件也包含在集合中
+func LoadDescriptorSet(path string) (*protoregistry.Files, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("parse descriptor set %s: %w", path, err)
+	}
+	return NewDescriptors(set)
+}
+
+// NewDescriptors 从描述符集合创建 Config.Descriptors
+func NewDescriptors(set *descriptorpb.FileDescriptorSet) (*protoregistry.Files, error) {
+	return protodesc.NewFiles(set)
+}
+
+// decode 解压并解码消息，结果写入msg
+func (p *processor) decode(call *Call, dir reassembly.TCPFlowDirection, msg *Message, encoding string) {
+	if msg.Compressed {
+		data, err := decompress(encoding, msg.Data, p.config.MaxMessageSize)
+		if err != nil {
+			msg.DecodeError = err
+			return
+		}
+		msg.Data = data
+		if len(data) > p.config.MaxMessageSize {
+			msg.Data = data[:p.config.MaxMessageSize]
+			msg.Truncated = true
+			return
+		}
+	}
+
+	if p.config.Descriptors == nil {
+		msg.Text = rawText(msg.Data)
+		return
+	}
+	text, err := p.decodeMessage(call, dir, msg.Data)
+	if err != nil {
+		msg.DecodeError = err
+		msg.Text = rawText(msg.Data)
+		return
+	}
+	msg.Text = text
+}
+
+// decompress 按grpc-encoding解压消息，解压后的长度最多为limit+1，用于判断是否超过限制
+func decompress(encoding string, data []byte, limit int) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		r = gr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(data))
+	case "", "identity":
+		// 设置了压缩标志却没有编码，按协议是错误，保留原始数据
+		return nil, fmt.Errorf("%w %q for compressed message", errUnsupportedEncoding, encoding)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+	return io.ReadAll(io.LimitReader(r, int64(limit)+1))
+}
+
+// decodeMessage 按方法的输入或输出类型把消息解码为JSON
+func (p *processor) decodeMessage(call *Call, dir reassembly.TCPFlowDirection, data []byte) (string, error) {
+	desc, err := p.config.Descriptors.FindDescriptorByName(protoreflect.FullName(call.Service))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errUnknownMethod, call.Path)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errUnknownMethod, call.Path)
+	}
+	method := service.Methods().ByName(protoreflect.Name(call.Method))
+	if method == nil {
+		return "", fmt.Errorf("%w: %s", errUnknownMethod, call.Path)
+	}
+
+	md := method.Output()
+	if dir == reassembly.TCPDirClientToServer {
+		md = method.Input()
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(data, m); err != nil {
+		return "", fmt.Errorf("unmarshal %s: %w", md.FullName(), err)
+	}
+	out, err := protojson.MarshalOptions{Resolver: dynamicpb.NewTypes(p.config.Descriptors)}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// rawText 没有描述符时输出原始字段，格式类似 protoc --decode_raw 的单行形式：
+// 字段号:值，嵌套消息用{}包围，length-delimited字段可打印时按字符串输出，否则尝试按嵌套消息解析
+func rawText(data []byte) string {
+	var b strings.Builder
+	if !writeRawFields(&b, data) {
+		return fmt.Sprintf("%q", data)
+	}
+	return b.String()
+}
+
+// writeRawFields 输出消息的所有字段，数据不是有效的protobuf编码时返回false
+func writeRawFields(b *strings.Builder, data []byte) bool {
+	first := true
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		fmt.Fprintf(b, "%d:", num)
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(b, "%d", v)
+			data = data[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(b, "0x%08x", v)
+			data = data[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return false
+			}
+			fmt.Fprintf(b, "0x%016x", v)
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return false
+			}
+			writeRawBytes(b, v)
+			data = data[n:]
+		case protowire.StartGroupType:
+			v, n := protowire.ConsumeGroup(num, data)
+			if n < 0 {
+				return false
+			}
+			b.WriteByte('{')
+			if !writeRawFields(b, v) {
+				return false
+			}
+			b.WriteByte('}')
+			data = data[n:]
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writeRawBytes 输出length-delimited字段：可打印的按字符串，能解析为消息的按嵌套消息，否则按转义的字符串
+func writeRawBytes(b *strings.Builder, v []byte) {
+	if printable(v) {
+		fmt.Fprintf(b, "%q", v)
+		return
+	}
+	var nested strings.Builder
+	if len(v) > 0 && writeRawFields(&nested, v) {
+		b.WriteString("{" + nested.String() + "}")
+		return
+	}
+	fmt.Fprintf(b, "%q", v)
+}
+
+// printable 判断数据是否为可打印的UTF-8文本
+func printable(v []byte) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	for _, r := range string(v) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
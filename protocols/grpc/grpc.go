@@ -0,0 +1,197 @@
+// Package grpc 提供基于h2c的gRPC调用解析
+// 在 protocols/http2 之上按流识别gRPC调用（content-type为application/grpc），
+// 从:path解析服务和方法名，按长度前缀切分消息并处理压缩标志，从trailer中读取grpc-status/grpc-message。
+// 提供protobuf描述符集合时按方法的输入输出类型解码消息，否则输出原始字段
+package grpc
+
+import (
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http2"
+	"github.com/google/gopacket/reassembly"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "gRPC"
+
+const (
+	defaultMaxMessageSize  = 4 * 1024 * 1024
+	defaultMaxCallMessages = 64
+)
+
+// statusNames gRPC状态码名称
+var statusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE",
+	"UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// Status 调用的最终状态（grpc-status和grpc-message）
+type Status struct {
+	Code    int
+	Message string
+}
+
+// String 返回状态码名称和消息
+func (s *Status) String() string {
+	name := fmt.Sprintf("CODE(%d)", s.Code)
+	if s.Code >= 0 && s.Code < len(statusNames) {
+		name = statusNames[s.Code]
+	}
+	if s.Message == "" {
+		return name
+	}
+	return name + ": " + s.Message
+}
+
+// Message 一条gRPC消息
+type Message struct {
+	Compressed  bool      // 消息的压缩标志
+	Size        int       // 消息在传输中的长度（解压前）
+	Data        []byte    // 消息内容（已解压），超过 Config.MaxMessageSize 时被截断
+	Truncated   bool      // 消息被截断，不会被解码
+	Text        string    // 消息的文本形式：有描述符时为JSON，否则为原始字段
+	DecodeError error     // 解压或解码失败的原因
+	Time        time.Time // 消息最后一个字节的时间
+}
+
+// Call 一次gRPC调用
+type Call struct {
+	StreamInfo tcpdumper.StreamInfo
+	StreamID   uint32
+	Path       string // :path，如 "/helloworld.Greeter/SayHello"
+	Service    string // 服务全名，如 "helloworld.Greeter"
+	Method     string // 方法名，如 "SayHello"
+
+	RequestHeader  nethttp.Header // 请求元数据，没有看到请求时为nil
+	ResponseHeader nethttp.Header // 响应元数据
+	Trailer        nethttp.Header // 响应trailer（Trailers-Only响应时与 ResponseHeader 相同）
+	Status         *Status        // 最终状态，没有收到grpc-status时为nil
+
+	// 保存的消息，每个方向最多 Config.MaxCallMessages 条；RequestCount/ResponseCount 为实际消息数
+	Requests      []*Message
+	Responses     []*Message
+	RequestCount  int
+	ResponseCount int
+
+	Stream *http2.Stream // 承载调用的HTTP/2流
+}
+
+// Duration 调用耗时
+func (c *Call) Duration() time.Duration {
+	if c.Stream == nil {
+		return 0
+	}
+	return c.Stream.Duration()
+}
+
+// String 返回调用摘要
+func (c *Call) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%d requests, %d responses", c.Path, c.RequestCount, c.ResponseCount)
+	if d := c.Duration(); d > 0 {
+		fmt.Fprintf(&b, ", %v", d)
+	}
+	b.WriteString(") -> ")
+	if c.Status != nil {
+		b.WriteString(c.Status.String())
+	} else {
+		b.WriteString("<no status>")
+	}
+	return b.String()
+}
+
+// Config gRPC处理器配置
+type Config struct {
+	// OnCall 调用结束时的回调，为nil时把调用摘要和消息输出到Output
+	OnCall func(*Call)
+	// OnMessage 每条消息完整时的回调，用于流式调用中逐条处理消息，可以为nil
+	OnMessage func(call *Call, dir reassembly.TCPFlowDirection, msg *Message)
+	Output    io.Writer // 默认回调的输出，nil为标准输出
+
+	// Descriptors 用于解码消息的protobuf描述符，为nil时输出原始字段
+	// 可以用 LoadDescriptorSet 从 protoc --descriptor_set_out --include_imports 生成的文件加载
+	Descriptors *protoregistry.Files
+
+	MaxMessageSize  int // 单条消息最多保存的长度，0为默认4MB
+	MaxCallMessages int // 每次调用每个方向最多保存的消息数，0为默认64
+
+	// HTTP2 底层HTTP/2处理器的配置，连接中不是gRPC的流交给 HTTP2.OnStream（为nil时忽略）
+	// OnData 由gRPC处理器使用，设置的值会被忽略
+	HTTP2 http2.Config
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+	if c.MaxCallMessages <= 0 {
+		c.MaxCallMessages = defaultMaxCallMessages
+	}
+	if c.OnCall == nil {
+		w := c.Output
+		if w == nil {
+			w = os.Stdout
+		}
+		c.OnCall = func(call *Call) {
+			fmt.Fprintf(w, "gRPC/%s: %s\n", call.StreamInfo.Ident, call)
+			for _, msg := range call.Requests {
+				fmt.Fprintf(w, "  > %s\n", msg.Text)
+			}
+			for _, msg := range call.Responses {
+				fmt.Fprintf(w, "  < %s\n", msg.Text)
+			}
+		}
+	}
+	if c.HTTP2.OnStream == nil {
+		c.HTTP2.OnStream = func(*http2.Stream) {}
+	}
+	return c
+}
+
+// Detector gRPC检测器，按HTTP/2连接前言识别，替代 http2.Register 使用
+type Detector struct {
+	http2  *http2.Detector
+	config Config
+}
+
+// NewDetector 创建gRPC检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{http2: http2.NewDetector(http2.Config{}), config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	return d.http2.Detect(data, dir)
+}
+
+// DetectWithContext 与HTTP/2检测相同
+func (d *Detector) DetectWithContext(ctx *tcpdumper.DetectContext) int {
+	return d.http2.DetectWithContext(ctx)
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, d.config)
+}
+
+// NewProcessor 创建gRPC处理器
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册gRPC协议
+// gRPC检测器与HTTP/2检测器识别相同的连接，两者只需注册一个；非gRPC的流通过 Config.HTTP2.OnStream 处理
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,275 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http2"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// frame 构造HTTP/2帧
+func frame(typ, flags uint8, streamID uint32, payload []byte) []byte {
+	buf := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[5:], streamID)
+	return append(buf, payload...)
+}
+
+const (
+	frameData    = 0x0
+	frameHeaders = 0x1
+	endStream    = 0x1
+	endHeaders   = 0x4
+)
+
+// headers 构造HEADERS帧，参数为交替的名称和值
+func headers(enc *hpack.Encoder, buf *bytes.Buffer, streamID uint32, end bool, kv ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(kv); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	flags := uint8(endHeaders)
+	if end {
+		flags |= endStream
+	}
+	return frame(frameHeaders, flags, streamID, append([]byte(nil), buf.Bytes()...))
+}
+
+// grpcMessage 构造带长度前缀的gRPC消息
+func grpcMessage(compressed bool, data []byte) []byte {
+	prefix := make([]byte, 5)
+	if compressed {
+		prefix[0] = 1
+	}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	return append(prefix, data...)
+}
+
+// testConn 模拟gRPC连接
+type testConn struct {
+	t                 *testing.T
+	p                 tcpdumper.ProtocolProcessor
+	clientBuf, srvBuf bytes.Buffer
+	clientEnc, srvEnc *hpack.Encoder
+	calls             []*Call
+	otherStreams      []*http2.Stream
+}
+
+func newTestConn(t *testing.T, config Config) *testConn {
+	c := &testConn{t: t}
+	c.clientEnc, c.srvEnc = hpack.NewEncoder(&c.clientBuf), hpack.NewEncoder(&c.srvBuf)
+	config.OnCall = func(call *Call) { c.calls = append(c.calls, call) }
+	config.HTTP2.OnStream = func(s *http2.Stream) { c.otherStreams = append(c.otherStreams, s) }
+	c.p = NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+	assert.NoError(t, c.p.ProcessData([]byte(http2.ClientPreface), c2s, true, false))
+	return c
+}
+
+func (c *testConn) send(dir reassembly.TCPFlowDirection, frames ...[]byte) {
+	data := bytes.Join(frames, nil)
+	for i := 0; i < len(data); i += 5 {
+		assert.NoError(c.t, c.p.ProcessData(data[i:min(i+5, len(data))], dir, false, false))
+	}
+}
+
+func (c *testConn) request(streamID uint32, path string, extra ...string) []byte {
+	kv := append([]string{":method", "POST", ":scheme", "http", ":path", path, ":authority", "svc", "content-type", "application/grpc"}, extra...)
+	return headers(c.clientEnc, &c.clientBuf, streamID, false, kv...)
+}
+
+func (c *testConn) response(streamID uint32, end bool, kv ...string) []byte {
+	return headers(c.srvEnc, &c.srvBuf, streamID, end, kv...)
+}
+
+// greeterDescriptors 测试用的描述符：greet.Greeter/SayHello(HelloRequest) returns (HelloReply)
+func greeterDescriptors() *descriptorpb.FileDescriptorSet {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	return &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("greet.proto"),
+		Package: proto.String("greet"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("HelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+			{Name: proto.String("HelloReply"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".greet.HelloRequest"),
+				OutputType: proto.String(".greet.HelloReply"),
+			}},
+		}},
+	}}}
+}
+
+// helloRequest 编码HelloRequest
+func helloRequest(name string) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendString(b, name)
+}
+
+// helloReply 编码HelloReply
+func helloReply(message string, count uint64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, message)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, count)
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// assertJSON 比较JSON内容（protojson的输出格式不稳定）
+func assertJSON(t *testing.T, expected, actual string) {
+	var e, a any
+	assert.NoError(t, json.Unmarshal([]byte(expected), &e))
+	if assert.NoError(t, json.Unmarshal([]byte(actual), &a), actual) {
+		assert.Equal(t, e, a)
+	}
+}
+
+// 测试一元调用：跨帧的消息、压缩的响应、按描述符解码和trailer中的状态
+func TestUnaryCall(t *testing.T) {
+	files, err := NewDescriptors(greeterDescriptors())
+	assert.NoError(t, err)
+	c := newTestConn(t, Config{Descriptors: files})
+
+	req := grpcMessage(false, helloRequest("alice"))
+	c.send(c2s, c.request(1, "/greet.Greeter/SayHello", "grpc-encoding", "gzip"),
+		frame(frameData, 0, 1, req[:4]),
+		frame(frameData, endStream, 1, req[4:]))
+	c.send(s2c, c.response(1, false, ":status", "200", "content-type", "application/grpc", "grpc-encoding", "gzip"),
+		frame(frameData, 0, 1, grpcMessage(true, gzipData(t, helloReply("hello alice", 3)))),
+		c.response(1, true, "grpc-status", "0"))
+	assert.NoError(t, c.p.Close())
+
+	if assert.Len(t, c.calls, 1) {
+		call := c.calls[0]
+		assert.Equal(t, "greet.Greeter", call.Service)
+		assert.Equal(t, "SayHello", call.Method)
+		assert.Equal(t, uint32(1), call.StreamID)
+		assert.Equal(t, &Status{Code: 0}, call.Status)
+		assert.Regexp(t, `^/greet.Greeter/SayHello \(1 requests, 1 responses, .+\) -> OK$`, call.String())
+		if assert.Len(t, call.Requests, 1) && assert.Len(t, call.Responses, 1) {
+			assert.False(t, call.Requests[0].Compressed)
+			assertJSON(t, `{"name":"alice"}`, call.Requests[0].Text)
+			resp := call.Responses[0]
+			assert.True(t, resp.Compressed)
+			assert.NoError(t, resp.DecodeError)
+			assert.Equal(t, helloReply("hello alice", 3), resp.Data)
+			assertJSON(t, `{"message":"hello alice","count":3}`, resp.Text)
+		}
+	}
+	assert.Empty(t, c.otherStreams)
+}
+
+// 测试没有描述符时输出原始字段，以及流式调用的多条消息
+func TestStreamingRawFields(t *testing.T) {
+	var messages []string
+	c := newTestConn(t, Config{
+		MaxCallMessages: 2,
+		OnMessage: func(call *Call, dir reassembly.TCPFlowDirection, msg *Message) {
+			messages = append(messages, dir.String()+" "+msg.Text)
+		},
+	})
+
+	nested := protowire.AppendTag(nil, 1, protowire.VarintType)
+	nested = protowire.AppendVarint(nested, 150)
+	item := protowire.AppendTag(helloRequest("a"), 2, protowire.BytesType)
+	item = protowire.AppendBytes(item, nested)
+	item = protowire.AppendTag(item, 3, protowire.Fixed32Type)
+	item = protowire.AppendFixed32(item, 7)
+
+	c.send(c2s, c.request(1, "/list.Lister/List"), frame(frameData, endStream, 1, grpcMessage(false, nil)))
+	stream := bytes.Join([][]byte{grpcMessage(false, item), grpcMessage(false, helloRequest("b")), grpcMessage(false, helloRequest("c"))}, nil)
+	c.send(s2c, c.response(1, false, ":status", "200", "content-type", "application/grpc+proto"),
+		frame(frameData, 0, 1, stream),
+		c.response(1, true, "grpc-status", "0"))
+
+	if assert.Len(t, c.calls, 1) {
+		call := c.calls[0]
+		assert.Equal(t, 1, call.RequestCount)
+		assert.Equal(t, 3, call.ResponseCount)
+		assert.Len(t, call.Responses, 2)
+		assert.Equal(t, `1:"a" 2:{1:150} 3:0x00000007`, call.Responses[0].Text)
+	}
+	assert.Equal(t, []string{
+		"client->server ",
+		`server->client 1:"a" 2:{1:150} 3:0x00000007`,
+		`server->client 1:"b"`,
+		`server->client 1:"c"`,
+	}, messages)
+	assert.Equal(t, `"\xff\xff"`, rawText([]byte{0xff, 0xff}))
+}
+
+// 测试Trailers-Only错误响应、不支持的压缩编码和连接中的非gRPC流
+func TestErrorsAndOtherStreams(t *testing.T) {
+	c := newTestConn(t, Config{})
+
+	c.send(c2s, c.request(1, "/greet.Greeter/Missing"), frame(frameData, endStream, 1, grpcMessage(false, helloRequest("x"))))
+	c.send(s2c, c.response(1, true, ":status", "200", "content-type", "application/grpc", "grpc-status", "12", "grpc-message", "unknown%20method%20Missing"))
+
+	c.send(c2s, c.request(3, "/greet.Greeter/SayHello", "grpc-encoding", "snappy"),
+		frame(frameData, endStream, 3, grpcMessage(true, []byte("??"))))
+	c.send(s2c, c.response(3, true, ":status", "200", "content-type", "application/grpc", "grpc-status", "13"))
+
+	c.send(c2s, headers(c.clientEnc, &c.clientBuf, 5, true, ":method", "GET", ":path", "/healthz"))
+	c.send(s2c, c.response(5, true, ":status", "204"))
+	assert.NoError(t, c.p.Close())
+
+	if assert.Len(t, c.calls, 2) {
+		assert.Equal(t, "UNIMPLEMENTED: unknown method Missing", c.calls[0].Status.String())
+		assert.Equal(t, c.calls[0].ResponseHeader, c.calls[0].Trailer)
+		assert.Equal(t, 13, c.calls[1].Status.Code)
+		if assert.Len(t, c.calls[1].Requests, 1) {
+			assert.ErrorIs(t, c.calls[1].Requests[0].DecodeError, errUnsupportedEncoding)
+		}
+	}
+	if assert.Len(t, c.otherStreams, 1) {
+		assert.Equal(t, "/healthz", c.otherStreams[0].Request.Path)
+	}
+}
+
+// 测试通过注册表识别gRPC连接
+func TestRegister(t *testing.T) {
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{})
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{}, nil)
+	assert.NoError(t, d.ProcessData([]byte(http2.ClientPreface), c2s, true, false))
+	assert.Equal(t, ProtocolName, d.GetProtocolName())
+	assert.NoError(t, d.Close())
+}
@@ -0,0 +1,201 @@
+package grpc
+
+import (
+	"encoding/binary"
+	nethttp "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http2"
+	"github.com/google/gopacket/reassembly"
+)
+
+// messagePrefixLen 消息前缀长度：1字节压缩标志和4字节长度
+const messagePrefixLen = 5
+
+// messageReader 按长度前缀切分一个方向的消息，消息可以跨越多个DATA帧
+type messageReader struct {
+	prefix     []byte
+	compressed bool
+	length     int // 当前消息的长度
+	received   int // 当前消息已收到的字节数
+	data       []byte
+}
+
+// callState 一次调用的解析状态
+type callState struct {
+	call    *Call
+	readers [2]messageReader
+}
+
+// processor gRPC处理器，包装HTTP/2处理器并在其回调中解析gRPC消息
+type processor struct {
+	*tcpdumper.FramedProcessor
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	calls      map[*http2.Stream]*callState
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	p := &processor{
+		streamInfo: streamInfo,
+		config:     config,
+		calls:      make(map[*http2.Stream]*callState),
+	}
+	h2 := config.HTTP2
+	h2.OnData = p.data
+	h2.OnStream = p.stream
+	p.FramedProcessor = http2.NewProcessor(streamInfo, h2)
+	return p
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
+
+// isGRPC 根据content-type判断流是否为gRPC调用
+func isGRPC(s *http2.Stream) bool {
+	var contentType string
+	if s.Request != nil {
+		contentType = s.Request.Header.Get("Content-Type")
+	}
+	if contentType == "" && s.Response != nil {
+		contentType = s.Response.Header.Get("Content-Type")
+	}
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// callFor 获取流对应的调用，不存在时创建
+func (p *processor) callFor(s *http2.Stream) *callState {
+	state := p.calls[s]
+	if state == nil {
+		call := &Call{StreamInfo: p.streamInfo, StreamID: s.ID, Stream: s}
+		if s.Request != nil {
+			call.Path = s.Request.Path
+			call.Service, call.Method, _ = strings.Cut(strings.TrimPrefix(s.Request.Path, "/"), "/")
+		}
+		state = &callState{call: call}
+		p.calls[s] = state
+	}
+	return state
+}
+
+// data HTTP/2 DATA帧回调
+func (p *processor) data(s *http2.Stream, dir reassembly.TCPFlowDirection, data []byte, endStream bool) {
+	if !isGRPC(s) {
+		return
+	}
+	state := p.callFor(s)
+	idx := 1
+	if dir == reassembly.TCPDirClientToServer {
+		idx = 0
+	}
+	r := &state.readers[idx]
+
+	for len(data) > 0 {
+		if len(r.prefix) < messagePrefixLen {
+			n := min(messagePrefixLen-len(r.prefix), len(data))
+			r.prefix = append(r.prefix, data[:n]...)
+			data = data[n:]
+			if len(r.prefix) < messagePrefixLen {
+				break
+			}
+			r.compressed = r.prefix[0]&1 != 0
+			r.length = int(binary.BigEndian.Uint32(r.prefix[1:]))
+			r.received = 0
+			r.data = make([]byte, 0, min(r.length, p.config.MaxMessageSize))
+		}
+
+		n := min(r.length-r.received, len(data))
+		if room := p.config.MaxMessageSize - len(r.data); room > 0 {
+			r.data = append(r.data, data[:min(n, room)]...)
+		}
+		r.received += n
+		data = data[n:]
+		if r.received == r.length {
+			p.message(state, s, dir, r)
+		}
+	}
+}
+
+// message 一条消息接收完成
+func (p *processor) message(state *callState, s *http2.Stream, dir reassembly.TCPFlowDirection, r *messageReader) {
+	msg := &Message{
+		Compressed: r.compressed,
+		Size:       r.length,
+		Data:       r.data,
+		Truncated:  r.length > p.config.MaxMessageSize,
+	}
+	r.prefix, r.data = nil, nil
+
+	call := state.call
+	var header nethttp.Header
+	if dir == reassembly.TCPDirClientToServer {
+		if s.Request != nil {
+			msg.Time = s.Request.End
+			header = s.Request.Header
+		}
+	} else if s.Response != nil {
+		msg.Time = s.Response.End
+		header = s.Response.Header
+	}
+	if !msg.Truncated {
+		p.decode(call, dir, msg, header.Get("Grpc-Encoding"))
+	}
+
+	if dir == reassembly.TCPDirClientToServer {
+		call.RequestCount++
+		if len(call.Requests) < p.config.MaxCallMessages {
+			call.Requests = append(call.Requests, msg)
+		}
+	} else {
+		call.ResponseCount++
+		if len(call.Responses) < p.config.MaxCallMessages {
+			call.Responses = append(call.Responses, msg)
+		}
+	}
+	if p.config.OnMessage != nil {
+		p.config.OnMessage(call, dir, msg)
+	}
+}
+
+// stream HTTP/2流结束回调
+func (p *processor) stream(s *http2.Stream) {
+	if !isGRPC(s) {
+		p.config.HTTP2.OnStream(s)
+		return
+	}
+	call := p.callFor(s).call
+	delete(p.calls, s)
+
+	if s.Request != nil {
+		call.RequestHeader = s.Request.Header
+	}
+	if s.Response != nil {
+		call.ResponseHeader = s.Response.Header
+		call.Trailer = s.Response.Trailer
+		if call.Trailer == nil && s.Response.Header.Get("Grpc-Status") != "" {
+			// Trailers-Only响应：状态在唯一的HEADERS中
+			call.Trailer = s.Response.Header
+		}
+	}
+	call.Status = parseStatus(call.Trailer.Get("Grpc-Status"), call.Trailer.Get("Grpc-Message"))
+	p.config.OnCall(call)
+}
+
+// parseStatus 解析grpc-status和grpc-message，grpc-message使用百分号编码
+func parseStatus(code, message string) *Status {
+	if code == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		n = 2 // UNKNOWN
+	}
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	return &Status{Code: n, Message: message}
+}
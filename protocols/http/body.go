@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// errUnsupportedEncoding 不支持的Content-Encoding
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// contentEncoding 返回消息的Content-Encoding，多个头部按出现顺序合并
+func contentEncoding(msg *Message) string {
+	return strings.Join(msg.Header.Values("Content-Encoding"), ",")
+}
+
+// newDecoder 按Content-Encoding创建解码器
+// 多个编码按应用顺序列出（如 "gzip, br"），解码时逆序进行
+func newDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("gzip: %w", err)
+			}
+			r = gr
+		case "deflate":
+			r = newDeflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		default:
+			return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, coding)
+		}
+	}
+	return r, nil
+}
+
+// newDeflateReader 创建deflate解码器
+// deflate编码按规范是zlib格式，但不少服务器发送的是不带zlib头的原始deflate数据，按前两个字节区分
+func newDeflateReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		zr, err := zlib.NewReader(br)
+		if err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// lazyDecoder 在第一次读取时才创建解码器
+// gzip等解码器创建时就会读取数据，延迟到读取方的goroutine中进行，避免阻塞抓包
+type lazyDecoder struct {
+	encoding string
+	src      io.Reader
+	r        io.Reader
+	err      error
+}
+
+func (ld *lazyDecoder) Read(p []byte) (int, error) {
+	if ld.r == nil && ld.err == nil {
+		ld.r, ld.err = newDecoder(ld.encoding, ld.src)
+	}
+	if ld.err != nil {
+		return 0, ld.err
+	}
+	return ld.r.Read(p)
+}
+
+// decodeBody 按Content-Encoding解码已保存的消息体，解码后的内容同样受limit限制
+// 解码失败时保留原始消息体并记录 DecodeError
+func decodeBody(msg *Message, limit int) {
+	encoding := contentEncoding(msg)
+	if encoding == "" || len(msg.Body) == 0 {
+		return
+	}
+
+	r, err := newDecoder(encoding, bytes.NewReader(msg.Body))
+	if err != nil {
+		msg.DecodeError = err
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil && !msg.BodyTruncated {
+		msg.DecodeError = err
+		return
+	}
+	// 原始消息体已被截断时，解码出尽可能多的内容
+	if len(body) > limit {
+		body = body[:limit]
+		msg.BodyTruncated = true
+	}
+	msg.Body = body
+	msg.Decoded = true
+}
@@ -0,0 +1,175 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+// compress 按编码压缩测试数据
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		assert.NoError(t, err)
+		w = fw
+	case "br":
+		w = brotli.NewWriter(&buf)
+	}
+	_, err := w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// response 构造带Content-Encoding的响应
+func response(encoding string, body []byte) []byte {
+	return append([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n", encoding, len(body))), body...)
+}
+
+// 测试保存的消息体按Content-Encoding解码
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(strings.Repeat("hello compressed world ", 20))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"gzip", "gzip", compress(t, "gzip", plain)},
+		{"deflate zlib", "deflate", compress(t, "zlib", plain)},
+		{"deflate raw", "deflate", compress(t, "flate", plain)},
+		{"brotli", "br", compress(t, "br", plain)},
+		{"gzip then brotli", "gzip, br", compress(t, "br", compress(t, "gzip", plain))},
+		{"identity", "identity", plain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, txs := newTestProcessor(Config{CaptureBody: true})
+			assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+			feedBytes(t, p, string(response(tt.encoding, tt.body)), s2c)
+			if assert.Len(t, *txs, 1) {
+				resp := (*txs)[0].Response
+				assert.True(t, resp.Decoded)
+				assert.NoError(t, resp.DecodeError)
+				assert.Equal(t, plain, resp.Body)
+				assert.Equal(t, int64(len(tt.body)), resp.BodySize)
+			}
+		})
+	}
+}
+
+// 测试解码失败和关闭解码
+func TestDecodeBodyRaw(t *testing.T) {
+	body := compress(t, "gzip", []byte("data"))
+
+	p, txs := newTestProcessor(Config{CaptureBody: true, DisableDecompression: true})
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData(response("gzip", body), s2c, true, false))
+	if assert.Len(t, *txs, 1) {
+		assert.False(t, (*txs)[0].Response.Decoded)
+		assert.Equal(t, body, (*txs)[0].Response.Body)
+	}
+
+	p, txs = newTestProcessor(Config{CaptureBody: true})
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData(response("zstd", []byte("xx")), s2c, true, false))
+	assert.NoError(t, p.ProcessData(response("gzip", []byte("not gzip")), s2c, false, false))
+	if assert.Len(t, *txs, 2) {
+		resp := (*txs)[0].Response
+		assert.ErrorIs(t, resp.DecodeError, errUnsupportedEncoding)
+		assert.False(t, resp.Decoded)
+		assert.Equal(t, []byte("xx"), resp.Body)
+		resp = (*txs)[1].Response
+		assert.Error(t, resp.DecodeError)
+		assert.Equal(t, []byte("not gzip"), resp.Body)
+	}
+}
+
+// 测试解码后的消息体同样受长度限制，原始消息体被截断时解码出尽可能多的内容
+func TestDecodeBodyLimit(t *testing.T) {
+	plain := bytes.Repeat([]byte{'z'}, 100000)
+	body := compress(t, "gzip", plain)
+	assert.Less(t, len(body), 1000)
+
+	p, txs := newTestProcessor(Config{CaptureBody: true, MaxBodySize: 1000})
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData(response("gzip", body), s2c, true, false))
+	if assert.Len(t, *txs, 1) {
+		resp := (*txs)[0].Response
+		assert.True(t, resp.Decoded)
+		assert.True(t, resp.BodyTruncated)
+		assert.Equal(t, plain[:1000], resp.Body)
+	}
+
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+	body = compress(t, "gzip", random)
+	p, txs = newTestProcessor(Config{CaptureBody: true, MaxBodySize: len(body) / 2})
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData(response("gzip", body), s2c, true, false))
+	if assert.Len(t, *txs, 1) {
+		resp := (*txs)[0].Response
+		assert.True(t, resp.BodyTruncated)
+		assert.NoError(t, resp.DecodeError)
+		assert.True(t, bytes.HasPrefix(random, resp.Body))
+	}
+}
+
+// 测试以流的方式读取解码后的消息体
+func TestBodyStream(t *testing.T) {
+	plain := []byte(strings.Repeat("streamed body ", 1000))
+	body := compress(t, "gzip", plain)
+
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+	errs := map[string]error{}
+	p, txs := newTestProcessor(Config{
+		OnBody: func(tx *Transaction, r io.Reader) {
+			data, err := io.ReadAll(r)
+			key := "request " + tx.Request.URI
+			if tx.Response != nil {
+				key = "response " + tx.Request.URI
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			bodies[key], errs[key] = data, err
+		},
+	})
+
+	assert.NoError(t, p.ProcessData([]byte("POST /up HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /down HTTP/1.1\r\n\r\n"), c2s, true, false))
+	chunked := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	for i := 0; i < len(chunked); i += 100 {
+		assert.NoError(t, p.ProcessData([]byte(chunked[i:min(i+100, len(chunked))]), s2c, false, false))
+	}
+	// 流在消息体中途结束
+	assert.NoError(t, p.ProcessData([]byte("PUT /cut HTTP/1.1\r\nContent-Length: 10\r\n\r\n12345"), c2s, false, false))
+	assert.NoError(t, p.Close())
+
+	assert.Len(t, *txs, 3)
+	assert.Equal(t, []byte("abc"), bodies["request /up"])
+	assert.NoError(t, errs["request /up"])
+	assert.Equal(t, plain, bodies["response /down"])
+	assert.NoError(t, errs["response /down"])
+	assert.Nil(t, (*txs)[1].Response.Body, "body is streamed, not captured")
+	assert.Equal(t, []byte("12345"), bodies["request /cut"])
+	assert.ErrorIs(t, errs["request /cut"], io.ErrUnexpectedEOF)
+	assert.Len(t, bodies, 3, "messages without body have no stream")
+}
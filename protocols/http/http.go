@@ -0,0 +1,185 @@
+// Package http 提供HTTP/1.x协议的检测器和处理器
+// 处理器解析请求和响应（支持keep-alive、pipelining、chunked、Content-Length以及HEAD/204/304等没有响应体的情况），
+// 按顺序配对后以事务（Transaction）事件的形式交给回调。
+// CONNECT隧道建立和101 Switching Protocols之后，流的剩余数据交给注册表重新识别
+package http
+
+import (
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "HTTP"
+
+const (
+	defaultMaxHeaderSize = 64 * 1024
+	defaultMaxBodySize   = 1024 * 1024
+)
+
+// methods 用于检测的请求方法
+var methods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "PATCH ", "OPTIONS ", "TRACE ", "CONNECT "}
+
+// Message 请求和响应共有的字段
+type Message struct {
+	Proto         string         // 协议版本，如 "HTTP/1.1"
+	Header        nethttp.Header // 头部
+	Trailer       nethttp.Header // chunked编码的trailer，没有时为nil
+	Chunked       bool           // 是否使用chunked编码
+	Body          []byte         // 消息体（已去掉chunked编码），仅在 Config.CaptureBody 为true时保存
+	BodySize      int64          // 消息体在传输中的实际长度（解码前）
+	BodyTruncated bool           // 消息体（原始或解码后）超过 Config.MaxBodySize 被截断
+	Decoded       bool           // Body 已按Content-Encoding解码
+	DecodeError   error          // 解码失败的原因，此时 Body 为原始数据
+	Start         time.Time      // 第一个字节的时间
+	End           time.Time      // 最后一个字节的时间
+}
+
+// Request HTTP请求
+type Request struct {
+	Message
+	Method string
+	URI    string // 请求行中的URI
+	Host   string
+}
+
+// Response HTTP响应
+type Response struct {
+	Message
+	StatusCode int
+	Status     string // 状态行中的状态，如 "200 OK"
+}
+
+// Transaction 一次HTTP请求/响应事务
+// 流结束时仍没有响应的请求，Response为nil；抓包从响应开始时，Request为nil
+type Transaction struct {
+	StreamInfo tcpdumper.StreamInfo
+	Request    *Request
+	Response   *Response
+}
+
+// Duration 从请求的第一个字节到响应的最后一个字节的时间
+func (tx *Transaction) Duration() time.Duration {
+	if tx.Request == nil || tx.Response == nil {
+		return 0
+	}
+	return tx.Response.End.Sub(tx.Request.Start)
+}
+
+// Latency 从请求的最后一个字节到响应的第一个字节的时间（首字节时间）
+func (tx *Transaction) Latency() time.Duration {
+	if tx.Request == nil || tx.Response == nil {
+		return 0
+	}
+	return tx.Response.Start.Sub(tx.Request.End)
+}
+
+// String 返回事务摘要
+func (tx *Transaction) String() string {
+	var b strings.Builder
+	if tx.Request != nil {
+		fmt.Fprintf(&b, "%s %s%s", tx.Request.Method, tx.Request.Host, tx.Request.URI)
+	} else {
+		b.WriteString("<no request>")
+	}
+	if tx.Response != nil {
+		fmt.Fprintf(&b, " -> %s (%d bytes, %v)", tx.Response.Status, tx.Response.BodySize, tx.Duration())
+	} else {
+		b.WriteString(" -> <no response>")
+	}
+	return b.String()
+}
+
+// Config HTTP处理器配置
+type Config struct {
+	// OnTransaction 事务完成时的回调，为nil时把事务摘要输出到Output
+	OnTransaction func(*Transaction)
+	Output        io.Writer // 默认回调的输出，nil为标准输出
+
+	CaptureBody          bool // 是否保存消息体
+	DisableDecompression bool // 不解码Content-Encoding（gzip、deflate、br），保存原始消息体
+	MaxBodySize          int  // 保存的消息体（原始和解码后）最大长度，0为默认1MB
+	MaxHeaderSize        int  // 头部最大长度，0为默认64KB
+
+	// OnBody 以流的方式处理消息体，适用于不适合完整保存的大文件传输，为nil时不启用
+	// 每个有消息体的消息在头部解析完成时调用一次，在独立的goroutine中执行；
+	// tx.Response 不为nil表示响应的消息体。body 按Content-Encoding解码（除非 DisableDecompression），
+	// 消息结束时返回io.EOF，流在消息中途结束时返回io.ErrUnexpectedEOF。
+	// 回调中只应读取请求行、状态行和头部，其余字段仍在抓包goroutine中更新。
+	// 缓冲区满时的处理见 BodyStreamConfig：默认策略 ReaderBlock 会在回调读取过慢时阻塞抓包goroutine
+	OnBody func(tx *Transaction, body io.Reader)
+	// BodyStreamConfig 消息体流的缓冲区大小和溢出策略；Policy的零值为 ReaderBlock（背压），
+	// 回调可能读取缓慢（如写入网络或磁盘）时应使用 ReaderDropStream，避免拖慢抓包
+	BodyStreamConfig tcpdumper.ReaderConfig
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = defaultMaxBodySize
+	}
+	if c.MaxHeaderSize <= 0 {
+		c.MaxHeaderSize = defaultMaxHeaderSize
+	}
+	if c.OnTransaction == nil {
+		w := c.Output
+		if w == nil {
+			w = os.Stdout
+		}
+		c.OnTransaction = func(tx *Transaction) {
+			fmt.Fprintf(w, "HTTP/%s: %s\n", tx.StreamInfo.Ident, tx)
+		}
+	}
+	return c
+}
+
+// Detector HTTP/1.x协议检测器
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建HTTP检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	s := string(data)
+	if dir == reassembly.TCPDirClientToServer {
+		for _, method := range methods {
+			if strings.HasPrefix(s, method) {
+				return 90
+			}
+		}
+		return 0
+	}
+	if strings.HasPrefix(s, "HTTP/1.") {
+		return 90
+	}
+	return 0
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, d.config)
+}
+
+// NewProcessor 创建HTTP处理器
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *Processor {
+	return newProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册HTTP协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,324 @@
+package http
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+var baseTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at 返回测试基准时间之后ms毫秒的时间戳
+func at(ms int) time.Time {
+	return baseTime.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// newTestProcessor 创建收集事务的处理器
+func newTestProcessor(config Config) (*Processor, *[]*Transaction) {
+	txs := &[]*Transaction{}
+	config.OnTransaction = func(tx *Transaction) { *txs = append(*txs, tx) }
+	return NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config), txs
+}
+
+// feedBytes 逐字节输入数据，验证任意切分位置
+func feedBytes(t *testing.T, p *Processor, data string, dir reassembly.TCPFlowDirection) {
+	for i := 0; i < len(data); i++ {
+		assert.NoError(t, p.ProcessData([]byte{data[i]}, dir, false, false))
+	}
+}
+
+// 测试keep-alive连接上的多个事务和耗时计算
+func TestKeepAliveTimings(t *testing.T) {
+	p, txs := newTestProcessor(Config{})
+
+	assert.NoError(t, p.ProcessTimedData([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"), c2s, true, false, at(0)))
+	assert.NoError(t, p.ProcessTimedData([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhel"), s2c, true, false, at(30)))
+	assert.NoError(t, p.ProcessTimedData([]byte("lo"), s2c, false, false, at(50)))
+	assert.NoError(t, p.ProcessTimedData([]byte("GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"), c2s, false, false, at(100)))
+	assert.NoError(t, p.ProcessTimedData([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"), s2c, false, false, at(110)))
+
+	if assert.Len(t, *txs, 2) {
+		tx := (*txs)[0]
+		assert.Equal(t, "GET", tx.Request.Method)
+		assert.Equal(t, "/a", tx.Request.URI)
+		assert.Equal(t, "example.com", tx.Request.Host)
+		assert.Equal(t, 200, tx.Response.StatusCode)
+		assert.Equal(t, "200 OK", tx.Response.Status)
+		assert.Equal(t, int64(5), tx.Response.BodySize)
+		assert.Nil(t, tx.Response.Body, "body is not captured by default")
+		assert.Equal(t, 50*time.Millisecond, tx.Duration())
+		assert.Equal(t, 30*time.Millisecond, tx.Latency())
+		assert.Equal(t, "GET example.com/a -> 200 OK (5 bytes, 50ms)", tx.String())
+
+		tx = (*txs)[1]
+		assert.Equal(t, "/b", tx.Request.URI)
+		assert.Equal(t, 404, tx.Response.StatusCode)
+		assert.Equal(t, 10*time.Millisecond, tx.Duration())
+	}
+	assert.NoError(t, p.Close())
+	assert.Len(t, *txs, 2)
+}
+
+// 测试pipelining：多个请求先于响应发送，响应按顺序配对
+func TestPipelining(t *testing.T) {
+	p, txs := newTestProcessor(Config{CaptureBody: true})
+
+	feedBytes(t, p, "GET /1 HTTP/1.1\r\n\r\nPOST /2 HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcHEAD /3 HTTP/1.1\r\n\r\n", c2s)
+	assert.Empty(t, *txs)
+	feedBytes(t, p, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n", s2c)
+
+	if assert.Len(t, *txs, 3) {
+		assert.Equal(t, "/1", (*txs)[0].Request.URI)
+		assert.Equal(t, []byte("ok"), (*txs)[0].Response.Body)
+		assert.Equal(t, "/2", (*txs)[1].Request.URI)
+		assert.Equal(t, []byte("abc"), (*txs)[1].Request.Body)
+		assert.Equal(t, 201, (*txs)[1].Response.StatusCode)
+		// HEAD响应的Content-Length不代表消息体
+		assert.Equal(t, "HEAD", (*txs)[2].Request.Method)
+		assert.Equal(t, int64(0), (*txs)[2].Response.BodySize)
+	}
+}
+
+// 测试chunked编码和trailer
+func TestChunked(t *testing.T) {
+	p, txs := newTestProcessor(Config{CaptureBody: true})
+
+	feedBytes(t, p, "POST /upload HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\n\r\n", c2s)
+	feedBytes(t, p, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: 1234\r\n\r\n", s2c)
+
+	if assert.Len(t, *txs, 1) {
+		tx := (*txs)[0]
+		assert.True(t, tx.Request.Chunked)
+		assert.Equal(t, []byte("abc"), tx.Request.Body)
+		assert.True(t, tx.Response.Chunked)
+		assert.Equal(t, []byte("hello world"), tx.Response.Body)
+		assert.Equal(t, int64(11), tx.Response.BodySize)
+		assert.Equal(t, "1234", tx.Response.Trailer.Get("X-Checksum"))
+	}
+
+	// 非法的chunk长度使该方向停止解析
+	err := p.ProcessData([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"), s2c, false, false)
+	assert.ErrorIs(t, err, errBadChunk)
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 200 OK\r\n\r\n"), s2c, false, false))
+}
+
+// 测试没有消息体的响应
+func TestNoBodyResponses(t *testing.T) {
+	p, txs := newTestProcessor(Config{})
+
+	assert.NoError(t, p.ProcessData([]byte("GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte(
+		"HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n"+
+			"HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), s2c, true, false))
+
+	if assert.Len(t, *txs, 3) {
+		assert.Equal(t, 204, (*txs)[0].Response.StatusCode)
+		assert.Equal(t, 304, (*txs)[1].Response.StatusCode)
+		assert.False(t, (*txs)[1].Response.Chunked)
+		assert.Equal(t, 200, (*txs)[2].Response.StatusCode)
+	}
+}
+
+// 测试 Expect: 100-continue：中间响应不参与配对
+func TestContinue(t *testing.T) {
+	p, txs := newTestProcessor(Config{CaptureBody: true})
+
+	assert.NoError(t, p.ProcessData([]byte("PUT /f HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 100 Continue\r\n\r\n"), s2c, true, false))
+	assert.NoError(t, p.ProcessData([]byte("data"), c2s, false, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"), s2c, false, false))
+
+	if assert.Len(t, *txs, 1) {
+		assert.Equal(t, []byte("data"), (*txs)[0].Request.Body)
+		assert.Equal(t, 201, (*txs)[0].Response.StatusCode)
+	}
+}
+
+// 测试没有长度的响应在流结束时完成，以及没有响应的请求
+func TestUntilCloseAndUnanswered(t *testing.T) {
+	p, txs := newTestProcessor(Config{CaptureBody: true})
+
+	assert.NoError(t, p.ProcessData([]byte("GET /old HTTP/1.0\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.0 200 OK\r\n\r\npart1,"), s2c, true, false))
+	assert.NoError(t, p.ProcessData([]byte("part2"), s2c, false, false))
+	assert.Empty(t, *txs)
+	assert.NoError(t, p.ProcessData(nil, s2c, false, true))
+	if assert.Len(t, *txs, 1) {
+		assert.Equal(t, []byte("part1,part2"), (*txs)[0].Response.Body)
+	}
+
+	p, txs = newTestProcessor(Config{})
+	assert.NoError(t, p.ProcessData([]byte("GET /lost HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.Close())
+	if assert.Len(t, *txs, 1) {
+		assert.Nil(t, (*txs)[0].Response)
+		assert.Equal(t, "GET /lost -> <no response>", (*txs)[0].String())
+	}
+}
+
+// 测试消息体截断和头部长度限制
+func TestLimits(t *testing.T) {
+	p, txs := newTestProcessor(Config{CaptureBody: true, MaxBodySize: 4})
+
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123456789"), s2c, true, false))
+	if assert.Len(t, *txs, 1) {
+		resp := (*txs)[0].Response
+		assert.Equal(t, []byte("0123"), resp.Body)
+		assert.True(t, resp.BodyTruncated)
+		assert.Equal(t, int64(10), resp.BodySize)
+	}
+
+	p, _ = newTestProcessor(Config{MaxHeaderSize: 16})
+	err := p.ProcessData([]byte("GET / HTTP/1.1\r\nHost: a-very-long-host-name\r\n"), c2s, true, false)
+	assert.ErrorIs(t, err, errHeaderTooLarge)
+}
+
+// 测试CONNECT被拒绝时，暂存的数据仍然按HTTP解析
+func TestConnectRejected(t *testing.T) {
+	p, txs := newTestProcessor(Config{})
+
+	assert.NoError(t, p.ProcessData([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\nGET /next HTTP/1.1\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"), s2c, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), s2c, false, false))
+
+	if assert.Len(t, *txs, 2) {
+		assert.Equal(t, 407, (*txs)[0].Response.StatusCode)
+		assert.Equal(t, "/next", (*txs)[1].Request.URI)
+	}
+}
+
+// 测试CONNECT被拒绝后，暂存数据中的错误返回给调用者
+func TestConnectRejectedMalformed(t *testing.T) {
+	p, txs := newTestProcessor(Config{})
+
+	assert.NoError(t, p.ProcessData([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\nBOGUS\r\n\r\n"), c2s, true, false))
+	err := p.ProcessData([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"), s2c, true, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `client->server: malformed request line "BOGUS"`)
+	}
+	assert.NoError(t, p.Close())
+	assert.Len(t, *txs, 1)
+}
+
+// tunnelProcessor 记录隧道数据的测试处理器
+type tunnelProcessor struct {
+	data [2]bytes.Buffer
+}
+
+func (tp *tunnelProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	if dir == c2s {
+		tp.data[0].Write(data)
+	} else {
+		tp.data[1].Write(data)
+	}
+	return nil
+}
+
+func (tp *tunnelProcessor) Close() error            { return nil }
+func (tp *tunnelProcessor) GetProtocolName() string { return "TLS" }
+
+// 测试CONNECT隧道建立后，剩余数据由分发器重新检测
+func TestConnectSwitch(t *testing.T) {
+	registry := tcpdumper.NewProtocolRegistry()
+	var txs []*Transaction
+	Register(registry, Config{OnTransaction: func(tx *Transaction) { txs = append(txs, tx) }})
+	var tunnels []*tunnelProcessor
+	tcpdumper.RegisterSimpleProtocol(registry, "TLS", "\x16\x03", func(tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+		tp := &tunnelProcessor{}
+		tunnels = append(tunnels, tp)
+		return tp
+	})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{}, nil)
+	// 客户端在收到响应前就发送了ClientHello
+	assert.NoError(t, d.ProcessData([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n\x16\x03\x01hello"), c2s, true, false))
+	assert.NoError(t, d.ProcessData([]byte("HTTP/1.1 200 Connection established\r\n\r\n\x16\x03\x03server"), s2c, true, false))
+	assert.NoError(t, d.ProcessData([]byte("\x17\x03\x03app"), c2s, false, false))
+	assert.Equal(t, "TLS", d.GetProtocolName())
+	assert.NoError(t, d.Close())
+
+	if assert.Len(t, txs, 1) {
+		assert.Equal(t, "CONNECT", txs[0].Request.Method)
+		assert.Equal(t, 200, txs[0].Response.StatusCode)
+	}
+	if assert.Len(t, tunnels, 1) {
+		assert.Equal(t, "\x16\x03\x01hello\x17\x03\x03app", tunnels[0].data[0].String())
+		assert.Equal(t, "\x16\x03\x03server", tunnels[0].data[1].String())
+	}
+}
+
+// 测试101 Switching Protocols之后HTTP处理器退出
+func TestUpgradeSwitch(t *testing.T) {
+	p, txs := newTestProcessor(Config{})
+
+	assert.NoError(t, p.ProcessData([]byte("GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n\x81\x05"), c2s, true, false))
+	err := p.ProcessData([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"), s2c, true, false)
+	var ps *tcpdumper.ProtocolSwitch
+	if assert.ErrorAs(t, err, &ps) {
+		assert.Equal(t, "", ps.Protocol)
+		assert.Equal(t, []byte("\x81\x05"), ps.ClientData)
+		assert.Equal(t, []byte("\x81\x02hi"), ps.ServerData)
+	}
+	if assert.Len(t, *txs, 1) {
+		assert.Equal(t, 101, (*txs)[0].Response.StatusCode)
+	}
+}
+
+// 测试检测器
+func TestDetect(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, 90, d.Detect([]byte("GET / HTTP/1.1\r\n"), c2s))
+	assert.Equal(t, 90, d.Detect([]byte("HTTP/1.1 200 OK\r\n"), s2c))
+	assert.Equal(t, 0, d.Detect([]byte("HTTP/1.1 200 OK\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("\x16\x03\x01"), c2s))
+	assert.Equal(t, ProtocolName, d.Name())
+}
+
+// 测试默认回调输出事务摘要
+func TestDefaultOutput(t *testing.T) {
+	var out strings.Builder
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "flow"}, Config{Output: &out})
+	assert.NoError(t, p.ProcessData([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\n"), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), s2c, true, false))
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/flow: GET h/ -> 200 OK (0 bytes, "))
+}
+
+// 回归测试：抓包中的CONNECT事务被解析，隧道中的TLS被重新识别
+func TestConnectPcap(t *testing.T) {
+	dumper := tcpdumper.NewFileDumper("../../pcap_data/connect_https.pcapng")
+	var txs []*Transaction
+	Register(dumper.Registry(), Config{OnTransaction: func(tx *Transaction) { txs = append(txs, tx) }})
+	var tunnels []*tunnelProcessor
+	tcpdumper.RegisterSimpleProtocol(dumper.Registry(), "TLS", "\x16\x03", func(tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+		tp := &tunnelProcessor{}
+		tunnels = append(tunnels, tp)
+		return tp
+	})
+
+	assert.NoError(t, dumper.Start())
+	dumper.Wait()
+
+	if assert.Len(t, txs, 1) {
+		assert.Equal(t, "CONNECT", txs[0].Request.Method)
+		assert.Equal(t, "ip.bmh.im:443", txs[0].Request.URI)
+		assert.Equal(t, 200, txs[0].Response.StatusCode)
+		assert.Greater(t, txs[0].Duration(), time.Duration(0))
+	}
+	if assert.Len(t, tunnels, 1) {
+		assert.True(t, strings.HasPrefix(tunnels[0].data[0].String(), "\x16\x03\x01"))
+	}
+}
@@ -0,0 +1,344 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+)
+
+var (
+	errHeaderTooLarge = errors.New("header too large")
+	errBadChunk       = errors.New("malformed chunked encoding")
+)
+
+// bodyMode 消息体的格式
+type bodyMode int
+
+const (
+	bodyNone       bodyMode = iota // 没有消息体
+	bodyLength                     // Content-Length指定长度
+	bodyChunked                    // chunked编码
+	bodyUntilClose                 // 直到连接关闭（没有长度的响应）
+)
+
+// parseState 解析器状态
+type parseState int
+
+const (
+	stateHeader     parseState = iota // 等待起始行和头部
+	stateBody                         // Content-Length消息体
+	stateChunkSize                    // chunk长度行
+	stateChunkData                    // chunk数据
+	stateChunkEnd                     // chunk数据之后的CRLF
+	stateTrailer                      // chunked编码的trailer
+	stateUntilClose                   // 直到连接关闭的消息体
+	stateHold                         // 等待CONNECT/Upgrade请求的响应，数据暂存
+	stateSwitched                     // 协议已切换，不再解析
+	stateBroken                       // 解析失败，丢弃后续数据
+)
+
+// messageInfo 头部解析完成后由处理器决定的消息信息
+type messageInfo struct {
+	msg    *Message
+	mode   bodyMode
+	length int64                   // bodyLength时的长度
+	hold   bool                    // 消息完成后暂存后续数据，等待对端决定是否切换协议
+	stream *tcpdumper.BufferedPipe // 消息体流，不为nil时消息体同时写入此管道
+}
+
+// parser 单个方向的增量HTTP消息解析器
+// 数据可以在任意位置被切分，解析器在数据块之间保存状态
+type parser struct {
+	onHeaders  func(startLine string, header nethttp.Header) (messageInfo, error)
+	onComplete func(msg *Message)
+
+	maxHeader   int
+	maxBody     int
+	captureBody bool
+	decode      bool // 消息完成时按Content-Encoding解码保存的消息体
+
+	state     parseState
+	buf       []byte // 未完成的头部、chunk长度行或暂存的数据
+	remaining int64  // 消息体或当前chunk的剩余字节数
+	msg       *Message
+	hold      bool
+	stream    *tcpdumper.BufferedPipe
+	start     time.Time // 当前消息第一个字节的时间
+}
+
+// feed 解析一个数据块
+// 协议切换后返回尚未解析的剩余数据
+func (p *parser) feed(data []byte, ts time.Time) ([]byte, error) {
+	for len(data) > 0 {
+		switch p.state {
+		case stateBroken:
+			return nil, nil
+
+		case stateSwitched:
+			return data, nil
+
+		case stateHold:
+			if room := p.maxBody - len(p.buf); room < len(data) {
+				data = data[:max(room, 0)]
+			}
+			p.buf = append(p.buf, data...)
+			return nil, nil
+
+		case stateHeader:
+			if len(p.buf) == 0 {
+				// 忽略消息之间多余的空行
+				data = bytes.TrimLeft(data, "\r\n")
+				if len(data) == 0 {
+					return nil, nil
+				}
+				p.start = ts
+			}
+			p.buf = append(p.buf, data...)
+			end, next := headerEnd(p.buf)
+			if end < 0 {
+				if len(p.buf) > p.maxHeader {
+					return nil, p.fail(errHeaderTooLarge)
+				}
+				return nil, nil
+			}
+			head := p.buf[:end]
+			data = p.buf[next:]
+			p.buf = nil
+			if err := p.parseHeader(head, ts); err != nil {
+				return nil, p.fail(err)
+			}
+
+		case stateBody, stateChunkData:
+			n := int64(len(data))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			p.body(data[:n], ts)
+			data = data[n:]
+			p.remaining -= n
+			if p.remaining == 0 {
+				if p.state == stateBody {
+					p.complete()
+				} else {
+					p.state = stateChunkEnd
+				}
+			}
+
+		case stateUntilClose:
+			p.body(data, ts)
+			return nil, nil
+
+		case stateChunkSize, stateChunkEnd, stateTrailer:
+			p.buf = append(p.buf, data...)
+			i := bytes.IndexByte(p.buf, '\n')
+			if i < 0 {
+				if len(p.buf) > p.maxHeader {
+					return nil, p.fail(errHeaderTooLarge)
+				}
+				return nil, nil
+			}
+			line := bytes.TrimSuffix(p.buf[:i], []byte("\r"))
+			data = p.buf[i+1:]
+			p.buf = nil
+			p.msg.End = ts
+			if err := p.line(string(line)); err != nil {
+				return nil, p.fail(err)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// fail 解析失败，丢弃该方向后续数据
+func (p *parser) fail(err error) error {
+	p.closeStream(err)
+	p.state = stateBroken
+	p.buf = nil
+	p.msg = nil
+	return err
+}
+
+// headerEnd 查找头部结束位置，返回头部长度和消息体起始位置，没有找到时返回-1
+func headerEnd(buf []byte) (end, next int) {
+	if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+		end, next = i, i+4
+	} else {
+		end, next = -1, -1
+	}
+	// 兼容只使用\n换行的实现
+	if i := bytes.Index(buf, []byte("\n\n")); i >= 0 && (end < 0 || i < end) {
+		end, next = i, i+2
+	}
+	return end, next
+}
+
+// parseHeader 解析起始行和头部，并根据消息体格式进入相应状态
+func (p *parser) parseHeader(head []byte, ts time.Time) error {
+	lines := strings.Split(string(head), "\n")
+	startLine := strings.TrimSuffix(lines[0], "\r")
+	header := nethttp.Header{}
+	var last string
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		// 折叠的头部（以空白开头）接在上一个头部之后
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			values := header[last]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("malformed header line %q", line)
+		}
+		last = nethttp.CanonicalHeaderKey(strings.TrimSpace(key))
+		header.Add(last, strings.TrimSpace(value))
+	}
+
+	info, err := p.onHeaders(startLine, header)
+	if err != nil {
+		return err
+	}
+	p.msg = info.msg
+	p.msg.Start = p.start
+	p.msg.End = ts
+	p.hold = info.hold
+	p.stream = info.stream
+
+	switch info.mode {
+	case bodyNone:
+		p.complete()
+	case bodyLength:
+		if info.length == 0 {
+			p.complete()
+			break
+		}
+		p.state = stateBody
+		p.remaining = info.length
+	case bodyChunked:
+		p.msg.Chunked = true
+		p.state = stateChunkSize
+	case bodyUntilClose:
+		p.state = stateUntilClose
+	}
+	return nil
+}
+
+// line 处理chunked编码中的一行
+func (p *parser) line(line string) error {
+	switch p.state {
+	case stateChunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: invalid chunk size %q", errBadChunk, line)
+		}
+		if n == 0 {
+			p.state = stateTrailer
+		} else {
+			p.state = stateChunkData
+			p.remaining = n
+		}
+	case stateChunkEnd:
+		if line != "" {
+			return fmt.Errorf("%w: missing CRLF after chunk data", errBadChunk)
+		}
+		p.state = stateChunkSize
+	case stateTrailer:
+		if line == "" {
+			p.complete()
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%w: malformed trailer %q", errBadChunk, line)
+		}
+		if p.msg.Trailer == nil {
+			p.msg.Trailer = nethttp.Header{}
+		}
+		p.msg.Trailer.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// body 记录消息体数据
+func (p *parser) body(data []byte, ts time.Time) {
+	msg := p.msg
+	msg.BodySize += int64(len(data))
+	msg.End = ts
+	if p.stream != nil {
+		// 读取方过慢时按管道的溢出策略处理，读取方会从管道读到相应的错误
+		p.stream.Write(data)
+	}
+	if !p.captureBody {
+		return
+	}
+	if room := p.maxBody - len(msg.Body); room < len(data) {
+		msg.BodyTruncated = true
+		data = data[:max(room, 0)]
+	}
+	msg.Body = append(msg.Body, data...)
+}
+
+// complete 当前消息解析完成
+// 回调可以修改解析器状态（如进入stateSwitched）
+func (p *parser) complete() {
+	msg := p.msg
+	p.msg = nil
+	p.closeStream(nil)
+	if p.decode {
+		decodeBody(msg, p.maxBody)
+	}
+	p.state = stateHeader
+	if p.hold {
+		p.state = stateHold
+		p.hold = false
+	}
+	p.onComplete(msg)
+}
+
+// release 结束暂存状态，把暂存的数据按HTTP继续解析
+func (p *parser) release(ts time.Time) error {
+	if p.state != stateHold {
+		return nil
+	}
+	data := p.buf
+	p.buf = nil
+	p.state = stateHeader
+	_, err := p.feed(data, ts)
+	return err
+}
+
+// takeHeld 取出暂存的数据并停止解析
+func (p *parser) takeHeld() []byte {
+	var data []byte
+	if p.state == stateHold {
+		data = p.buf
+	}
+	p.buf = nil
+	p.state = stateSwitched
+	return data
+}
+
+// finish 该方向结束，完成直到连接关闭的消息体
+func (p *parser) finish() {
+	if p.state == stateUntilClose {
+		p.complete()
+	}
+}
+
+// closeStream 结束当前消息体流，err为nil时读取方收到io.EOF
+func (p *parser) closeStream(err error) {
+	if p.stream != nil {
+		p.stream.CloseWithError(err)
+		p.stream = nil
+	}
+}
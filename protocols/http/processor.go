@@ -0,0 +1,267 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// Processor HTTP/1.x协议处理器
+// 增量解析两个方向的消息，响应按顺序与请求配对（支持pipelining），每个事务完成时调用 Config.OnTransaction
+type Processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+
+	client, server *parser
+	pending        []*Transaction // 等待响应的事务，按请求顺序
+	response       *Response      // 正在解析的响应
+	informational  bool           // 正在解析的响应是否为1xx（101除外）
+	ts             time.Time      // 当前数据块的时间戳
+	switching      *tcpdumper.ProtocolSwitch
+	releaseErr     error          // 请求被拒绝后重新解析暂存的客户端数据时的错误
+	wg             sync.WaitGroup // 消息体流的回调
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *Processor {
+	p := &Processor{streamInfo: streamInfo, config: config}
+	p.client = p.newParser(p.requestHeaders, func(*Message) {})
+	p.server = p.newParser(p.responseHeaders, p.responseComplete)
+	return p
+}
+
+func (p *Processor) newParser(onHeaders func(string, nethttp.Header) (messageInfo, error), onComplete func(*Message)) *parser {
+	return &parser{
+		onHeaders:   onHeaders,
+		onComplete:  onComplete,
+		maxHeader:   p.config.MaxHeaderSize,
+		maxBody:     p.config.MaxBodySize,
+		captureBody: p.config.CaptureBody,
+		decode:      !p.config.DisableDecompression,
+	}
+}
+
+func (p *Processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理带时间戳的数据，时间戳用于计算事务耗时；没有时间戳时使用当前时间
+func (p *Processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	p.ts = ts
+
+	parser := p.server
+	if dir == reassembly.TCPDirClientToServer {
+		parser = p.client
+	}
+	rest, err := parser.feed(data, ts)
+	if end {
+		parser.finish()
+	}
+
+	if p.switching != nil {
+		// 隧道建立或协议升级，剩余数据交给注册表重新检测
+		ps := p.switching
+		p.switching = nil
+		ps.ServerData = append(ps.ServerData, rest...)
+		return ps
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %w", dir, err)
+	}
+	return errors.Join(err, p.takeReleaseErr())
+}
+
+// takeReleaseErr 取出重新解析暂存数据时的错误
+func (p *Processor) takeReleaseErr() error {
+	err := p.releaseErr
+	p.releaseErr = nil
+	if err != nil {
+		return fmt.Errorf("%s: %w", reassembly.TCPDirClientToServer, err)
+	}
+	return nil
+}
+
+// requestHeaders 请求头部解析完成
+func (p *Processor) requestHeaders(startLine string, header nethttp.Header) (messageInfo, error) {
+	parts := strings.SplitN(startLine, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/") {
+		return messageInfo{}, fmt.Errorf("malformed request line %q", startLine)
+	}
+	req := &Request{
+		Message: Message{Proto: parts[2], Header: header},
+		Method:  parts[0],
+		URI:     parts[1],
+		Host:    header.Get("Host"),
+	}
+	// 请求头部完成即开始等待响应，以支持 Expect: 100-continue 等先响应后发送消息体的情况
+	p.pending = append(p.pending, &Transaction{StreamInfo: p.streamInfo, Request: req})
+
+	info := messageInfo{msg: &req.Message}
+	// CONNECT和Upgrade请求之后的数据在收到响应前无法确定协议，先暂存
+	info.hold = req.Method == nethttp.MethodConnect || header.Get("Upgrade") != ""
+
+	switch {
+	case isChunked(header):
+		info.mode = bodyChunked
+	case header.Get("Content-Length") != "":
+		length, err := contentLength(header)
+		if err != nil {
+			return messageInfo{}, err
+		}
+		info.mode, info.length = bodyLength, length
+	}
+	info.stream = p.openStream(info, &Transaction{StreamInfo: p.streamInfo, Request: req})
+	return info, nil
+}
+
+// responseHeaders 响应头部解析完成
+func (p *Processor) responseHeaders(startLine string, header nethttp.Header) (messageInfo, error) {
+	parts := strings.SplitN(startLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return messageInfo{}, fmt.Errorf("malformed status line %q", startLine)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 || code > 999 {
+		return messageInfo{}, fmt.Errorf("malformed status code %q", parts[1])
+	}
+	status := parts[1]
+	if len(parts) == 3 {
+		status += " " + parts[2]
+	}
+	resp := &Response{
+		Message:    Message{Proto: parts[0], Header: header},
+		StatusCode: code,
+		Status:     status,
+	}
+	p.response = resp
+	p.informational = code/100 == 1 && code != nethttp.StatusSwitchingProtocols
+
+	var req *Request
+	if len(p.pending) > 0 {
+		req = p.pending[0].Request
+	}
+
+	info := messageInfo{msg: &resp.Message}
+	switch {
+	case code/100 == 1, code == nethttp.StatusNoContent, code == nethttp.StatusNotModified:
+		// 没有消息体
+	case req != nil && req.Method == nethttp.MethodHead:
+		// HEAD请求的响应没有消息体
+	case req != nil && req.Method == nethttp.MethodConnect && code/100 == 2:
+		// 隧道建立，之后的数据属于隧道
+	case isChunked(header):
+		info.mode = bodyChunked
+	case header.Get("Content-Length") != "":
+		length, err := contentLength(header)
+		if err != nil {
+			return messageInfo{}, err
+		}
+		info.mode, info.length = bodyLength, length
+	default:
+		info.mode = bodyUntilClose
+	}
+	info.stream = p.openStream(info, &Transaction{StreamInfo: p.streamInfo, Request: req, Response: resp})
+	return info, nil
+}
+
+// openStream 为有消息体的消息创建消息体流并启动 Config.OnBody，未配置 OnBody 时返回nil
+func (p *Processor) openStream(info messageInfo, tx *Transaction) *tcpdumper.BufferedPipe {
+	if p.config.OnBody == nil || info.mode == bodyNone || (info.mode == bodyLength && info.length == 0) {
+		return nil
+	}
+	pipe := tcpdumper.NewBufferedPipe(p.config.BodyStreamConfig.BufferSize, p.config.BodyStreamConfig.Policy)
+	var body io.Reader = pipe
+	if encoding := contentEncoding(info.msg); encoding != "" && !p.config.DisableDecompression {
+		body = &lazyDecoder{encoding: encoding, src: pipe}
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.config.OnBody(tx, body)
+		// 不再读取，剩余数据的写入会失败并被丢弃
+		pipe.CloseRead()
+	}()
+	return pipe
+}
+
+// responseComplete 响应解析完成，与最早的未完成请求配对
+func (p *Processor) responseComplete(*Message) {
+	resp := p.response
+	p.response = nil
+	if p.informational {
+		// 1xx响应之后还有最终响应
+		return
+	}
+
+	tx := &Transaction{StreamInfo: p.streamInfo}
+	if len(p.pending) > 0 {
+		tx = p.pending[0]
+		p.pending = p.pending[1:]
+	}
+	tx.Response = resp
+	p.config.OnTransaction(tx)
+
+	upgraded := resp.StatusCode == nethttp.StatusSwitchingProtocols ||
+		(tx.Request != nil && tx.Request.Method == nethttp.MethodConnect && resp.StatusCode/100 == 2)
+	if upgraded {
+		p.server.state = stateSwitched
+		p.switching = &tcpdumper.ProtocolSwitch{ClientData: p.client.takeHeld()}
+		return
+	}
+	// 请求被拒绝，暂存的数据仍然是HTTP
+	if err := p.client.release(p.ts); err != nil {
+		p.releaseErr = errors.Join(p.releaseErr, err)
+	}
+}
+
+func (p *Processor) Close() error {
+	p.client.finish()
+	p.server.finish()
+	// 流在消息体中途结束
+	p.client.closeStream(io.ErrUnexpectedEOF)
+	p.server.closeStream(io.ErrUnexpectedEOF)
+	p.wg.Wait()
+
+	// 没有响应的请求
+	for _, tx := range p.pending {
+		p.config.OnTransaction(tx)
+	}
+	p.pending = nil
+	return p.takeReleaseErr()
+}
+
+func (p *Processor) GetProtocolName() string {
+	return ProtocolName
+}
+
+// isChunked 判断消息是否使用chunked编码
+// 多个编码时chunked必须是最后一个，如 "gzip, chunked"
+func isChunked(header nethttp.Header) bool {
+	te := strings.Join(header.Values("Transfer-Encoding"), ",")
+	if te == "" {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// contentLength 解析Content-Length
+func contentLength(header nethttp.Header) (int64, error) {
+	value := strings.TrimSpace(header.Get("Content-Length"))
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid Content-Length %q", value)
+	}
+	return length, nil
+}
@@ -0,0 +1,103 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// frameHeaderLen 帧头长度
+const frameHeaderLen = 9
+
+// 帧类型
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+// 帧标志
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+// settingHeaderTableSize SETTINGS_HEADER_TABLE_SIZE
+const settingHeaderTableSize = 0x1
+
+var errBadPadding = errors.New("invalid frame padding")
+
+// frameHeader 帧头
+type frameHeader struct {
+	length   int
+	typ      uint8
+	flags    uint8
+	streamID uint32
+}
+
+// parseFrameHeader 解析帧头，data至少需要 frameHeaderLen 字节
+func parseFrameHeader(data []byte) frameHeader {
+	return frameHeader{
+		length:   int(data[0])<<16 | int(data[1])<<8 | int(data[2]),
+		typ:      data[3],
+		flags:    data[4],
+		streamID: binary.BigEndian.Uint32(data[5:9]) & 0x7fffffff,
+	}
+}
+
+// frameSplitter HTTP/2分帧器，客户端的连接前言作为单独的一条消息
+type frameSplitter struct{}
+
+func (frameSplitter) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	if n := min(len(data), len(ClientPreface)); bytes.Equal(data[:n], []byte(ClientPreface[:n])) {
+		if n == len(ClientPreface) {
+			return n, data[:n], nil
+		}
+		if !atEOF {
+			return 0, nil, nil
+		}
+	}
+
+	if len(data) < frameHeaderLen {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	// 长度字段为24位，不会超过协议允许的最大帧长度
+	total := frameHeaderLen + parseFrameHeader(data).length
+	if len(data) < total {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	return total, data[:total], nil
+}
+
+// unpad 去掉PADDED标志的帧负载中的填充
+func unpad(flags uint8, payload []byte) ([]byte, error) {
+	if flags&flagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, errBadPadding
+	}
+	padding := int(payload[0])
+	payload = payload[1:]
+	if padding > len(payload) {
+		return nil, errBadPadding
+	}
+	return payload[:len(payload)-padding], nil
+}
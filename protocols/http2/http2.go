@@ -0,0 +1,206 @@
+// Package http2 提供明文HTTP/2（h2c）的检测器和处理器
+// 支持prior knowledge（直接发送连接前言）和HTTP/1.1 Upgrade两种方式建立的连接。
+// 处理器解析帧、为每个方向维护HPACK解码状态，每个HTTP/2流结束时以 Stream 事件的形式交给回调
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "HTTP2"
+
+// ClientPreface 客户端连接前言
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	defaultMaxBodySize       = 1024 * 1024
+	defaultMaxHeaderListSize = 64 * 1024
+)
+
+// Message 请求和响应共有的字段
+type Message struct {
+	Header        nethttp.Header // 普通头部，不含伪头部（:method、:status等）
+	Trailer       nethttp.Header // 消息体之后的头部，没有时为nil
+	Body          []byte         // DATA帧的内容，仅在 Config.CaptureBody 为true时保存
+	BodySize      int64          // 消息体的实际长度
+	BodyTruncated bool           // 消息体超过 Config.MaxBodySize 被截断
+	EndStream     bool           // 是否收到了END_STREAM
+	Start         time.Time      // 第一个帧的时间
+	End           time.Time      // 最后一个帧的时间
+}
+
+// Request HTTP/2请求
+type Request struct {
+	Message
+	Method    string
+	Scheme    string
+	Authority string
+	Path      string
+}
+
+// Response HTTP/2响应
+type Response struct {
+	Message
+	StatusCode int
+}
+
+// Stream 一个HTTP/2流（一次请求/响应）
+// 抓包从连接中途开始或通过HTTP/1.1 Upgrade建立的连接（流1的请求以HTTP/1.1发送）Request为nil；
+// 流结束时仍没有响应的，Response为nil
+type Stream struct {
+	StreamInfo tcpdumper.StreamInfo
+	ID         uint32
+	Request    *Request
+	Response   *Response
+	Pushed     bool   // 服务器推送的流，Request来自PUSH_PROMISE
+	Reset      bool   // 流被RST_STREAM终止
+	ErrorCode  uint32 // RST_STREAM的错误码
+}
+
+// Duration 从请求的第一个帧到响应的最后一个帧的时间
+func (s *Stream) Duration() time.Duration {
+	if s.Request == nil || s.Response == nil {
+		return 0
+	}
+	return s.Response.End.Sub(s.Request.Start)
+}
+
+// Latency 从请求的最后一个帧到响应的第一个帧的时间
+func (s *Stream) Latency() time.Duration {
+	if s.Request == nil || s.Response == nil {
+		return 0
+	}
+	return s.Response.Start.Sub(s.Request.End)
+}
+
+// String 返回流的摘要
+func (s *Stream) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stream %d ", s.ID)
+	if s.Request != nil {
+		fmt.Fprintf(&b, "%s %s%s", s.Request.Method, s.Request.Authority, s.Request.Path)
+	} else {
+		b.WriteString("<no request>")
+	}
+	if s.Response != nil {
+		fmt.Fprintf(&b, " -> %d (%d bytes, %v)", s.Response.StatusCode, s.Response.BodySize, s.Duration())
+	} else {
+		b.WriteString(" -> <no response>")
+	}
+	if s.Reset {
+		fmt.Fprintf(&b, " reset(%d)", s.ErrorCode)
+	}
+	return b.String()
+}
+
+// Config HTTP/2处理器配置
+type Config struct {
+	// OnStream 流结束（双方都发送了END_STREAM或被重置）时的回调，为nil时把摘要输出到Output
+	OnStream func(*Stream)
+	Output   io.Writer // 默认回调的输出，nil为标准输出
+
+	// OnData 每个DATA帧（已去掉填充）的回调，用于在HTTP/2之上逐帧解析（如gRPC），可以为nil
+	// dir 为数据方向，endStream 表示该方向的最后一帧；data在返回后会被复用，需要保留时请拷贝
+	OnData func(s *Stream, dir reassembly.TCPFlowDirection, data []byte, endStream bool)
+
+	CaptureBody       bool // 是否保存消息体
+	MaxBodySize       int  // 保存的消息体最大长度，0为默认1MB
+	MaxHeaderListSize int  // 单个头部块（HEADERS及其CONTINUATION）的最大长度，0为默认64KB
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = defaultMaxBodySize
+	}
+	if c.MaxHeaderListSize <= 0 {
+		c.MaxHeaderListSize = defaultMaxHeaderListSize
+	}
+	if c.OnStream == nil {
+		w := c.Output
+		if w == nil {
+			w = os.Stdout
+		}
+		c.OnStream = func(s *Stream) {
+			fmt.Fprintf(w, "HTTP2/%s: %s\n", s.StreamInfo.Ident, s)
+		}
+	}
+	return c
+}
+
+// Detector HTTP/2检测器
+// 客户端数据以连接前言开头时确定为HTTP/2；只看到服务器数据时，以SETTINGS帧开头的按较低置信度识别
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建HTTP/2检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return detectPreface(data)
+	}
+	return detectSettings(data)
+}
+
+// DetectWithContext 服务器先发送SETTINGS时，如果已看到客户端的连接前言也能确定
+func (d *Detector) DetectWithContext(ctx *tcpdumper.DetectContext) int {
+	if score := detectPreface(ctx.ClientData); score > 0 {
+		return score
+	}
+	if len(ctx.ClientData) == 0 {
+		return detectSettings(ctx.ServerData)
+	}
+	return 0
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, d.config), frameSplitter{})
+}
+
+// detectPreface 检测客户端连接前言
+func detectPreface(data []byte) int {
+	if bytes.HasPrefix(data, []byte(ClientPreface)) {
+		return 100
+	}
+	return 0
+}
+
+// detectSettings 检测服务器的连接前言（SETTINGS帧）
+func detectSettings(data []byte) int {
+	if len(data) < frameHeaderLen {
+		return 0
+	}
+	h := parseFrameHeader(data)
+	if h.typ == frameSettings && h.streamID == 0 && h.flags&^flagAck == 0 && h.length%6 == 0 && h.length <= 16384 {
+		return 60
+	}
+	return 0
+}
+
+// NewProcessor 创建HTTP/2处理器，返回的处理器会先把数据切分为完整的帧
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config.withDefaults()), frameSplitter{})
+}
+
+// Register 向注册表注册HTTP/2协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
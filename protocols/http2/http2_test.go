@@ -0,0 +1,255 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	tcphttp "github.com/LubyRuffy/tcpdumper/protocols/http"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// frame 构造一个帧
+func frame(typ, flags uint8, streamID uint32, payload []byte) []byte {
+	buf := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[5:], streamID)
+	return append(buf, payload...)
+}
+
+// encoder 一个方向的HPACK编码器
+type encoder struct {
+	buf bytes.Buffer
+	enc *hpack.Encoder
+}
+
+func newEncoder() *encoder {
+	e := &encoder{}
+	e.enc = hpack.NewEncoder(&e.buf)
+	return e
+}
+
+// block 编码头部块，参数为交替的名称和值
+func (e *encoder) block(kv ...string) []byte {
+	e.buf.Reset()
+	for i := 0; i < len(kv); i += 2 {
+		e.enc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return append([]byte(nil), e.buf.Bytes()...)
+}
+
+var settings = frame(frameSettings, 0, 0, []byte{0, 3, 0, 0, 0, 100})
+
+// conn 模拟连接，通过分发器逐段输入数据
+type conn struct {
+	t          *testing.T
+	dispatcher *tcpdumper.Dispatcher
+	now        time.Time
+}
+
+func (c *conn) send(dir reassembly.TCPFlowDirection, frames ...[]byte) {
+	data := bytes.Join(frames, nil)
+	// 以不对齐帧边界的小块输入
+	for i := 0; i < len(data); i += 7 {
+		c.now = c.now.Add(time.Millisecond)
+		assert.NoError(c.t, c.dispatcher.ProcessTimedData(data[i:min(i+7, len(data))], dir, i == 0, false, c.now))
+	}
+}
+
+func newConn(t *testing.T, registry *tcpdumper.ProtocolRegistry) *conn {
+	return &conn{
+		t:          t,
+		dispatcher: tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "test"}, nil),
+		now:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// collect 注册HTTP/2并收集结束的流
+func collect(registry *tcpdumper.ProtocolRegistry, config Config) *[]*Stream {
+	streams := &[]*Stream{}
+	config.OnStream = func(s *Stream) { *streams = append(*streams, s) }
+	Register(registry, config)
+	return streams
+}
+
+// 测试prior knowledge连接：多个流交错、CONTINUATION、填充、动态表复用和trailer
+func TestPriorKnowledge(t *testing.T) {
+	registry := tcpdumper.NewProtocolRegistry()
+	var dataFrames []string
+	streams := collect(registry, Config{
+		CaptureBody: true,
+		OnData: func(s *Stream, dir reassembly.TCPFlowDirection, data []byte, endStream bool) {
+			dataFrames = append(dataFrames, string(data))
+		},
+	})
+	c := newConn(t, registry)
+	client, server := newEncoder(), newEncoder()
+
+	get := client.block(":method", "GET", ":scheme", "http", ":authority", "svc:8080", ":path", "/a", "user-agent", "test")
+	post := client.block(":method", "POST", ":scheme", "http", ":authority", "svc:8080", ":path", "/b", "user-agent", "test",
+		"content-type", "text/plain")
+	c.send(c2s, []byte(ClientPreface), settings,
+		frame(frameHeaders, flagEndHeaders|flagEndStream, 1, get),
+		frame(frameHeaders, 0, 3, post[:3]),
+		frame(frameContinuation, flagEndHeaders, 3, post[3:]),
+		frame(frameData, flagPadded, 3, append([]byte{2}, "hel\x00\x00"...)),
+		frame(frameData, flagEndStream, 3, []byte("lo")),
+	)
+	assert.Equal(t, ProtocolName, c.dispatcher.GetProtocolName())
+
+	resp := server.block(":status", "200", "content-type", "text/plain", "server", "h2")
+	c.send(s2c, settings, frame(frameSettings, flagAck, 0, nil),
+		frame(frameHeaders, flagEndHeaders, 3, resp),
+		frame(frameHeaders, flagEndHeaders, 1, server.block(":status", "200", "content-type", "text/plain", "server", "h2")),
+		frame(frameData, flagEndStream, 1, []byte("for a")),
+		frame(frameData, 0, 3, []byte("for b")),
+		frame(frameHeaders, flagEndHeaders|flagEndStream, 3, server.block("grpc-status", "0")),
+	)
+	assert.NoError(t, c.dispatcher.Close())
+
+	if assert.Len(t, *streams, 2) {
+		s := (*streams)[0]
+		assert.Equal(t, uint32(1), s.ID)
+		assert.Equal(t, "GET", s.Request.Method)
+		assert.Equal(t, "svc:8080", s.Request.Authority)
+		assert.Equal(t, "/a", s.Request.Path)
+		assert.Equal(t, "test", s.Request.Header.Get("User-Agent"))
+		assert.Equal(t, 200, s.Response.StatusCode)
+		// 第二个响应的头部来自动态表
+		assert.Equal(t, "h2", s.Response.Header.Get("Server"))
+		assert.Equal(t, []byte("for a"), s.Response.Body)
+		assert.Greater(t, s.Duration(), time.Duration(0))
+
+		s = (*streams)[1]
+		assert.Equal(t, uint32(3), s.ID)
+		assert.Equal(t, "POST", s.Request.Method)
+		assert.Equal(t, "text/plain", s.Request.Header.Get("Content-Type"))
+		assert.Equal(t, []byte("hello"), s.Request.Body)
+		assert.Equal(t, []byte("for b"), s.Response.Body)
+		assert.Equal(t, "0", s.Response.Trailer.Get("Grpc-Status"))
+		assert.True(t, s.Response.EndStream)
+	}
+	assert.Equal(t, []string{"hel", "lo", "for a", "for b"}, dataFrames)
+}
+
+// 测试流被重置、服务器推送以及连接结束时未完成的流
+func TestResetPushAndClose(t *testing.T) {
+	registry := tcpdumper.NewProtocolRegistry()
+	streams := collect(registry, Config{})
+	c := newConn(t, registry)
+	client, server := newEncoder(), newEncoder()
+
+	c.send(c2s, []byte(ClientPreface), settings,
+		frame(frameHeaders, flagEndHeaders|flagEndStream, 1, client.block(":method", "GET", ":path", "/index")),
+		frame(frameHeaders, flagEndHeaders|flagEndStream|flagPriority, 3, append(make([]byte, 5), client.block(":method", "GET", ":path", "/slow")...)),
+		frame(frameRSTStream, 0, 3, []byte{0, 0, 0, 8}),
+		frame(frameHeaders, flagEndHeaders, 5, client.block(":method", "POST", ":path", "/upload")),
+	)
+	promise := append([]byte{0, 0, 0, 2}, server.block(":method", "GET", ":path", "/style.css")...)
+	c.send(s2c, settings,
+		frame(framePushPromise, flagEndHeaders, 1, promise),
+		frame(frameHeaders, flagEndHeaders|flagEndStream, 1, server.block(":status", "200")),
+		frame(frameHeaders, flagEndHeaders, 2, server.block(":status", "200")),
+		frame(frameData, flagEndStream, 2, []byte("body{}")),
+	)
+	assert.NoError(t, c.dispatcher.Close())
+
+	if assert.Len(t, *streams, 4) {
+		assert.Equal(t, "stream 3 GET /slow -> <no response> reset(8)", (*streams)[0].String())
+		assert.Equal(t, uint32(1), (*streams)[1].ID)
+		pushed := (*streams)[2]
+		assert.True(t, pushed.Pushed)
+		assert.Equal(t, "/style.css", pushed.Request.Path)
+		assert.Equal(t, int64(6), pushed.Response.BodySize)
+		// 连接结束时没有响应的流
+		assert.Equal(t, uint32(5), (*streams)[3].ID)
+		assert.Nil(t, (*streams)[3].Response)
+	}
+}
+
+// 测试HTTP/1.1 Upgrade: h2c 之后由注册表识别为HTTP/2
+func TestUpgrade(t *testing.T) {
+	registry := tcpdumper.NewProtocolRegistry()
+	var txs []*tcphttp.Transaction
+	tcphttp.Register(registry, tcphttp.Config{OnTransaction: func(tx *tcphttp.Transaction) { txs = append(txs, tx) }})
+	streams := collect(registry, Config{CaptureBody: true})
+	c := newConn(t, registry)
+	client, server := newEncoder(), newEncoder()
+
+	c.send(c2s, []byte("GET / HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n"))
+	c.send(s2c, []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"), settings,
+		frame(frameHeaders, flagEndHeaders, 1, server.block(":status", "200")),
+		frame(frameData, flagEndStream, 1, []byte("upgraded")),
+	)
+	c.send(c2s, []byte(ClientPreface), settings,
+		frame(frameHeaders, flagEndHeaders|flagEndStream, 3, client.block(":method", "GET", ":path", "/next")),
+	)
+	c.send(s2c, frame(frameHeaders, flagEndHeaders|flagEndStream, 3, server.block(":status", "404")))
+	assert.Equal(t, ProtocolName, c.dispatcher.GetProtocolName())
+	assert.NoError(t, c.dispatcher.Close())
+
+	if assert.Len(t, txs, 1) {
+		assert.Equal(t, 101, txs[0].Response.StatusCode)
+	}
+	if assert.Len(t, *streams, 2) {
+		// 流1的请求以HTTP/1.1发送
+		assert.Nil(t, (*streams)[0].Request)
+		assert.Equal(t, []byte("upgraded"), (*streams)[0].Response.Body)
+		assert.Equal(t, "/next", (*streams)[1].Request.Path)
+		assert.Equal(t, 404, (*streams)[1].Response.StatusCode)
+	}
+}
+
+// 测试头部块解码失败后忽略连接后续的帧
+func TestBrokenHPACK(t *testing.T) {
+	streams := &[]*Stream{}
+	p := newProcessor(tcpdumper.StreamInfo{}, Config{OnStream: func(s *Stream) { *streams = append(*streams, s) }}.withDefaults())
+
+	// 引用不存在的动态表项
+	err := p.ProcessData(frame(frameHeaders, flagEndHeaders, 1, []byte{0xff, 0x7f}), c2s, true, false)
+	assert.Error(t, err)
+	assert.NoError(t, p.ProcessData(frame(frameHeaders, flagEndHeaders, 3, newEncoder().block(":method", "GET")), c2s, false, false))
+	assert.NoError(t, p.Close())
+	assert.Empty(t, *streams)
+
+	// CONTINUATION之前插入其他帧
+	p = newProcessor(tcpdumper.StreamInfo{}, Config{OnStream: func(*Stream) {}}.withDefaults())
+	assert.NoError(t, p.ProcessData(frame(frameHeaders, 0, 1, []byte{0x82}), c2s, true, false))
+	assert.ErrorIs(t, p.ProcessData(frame(frameData, 0, 1, []byte("x")), c2s, false, false), errProtocol)
+}
+
+// 测试检测器
+func TestDetect(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, 100, d.Detect([]byte(ClientPreface), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("PRI * HTTP/2.0"), c2s))
+	assert.Equal(t, 60, d.Detect(settings, s2c))
+	assert.Equal(t, 0, d.Detect([]byte("HTTP/1.1 200 OK\r\n"), s2c))
+	assert.Equal(t, 100, d.DetectWithContext(&tcpdumper.DetectContext{Dir: s2c, ClientData: []byte(ClientPreface), ServerData: settings}))
+	assert.Equal(t, 0, d.DetectWithContext(&tcpdumper.DetectContext{Dir: s2c, ClientData: []byte("GET /"), ServerData: settings}))
+}
+
+// 测试分帧器
+func TestFrameSplitter(t *testing.T) {
+	var fs frameSplitter
+	data := append([]byte(ClientPreface), settings...)
+	n, msg, err := fs.Frame(data[:10], false)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, msg)
+	assert.NoError(t, err)
+	n, _, _ = fs.Frame(data, false)
+	assert.Equal(t, len(ClientPreface), n)
+	n, msg, _ = fs.Frame(data[n:], false)
+	assert.Equal(t, settings, msg)
+	assert.Equal(t, len(settings), n)
+	_, _, err = fs.Frame(settings[:12], true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,337 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+	"golang.org/x/net/http2/hpack"
+)
+
+// defaultHeaderTableSize HPACK动态表的默认大小
+const defaultHeaderTableSize = 4096
+
+var (
+	errProtocol        = errors.New("http2 protocol error")
+	errHeaderListLarge = errors.New("header block too large")
+)
+
+// headerBlock 正在接收的头部块（HEADERS或PUSH_PROMISE，以及之后的CONTINUATION）
+type headerBlock struct {
+	streamID  uint32
+	promised  uint32 // PUSH_PROMISE承诺的流ID，HEADERS为0
+	endStream bool
+	data      []byte
+}
+
+// Processor HTTP/2处理器，每次调用必须是一个完整的帧（或客户端连接前言），通常由 FramedProcessor 包装
+// 两个方向各有一个HPACK解码器，所有头部块都按顺序解码以保持动态表同步；
+// 头部块解码失败后动态表状态无法恢复，连接后续的帧被忽略
+type Processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+
+	decoders [2]*hpack.Decoder
+	blocks   [2]*headerBlock // 每个方向未结束的头部块
+	streams  map[uint32]*Stream
+	broken   bool
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *Processor {
+	p := &Processor{
+		streamInfo: streamInfo,
+		config:     config,
+		streams:    make(map[uint32]*Stream),
+	}
+	for i := range p.decoders {
+		p.decoders[i] = hpack.NewDecoder(defaultHeaderTableSize, nil)
+		p.decoders[i].SetMaxStringLength(config.MaxHeaderListSize)
+	}
+	return p
+}
+
+// dirIndex 将方向转换为数组下标
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+func (p *Processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一个带时间戳的帧，没有时间戳时使用当前时间
+func (p *Processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if p.broken || string(data) == ClientPreface || len(data) < frameHeaderLen {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	if err := p.frame(data, dir, ts); err != nil {
+		p.broken = true
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	return nil
+}
+
+// frame 处理一个帧
+func (p *Processor) frame(data []byte, dir reassembly.TCPFlowDirection, ts time.Time) error {
+	idx := dirIndex(dir)
+	h := parseFrameHeader(data)
+	payload := data[frameHeaderLen:]
+
+	// 头部块的CONTINUATION必须紧跟在HEADERS/PUSH_PROMISE之后
+	if block := p.blocks[idx]; block != nil {
+		if h.typ != frameContinuation || h.streamID != block.streamID {
+			return fmt.Errorf("%w: expected CONTINUATION for stream %d", errProtocol, block.streamID)
+		}
+		return p.headerFragment(dir, block, payload, h.flags, ts)
+	}
+
+	switch h.typ {
+	case frameData:
+		payload, err := unpad(h.flags, payload)
+		if err != nil {
+			return err
+		}
+		p.data(dir, h.streamID, payload, h.flags&flagEndStream != 0, ts)
+
+	case frameHeaders:
+		payload, err := unpad(h.flags, payload)
+		if err != nil {
+			return err
+		}
+		if h.flags&flagPriority != 0 {
+			if len(payload) < 5 {
+				return fmt.Errorf("%w: short HEADERS priority", errProtocol)
+			}
+			payload = payload[5:]
+		}
+		block := &headerBlock{streamID: h.streamID, endStream: h.flags&flagEndStream != 0}
+		return p.headerFragment(dir, block, payload, h.flags, ts)
+
+	case framePushPromise:
+		payload, err := unpad(h.flags, payload)
+		if err != nil {
+			return err
+		}
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: short PUSH_PROMISE", errProtocol)
+		}
+		block := &headerBlock{streamID: h.streamID, promised: binary.BigEndian.Uint32(payload) & 0x7fffffff}
+		return p.headerFragment(dir, block, payload[4:], h.flags, ts)
+
+	case frameRSTStream:
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: short RST_STREAM", errProtocol)
+		}
+		if s := p.streams[h.streamID]; s != nil {
+			s.Reset = true
+			s.ErrorCode = binary.BigEndian.Uint32(payload)
+			p.finish(s)
+		}
+
+	case frameSettings:
+		if h.flags&flagAck != 0 {
+			break
+		}
+		for i := 0; i+6 <= len(payload); i += 6 {
+			id, value := binary.BigEndian.Uint16(payload[i:]), binary.BigEndian.Uint32(payload[i+2:])
+			if id == settingHeaderTableSize {
+				// 一端通告的动态表大小限制的是对端的编码器
+				p.decoders[1-idx].SetAllowedMaxDynamicTableSize(value)
+			}
+		}
+	}
+	// PRIORITY、PING、GOAWAY、WINDOW_UPDATE以及未知类型的帧不影响流的内容
+	return nil
+}
+
+// headerFragment 追加头部块片段，收到END_HEADERS后解码
+func (p *Processor) headerFragment(dir reassembly.TCPFlowDirection, block *headerBlock, fragment []byte, flags uint8, ts time.Time) error {
+	idx := dirIndex(dir)
+	block.data = append(block.data, fragment...)
+	if len(block.data) > p.config.MaxHeaderListSize {
+		return errHeaderListLarge
+	}
+	if flags&flagEndHeaders == 0 {
+		p.blocks[idx] = block
+		return nil
+	}
+	p.blocks[idx] = nil
+
+	fields, err := p.decoders[idx].DecodeFull(block.data)
+	if err != nil {
+		return fmt.Errorf("hpack: %w", err)
+	}
+	p.headers(dir, block, fields, ts)
+	return nil
+}
+
+// headers 处理解码后的头部
+func (p *Processor) headers(dir reassembly.TCPFlowDirection, block *headerBlock, fields []hpack.HeaderField, ts time.Time) {
+	pseudo, header := splitHeader(fields)
+
+	if block.promised != 0 {
+		// 服务器推送：PUSH_PROMISE中是推送流的请求，推送的请求没有消息体
+		s := p.stream(block.promised)
+		s.Pushed = true
+		s.Request = newRequest(pseudo, header, ts)
+		s.Request.EndStream = true
+		return
+	}
+
+	s := p.stream(block.streamID)
+	var msg *Message
+	if dir == reassembly.TCPDirClientToServer {
+		if s.Request == nil {
+			s.Request = newRequest(pseudo, header, ts)
+			msg = &s.Request.Message
+		} else {
+			msg = &s.Request.Message
+			msg.Trailer = header
+		}
+	} else {
+		switch {
+		case s.Response != nil:
+			msg = &s.Response.Message
+			msg.Trailer = header
+		case isInformational(pseudo[":status"]):
+			// 1xx中间响应之后还有最终响应
+			return
+		default:
+			code, _ := strconv.Atoi(pseudo[":status"])
+			s.Response = &Response{Message: Message{Header: header, Start: ts}, StatusCode: code}
+			msg = &s.Response.Message
+		}
+	}
+
+	msg.End = ts
+	if block.endStream {
+		msg.EndStream = true
+		p.checkDone(s)
+	}
+}
+
+// data 处理DATA帧
+func (p *Processor) data(dir reassembly.TCPFlowDirection, streamID uint32, data []byte, endStream bool, ts time.Time) {
+	s := p.streams[streamID]
+	if s == nil {
+		// 没有看到头部的流（抓包从中途开始）或已经结束的流
+		return
+	}
+	var msg *Message
+	if dir == reassembly.TCPDirClientToServer {
+		if s.Request == nil {
+			s.Request = &Request{Message: Message{Start: ts}}
+		}
+		msg = &s.Request.Message
+	} else {
+		if s.Response == nil {
+			return
+		}
+		msg = &s.Response.Message
+	}
+
+	msg.BodySize += int64(len(data))
+	msg.End = ts
+	if p.config.CaptureBody {
+		body := data
+		if room := p.config.MaxBodySize - len(msg.Body); room < len(body) {
+			msg.BodyTruncated = true
+			body = body[:max(room, 0)]
+		}
+		msg.Body = append(msg.Body, body...)
+	}
+	if p.config.OnData != nil {
+		p.config.OnData(s, dir, data, endStream)
+	}
+	if endStream {
+		msg.EndStream = true
+		p.checkDone(s)
+	}
+}
+
+// stream 获取流，不存在时创建
+func (p *Processor) stream(id uint32) *Stream {
+	s := p.streams[id]
+	if s == nil {
+		s = &Stream{StreamInfo: p.streamInfo, ID: id}
+		p.streams[id] = s
+	}
+	return s
+}
+
+// checkDone 两个方向都结束时完成流；没有看到请求时（如Upgrade建立的流1）以响应结束为准
+func (p *Processor) checkDone(s *Stream) {
+	if s.Response == nil || !s.Response.EndStream {
+		return
+	}
+	if s.Request != nil && !s.Request.EndStream {
+		return
+	}
+	p.finish(s)
+}
+
+// finish 流结束，调用回调
+func (p *Processor) finish(s *Stream) {
+	delete(p.streams, s.ID)
+	p.config.OnStream(s)
+}
+
+func (p *Processor) Close() error {
+	// 连接结束时仍未完成的流按ID顺序交给回调
+	ids := make([]uint32, 0, len(p.streams))
+	for id := range p.streams {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		p.finish(p.streams[id])
+	}
+	return nil
+}
+
+func (p *Processor) GetProtocolName() string {
+	return ProtocolName
+}
+
+// splitHeader 把头部字段分为伪头部和普通头部
+func splitHeader(fields []hpack.HeaderField) (map[string]string, nethttp.Header) {
+	pseudo := make(map[string]string)
+	header := nethttp.Header{}
+	for _, f := range fields {
+		if f.IsPseudo() {
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		header.Add(f.Name, f.Value)
+	}
+	return pseudo, header
+}
+
+// newRequest 从头部创建请求
+func newRequest(pseudo map[string]string, header nethttp.Header, ts time.Time) *Request {
+	return &Request{
+		Message:   Message{Header: header, Start: ts, End: ts},
+		Method:    pseudo[":method"],
+		Scheme:    pseudo[":scheme"],
+		Authority: pseudo[":authority"],
+		Path:      pseudo[":path"],
+	}
+}
+
+// isInformational 判断是否为1xx中间响应（101在HTTP/2中不允许）
+func isInformational(status string) bool {
+	return len(status) == 3 && status[0] == '1'
+}
@@ -0,0 +1,358 @@
+// Package kafka 提供Kafka协议的检测器和处理器
+// 按4字节长度前缀切分消息，解析请求头（api_key、api_version、correlation_id、client_id），按correlation_id配对响应；
+// Produce、Fetch和Metadata解码到主题、分区和错误码；每个请求以 Call 事件的形式交给回调
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "Kafka"
+
+// APIKey 请求类型
+type APIKey int16
+
+// 解码消息体的请求类型
+const (
+	Produce     APIKey = 0
+	Fetch       APIKey = 1
+	Metadata    APIKey = 3
+	APIVersions APIKey = 18
+)
+
+// apiNames 请求类型的名称，与协议文档一致
+var apiNames = []string{
+	"Produce", "Fetch", "ListOffsets", "Metadata", "LeaderAndIsr", "StopReplica", "UpdateMetadata",
+	"ControlledShutdown", "OffsetCommit", "OffsetFetch", "FindCoordinator", "JoinGroup", "Heartbeat",
+	"LeaveGroup", "SyncGroup", "DescribeGroups", "ListGroups", "SaslHandshake", "ApiVersions",
+	"CreateTopics", "DeleteTopics", "DeleteRecords", "InitProducerId", "OffsetForLeaderEpoch",
+	"AddPartitionsToTxn", "AddOffsetsToTxn", "EndTxn", "WriteTxnMarkers", "TxnOffsetCommit",
+	"DescribeAcls", "CreateAcls", "DeleteAcls", "DescribeConfigs", "AlterConfigs", "AlterReplicaLogDirs",
+	"DescribeLogDirs", "SaslAuthenticate", "CreatePartitions", "CreateDelegationToken",
+	"RenewDelegationToken", "ExpireDelegationToken", "DescribeDelegationToken", "DeleteGroups",
+	"ElectLeaders", "IncrementalAlterConfigs", "AlterPartitionReassignments", "ListPartitionReassignments",
+	"OffsetDelete", "DescribeClientQuotas", "AlterClientQuotas", "DescribeUserScramCredentials",
+	"AlterUserScramCredentials", "Vote", "BeginQuorumEpoch", "EndQuorumEpoch", "DescribeQuorum",
+	"AlterPartition", "UpdateFeatures", "Envelope", "FetchSnapshot", "DescribeCluster", "DescribeProducers",
+	"BrokerRegistration", "BrokerHeartbeat", "UnregisterBroker", "DescribeTransactions", "ListTransactions",
+	"AllocateProducerIds", "ConsumerGroupHeartbeat", "ConsumerGroupDescribe", "ControllerRegistration",
+	"GetTelemetrySubscriptions", "PushTelemetry", "AssignReplicasToDirs", "ListClientMetricsResources",
+	"DescribeTopicPartitions",
+}
+
+func (k APIKey) String() string {
+	if k >= 0 && int(k) < len(apiNames) {
+		return apiNames[k]
+	}
+	return fmt.Sprintf("ApiKey(%d)", int16(k))
+}
+
+// ErrorCode 响应中的错误码，0表示成功
+type ErrorCode int16
+
+var errorNames = map[ErrorCode]string{
+	-1:  "UNKNOWN_SERVER_ERROR",
+	0:   "NONE",
+	1:   "OFFSET_OUT_OF_RANGE",
+	2:   "CORRUPT_MESSAGE",
+	3:   "UNKNOWN_TOPIC_OR_PARTITION",
+	4:   "INVALID_FETCH_SIZE",
+	5:   "LEADER_NOT_AVAILABLE",
+	6:   "NOT_LEADER_OR_FOLLOWER",
+	7:   "REQUEST_TIMED_OUT",
+	8:   "BROKER_NOT_AVAILABLE",
+	9:   "REPLICA_NOT_AVAILABLE",
+	10:  "MESSAGE_TOO_LARGE",
+	13:  "NETWORK_EXCEPTION",
+	14:  "COORDINATOR_LOAD_IN_PROGRESS",
+	15:  "COORDINATOR_NOT_AVAILABLE",
+	16:  "NOT_COORDINATOR",
+	17:  "INVALID_TOPIC_EXCEPTION",
+	18:  "RECORD_LIST_TOO_LARGE",
+	19:  "NOT_ENOUGH_REPLICAS",
+	20:  "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21:  "INVALID_REQUIRED_ACKS",
+	22:  "ILLEGAL_GENERATION",
+	25:  "UNKNOWN_MEMBER_ID",
+	27:  "REBALANCE_IN_PROGRESS",
+	29:  "TOPIC_AUTHORIZATION_FAILED",
+	30:  "GROUP_AUTHORIZATION_FAILED",
+	31:  "CLUSTER_AUTHORIZATION_FAILED",
+	35:  "UNSUPPORTED_VERSION",
+	36:  "TOPIC_ALREADY_EXISTS",
+	41:  "NOT_CONTROLLER",
+	47:  "INVALID_PRODUCER_EPOCH",
+	58:  "SASL_AUTHENTICATION_FAILED",
+	74:  "FENCED_LEADER_EPOCH",
+	75:  "UNKNOWN_LEADER_EPOCH",
+	100: "UNKNOWN_TOPIC_ID",
+}
+
+func (e ErrorCode) String() string {
+	if name, ok := errorNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("ERROR_%d", int16(e))
+}
+
+// Partition 请求或响应中的一个分区
+type Partition struct {
+	Index         int32
+	ErrorCode     ErrorCode
+	Offset        int64 // Fetch请求的fetch_offset，Produce响应的base_offset
+	HighWatermark int64 // Fetch响应的高水位
+	Leader        int32 // Metadata响应的leader节点
+	Records       int   // Produce请求和Fetch响应中的记录数
+	Bytes         int   // Produce请求和Fetch响应中记录数据的字节数
+}
+
+// Topic 请求或响应中的一个主题
+type Topic struct {
+	Name       string
+	ID         string    // 主题ID，只在使用ID的版本中出现（Fetch v13+、Metadata v10+）
+	ErrorCode  ErrorCode // Metadata响应中主题的错误码
+	Partitions []Partition
+}
+
+// partition 按分区号查找分区，不存在时添加
+func (t *Topic) partition(index int32) *Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Index == index {
+			return &t.Partitions[i]
+		}
+	}
+	t.Partitions = append(t.Partitions, Partition{Index: index})
+	return &t.Partitions[len(t.Partitions)-1]
+}
+
+func (t *Topic) label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.ID
+}
+
+// Call 一个请求和它的响应
+// Produce、Fetch和Metadata的请求和响应合并到 Topics 中，其他请求只有请求头
+type Call struct {
+	StreamInfo    tcpdumper.StreamInfo
+	APIKey        APIKey
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+	Acks          int16 // Produce请求的acks，0时服务器不响应
+
+	Topics    []*Topic
+	ErrorCode ErrorCode // 响应的顶层错误码（Fetch v7+、ApiVersions）
+	Brokers   int       // Metadata响应中的broker数
+	Error     error     // 消息体解析错误
+
+	RequestSize  int
+	ResponseSize int
+	Complete     bool
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// topic 按主题名或ID查找主题，不存在时添加
+func (c *Call) topic(name, id string) *Topic {
+	for _, t := range c.Topics {
+		if name != "" && t.Name == name || name == "" && id != "" && t.ID == id {
+			if t.ID == "" {
+				t.ID = id
+			}
+			return t
+		}
+	}
+	t := &Topic{Name: name, ID: id}
+	c.Topics = append(c.Topics, t)
+	return t
+}
+
+// Latency 从请求到响应的时间
+func (c *Call) Latency() time.Duration {
+	if !c.Complete {
+		return 0
+	}
+	return c.ResponseTime.Sub(c.RequestTime)
+}
+
+// NoResponse 请求不需要响应（acks=0的Produce）
+func (c *Call) NoResponse() bool {
+	return c.APIKey == Produce && c.Acks == 0
+}
+
+// Records 所有分区的记录数之和
+func (c *Call) Records() int {
+	n := 0
+	for _, t := range c.Topics {
+		for _, p := range t.Partitions {
+			n += p.Records
+		}
+	}
+	return n
+}
+
+// FirstError 响应中的第一个错误码：依次检查顶层、主题和分区
+func (c *Call) FirstError() ErrorCode {
+	if c.ErrorCode != 0 {
+		return c.ErrorCode
+	}
+	for _, t := range c.Topics {
+		if t.ErrorCode != 0 {
+			return t.ErrorCode
+		}
+		for _, p := range t.Partitions {
+			if p.ErrorCode != 0 {
+				return p.ErrorCode
+			}
+		}
+	}
+	return 0
+}
+
+// maxStringTopics String中最多列出的主题数
+const maxStringTopics = 10
+
+// String 返回请求的摘要，如 Produce v9 corr=5 client="app" acks=-1 orders[0,1] records=3 -> NONE (2ms)
+func (c *Call) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s v%d corr=%d", c.APIKey, c.APIVersion, c.CorrelationID)
+	if c.ClientID != "" {
+		fmt.Fprintf(&b, " client=%q", c.ClientID)
+	}
+	if c.APIKey == Produce {
+		fmt.Fprintf(&b, " acks=%d", c.Acks)
+	}
+	for i, t := range c.Topics {
+		if i == maxStringTopics {
+			fmt.Fprintf(&b, " ...(+%d)", len(c.Topics)-i)
+			break
+		}
+		fmt.Fprintf(&b, " %s", t.label())
+		if len(t.Partitions) > 0 {
+			b.WriteByte('[')
+			for j, p := range t.Partitions {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%d", p.Index)
+			}
+			b.WriteByte(']')
+		}
+	}
+	if n := c.Records(); n > 0 {
+		fmt.Fprintf(&b, " records=%d", n)
+	}
+	switch {
+	case c.NoResponse() && !c.Complete:
+		b.WriteString(" -> <no response expected>")
+		return b.String()
+	case !c.Complete:
+		b.WriteString(" -> <no response>")
+		return b.String()
+	case c.Error != nil:
+		fmt.Fprintf(&b, " -> <%v>", c.Error)
+	case decodable(c.APIKey, c.APIVersion):
+		fmt.Fprintf(&b, " -> %s", c.FirstError())
+		if c.APIKey == Metadata {
+			fmt.Fprintf(&b, " brokers=%d", c.Brokers)
+		}
+	default:
+		fmt.Fprintf(&b, " -> %dB", c.ResponseSize)
+	}
+	fmt.Fprintf(&b, " (%v)", c.Latency())
+	return b.String()
+}
+
+// Config Kafka处理器配置
+type Config struct {
+	// OnCall 收到响应、请求不需要响应或连接关闭时的回调，为nil时把摘要输出到Output
+	OnCall func(*Call)
+	Output io.Writer // 默认回调的输出，nil为标准输出
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnCall == nil {
+		c.OnCall = func(call *Call) {
+			fmt.Fprintf(w, "KAFKA/%s: %s\n", call.StreamInfo.Ident, call)
+		}
+	}
+	return c
+}
+
+// maxDetectVersion 检测时接受的最高API版本
+const maxDetectVersion = 20
+
+// Detector Kafka检测器
+// 客户端数据以合法的请求头开头（已知的api_key、合理的版本和可打印的client_id）时置信度为80，
+// 客户端通常先发送的ApiVersions为90
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建Kafka检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if dir != reassembly.TCPDirClientToServer || len(data) < 14 {
+		return 0
+	}
+	size := int(int32(binary.BigEndian.Uint32(data)))
+	key := APIKey(binary.BigEndian.Uint16(data[4:]))
+	version := int16(binary.BigEndian.Uint16(data[6:]))
+	if size < 10 || size > maxMessageSize || key < 0 || int(key) >= len(apiNames) || version < 0 || version > maxDetectVersion {
+		return 0
+	}
+	n := int(int16(binary.BigEndian.Uint16(data[12:])))
+	if n < -1 || n > size-10 {
+		return 0
+	}
+	for _, c := range data[14:min(len(data), 14+max(n, 0))] {
+		if c < 0x20 || c > 0x7e {
+			return 0
+		}
+	}
+	if key == APIVersions {
+		return 90
+	}
+	return 80
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), messageFramer)
+}
+
+// NewProcessor 创建Kafka处理器，返回的处理器会先按长度前缀切分消息
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册Kafka协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,344 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/internal/prototest"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// encoder 构造消息体，flex为true时使用紧凑编码，只用于测试
+type encoder struct {
+	buf  []byte
+	flex bool
+}
+
+func (e *encoder) i8(v int8) *encoder {
+	e.buf = append(e.buf, byte(v))
+	return e
+}
+
+func (e *encoder) i16(v int16) *encoder {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+	return e
+}
+
+func (e *encoder) i32(v int32) *encoder {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+	return e
+}
+
+func (e *encoder) i64(v int64) *encoder {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+	return e
+}
+
+// length 数组、字符串或字节的长度，-1为null
+func (e *encoder) length(n int, legacy func(int)) *encoder {
+	if e.flex {
+		e.buf = binary.AppendUvarint(e.buf, uint64(n+1))
+	} else {
+		legacy(n)
+	}
+	return e
+}
+
+func (e *encoder) array(n int) *encoder {
+	return e.length(n, func(n int) { e.i32(int32(n)) })
+}
+
+func (e *encoder) str(s string) *encoder {
+	e.length(len(s), func(n int) { e.i16(int16(n)) })
+	e.buf = append(e.buf, s...)
+	return e
+}
+
+func (e *encoder) bytes(b []byte) *encoder {
+	e.length(len(b), func(n int) { e.i32(int32(n)) })
+	e.buf = append(e.buf, b...)
+	return e
+}
+
+// tags 空的标签字段
+func (e *encoder) tags() *encoder {
+	if e.flex {
+		e.buf = append(e.buf, 0)
+	}
+	return e
+}
+
+// frame 加上4字节长度前缀
+func frame(parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+// request 构造请求：请求头加消息体
+func request(key APIKey, version int16, corr int32, clientID string, body []byte) []byte {
+	h := &encoder{}
+	h.i16(int16(key)).i16(version).i32(corr).str(clientID)
+	if flexible(key, version) {
+		h.buf = append(h.buf, 0)
+	}
+	return frame(h.buf, body)
+}
+
+// response 构造响应：响应头加消息体
+func response(key APIKey, version int16, corr int32, body []byte) []byte {
+	h := (&encoder{}).i32(corr)
+	if key != APIVersions && flexible(key, version) {
+		h.buf = append(h.buf, 0)
+	}
+	return frame(h.buf, body)
+}
+
+// recordBatch v2记录批次，只填写长度、magic和记录数
+func recordBatch(records int32) []byte {
+	b := make([]byte, 61+10*records)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	b[16] = 2
+	binary.BigEndian.PutUint32(b[57:], uint32(records))
+	return b
+}
+
+func collect(config *Config) *[]*Call {
+	var calls []*Call
+	config.OnCall = func(c *Call) {
+		calls = append(calls, c)
+	}
+	return &calls
+}
+
+var apiVersionsRequest = request(APIVersions, 3, 1, "rdkafka",
+	(&encoder{flex: true}).str("librdkafka").str("2.3.0").tags().buf)
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	assert.Equal(t, 90, d.Detect(apiVersionsRequest, c2s))
+	assert.Equal(t, 90, d.Detect(apiVersionsRequest[:16], c2s))
+	assert.Equal(t, 80, d.Detect(request(Metadata, 1, 2, "", (&encoder{}).array(-1).buf), c2s))
+
+	assert.Equal(t, 0, d.Detect(apiVersionsRequest, s2c))
+	assert.Equal(t, 0, d.Detect(request(APIKey(500), 0, 1, "x", nil), c2s))
+	assert.Equal(t, 0, d.Detect(request(Metadata, 99, 1, "x", nil), c2s))
+	assert.Equal(t, 0, d.Detect(request(Metadata, 1, 1, "bad\x01id", nil), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), c2s))
+	// PostgreSQL的SSLRequest
+	assert.Equal(t, 0, d.Detect([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f, 0, 0, 0, 0, 0, 0}, c2s))
+}
+
+func TestProduce(t *testing.T) {
+	config := Config{}
+	calls := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	// v9使用紧凑编码
+	body := (&encoder{flex: true}).str("").i16(-1).i32(30000).
+		array(1).str("orders").
+		array(2).
+		i32(0).bytes(append(recordBatch(2), recordBatch(1)...)).tags().
+		i32(1).bytes(recordBatch(4)).tags().
+		tags().tags()
+	resp := (&encoder{flex: true}).array(1).str("orders").
+		array(2).
+		i32(0).i16(0).i64(100).i64(-1).i64(0).array(0).str("").tags().
+		i32(1).i16(6).i64(-1).i64(-1).i64(0).array(0).str("not leader").tags().
+		tags().i32(0).tags()
+	prototest.Feed(t, p,
+		prototest.C2S(request(Produce, 9, 7, "producer-1", body.buf)),
+		prototest.S2C(response(Produce, 9, 7, resp.buf)),
+	)
+
+	if assert.Len(t, *calls, 1) {
+		c := (*calls)[0]
+		assert.Equal(t, Produce, c.APIKey)
+		assert.Equal(t, int16(9), c.APIVersion)
+		assert.Equal(t, int32(7), c.CorrelationID)
+		assert.Equal(t, "producer-1", c.ClientID)
+		assert.Equal(t, int16(-1), c.Acks)
+		assert.NoError(t, c.Error)
+		if assert.Len(t, c.Topics, 1) && assert.Len(t, c.Topics[0].Partitions, 2) {
+			assert.Equal(t, Partition{Index: 0, Offset: 100, Records: 3, Bytes: 2*61 + 30}, c.Topics[0].Partitions[0])
+			assert.Equal(t, Partition{Index: 1, ErrorCode: 6, Offset: -1, Records: 4, Bytes: 101}, c.Topics[0].Partitions[1])
+		}
+		assert.Equal(t, ErrorCode(6), c.FirstError())
+		assert.Equal(t, time.Millisecond, c.Latency())
+		assert.Equal(t, `Produce v9 corr=7 client="producer-1" acks=-1 orders[0,1] records=7 -> NOT_LEADER_OR_FOLLOWER (1ms)`, c.String())
+	}
+
+	// acks=0不等待响应，v3之前没有transactional_id
+	*calls = nil
+	body = (&encoder{}).i16(0).i32(1000).array(1).str("logs").array(1).i32(2).bytes(recordBatch(1))
+	prototest.Feed(t, p,
+		prototest.C2S(request(Produce, 2, 8, "", body.buf)),
+	)
+	if assert.Len(t, *calls, 1) {
+		assert.Equal(t, `Produce v2 corr=8 acks=0 logs[2] records=1 -> <no response expected>`, (*calls)[0].String())
+	}
+}
+
+func TestFetch(t *testing.T) {
+	config := Config{}
+	calls := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	// v11：非紧凑编码，按主题名
+	req := (&encoder{}).i32(-1).i32(500).i32(1).i32(52428800).i8(0).i32(0).i32(-1).
+		array(1).str("orders").array(1).i32(0).i32(5).i64(42).i64(-1).i32(1048576).
+		array(0).str("")
+	resp := (&encoder{}).i32(0).i16(0).i32(12).
+		array(1).str("orders").array(1).
+		i32(0).i16(0).i64(45).i64(45).i64(0).array(-1).i32(-1).bytes(append(recordBatch(3), 0, 0, 0)).
+		array(0)
+	prototest.Feed(t, p,
+		prototest.C2S(request(Fetch, 11, 3, "consumer", req.buf)),
+		prototest.S2C(response(Fetch, 11, 3, resp.buf)),
+	)
+
+	if assert.Len(t, *calls, 1) {
+		c := (*calls)[0]
+		assert.NoError(t, c.Error)
+		if assert.Len(t, c.Topics, 1) && assert.Len(t, c.Topics[0].Partitions, 1) {
+			assert.Equal(t, Partition{Index: 0, Offset: 42, HighWatermark: 45, Records: 3, Bytes: 94}, c.Topics[0].Partitions[0])
+		}
+		assert.Equal(t, `Fetch v11 corr=3 client="consumer" orders[0] records=3 -> NONE (1ms)`, c.String())
+	}
+
+	// v13起按主题ID，使用紧凑编码；顶层错误码
+	*calls = nil
+	id := bytes.Repeat([]byte{0xab}, 16)
+	req = (&encoder{flex: true}).i32(-1).i32(500).i32(1).i32(1024).i8(1).i32(0).i32(0).
+		array(1)
+	req.buf = append(req.buf, id...)
+	req.array(1).i32(2).i32(0).i64(7).i32(-1).i64(-1).i32(1024).tags().tags().array(0).str("").tags()
+	resp = (&encoder{flex: true}).i32(0).i16(71).i32(0).array(0).tags()
+	prototest.Feed(t, p,
+		prototest.C2S(request(Fetch, 13, 4, "consumer", req.buf)),
+		prototest.S2C(response(Fetch, 13, 4, resp.buf)),
+	)
+	if assert.Len(t, *calls, 1) {
+		c := (*calls)[0]
+		assert.NoError(t, c.Error)
+		if assert.Len(t, c.Topics, 1) {
+			assert.Equal(t, "abababab-abab-abab-abab-abababababab", c.Topics[0].ID)
+		}
+		assert.Equal(t, `Fetch v13 corr=4 client="consumer" abababab-abab-abab-abab-abababababab[2] -> ERROR_71 (1ms)`, c.String())
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	config := Config{}
+	calls := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	// v12：请求中的主题带ID，响应包含broker、主题和分区
+	zero := make([]byte, 16)
+	req := (&encoder{flex: true}).array(2)
+	req.buf = append(req.buf, zero...)
+	req.str("orders").tags()
+	req.buf = append(req.buf, zero...)
+	req.str("missing").tags().i8(1).i8(0).tags()
+	resp := (&encoder{flex: true}).i32(0).
+		array(2).
+		i32(1).str("kafka-1").i32(9092).str("").tags().
+		i32(2).str("kafka-2").i32(9092).str("rack-b").tags().
+		str("cluster").i32(1).
+		array(2).
+		i16(0).str("orders")
+	resp.buf = append(resp.buf, bytes.Repeat([]byte{1}, 16)...)
+	resp.i8(0).array(2).
+		i16(0).i32(0).i32(1).i32(5).array(2).i32(1).i32(2).array(1).i32(1).array(0).tags().
+		i16(0).i32(1).i32(2).i32(5).array(2).i32(2).i32(1).array(2).i32(2).i32(1).array(0).tags().
+		i32(-2147483648).tags().
+		i16(3).str("missing")
+	resp.buf = append(resp.buf, zero...)
+	resp.i8(0).array(0).i32(-2147483648).tags().tags()
+	prototest.Feed(t, p,
+		prototest.C2S(request(Metadata, 12, 1, "admin", req.buf)),
+		prototest.S2C(response(Metadata, 12, 1, resp.buf)),
+	)
+
+	if assert.Len(t, *calls, 1) {
+		c := (*calls)[0]
+		assert.NoError(t, c.Error)
+		assert.Equal(t, 2, c.Brokers)
+		if assert.Len(t, c.Topics, 2) {
+			assert.Equal(t, "orders", c.Topics[0].Name)
+			assert.Equal(t, "01010101-0101-0101-0101-010101010101", c.Topics[0].ID)
+			if assert.Len(t, c.Topics[0].Partitions, 2) {
+				assert.Equal(t, int32(2), c.Topics[0].Partitions[1].Leader)
+			}
+			assert.Equal(t, ErrorCode(3), c.Topics[1].ErrorCode)
+		}
+		assert.Equal(t, `Metadata v12 corr=1 client="admin" orders[0,1] missing -> UNKNOWN_TOPIC_OR_PARTITION brokers=2 (1ms)`, c.String())
+	}
+}
+
+func TestPairing(t *testing.T) {
+	config := Config{}
+	calls := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	// 流水线请求乱序响应；未解析消息体的API只记录响应大小；没有请求的响应被忽略
+	prototest.Feed(t, p,
+		prototest.C2S(apiVersionsRequest,
+			request(APIKey(10), 4, 2, "rdkafka", (&encoder{flex: true}).str("group").i8(0).tags().buf),
+			request(APIKey(12), 4, 3, "rdkafka", nil)),
+		prototest.S2C(response(APIKey(10), 4, 2, make([]byte, 20)),
+			response(APIVersions, 3, 99, nil),
+			response(APIVersions, 3, 1, (&encoder{}).i16(35).buf)),
+	)
+	assert.NoError(t, p.Close())
+	if assert.Len(t, *calls, 3) {
+		assert.Equal(t, `FindCoordinator v4 corr=2 client="rdkafka" -> 28B (2ms)`, (*calls)[0].String())
+		assert.Equal(t, `ApiVersions v3 corr=1 client="rdkafka" -> UNSUPPORTED_VERSION (5ms)`, (*calls)[1].String())
+		assert.Equal(t, `Heartbeat v4 corr=3 client="rdkafka" -> <no response>`, (*calls)[2].String())
+	}
+
+	// 截断的消息体
+	*calls = nil
+	prototest.Feed(t, p,
+		prototest.C2S(request(Metadata, 1, 5, "", (&encoder{}).array(1).buf)),
+		prototest.S2C(response(Metadata, 1, 5, nil)),
+	)
+	if assert.Len(t, *calls, 1) {
+		assert.ErrorIs(t, (*calls)[0].Error, errShortMessage)
+		assert.Equal(t, `Metadata v1 corr=5 -> <short message> (1ms)`, (*calls)[0].String())
+	}
+	assert.Error(t, p.ProcessTimedData([]byte{0, 0, 0, 2, 0, 1}, c2s, false, false, prototest.Start))
+}
+
+func TestCountRecords(t *testing.T) {
+	legacy := make([]byte, 26)
+	binary.BigEndian.PutUint32(legacy[8:], 14)
+	assert.Equal(t, 0, countRecords(nil))
+	assert.Equal(t, 6, countRecords(append(recordBatch(5), legacy...)))
+	assert.Equal(t, 2, countRecords(bytes.Repeat(legacy, 2)))
+	assert.Equal(t, 1, countRecords(append(recordBatch(1), recordBatch(3)[:40]...)))
+}
+
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:9092"}, nil)
+	assert.NoError(t, d.ProcessData(apiVersionsRequest[:10], c2s, true, false))
+	assert.NoError(t, d.ProcessData(apiVersionsRequest[10:], c2s, false, false))
+	assert.NoError(t, d.ProcessData(response(APIVersions, 3, 1, (&encoder{}).i16(0).buf), s2c, true, false))
+	assert.NoError(t, d.ProcessData(request(Metadata, 1, 2, "rdkafka", (&encoder{}).array(-1).buf), c2s, false, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^KAFKA/a:1-b:9092: ApiVersions v3 corr=1 client="rdkafka" -> NONE \(.+\)\n`+
+		`KAFKA/a:1-b:9092: Metadata v1 corr=2 client="rdkafka" -> <no response>\n$`, out.String())
+}
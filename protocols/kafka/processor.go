@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxPending 等待响应的请求数上限，超过时最早的请求按没有响应回调
+const maxPending = 10000
+
+// processor Kafka处理器，每次调用必须是一条完整的消息（含长度前缀），由 FramedProcessor 包装
+// 客户端可以在收到响应之前发送多个请求，按correlation_id查找对应的请求
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	pending    []*Call
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{streamInfo: streamInfo, config: config}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一条带时间戳的消息，没有时间戳时使用当前时间
+// 消息体无法解析时仍按消息头配对，解析错误记录在 Call.Error 中
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if len(data) < 8 {
+		return errShortMessage
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if dir == reassembly.TCPDirClientToServer {
+		return p.request(data, ts)
+	}
+	p.response(data, ts)
+	return nil
+}
+
+// request 处理客户端的请求
+func (p *processor) request(data []byte, ts time.Time) error {
+	c := &Call{StreamInfo: p.streamInfo, RequestSize: len(data), RequestTime: ts}
+	r, err := requestHeader(c, data[4:])
+	if err != nil {
+		return err
+	}
+	if c.APIKey == Produce {
+		c.Acks = -1 // 解析失败时按需要响应处理
+	}
+	c.Error = decodeRequest(c, r)
+	if c.NoResponse() {
+		p.config.OnCall(c)
+		return nil
+	}
+	if len(p.pending) >= maxPending {
+		p.config.OnCall(p.pending[0])
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, c)
+	return nil
+}
+
+// response 处理服务器的响应，响应头只有correlation_id
+func (p *processor) response(data []byte, ts time.Time) {
+	id := int32(binary.BigEndian.Uint32(data[4:]))
+	var c *Call
+	for i, v := range p.pending {
+		if v.CorrelationID == id {
+			c = v
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+	if c == nil {
+		return
+	}
+	c.Complete, c.ResponseTime, c.ResponseSize = true, ts, len(data)
+	r := newReader(data[8:], c.APIKey != APIVersions && flexible(c.APIKey, c.APIVersion))
+	r.tags()
+	if c.Error == nil {
+		c.Error = decodeResponse(c, r)
+	}
+	p.config.OnCall(c)
+}
+
+func (p *processor) Close() error {
+	for _, c := range p.pending {
+		p.config.OnCall(c)
+	}
+	p.pending = nil
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
@@ -0,0 +1,450 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/LubyRuffy/tcpdumper"
+)
+
+// maxMessageSize 单条消息的最大长度，需要容纳fetch.max.bytes（默认50MB）的Fetch响应
+const maxMessageSize = 128 << 20
+
+var errShortMessage = errors.New("short message")
+
+// flexibleVersions 需要解析消息体的API从哪个版本开始使用紧凑编码和标签字段（KIP-482）
+var flexibleVersions = map[APIKey]int16{
+	Produce:     9,
+	Fetch:       12,
+	Metadata:    9,
+	APIVersions: 3,
+}
+
+// maxDecodeVersions 支持解析消息体的最高版本
+var maxDecodeVersions = map[APIKey]int16{
+	Produce:     12,
+	Fetch:       17,
+	Metadata:    12,
+	APIVersions: 4,
+}
+
+// flexible 请求使用紧凑编码，请求头为v2，响应头为v1（ApiVersions的响应头总是v0）
+func flexible(key APIKey, version int16) bool {
+	v, ok := flexibleVersions[key]
+	return ok && version >= v
+}
+
+// decodable 是否支持解析该版本的消息体
+func decodable(key APIKey, version int16) bool {
+	v, ok := maxDecodeVersions[key]
+	return ok && version <= v
+}
+
+// reader 大端读取器，flex为true时字符串、数组和字节使用紧凑编码；读取越界时ok变为false
+type reader struct {
+	data []byte
+	ok   bool
+	flex bool
+}
+
+func newReader(data []byte, flex bool) *reader {
+	return &reader{data: data, ok: true, flex: flex}
+}
+
+func (r *reader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) i8() int8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (r *reader) i16() int16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *reader) i32() int32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *reader) i64() int64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *reader) uvarint() uint64 {
+	if !r.ok {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.ok = false
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// compactLength 紧凑编码的长度：无符号变长整数N+1，0表示null（返回-1）
+func (r *reader) compactLength() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data))+1 {
+		r.ok = false
+		return -1
+	}
+	return int(n) - 1
+}
+
+// arrayLen 数组的元素数，null数组返回-1；元素至少占一个字节，超过剩余数据时视为越界
+func (r *reader) arrayLen() int {
+	var n int
+	if r.flex {
+		n = r.compactLength()
+	} else {
+		n = int(r.i32())
+	}
+	if n > len(r.data) {
+		r.ok = false
+	}
+	if !r.ok {
+		return 0
+	}
+	return n
+}
+
+// str 字符串，null为空字符串；请求头中的client_id总是使用非紧凑编码
+func (r *reader) str() string {
+	var n int
+	if r.flex {
+		n = r.compactLength()
+	} else {
+		n = int(r.i16())
+	}
+	if n < 0 {
+		return ""
+	}
+	return string(r.bytes(n))
+}
+
+// nullableBytes 字节数组，null返回nil
+func (r *reader) nullableBytes() []byte {
+	var n int
+	if r.flex {
+		n = r.compactLength()
+	} else {
+		n = int(r.i32())
+	}
+	if n < 0 {
+		return nil
+	}
+	return r.bytes(n)
+}
+
+// int32Array 跳过int32数组
+func (r *reader) int32Array() {
+	n := r.arrayLen()
+	r.bytes(4 * max(n, 0))
+}
+
+// tags 跳过标签字段，只有紧凑编码的结构中才有
+func (r *reader) tags() {
+	if !r.flex {
+		return
+	}
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.ok; i++ {
+		r.uvarint()
+		r.bytes(int(r.uvarint()))
+	}
+}
+
+// uuid 主题ID，全0时返回空
+func (r *reader) uuid() string {
+	b := r.bytes(16)
+	if b == nil || [16]byte(b) == [16]byte{} {
+		return ""
+	}
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+}
+
+func (r *reader) err() error {
+	if !r.ok {
+		return errShortMessage
+	}
+	return nil
+}
+
+// requestHeader 解析请求头：api_key、api_version、correlation_id和client_id，返回消息体的读取器
+func requestHeader(c *Call, data []byte) (*reader, error) {
+	r := newReader(data, false)
+	c.APIKey = APIKey(r.i16())
+	c.APIVersion = r.i16()
+	c.CorrelationID = r.i32()
+	c.ClientID = r.str()
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	r.flex = flexible(c.APIKey, c.APIVersion)
+	r.tags()
+	return r, r.err()
+}
+
+// countRecords 统计记录批次中的记录数，v2批次读取头部的记录数，旧版消息集每条消息计为1；结尾不完整的批次被忽略
+func countRecords(data []byte) int {
+	n := 0
+	for len(data) >= 17 {
+		size := 12 + int(int32(binary.BigEndian.Uint32(data[8:])))
+		if size < 17 || size > len(data) {
+			break
+		}
+		if magic := data[16]; magic >= 2 {
+			if size >= 61 {
+				n += int(int32(binary.BigEndian.Uint32(data[57:])))
+			}
+		} else {
+			n++
+		}
+		data = data[size:]
+	}
+	return n
+}
+
+// decodeRequest 解析已知API的请求体
+func decodeRequest(c *Call, r *reader) error {
+	if !decodable(c.APIKey, c.APIVersion) {
+		return nil
+	}
+	v := c.APIVersion
+	switch c.APIKey {
+	case Produce:
+		if v >= 3 {
+			r.str() // transactional_id
+		}
+		c.Acks = r.i16()
+		r.i32() // timeout_ms
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			t := c.topic(r.str(), "")
+			for j, m := 0, r.arrayLen(); j < m && r.ok; j++ {
+				p := t.partition(r.i32())
+				records := r.nullableBytes()
+				p.Bytes, p.Records = len(records), countRecords(records)
+				r.tags()
+			}
+			r.tags()
+		}
+	case Fetch:
+		if v <= 14 {
+			r.i32() // replica_id
+		}
+		r.i32() // max_wait_ms
+		r.i32() // min_bytes
+		if v >= 3 {
+			r.i32() // max_bytes
+		}
+		if v >= 4 {
+			r.i8() // isolation_level
+		}
+		if v >= 7 {
+			r.i32() // session_id
+			r.i32() // session_epoch
+		}
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			t := topicByVersion(c, r, v >= 13)
+			for j, m := 0, r.arrayLen(); j < m && r.ok; j++ {
+				p := t.partition(r.i32())
+				if v >= 9 {
+					r.i32() // current_leader_epoch
+				}
+				p.Offset = r.i64()
+				if v >= 12 {
+					r.i32() // last_fetched_epoch
+				}
+				if v >= 5 {
+					r.i64() // log_start_offset
+				}
+				r.i32() // partition_max_bytes
+				r.tags()
+			}
+			r.tags()
+		}
+		// 之后的forgotten_topics_data和rack_id不需要
+	case Metadata:
+		// null数组表示请求所有主题
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			var id string
+			if v >= 10 {
+				id = r.uuid()
+			}
+			c.topic(r.str(), id)
+			r.tags()
+		}
+	}
+	return r.err()
+}
+
+// decodeResponse 解析已知API的响应体
+func decodeResponse(c *Call, r *reader) error {
+	if !decodable(c.APIKey, c.APIVersion) {
+		return nil
+	}
+	v := c.APIVersion
+	switch c.APIKey {
+	case Produce:
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			t := c.topic(r.str(), "")
+			for j, m := 0, r.arrayLen(); j < m && r.ok; j++ {
+				p := t.partition(r.i32())
+				p.ErrorCode = ErrorCode(r.i16())
+				p.Offset = r.i64() // base_offset
+				if v >= 2 {
+					r.i64() // log_append_time_ms
+				}
+				if v >= 5 {
+					r.i64() // log_start_offset
+				}
+				if v >= 8 {
+					for k, e := 0, r.arrayLen(); k < e && r.ok; k++ {
+						r.i32() // batch_index
+						r.str() // batch_index_error_message
+						r.tags()
+					}
+					r.str() // error_message
+				}
+				r.tags()
+			}
+			r.tags()
+		}
+		if v >= 1 {
+			r.i32() // throttle_time_ms
+		}
+	case Fetch:
+		if v >= 1 {
+			r.i32() // throttle_time_ms
+		}
+		if v >= 7 {
+			c.ErrorCode = ErrorCode(r.i16())
+			r.i32() // session_id
+		}
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			t := topicByVersion(c, r, v >= 13)
+			for j, m := 0, r.arrayLen(); j < m && r.ok; j++ {
+				p := t.partition(r.i32())
+				p.ErrorCode = ErrorCode(r.i16())
+				p.HighWatermark = r.i64()
+				if v >= 4 {
+					r.i64() // last_stable_offset
+				}
+				if v >= 5 {
+					r.i64() // log_start_offset
+				}
+				if v >= 4 {
+					for k, a := 0, r.arrayLen(); k < a && r.ok; k++ {
+						r.i64() // producer_id
+						r.i64() // first_offset
+						r.tags()
+					}
+				}
+				if v >= 11 {
+					r.i32() // preferred_read_replica
+				}
+				records := r.nullableBytes()
+				p.Bytes, p.Records = len(records), countRecords(records)
+				r.tags()
+			}
+			r.tags()
+		}
+	case Metadata:
+		if v >= 3 {
+			r.i32() // throttle_time_ms
+		}
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			c.Brokers++
+			r.i32() // node_id
+			r.str() // host
+			r.i32() // port
+			if v >= 1 {
+				r.str() // rack
+			}
+			r.tags()
+		}
+		if v >= 2 {
+			r.str() // cluster_id
+		}
+		if v >= 1 {
+			r.i32() // controller_id
+		}
+		for i, n := 0, r.arrayLen(); i < n && r.ok; i++ {
+			code := ErrorCode(r.i16())
+			name := r.str()
+			var id string
+			if v >= 10 {
+				id = r.uuid()
+			}
+			if v >= 1 {
+				r.i8() // is_internal
+			}
+			t := c.topic(name, id)
+			t.ErrorCode = code
+			for j, m := 0, r.arrayLen(); j < m && r.ok; j++ {
+				code := ErrorCode(r.i16())
+				p := t.partition(r.i32())
+				p.ErrorCode = code
+				p.Leader = r.i32()
+				if v >= 7 {
+					r.i32() // leader_epoch
+				}
+				r.int32Array() // replica_nodes
+				r.int32Array() // isr_nodes
+				if v >= 5 {
+					r.int32Array() // offline_replicas
+				}
+				r.tags()
+			}
+			if v >= 8 {
+				r.i32() // topic_authorized_operations
+			}
+			r.tags()
+		}
+	case APIVersions:
+		c.ErrorCode = ErrorCode(r.i16())
+	}
+	return r.err()
+}
+
+// topicByVersion 读取主题名或主题ID（Fetch v13起只有ID）
+func topicByVersion(c *Call, r *reader, byID bool) *Topic {
+	if byID {
+		return c.topic("", r.uuid())
+	}
+	return c.topic(r.str(), "")
+}
+
+// messageFramer 按4字节大端长度前缀切分消息，消息不包含长度字段本身
+var messageFramer, _ = tcpdumper.NewLengthPrefixFramer(tcpdumper.LengthPrefixConfig{
+	LengthSize: 4,
+	MaxMessage: maxMessageSize,
+})
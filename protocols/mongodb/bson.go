@@ -0,0 +1,399 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDepth 文档嵌套的最大深度
+const maxDepth = 100
+
+var errInvalidBSON = errors.New("invalid BSON")
+
+// Document BSON文档，按原始顺序保存的键值对
+// 值的Go类型：float64、string、Document、Array、Binary、Undefined、ObjectID、bool、time.Time（UTC）、
+// nil（null）、Regex、DBPointer、JavaScript、Symbol、int32、Timestamp、int64、Decimal128、MinKey、MaxKey
+type Document []Element
+
+// Element 文档中的一个键值对
+type Element struct {
+	Key   string
+	Value interface{}
+}
+
+// Array BSON数组
+type Array []interface{}
+
+// ObjectID 12字节的对象ID
+type ObjectID [12]byte
+
+// Binary 二进制数据
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// Regex 正则表达式
+type Regex struct {
+	Pattern string
+	Options string
+}
+
+// DBPointer 已废弃的数据库指针
+type DBPointer struct {
+	Namespace string
+	ID        ObjectID
+}
+
+// JavaScript JavaScript代码（带作用域的代码只保留代码）
+type JavaScript string
+
+// Symbol 已废弃的符号类型
+type Symbol string
+
+// Timestamp 内部时间戳，T为秒，I为序号
+type Timestamp struct {
+	T uint32
+	I uint32
+}
+
+// Decimal128 IEEE 754-2008 128位十进制数，保存原始的小端字节
+type Decimal128 [16]byte
+
+// Undefined 已废弃的undefined类型
+type Undefined struct{}
+
+// MinKey 比所有值都小的特殊值
+type MinKey struct{}
+
+// MaxKey 比所有值都大的特殊值
+type MaxKey struct{}
+
+// Lookup 查找键对应的值，找不到时返回false
+func (d Document) Lookup(key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// GetString 查找字符串类型的值，不存在或不是字符串时返回空
+func (d Document) GetString(key string) string {
+	v, _ := d.Lookup(key)
+	s, _ := v.(string)
+	return s
+}
+
+// GetInt 查找数值类型的值并转为int64，不存在或不是数值时返回false
+func (d Document) GetInt(key string) (int64, bool) {
+	v, _ := d.Lookup(key)
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// String 以类似mongo shell的形式返回文档，如 {find: "users", filter: {age: {$gt: 30}}}
+func (d Document) String() string {
+	return d.Render(0)
+}
+
+// Render 与 String 相同，maxLen大于0时超过maxLen的部分被截断
+func (d Document) Render(maxLen int) string {
+	var b strings.Builder
+	writeValue(&b, d)
+	s := b.String()
+	if maxLen > 0 && len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
+
+// writeValue 写入一个值
+func writeValue(b *strings.Builder, v interface{}) {
+	switch v := v.(type) {
+	case Document:
+		b.WriteByte('{')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeKey(b, e.Key)
+			b.WriteString(": ")
+			writeValue(b, e.Value)
+		}
+		b.WriteByte('}')
+	case Array:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeValue(b, e)
+		}
+		b.WriteByte(']')
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case nil:
+		b.WriteString("null")
+	case ObjectID:
+		fmt.Fprintf(b, "ObjectId(%q)", hex.EncodeToString(v[:]))
+	case time.Time:
+		fmt.Fprintf(b, "ISODate(%q)", v.Format("2006-01-02T15:04:05.000Z07:00"))
+	case Binary:
+		data := v.Data
+		if len(data) > 48 {
+			data = data[:48]
+		}
+		fmt.Fprintf(b, "BinData(%d, %q", v.Subtype, base64.StdEncoding.EncodeToString(data))
+		if len(v.Data) > len(data) {
+			fmt.Fprintf(b, "...(%d bytes)", len(v.Data))
+		}
+		b.WriteByte(')')
+	case Regex:
+		fmt.Fprintf(b, "/%s/%s", v.Pattern, v.Options)
+	case Timestamp:
+		fmt.Fprintf(b, "Timestamp(%d, %d)", v.T, v.I)
+	case Decimal128:
+		fmt.Fprintf(b, "NumberDecimal(0x%s)", hex.EncodeToString(v[:]))
+	case JavaScript:
+		fmt.Fprintf(b, "Code(%q)", string(v))
+	case Symbol:
+		b.WriteString(strconv.Quote(string(v)))
+	case DBPointer:
+		fmt.Fprintf(b, "DBPointer(%q, ObjectId(%q))", v.Namespace, hex.EncodeToString(v.ID[:]))
+	case Undefined:
+		b.WriteString("undefined")
+	case MinKey:
+		b.WriteString("MinKey")
+	case MaxKey:
+		b.WriteString("MaxKey")
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
+
+// writeKey 写入键，不是标识符的键带引号
+func writeKey(b *strings.Builder, key string) {
+	for i, c := range key {
+		if c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && (c >= '0' && c <= '9' || c == '.') {
+			continue
+		}
+		b.WriteString(strconv.Quote(key))
+		return
+	}
+	if key == "" {
+		b.WriteString(`""`)
+		return
+	}
+	b.WriteString(key)
+}
+
+// parseDocument 解析一个BSON文档，返回文档和占用的字节数
+func parseDocument(data []byte) (Document, int, error) {
+	return decodeDocument(data, 0)
+}
+
+func decodeDocument(data []byte, depth int) (Document, int, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("%w: nesting too deep", errInvalidBSON)
+	}
+	if len(data) < 5 {
+		return nil, 0, fmt.Errorf("%w: short document", errInvalidBSON)
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) || data[size-1] != 0 {
+		return nil, 0, fmt.Errorf("%w: document size %d", errInvalidBSON, size)
+	}
+
+	doc := Document{}
+	body := data[4 : size-1]
+	for len(body) > 0 {
+		typ := body[0]
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			return nil, 0, fmt.Errorf("%w: unterminated key", errInvalidBSON)
+		}
+		key := string(body[1 : 1+end])
+		value, n, err := decodeValue(typ, body[2+end:], depth)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", key, err)
+		}
+		doc = append(doc, Element{Key: key, Value: value})
+		body = body[2+end+n:]
+	}
+	return doc, size, nil
+}
+
+// decodeValue 解析指定类型的值，返回值和占用的字节数
+func decodeValue(typ byte, data []byte, depth int) (interface{}, int, error) {
+	fixed := func(n int) error {
+		if len(data) < n {
+			return fmt.Errorf("%w: short value of type 0x%02x", errInvalidBSON, typ)
+		}
+		return nil
+	}
+	switch typ {
+	case 0x01:
+		if err := fixed(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+	case 0x02, 0x0d, 0x0e:
+		s, n, err := decodeString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch typ {
+		case 0x0d:
+			return JavaScript(s), n, nil
+		case 0x0e:
+			return Symbol(s), n, nil
+		}
+		return s, n, nil
+	case 0x03:
+		return decodeDocument(data, depth+1)
+	case 0x04:
+		doc, n, err := decodeDocument(data, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		arr := make(Array, len(doc))
+		for i, e := range doc {
+			arr[i] = e.Value
+		}
+		return arr, n, nil
+	case 0x05:
+		if err := fixed(5); err != nil {
+			return nil, 0, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 0 || 5+size > len(data) {
+			return nil, 0, fmt.Errorf("%w: binary size %d", errInvalidBSON, size)
+		}
+		return Binary{Subtype: data[4], Data: append([]byte(nil), data[5:5+size]...)}, 5 + size, nil
+	case 0x06:
+		return Undefined{}, 0, nil
+	case 0x07:
+		if err := fixed(12); err != nil {
+			return nil, 0, err
+		}
+		var id ObjectID
+		copy(id[:], data)
+		return id, 12, nil
+	case 0x08:
+		if err := fixed(1); err != nil {
+			return nil, 0, err
+		}
+		return data[0] != 0, 1, nil
+	case 0x09:
+		if err := fixed(8); err != nil {
+			return nil, 0, err
+		}
+		return time.UnixMilli(int64(binary.LittleEndian.Uint64(data))).UTC(), 8, nil
+	case 0x0a:
+		return nil, 0, nil
+	case 0x0b:
+		pattern := bytes.IndexByte(data, 0)
+		if pattern < 0 {
+			return nil, 0, fmt.Errorf("%w: unterminated regex", errInvalidBSON)
+		}
+		options := bytes.IndexByte(data[pattern+1:], 0)
+		if options < 0 {
+			return nil, 0, fmt.Errorf("%w: unterminated regex options", errInvalidBSON)
+		}
+		return Regex{Pattern: string(data[:pattern]), Options: string(data[pattern+1 : pattern+1+options])}, pattern + options + 2, nil
+	case 0x0c:
+		ns, n, err := decodeString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(data) < n+12 {
+			return nil, 0, fmt.Errorf("%w: short DBPointer", errInvalidBSON)
+		}
+		p := DBPointer{Namespace: ns}
+		copy(p.ID[:], data[n:])
+		return p, n + 12, nil
+	case 0x0f:
+		// 带作用域的代码：总长度、代码、作用域文档
+		if err := fixed(4); err != nil {
+			return nil, 0, err
+		}
+		size := int(int32(binary.LittleEndian.Uint32(data)))
+		if size < 4 || size > len(data) {
+			return nil, 0, fmt.Errorf("%w: code with scope size %d", errInvalidBSON, size)
+		}
+		code, _, err := decodeString(data[4:size])
+		if err != nil {
+			return nil, 0, err
+		}
+		return JavaScript(code), size, nil
+	case 0x10:
+		if err := fixed(4); err != nil {
+			return nil, 0, err
+		}
+		return int32(binary.LittleEndian.Uint32(data)), 4, nil
+	case 0x11:
+		if err := fixed(8); err != nil {
+			return nil, 0, err
+		}
+		return Timestamp{I: binary.LittleEndian.Uint32(data), T: binary.LittleEndian.Uint32(data[4:])}, 8, nil
+	case 0x12:
+		if err := fixed(8); err != nil {
+			return nil, 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(data)), 8, nil
+	case 0x13:
+		if err := fixed(16); err != nil {
+			return nil, 0, err
+		}
+		var d Decimal128
+		copy(d[:], data)
+		return d, 16, nil
+	case 0xff:
+		return MinKey{}, 0, nil
+	case 0x7f:
+		return MaxKey{}, 0, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown type 0x%02x", errInvalidBSON, typ)
+}
+
+// decodeString 解析int32长度（包含结尾的0）加字符串
+func decodeString(data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, fmt.Errorf("%w: short string", errInvalidBSON)
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 1 || 4+size > len(data) || data[3+size] != 0 {
+		return "", 0, fmt.Errorf("%w: string size %d", errInvalidBSON, size)
+	}
+	return string(data[4 : 3+size]), 4 + size, nil
+}
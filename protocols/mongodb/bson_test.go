@@ -0,0 +1,150 @@
+package mongodb
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode 把文档编码为BSON，只用于测试
+func encode(doc Document) []byte {
+	var body []byte
+	for _, e := range doc {
+		typ, value := encodeValue(e.Value)
+		body = append(append(append(body, typ), e.Key...), 0)
+		body = append(body, value...)
+	}
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5))
+	return append(append(out, body...), 0)
+}
+
+func encodeString(s string) []byte {
+	return append(append(binary.LittleEndian.AppendUint32(nil, uint32(len(s)+1)), s...), 0)
+}
+
+func encodeValue(v interface{}) (byte, []byte) {
+	switch v := v.(type) {
+	case float64:
+		return 0x01, binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	case string:
+		return 0x02, encodeString(v)
+	case Document:
+		return 0x03, encode(v)
+	case Array:
+		doc := make(Document, len(v))
+		for i, e := range v {
+			doc[i] = Element{Key: string(rune('0' + i)), Value: e}
+		}
+		return 0x04, encode(doc)
+	case Binary:
+		return 0x05, append(append(binary.LittleEndian.AppendUint32(nil, uint32(len(v.Data))), v.Subtype), v.Data...)
+	case Undefined:
+		return 0x06, nil
+	case ObjectID:
+		return 0x07, v[:]
+	case bool:
+		if v {
+			return 0x08, []byte{1}
+		}
+		return 0x08, []byte{0}
+	case time.Time:
+		return 0x09, binary.LittleEndian.AppendUint64(nil, uint64(v.UnixMilli()))
+	case nil:
+		return 0x0a, nil
+	case Regex:
+		return 0x0b, append(append(append([]byte(v.Pattern), 0), v.Options...), 0)
+	case JavaScript:
+		return 0x0d, encodeString(string(v))
+	case Symbol:
+		return 0x0e, encodeString(string(v))
+	case int32:
+		return 0x10, binary.LittleEndian.AppendUint32(nil, uint32(v))
+	case Timestamp:
+		return 0x11, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, v.I), v.T)
+	case int64:
+		return 0x12, binary.LittleEndian.AppendUint64(nil, uint64(v))
+	case Decimal128:
+		return 0x13, v[:]
+	case MinKey:
+		return 0xff, nil
+	case MaxKey:
+		return 0x7f, nil
+	}
+	panic("unsupported type")
+}
+
+func TestParseDocument(t *testing.T) {
+	doc := Document{
+		{"double", 1.5},
+		{"string", "héllo"},
+		{"doc", Document{{"$gt", int32(30)}}},
+		{"array", Array{int32(1), "two", Document{}}},
+		{"binary", Binary{Subtype: 4, Data: []byte{1, 2, 3}}},
+		{"undefined", Undefined{}},
+		{"_id", ObjectID{0x65, 0x5f, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"bool", true},
+		{"date", time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)},
+		{"null", nil},
+		{"regex", Regex{Pattern: "^a.*", Options: "i"}},
+		{"code", JavaScript("function() {}")},
+		{"symbol", Symbol("sym")},
+		{"int32", int32(-7)},
+		{"ts", Timestamp{T: 1700000000, I: 3}},
+		{"int64", int64(1) << 40},
+		{"decimal", Decimal128{1}},
+		{"min", MinKey{}},
+		{"max", MaxKey{}},
+	}
+	data := encode(doc)
+	parsed, n, err := parseDocument(append(data, 0xee))
+	if assert.NoError(t, err) {
+		assert.Equal(t, len(data), n)
+		assert.Equal(t, doc, parsed)
+	}
+
+	assert.Equal(t, `{double: 1.5, string: "héllo", doc: {$gt: 30}, array: [1, "two", {}], binary: BinData(4, "AQID"), `+
+		`undefined: undefined, _id: ObjectId("655f0102030405060708090a"), bool: true, date: ISODate("2024-01-02T03:04:05.006Z"), `+
+		`null: null, regex: /^a.*/i, code: Code("function() {}"), symbol: "sym", int32: -7, ts: Timestamp(1700000000, 3), `+
+		`int64: 1099511627776, decimal: NumberDecimal(0x01000000000000000000000000000000), min: MinKey, max: MaxKey}`, parsed.String())
+	assert.Equal(t, `{double: 1.5, s...`, parsed.Render(15))
+	assert.Equal(t, `{"a b": 1, "": 2, "1x": 3}`, Document{{"a b", int32(1)}, {"", int32(2)}, {"1x", int32(3)}}.String())
+
+	v, ok := parsed.Lookup("bool")
+	assert.True(t, ok)
+	assert.Equal(t, true, v)
+	assert.Equal(t, "héllo", parsed.GetString("string"))
+	assert.Empty(t, parsed.GetString("int32"))
+	n64, ok := parsed.GetInt("double")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), n64)
+	_, ok = parsed.GetInt("missing")
+	assert.False(t, ok)
+}
+
+func TestParseDocumentInvalid(t *testing.T) {
+	data := encode(Document{{"name", "value"}, {"n", int32(1)}})
+	for name, bad := range map[string][]byte{
+		"short":        data[:4],
+		"truncated":    data[:len(data)-1],
+		"no trailer":   append(append([]byte(nil), data[:len(data)-1]...), 1),
+		"string size":  append(append(append([]byte(nil), data[:11]...), 0x7f), data[12:]...),
+		"unknown type": append(append(append([]byte(nil), data[:4]...), 0x42), data[5:]...),
+	} {
+		_, _, err := parseDocument(bad)
+		assert.ErrorIs(t, err, errInvalidBSON, name)
+	}
+
+	// 超过最大深度的嵌套
+	doc := Document{}
+	for i := 0; i < maxDepth+2; i++ {
+		doc = Document{{"a", doc}}
+	}
+	_, _, err := parseDocument(encode(doc))
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "nesting too deep"))
+	}
+}
@@ -0,0 +1,242 @@
+// Package mongodb 提供MongoDB线协议的检测器和处理器
+// 解析OP_MSG和旧版的OP_QUERY/OP_REPLY（包括zlib压缩的OP_COMPRESSED），解码命令和响应的BSON文档，
+// 按requestID/responseTo配对请求和响应；每个命令以 Command 事件的形式交给回调，包含命令名、数据库、集合、错误和延迟
+package mongodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "MongoDB"
+
+// ServerError 命令失败时响应中的错误
+type ServerError struct {
+	Code     int64
+	CodeName string // 如 NamespaceNotFound，旧版服务器可能为空
+	Message  string
+}
+
+func (e *ServerError) Error() string {
+	if e.CodeName != "" {
+		return fmt.Sprintf("%s(%d): %s", e.CodeName, e.Code, e.Message)
+	}
+	return fmt.Sprintf("error %d: %s", e.Code, e.Message)
+}
+
+// Command 一个命令和它的响应
+// exhaust游标和流式hello的每个后续响应都作为单独的 Command 回调，请求时间为上一个响应的时间
+type Command struct {
+	StreamInfo tcpdumper.StreamInfo
+	RequestID  int32
+	OpCode     OpCode // 请求的消息类型，压缩的消息为原始类型
+	// Name 命令名，即命令文档的第一个键，如 find、insert、hello；
+	// OP_QUERY查询普通集合时为find，旧版的OP_INSERT等为对应的命令名；压缩算法不支持时为空
+	Name       string
+	Database   string
+	Collection string         // 命令作用的集合，没有时为空
+	Document   Document       // 命令文档：OP_MSG的类型0段或OP_QUERY的查询
+	Sequences  map[string]int // OP_MSG文档序列的标识符和文档数，如insert的documents
+	Compressor string         // 请求使用的压缩算法
+	MoreToCome bool           // 请求设置了moreToCome（如w:0的写入），服务器不响应
+
+	Reply    Document // 响应的第一个文档
+	Returned int      // 响应返回的文档数：游标的firstBatch/nextBatch，或OP_REPLY的numberReturned
+	Error    *ServerError
+
+	Complete     bool
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Latency 从请求到响应的时间
+func (c *Command) Latency() time.Duration {
+	if !c.Complete {
+		return 0
+	}
+	return c.ResponseTime.Sub(c.RequestTime)
+}
+
+// Namespace 返回 数据库.集合，没有集合时只返回数据库
+func (c *Command) Namespace() string {
+	if c.Collection == "" {
+		return c.Database
+	}
+	return c.Database + "." + c.Collection
+}
+
+// String 返回命令的摘要，如 find shop.users -> ok 3 docs (1.2ms)
+func (c *Command) String() string {
+	var b strings.Builder
+	switch {
+	case c.Name != "":
+		b.WriteString(c.Name)
+	case c.Compressor != "":
+		fmt.Fprintf(&b, "<%s %s>", c.OpCode, c.Compressor)
+	default:
+		fmt.Fprintf(&b, "<%s>", c.OpCode)
+	}
+	if ns := c.Namespace(); ns != "" {
+		fmt.Fprintf(&b, " %s", ns)
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Sequences)) {
+		fmt.Fprintf(&b, " %s=%d", id, c.Sequences[id])
+	}
+	switch {
+	case c.MoreToCome && !c.Complete:
+		b.WriteString(" -> <no reply expected>")
+		return b.String()
+	case !c.Complete:
+		b.WriteString(" -> <no reply>")
+		return b.String()
+	case c.Error != nil:
+		fmt.Fprintf(&b, " -> %s", c.Error)
+	default:
+		b.WriteString(" -> ok")
+		if c.Returned > 0 {
+			fmt.Fprintf(&b, " %d docs", c.Returned)
+		}
+		if n, ok := c.Reply.GetInt("n"); ok {
+			fmt.Fprintf(&b, " n=%d", n)
+		}
+	}
+	fmt.Fprintf(&b, " (%v)", c.Latency())
+	return b.String()
+}
+
+// Config MongoDB处理器配置
+type Config struct {
+	// OnCommand 收到响应、请求不需要响应或连接关闭时的回调，为nil时把摘要输出到Output
+	OnCommand func(*Command)
+	Output    io.Writer // 默认回调的输出，nil为标准输出
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnCommand == nil {
+		c.OnCommand = func(cmd *Command) {
+			fmt.Fprintf(w, "MONGODB/%s: %s\n", cmd.StreamInfo.Ident, cmd)
+		}
+	}
+	return c
+}
+
+// Detector MongoDB检测器
+// 客户端数据为OP_MSG（以命令文档开头）或OP_QUERY（带完整集合名）的请求时置信度为90，
+// 压缩了这两种消息的OP_COMPRESSED为80
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建MongoDB检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if dir != reassembly.TCPDirClientToServer || len(data) < headerLen+5 {
+		return 0
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	responseTo := binary.LittleEndian.Uint32(data[8:])
+	if length < headerLen+5 || length > maxMessageSize || responseTo != 0 {
+		return 0
+	}
+	body := data[headerLen:min(len(data), length)]
+	switch OpCode(binary.LittleEndian.Uint32(data[12:])) {
+	case OpMsg:
+		flags := binary.LittleEndian.Uint32(body)
+		if flags&^(flagChecksumPresent|flagMoreToCome|flagExhaustAllowed) != 0 || body[4] != 0 {
+			return 0
+		}
+		if len(body) >= 10 && !plausibleDocument(body[5:], length-headerLen-5) {
+			return 0
+		}
+		return 90
+	case OpQuery:
+		end := bytes.IndexByte(body[4:], 0)
+		if end <= 0 || end > 128 {
+			return 0
+		}
+		ns := string(body[4 : 4+end])
+		if !strings.Contains(ns, ".") || strings.ContainsFunc(ns, func(r rune) bool { return r < 0x20 || r > 0x7e }) {
+			return 0
+		}
+		return 90
+	case OpCompressed:
+		if len(body) < 9 || body[8] > 3 {
+			return 0
+		}
+		switch OpCode(binary.LittleEndian.Uint32(body)) {
+		case OpMsg, OpQuery:
+			return 80
+		}
+	}
+	return 0
+}
+
+// plausibleDocument 检查文档长度和第一个元素：合法的类型和可打印的键
+func plausibleDocument(data []byte, maxSize int) bool {
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > maxSize {
+		return false
+	}
+	if size == 5 {
+		return true
+	}
+	typ := data[4]
+	if typ == 0 || typ > 0x13 && typ != 0x7f && typ != 0xff {
+		return false
+	}
+	end := bytes.IndexByte(data[5:], 0)
+	if end == 0 {
+		return false
+	}
+	key := data[5:]
+	if end > 0 {
+		key = key[:end]
+	}
+	for _, c := range key {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), messageFramer)
+}
+
+// NewProcessor 创建MongoDB处理器，返回的处理器会先按消息头中的长度切分消息
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册MongoDB协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,253 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/internal/prototest"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+func cstr(s string) []byte { return append([]byte(s), 0) }
+
+// wireMessage 加上16字节消息头
+func wireMessage(requestID, responseTo int32, op OpCode, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return bytes.Join([][]byte{
+		le32(uint32(headerLen + len(body))), le32(uint32(requestID)), le32(uint32(responseTo)), le32(uint32(op)), body,
+	}, nil)
+}
+
+func opMsg(requestID, responseTo int32, flags uint32, doc Document) []byte {
+	return wireMessage(requestID, responseTo, OpMsg, le32(flags), []byte{0}, encode(doc))
+}
+
+// sequence OP_MSG的类型1段
+func sequence(id string, docs ...Document) []byte {
+	body := cstr(id)
+	for _, doc := range docs {
+		body = append(body, encode(doc)...)
+	}
+	return append(append([]byte{1}, le32(uint32(len(body)+4))...), body...)
+}
+
+func opQuery(requestID int32, ns string, doc Document) []byte {
+	return wireMessage(requestID, 0, OpQuery, le32(0), cstr(ns), le32(0), le32(0xffffffff), encode(doc))
+}
+
+func opReply(requestID, responseTo int32, flags uint32, docs ...Document) []byte {
+	parts := [][]byte{le32(flags), make([]byte, 12), le32(uint32(len(docs)))}
+	for _, doc := range docs {
+		parts = append(parts, encode(doc))
+	}
+	return wireMessage(requestID, responseTo, OpReply, parts...)
+}
+
+// compressed 把消息压缩为OP_COMPRESSED
+func compressed(data []byte, compressor byte) []byte {
+	payload := data[headerLen:]
+	if compressor == 2 {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(payload)
+		zw.Close()
+		payload = buf.Bytes()
+	}
+	requestID := int32(binary.LittleEndian.Uint32(data[4:]))
+	responseTo := int32(binary.LittleEndian.Uint32(data[8:]))
+	return wireMessage(requestID, responseTo, OpCompressed,
+		data[12:16], le32(uint32(len(data)-headerLen)), []byte{compressor}, payload)
+}
+
+func collect(config *Config) *[]*Command {
+	var commands []*Command
+	config.OnCommand = func(c *Command) {
+		commands = append(commands, c)
+	}
+	return &commands
+}
+
+var findUsers = Document{{"find", "users"}, {"filter", Document{{"age", Document{{"$gt", int32(30)}}}}}, {"$db", "shop"}}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	msg := opMsg(1, 0, 0, findUsers)
+	assert.Equal(t, 90, d.Detect(msg, c2s))
+	assert.Equal(t, 90, d.Detect(msg[:24], c2s))
+	assert.Equal(t, 90, d.Detect(opQuery(1, "admin.$cmd", Document{{"isMaster", int32(1)}}), c2s))
+	assert.Equal(t, 80, d.Detect(compressed(msg, 2), c2s))
+
+	assert.Equal(t, 0, d.Detect(msg, s2c))
+	assert.Equal(t, 0, d.Detect(opMsg(2, 1, 0, findUsers), c2s))
+	assert.Equal(t, 0, d.Detect(opMsg(1, 0, 1<<5, findUsers), c2s))
+	assert.Equal(t, 0, d.Detect(opQuery(1, "nodot", Document{{"a", int32(1)}}), c2s))
+	assert.Equal(t, 0, d.Detect(opReply(1, 0, 0, Document{}), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), c2s))
+	bad := append([]byte(nil), msg...)
+	bad[25] = 0x55 // 第一个元素的类型无效
+	assert.Equal(t, 0, d.Detect(bad, c2s))
+}
+
+func TestOpMsg(t *testing.T) {
+	config := Config{}
+	commands := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	insert := wireMessage(3, 0, OpMsg, le32(0), []byte{0},
+		encode(Document{{"insert", "users"}, {"ordered", true}, {"$db", "shop"}}),
+		sequence("documents", Document{{"_id", int32(1)}}, Document{{"_id", int32(2)}}))
+	prototest.Feed(t, p,
+		prototest.C2S(opMsg(1, 0, 0, findUsers)),
+		prototest.S2C(opMsg(100, 1, 0, Document{
+			{"cursor", Document{{"firstBatch", Array{Document{{"_id", int32(1)}}, Document{{"_id", int32(2)}}}}, {"id", int64(0)}, {"ns", "shop.users"}}},
+			{"ok", 1.0},
+		})),
+		prototest.C2S(insert),
+		prototest.S2C(opMsg(101, 3, 0, Document{{"n", int32(2)}, {"ok", 1.0}})),
+		// 两个请求的响应顺序与请求相反
+		prototest.C2S(opMsg(4, 0, 0, Document{{"count", "orders"}, {"$db", "shop"}}),
+			opMsg(5, 0, 0, Document{{"drop", "missing"}, {"$db", "shop"}})),
+		prototest.S2C(opMsg(102, 5, 0, Document{{"ok", 0.0}, {"errmsg", "ns not found"}, {"code", int32(26)}, {"codeName", "NamespaceNotFound"}}),
+			opMsg(103, 4, 0, Document{{"n", int32(7)}, {"ok", 1.0}})),
+		prototest.C2S(opMsg(6, 0, 0, Document{{"insert", "users"}, {"documents", Array{Document{{"_id", int32(1)}}}}, {"$db", "shop"}})),
+		prototest.S2C(opMsg(104, 6, 0, Document{{"n", int32(0)}, {"writeErrors", Array{Document{
+			{"index", int32(0)}, {"code", int32(11000)}, {"errmsg", "E11000 duplicate key error"},
+		}}}, {"ok", 1.0}})),
+		// w:0的写入不需要响应
+		prototest.C2S(opMsg(7, 0, flagMoreToCome, Document{{"delete", "sessions"}, {"$db", "shop"}}),
+			opMsg(8, 0, 0, Document{{"getMore", int64(42)}, {"collection", "events"}, {"$db", "shop"}})),
+	)
+	assert.NoError(t, p.Close())
+
+	if assert.Len(t, *commands, 7) {
+		c := (*commands)[0]
+		assert.Equal(t, OpMsg, c.OpCode)
+		assert.Equal(t, int32(1), c.RequestID)
+		assert.Equal(t, "find", c.Name)
+		assert.Equal(t, "shop", c.Database)
+		assert.Equal(t, "users", c.Collection)
+		assert.Equal(t, findUsers, c.Document)
+		assert.Equal(t, 2, c.Returned)
+		assert.Equal(t, time.Millisecond, c.Latency())
+		assert.Equal(t, "find shop.users -> ok 2 docs (1ms)", c.String())
+
+		assert.Equal(t, map[string]int{"documents": 2}, (*commands)[1].Sequences)
+		assert.Equal(t, "insert shop.users documents=2 -> ok n=2 (1ms)", (*commands)[1].String())
+
+		c = (*commands)[2]
+		if assert.NotNil(t, c.Error) {
+			assert.Equal(t, int64(26), c.Error.Code)
+		}
+		assert.Equal(t, "drop shop.missing -> NamespaceNotFound(26): ns not found (1ms)", c.String())
+		assert.Equal(t, "count shop.orders -> ok n=7 (3ms)", (*commands)[3].String())
+		assert.Equal(t, "insert shop.users -> error 11000: E11000 duplicate key error (1ms)", (*commands)[4].String())
+		assert.Equal(t, "delete shop.sessions -> <no reply expected>", (*commands)[5].String())
+		assert.Equal(t, "getMore shop.events -> <no reply>", (*commands)[6].String())
+	}
+}
+
+func TestExhaust(t *testing.T) {
+	config := Config{}
+	commands := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	// 流式hello：每个响应设置moreToCome，下一个响应的responseTo是上一个响应的requestID
+	prototest.Feed(t, p,
+		prototest.C2S(opMsg(1, 0, flagExhaustAllowed, Document{{"hello", int32(1)}, {"topologyVersion", Document{}}, {"$db", "admin"}})),
+		prototest.S2C(opMsg(100, 1, flagMoreToCome, Document{{"isWritablePrimary", true}, {"ok", 1.0}}),
+			opMsg(101, 100, flagMoreToCome, Document{{"isWritablePrimary", true}, {"ok", 1.0}}),
+			opMsg(102, 101, 0, Document{{"isWritablePrimary", false}, {"ok", 1.0}})),
+	)
+	if assert.Len(t, *commands, 3) {
+		for i, c := range *commands {
+			assert.Equal(t, int32(1), c.RequestID)
+			assert.Equal(t, "hello admin -> ok (1ms)", c.String())
+			assert.Equal(t, prototest.Start.Add(time.Duration(i)*time.Millisecond), c.RequestTime)
+		}
+		v, _ := (*commands)[2].Reply.Lookup("isWritablePrimary")
+		assert.Equal(t, false, v)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	config := Config{}
+	commands := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	prototest.Feed(t, p,
+		prototest.C2S(opQuery(1, "admin.$cmd", Document{{"$query", Document{{"isMaster", int32(1)}, {"client", Document{}}}}, {"$readPreference", Document{{"mode", "primary"}}}})),
+		prototest.S2C(opReply(100, 1, 0, Document{{"ismaster", true}, {"maxWireVersion", int32(6)}, {"ok", 1.0}})),
+		prototest.C2S(opQuery(2, "shop.users", Document{{"name", "alice"}})),
+		prototest.S2C(opReply(101, 2, 0, Document{{"_id", int32(1)}}, Document{{"_id", int32(2)}}, Document{{"_id", int32(3)}})),
+		prototest.C2S(opQuery(3, "shop.users", Document{{"$where", "sleep(1)"}})),
+		prototest.S2C(opReply(102, 3, replyQueryFailure, Document{{"$err", "$where is not allowed"}, {"code", int32(2)}})),
+		prototest.C2S(wireMessage(4, 0, OpInsert, le32(0), cstr("shop.logs"), encode(Document{{"a", int32(1)}}), encode(Document{{"a", int32(2)}}))),
+	)
+	if assert.Len(t, *commands, 4) {
+		c := (*commands)[0]
+		assert.Equal(t, OpQuery, c.OpCode)
+		assert.Equal(t, Document{{"isMaster", int32(1)}, {"client", Document{}}}, c.Document)
+		assert.Equal(t, "isMaster admin -> ok (1ms)", c.String())
+		assert.Equal(t, "find shop.users -> ok 3 docs (1ms)", (*commands)[1].String())
+		assert.Equal(t, "find shop.users -> error 2: $where is not allowed (1ms)", (*commands)[2].String())
+		assert.Equal(t, "insert shop.logs documents=2 -> <no reply expected>", (*commands)[3].String())
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	config := Config{}
+	commands := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	prototest.Feed(t, p,
+		prototest.C2S(compressed(opMsg(1, 0, 0, findUsers), 2)),
+		prototest.S2C(compressed(opMsg(100, 1, 0, Document{{"cursor", Document{{"firstBatch", Array{}}}}, {"ok", 1.0}}), 0)),
+		// snappy不支持解压，只按消息头配对
+		prototest.C2S(compressed(opMsg(2, 0, 0, findUsers), 1)),
+		prototest.S2C(compressed(opMsg(101, 2, 0, Document{{"ok", 1.0}}), 1)),
+	)
+	if assert.Len(t, *commands, 2) {
+		c := (*commands)[0]
+		assert.Equal(t, "zlib", c.Compressor)
+		assert.Equal(t, "find shop.users -> ok (1ms)", c.String())
+		assert.Equal(t, "<OP_MSG snappy> -> ok (1ms)", (*commands)[1].String())
+	}
+
+	// 消息体无效时仍然配对并返回错误
+	*commands = nil
+	bad := opMsg(3, 0, 0, findUsers)
+	bad[len(bad)-1] = 1
+	assert.Error(t, p.ProcessData(bad, c2s, false, false))
+	assert.NoError(t, p.ProcessData(opMsg(102, 3, 0, Document{{"ok", 1.0}}), s2c, false, false))
+	if assert.Len(t, *commands, 1) {
+		assert.Regexp(t, `^<OP_MSG> -> ok \(`, (*commands)[0].String())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:27017"}, nil)
+	req := opMsg(1, 0, 0, findUsers)
+	assert.NoError(t, d.ProcessData(req[:30], c2s, true, false))
+	assert.NoError(t, d.ProcessData(req[30:], c2s, false, false))
+	assert.NoError(t, d.ProcessData(opMsg(100, 1, 0, Document{{"ok", 1.0}}), s2c, true, false))
+	assert.NoError(t, d.ProcessData(opMsg(2, 0, 0, Document{{"ping", int32(1)}, {"$db", "admin"}}), c2s, false, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^MONGODB/a:1-b:27017: find shop.users -> ok \(.+\)\n`+
+		`MONGODB/a:1-b:27017: ping admin -> <no reply>\n$`, out.String())
+}
@@ -0,0 +1,240 @@
+package mongodb
+
+import (
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxPending 等待响应的请求数上限，超过时最早的请求按没有响应回调
+const maxPending = 10000
+
+// legacyCommands 旧版消息类型对应的命令名
+var legacyCommands = map[OpCode]string{
+	OpGetMore:     "getMore",
+	OpInsert:      "insert",
+	OpUpdate:      "update",
+	OpDelete:      "delete",
+	OpKillCursors: "killCursors",
+}
+
+// pendingCommand 等待响应的命令
+type pendingCommand struct {
+	responseTo  int32 // 响应中的responseTo：请求的requestID，exhaust的后续响应为上一个响应的requestID
+	cmd         *Command
+	legacyQuery bool // 用OP_QUERY查询普通集合，OP_REPLY中的文档是查询结果而不是命令响应
+}
+
+// processor MongoDB处理器，每次调用必须是一条完整的消息，由 FramedProcessor 包装
+// 客户端可以在收到响应之前发送多个请求（如不同游标的getMore），按responseTo查找对应的请求
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	pending    []*pendingCommand
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{streamInfo: streamInfo, config: config}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一条带时间戳的消息，没有时间戳时使用当前时间
+// 消息体无法解析时仍按消息头配对，并返回解析错误
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	m, err := parseMessage(data)
+	if m == nil {
+		return err
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if dir == reassembly.TCPDirClientToServer {
+		p.request(m, ts)
+	} else {
+		p.reply(m, ts)
+	}
+	return err
+}
+
+// request 处理客户端的请求
+func (p *processor) request(m *message, ts time.Time) {
+	c := &Command{
+		StreamInfo:  p.streamInfo,
+		RequestID:   m.requestID,
+		OpCode:      m.opCode,
+		Compressor:  m.compressor,
+		MoreToCome:  m.moreToCome,
+		RequestTime: ts,
+	}
+	pc := &pendingCommand{responseTo: m.requestID, cmd: c}
+	if m.decoded {
+		pc.legacyQuery = describe(c, m)
+	}
+	if _, ok := legacyCommands[m.opCode]; ok && m.opCode != OpGetMore {
+		// 旧版的写操作和killCursors没有响应
+		c.MoreToCome = true
+	}
+	if c.MoreToCome {
+		p.config.OnCommand(c)
+		return
+	}
+	p.push(pc)
+}
+
+// describe 从请求中取出命令名、数据库、集合和命令文档，OP_QUERY查询普通集合时返回true
+func describe(c *Command, m *message) bool {
+	switch m.opCode {
+	case OpMsg:
+		c.Document, c.Sequences = m.body, m.sequences
+		c.Database = m.body.GetString("$db")
+		c.Name, c.Collection = commandName(m.body)
+	case OpQuery:
+		db, coll := splitNamespace(m.namespace)
+		c.Database, c.Document = db, m.body
+		if coll != "$cmd" {
+			c.Name, c.Collection = "find", coll
+			return true
+		}
+		// 带读偏好等选项的命令被包装在 $query 中
+		if len(m.body) > 0 && (m.body[0].Key == "$query" || m.body[0].Key == "query") {
+			if inner, ok := m.body[0].Value.(Document); ok {
+				c.Document = inner
+			}
+		}
+		c.Name, c.Collection = commandName(c.Document)
+	default:
+		c.Database, c.Collection = splitNamespace(m.namespace)
+		c.Name = legacyCommands[m.opCode]
+		if m.opCode == OpInsert {
+			c.Sequences = map[string]int{"documents": m.documents}
+		}
+	}
+	return false
+}
+
+// commandName 命令名是命令文档的第一个键，值为字符串时是集合名
+func commandName(doc Document) (string, string) {
+	if len(doc) == 0 {
+		return "", ""
+	}
+	name := doc[0].Key
+	var coll string
+	switch v := doc[0].Value.(type) {
+	case string:
+		coll = v
+	case Document:
+		if name == "explain" {
+			_, coll = commandName(v)
+		}
+	}
+	if name == "getMore" {
+		coll = doc.GetString("collection")
+	}
+	return name, coll
+}
+
+// push 把请求加入等待队列
+func (p *processor) push(pc *pendingCommand) {
+	if len(p.pending) >= maxPending {
+		p.config.OnCommand(p.pending[0].cmd)
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, pc)
+}
+
+// reply 处理服务器的响应
+func (p *processor) reply(m *message, ts time.Time) {
+	var pc *pendingCommand
+	for i, v := range p.pending {
+		if v.responseTo == m.responseTo {
+			pc = v
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+	if pc == nil {
+		return
+	}
+
+	c := pc.cmd
+	c.Complete, c.ResponseTime = true, ts
+	if m.decoded {
+		result(c, m, pc.legacyQuery)
+	}
+	p.config.OnCommand(c)
+
+	if m.moreToCome {
+		// exhaust游标或流式hello：服务器会继续发送以本响应的requestID为responseTo的响应
+		next := *c
+		next.Reply, next.Returned, next.Error = nil, 0, nil
+		next.Complete, next.RequestTime, next.ResponseTime = false, ts, time.Time{}
+		p.push(&pendingCommand{responseTo: m.requestID, cmd: &next, legacyQuery: pc.legacyQuery})
+	}
+}
+
+// result 从响应中取出返回的文档数和错误
+func result(c *Command, m *message, legacyQuery bool) {
+	doc := m.body
+	c.Reply = doc
+	if m.opCode == OpReply {
+		if m.flags&replyQueryFailure != 0 {
+			code, _ := doc.GetInt("code")
+			c.Error = &ServerError{Code: code, Message: doc.GetString("$err")}
+			return
+		}
+		if legacyQuery {
+			c.Returned = int(m.returned)
+			return
+		}
+	}
+
+	if ok, found := doc.GetInt("ok"); found && ok == 0 {
+		c.Error = commandError(doc)
+	} else if errs, _ := doc.Lookup("writeErrors"); len(asArray(errs)) > 0 {
+		// 写操作的ok为1，部分文档失败时错误在writeErrors中，只保留第一个
+		if first, ok := asArray(errs)[0].(Document); ok {
+			c.Error = commandError(first)
+		}
+	} else if wce, ok := doc.Lookup("writeConcernError"); ok {
+		if wce, ok := wce.(Document); ok {
+			c.Error = commandError(wce)
+		}
+	}
+
+	if cursor, ok := doc.Lookup("cursor"); ok {
+		if cursor, ok := cursor.(Document); ok {
+			batch, found := cursor.Lookup("firstBatch")
+			if !found {
+				batch, _ = cursor.Lookup("nextBatch")
+			}
+			c.Returned = len(asArray(batch))
+		}
+	}
+}
+
+// commandError 从命令响应或writeErrors的元素中取出错误
+func commandError(doc Document) *ServerError {
+	code, _ := doc.GetInt("code")
+	return &ServerError{Code: code, CodeName: doc.GetString("codeName"), Message: doc.GetString("errmsg")}
+}
+
+func asArray(v interface{}) Array {
+	arr, _ := v.(Array)
+	return arr
+}
+
+func (p *processor) Close() error {
+	for _, pc := range p.pending {
+		p.config.OnCommand(pc.cmd)
+	}
+	p.pending = nil
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
@@ -0,0 +1,318 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/LubyRuffy/tcpdumper"
+)
+
+const (
+	headerLen      = 16
+	maxMessageSize = 48000000 // 服务器的maxMessageSizeBytes
+)
+
+// OpCode 消息类型
+type OpCode int32
+
+// 消息类型
+const (
+	OpReply       OpCode = 1
+	OpUpdate      OpCode = 2001
+	OpInsert      OpCode = 2002
+	OpQuery       OpCode = 2004
+	OpGetMore     OpCode = 2005
+	OpDelete      OpCode = 2006
+	OpKillCursors OpCode = 2007
+	OpCompressed  OpCode = 2012
+	OpMsg         OpCode = 2013
+)
+
+var opCodeNames = map[OpCode]string{
+	OpReply:       "OP_REPLY",
+	OpUpdate:      "OP_UPDATE",
+	OpInsert:      "OP_INSERT",
+	OpQuery:       "OP_QUERY",
+	OpGetMore:     "OP_GET_MORE",
+	OpDelete:      "OP_DELETE",
+	OpKillCursors: "OP_KILL_CURSORS",
+	OpCompressed:  "OP_COMPRESSED",
+	OpMsg:         "OP_MSG",
+}
+
+func (o OpCode) String() string {
+	if name, ok := opCodeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_%d", int32(o))
+}
+
+// OP_MSG的标志位
+const (
+	flagChecksumPresent = 1 << 0
+	flagMoreToCome      = 1 << 1
+	flagExhaustAllowed  = 1 << 16
+)
+
+// OP_REPLY的QueryFailure标志位，第一个文档包含$err
+const replyQueryFailure = 1 << 1
+
+// compressors OP_COMPRESSED的压缩算法
+var compressors = map[byte]string{0: "noop", 1: "snappy", 2: "zlib", 3: "zstd"}
+
+var errShortMessage = errors.New("short message")
+
+// message 解析后的消息
+type message struct {
+	requestID  int32
+	responseTo int32
+	opCode     OpCode // OP_COMPRESSED为原始的消息类型
+	compressor string // OP_COMPRESSED的压缩算法
+	decoded    bool   // 消息体是否已解析，压缩算法不支持时为false
+
+	flags      uint32         // OP_MSG的标志位、OP_QUERY和OP_REPLY的flags
+	body       Document       // OP_MSG的类型0段、OP_QUERY的查询、OP_REPLY的第一个文档
+	sequences  map[string]int // OP_MSG类型1段的标识符和文档数
+	namespace  string         // 旧版消息的完整集合名，如 shop.users 或 admin.$cmd
+	returned   int32          // OP_REPLY返回的文档数
+	documents  int            // OP_INSERT插入的文档数
+	moreToCome bool           // OP_MSG设置了moreToCome
+}
+
+// parseMessage 解析一条完整的消息（含16字节消息头）
+func parseMessage(data []byte) (*message, error) {
+	if len(data) < headerLen {
+		return nil, errShortMessage
+	}
+	m := &message{
+		requestID:  int32(binary.LittleEndian.Uint32(data[4:])),
+		responseTo: int32(binary.LittleEndian.Uint32(data[8:])),
+		opCode:     OpCode(binary.LittleEndian.Uint32(data[12:])),
+	}
+	body := data[headerLen:]
+	if m.opCode == OpCompressed {
+		if len(body) < 9 {
+			return nil, errShortMessage
+		}
+		m.opCode = OpCode(binary.LittleEndian.Uint32(body))
+		size := int(int32(binary.LittleEndian.Uint32(body[4:])))
+		id := body[8]
+		m.compressor = compressors[id]
+		if m.compressor == "" {
+			m.compressor = fmt.Sprintf("compressor-%d", id)
+		}
+		var err error
+		if body, err = decompress(id, body[9:], size); err != nil {
+			return m, err
+		}
+		if body == nil {
+			return m, nil
+		}
+	}
+	if err := m.parseBody(body); err != nil {
+		return m, fmt.Errorf("%s: %w", m.opCode, err)
+	}
+	m.decoded = true
+	return m, nil
+}
+
+// decompress 解压OP_COMPRESSED的消息体，不支持的压缩算法（snappy、zstd）返回nil
+func decompress(id byte, data []byte, size int) ([]byte, error) {
+	if size < 0 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid uncompressed size %d", size)
+	}
+	switch id {
+	case 0:
+		return data, nil
+	case 2:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+		out := make([]byte, size)
+		if _, err := io.ReadFull(zr, out); err != nil {
+			return nil, fmt.Errorf("zlib: %w", err)
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// parseBody 按消息类型解析消息体
+func (m *message) parseBody(data []byte) error {
+	r := &byteReader{data: data, ok: true}
+	switch m.opCode {
+	case OpMsg:
+		return m.parseMsg(r)
+	case OpQuery:
+		m.flags = r.u32()
+		m.namespace = r.cstring()
+		r.u32() // numberToSkip
+		r.u32() // numberToReturn
+		m.body = r.document()
+	case OpReply:
+		m.flags = r.u32()
+		r.bytes(8) // cursorID
+		r.bytes(4) // startingFrom
+		m.returned = int32(r.u32())
+		if m.returned > 0 {
+			m.body = r.document()
+		}
+	case OpGetMore, OpUpdate, OpDelete:
+		r.u32() // ZERO
+		m.namespace = r.cstring()
+	case OpInsert:
+		m.flags = r.u32()
+		m.namespace = r.cstring()
+		for r.ok && len(r.data) > 0 {
+			r.skipDocument()
+			m.documents++
+		}
+	case OpKillCursors:
+	default:
+		return fmt.Errorf("unknown opcode %d", int32(m.opCode))
+	}
+	return r.err()
+}
+
+// parseMsg 解析OP_MSG：标志位、若干段和可选的CRC-32C校验和
+func (m *message) parseMsg(r *byteReader) error {
+	m.flags = r.u32()
+	m.moreToCome = m.flags&flagMoreToCome != 0
+	if m.flags&flagChecksumPresent != 0 {
+		if len(r.data) < 4 {
+			return errShortMessage
+		}
+		r.data = r.data[:len(r.data)-4]
+	}
+	for r.ok && len(r.data) > 0 {
+		switch kind := r.u8(); kind {
+		case 0:
+			m.body = r.document()
+		case 1:
+			// 文档序列：长度（包含自身）、标识符和连续的文档
+			size := int(int32(r.u32()))
+			seq := &byteReader{data: r.bytes(size - 4), ok: r.ok}
+			id := seq.cstring()
+			n := 0
+			for seq.ok && len(seq.data) > 0 {
+				seq.skipDocument()
+				n++
+			}
+			if err := seq.err(); err != nil {
+				return fmt.Errorf("document sequence %q: %w", id, err)
+			}
+			if m.sequences == nil {
+				m.sequences = make(map[string]int)
+			}
+			m.sequences[id] += n
+		default:
+			return fmt.Errorf("unknown section kind %d", kind)
+		}
+	}
+	if m.body == nil && r.ok {
+		return errors.New("missing body section")
+	}
+	return r.err()
+}
+
+// splitNamespace 把完整的集合名拆成数据库名和集合名
+func splitNamespace(ns string) (string, string) {
+	db, coll, _ := strings.Cut(ns, ".")
+	return db, coll
+}
+
+// byteReader 消息读取器，读取越界或文档无效时ok变为false
+type byteReader struct {
+	data []byte
+	ok   bool
+	bad  error
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) u32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *byteReader) cstring() string {
+	i := bytes.IndexByte(r.data, 0)
+	if !r.ok || i < 0 {
+		r.ok = false
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+// document 解析一个BSON文档
+func (r *byteReader) document() Document {
+	if !r.ok {
+		return nil
+	}
+	doc, n, err := parseDocument(r.data)
+	if err != nil {
+		r.ok, r.bad = false, err
+		return nil
+	}
+	r.data = r.data[n:]
+	return doc
+}
+
+// skipDocument 跳过一个BSON文档而不解析
+func (r *byteReader) skipDocument() {
+	if len(r.data) < 5 {
+		r.ok = false
+		return
+	}
+	size := int(int32(binary.LittleEndian.Uint32(r.data)))
+	if size < 5 {
+		r.ok, r.bad = false, fmt.Errorf("%w: document size %d", errInvalidBSON, size)
+		return
+	}
+	r.bytes(size)
+}
+
+func (r *byteReader) err() error {
+	switch {
+	case r.bad != nil:
+		return r.bad
+	case !r.ok:
+		return errShortMessage
+	}
+	return nil
+}
+
+// messageFramer 按消息头中包含自身的4字节小端长度切分消息
+var messageFramer, _ = tcpdumper.NewLengthPrefixFramer(tcpdumper.LengthPrefixConfig{
+	LengthSize:   4,
+	ByteOrder:    binary.LittleEndian,
+	LengthAdjust: -4,
+	MaxMessage:   maxMessageSize,
+})
@@ -0,0 +1,231 @@
+// Package mqtt 提供MQTT（3.1、3.1.1和5.0）协议的检测器和处理器
+// 按固定报头中的变长剩余长度切分控制报文，解析全部15种控制报文和MQTT 5的属性；
+// 每个报文以 Packet 事件的形式交给回调，包含客户端标识符、主题、QoS、保留标志和负载大小
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "MQTT"
+
+// Will CONNECT中的遗嘱消息
+type Will struct {
+	Topic       string
+	QoS         byte
+	Retain      bool
+	PayloadSize int
+	Properties  Properties // MQTT 5的遗嘱属性
+}
+
+// Subscription SUBSCRIBE中的一个订阅，UNSUBSCRIBE只有主题过滤器
+type Subscription struct {
+	Topic             string
+	QoS               byte
+	NoLocal           bool // 以下为MQTT 5的订阅选项
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// Packet 一个控制报文
+type Packet struct {
+	StreamInfo tcpdumper.StreamInfo
+	FromClient bool
+	Type       PacketType
+	Version    byte // 连接的协议级别，没有看到CONNECT时按3.1.1解析
+	Size       int  // 包括固定报头的报文长度
+	// ClientID 客户端标识符：CONNECT中的标识符，客户端未提供时为CONNACK中服务器分配的标识符；
+	// 连接上之后的每个报文都带有该字段
+	ClientID string
+	PacketID uint16
+
+	// PUBLISH，使用主题别名时Topic为别名对应的主题
+	Topic       string
+	QoS         byte
+	Retain      bool
+	Dup         bool
+	PayloadSize int
+
+	// CONNECT，不保存密码
+	CleanStart  bool // 3.x的clean session
+	KeepAlive   uint16
+	Username    string
+	HasPassword bool
+	Will        *Will
+
+	SessionPresent bool         // CONNACK
+	ReasonCode     ReasonCode   // CONNACK的返回码，MQTT 5的PUBACK、PUBREC、PUBREL、PUBCOMP、DISCONNECT和AUTH的原因码
+	ReasonCodes    []ReasonCode // SUBACK和UNSUBACK中每个订阅的结果
+	Subscriptions  []Subscription
+	Properties     Properties // MQTT 5的属性
+
+	Error error // 报文解析错误，字段只包含出错之前解析的部分
+	Time  time.Time
+}
+
+// String 返回报文的摘要，> 为客户端发出，< 为服务器发出，如 > PUBLISH sensors/temp qos=1 id=7 retain 12B
+func (p *Packet) String() string {
+	var b strings.Builder
+	if p.FromClient {
+		b.WriteString("> ")
+	} else {
+		b.WriteString("< ")
+	}
+	b.WriteString(p.Type.String())
+	v5 := p.Version == Version5
+	switch p.Type {
+	case Connect:
+		fmt.Fprintf(&b, " v%d client=%q", p.Version, p.ClientID)
+		if p.Username != "" {
+			fmt.Fprintf(&b, " user=%q", p.Username)
+		}
+		fmt.Fprintf(&b, " keepalive=%d", p.KeepAlive)
+		if p.CleanStart {
+			b.WriteString(" clean")
+		}
+		if p.Will != nil {
+			fmt.Fprintf(&b, " will=%s", p.Will.Topic)
+		}
+	case Connack:
+		if name, ok := connackReturnCodes[p.ReasonCode]; ok && !v5 {
+			fmt.Fprintf(&b, " %s", name)
+		} else {
+			fmt.Fprintf(&b, " %s", p.ReasonCode)
+		}
+		if p.SessionPresent {
+			b.WriteString(" session-present")
+		}
+	case Publish:
+		fmt.Fprintf(&b, " %s qos=%d", p.Topic, p.QoS)
+		if p.QoS > 0 {
+			fmt.Fprintf(&b, " id=%d", p.PacketID)
+		}
+		if p.Retain {
+			b.WriteString(" retain")
+		}
+		if p.Dup {
+			b.WriteString(" dup")
+		}
+		fmt.Fprintf(&b, " %dB", p.PayloadSize)
+	case Puback, Pubrec, Pubrel, Pubcomp:
+		fmt.Fprintf(&b, " id=%d", p.PacketID)
+		if p.ReasonCode != 0 {
+			fmt.Fprintf(&b, " %s", p.ReasonCode)
+		}
+	case Subscribe, Unsubscribe:
+		fmt.Fprintf(&b, " id=%d", p.PacketID)
+		for _, s := range p.Subscriptions {
+			fmt.Fprintf(&b, " %s", s.Topic)
+			if p.Type == Subscribe {
+				fmt.Fprintf(&b, ":%d", s.QoS)
+			}
+		}
+	case Suback, Unsuback:
+		fmt.Fprintf(&b, " id=%d", p.PacketID)
+		if len(p.ReasonCodes) > 0 {
+			b.WriteString(" [")
+			for i, c := range p.ReasonCodes {
+				if i > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(c.String())
+			}
+			b.WriteByte(']')
+		}
+	case Disconnect, Auth:
+		if p.ReasonCode != 0 || p.Type == Auth {
+			fmt.Fprintf(&b, " %s", p.ReasonCode)
+		}
+	}
+	if len(p.Properties) > 0 {
+		fmt.Fprintf(&b, " %s", p.Properties)
+	}
+	if p.Error != nil {
+		fmt.Fprintf(&b, " <%v>", p.Error)
+	}
+	return b.String()
+}
+
+// Config MQTT处理器配置
+type Config struct {
+	// OnPacket 每个控制报文的回调，为nil时把摘要输出到Output
+	OnPacket func(*Packet)
+	Output   io.Writer // 默认回调的输出，nil为标准输出
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnPacket == nil {
+		c.OnPacket = func(p *Packet) {
+			fmt.Fprintf(w, "MQTT/%s: %s\n", p.StreamInfo.Ident, p)
+		}
+	}
+	return c
+}
+
+// Detector MQTT检测器
+// 客户端数据以CONNECT报文开头（协议名为MQTT或MQIsdp且协议级别匹配）时置信度为90
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建MQTT检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if dir != reassembly.TCPDirClientToServer || len(data) < 2 || data[0] != byte(Connect)<<4 {
+		return 0
+	}
+	length, n := decodeVarint(data[1:])
+	if n <= 0 || length < 10 {
+		return 0
+	}
+	header := string(data[1+n : min(len(data), 1+n+9)])
+	switch {
+	case strings.HasPrefix(header, "\x00\x04MQTT") && len(header) >= 7:
+		if level := header[6]; level == Version311 || level == Version5 {
+			return 90
+		}
+	case strings.HasPrefix(header, "\x00\x06MQIsdp") && len(header) == 9:
+		if header[8] == Version31 {
+			return 90
+		}
+	}
+	return 0
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), packetFramer{})
+}
+
+// NewProcessor 创建MQTT处理器，返回的处理器会先按剩余长度切分控制报文
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册MQTT协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,248 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/internal/prototest"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func str(s string) []byte  { return append(be16(uint16(len(s))), s...) }
+
+func varint(v int) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v > 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+// packet 加上固定报头
+func packet(header byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(append([]byte{header}, varint(len(body))...), body...)
+}
+
+// props MQTT 5的属性：长度加上编码好的属性
+func props(parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(varint(len(body)), body...)
+}
+
+func collect(config *Config) *[]*Packet {
+	var packets []*Packet
+	config.OnPacket = func(p *Packet) {
+		packets = append(packets, p)
+	}
+	return &packets
+}
+
+// connect311 带遗嘱、用户名和密码的3.1.1 CONNECT
+var connect311 = packet(0x10, str("MQTT"), []byte{4, 0xee}, be16(60),
+	str("sensor-1"), str("status/sensor-1"), str("offline"), str("gw"), str("secret"))
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	assert.Equal(t, 90, d.Detect(connect311, c2s))
+	assert.Equal(t, 90, d.Detect(connect311[:9], c2s))
+	assert.Equal(t, 90, d.Detect(packet(0x10, str("MQIsdp"), []byte{3, 2}, be16(10), str("old")), c2s))
+	assert.Equal(t, 90, d.Detect(packet(0x10, str("MQTT"), []byte{5, 2}, be16(10), props(), str("")), c2s))
+
+	assert.Equal(t, 0, d.Detect(connect311, s2c))
+	assert.Equal(t, 0, d.Detect(connect311[:6], c2s))
+	assert.Equal(t, 0, d.Detect(packet(0x10, str("MQTT"), []byte{6, 2}, be16(10), str("x")), c2s))
+	assert.Equal(t, 0, d.Detect(packet(0x30, str("MQTT"), []byte{4, 2}, be16(10), str("x")), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), c2s))
+}
+
+func TestMQTT311(t *testing.T) {
+	config := Config{}
+	packets := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	payload := bytes.Repeat([]byte("x"), 200) // 剩余长度需要两个字节
+	prototest.Feed(t, p,
+		prototest.C2S(connect311),
+		prototest.S2C(packet(0x20, []byte{1, 0})),
+		prototest.C2S(packet(0x82, be16(1), str("sensors/#"), []byte{1}, str("cmd/sensor-1"), []byte{2})),
+		prototest.S2C(packet(0x90, be16(1), []byte{1, 0x80})),
+		prototest.C2S(packet(0x3b, str("sensors/temp"), be16(7), payload)),
+		prototest.S2C(packet(0x40, be16(7))),
+		prototest.C2S(packet(0x30, str("sensors/hum"), []byte("42")),
+			packet(0xa2, be16(2), str("sensors/#"))),
+		prototest.S2C(packet(0xb0, be16(2))),
+		prototest.C2S(packet(0xc0)),
+		prototest.S2C(packet(0xd0)),
+		prototest.C2S(packet(0xe0)),
+	)
+
+	var lines []string
+	for _, pkt := range *packets {
+		lines = append(lines, pkt.String())
+		assert.Equal(t, "sensor-1", pkt.ClientID)
+		assert.NoError(t, pkt.Error)
+	}
+	assert.Equal(t, []string{
+		`> CONNECT v4 client="sensor-1" user="gw" keepalive=60 clean will=status/sensor-1`,
+		`< CONNACK Accepted session-present`,
+		`> SUBSCRIBE id=1 sensors/#:1 cmd/sensor-1:2`,
+		`< SUBACK id=1 [GrantedQoS1 UnspecifiedError]`,
+		`> PUBLISH sensors/temp qos=1 id=7 retain dup 200B`,
+		`< PUBACK id=7`,
+		`> PUBLISH sensors/hum qos=0 2B`,
+		`> UNSUBSCRIBE id=2 sensors/#`,
+		`< UNSUBACK id=2`,
+		`> PINGREQ`,
+		`< PINGRESP`,
+		`> DISCONNECT`,
+	}, lines)
+
+	if assert.Len(t, *packets, 12) {
+		c := (*packets)[0]
+		assert.True(t, c.FromClient)
+		assert.Equal(t, Version311, c.Version)
+		assert.True(t, c.HasPassword)
+		assert.Equal(t, &Will{Topic: "status/sensor-1", QoS: 1, Retain: true, PayloadSize: 7}, c.Will)
+		assert.Equal(t, len(connect311), c.Size)
+		assert.Equal(t, prototest.Start, c.Time)
+
+		pub := (*packets)[4]
+		assert.Equal(t, byte(1), pub.QoS)
+		assert.True(t, pub.Retain)
+		assert.Equal(t, 200, pub.PayloadSize)
+	}
+}
+
+func TestMQTT5(t *testing.T) {
+	config := Config{}
+	packets := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	prototest.Feed(t, p,
+		// 客户端不提供标识符，由服务器分配
+		prototest.C2S(packet(0x10, str("MQTT"), []byte{5, 0x02}, be16(30),
+			props([]byte{byte(PropSessionExpiryInterval)}, []byte{0, 0, 0x0e, 0x10}, []byte{byte(PropReceiveMaximum)}, be16(20)),
+			str(""))),
+		prototest.S2C(packet(0x20, []byte{0, 0},
+			props([]byte{byte(PropAssignedClientIdentifier)}, str("auto-1"), []byte{byte(PropTopicAliasMaximum)}, be16(10)))),
+		prototest.C2S(packet(0x82, be16(1), props([]byte{byte(PropSubscriptionIdentifier)}, varint(300)),
+			str("sensors/#"), []byte{0x2d})),
+		prototest.S2C(packet(0x90, be16(1), props(), []byte{1})),
+		// 第一次带主题设置别名，之后只用别名
+		prototest.C2S(packet(0x32, str("sensors/temp"), be16(3),
+			props([]byte{byte(PropTopicAlias)}, be16(1), []byte{byte(PropContentType)}, str("application/json"),
+				[]byte{byte(PropUserProperty)}, str("unit"), str("C"), []byte{byte(PropCorrelationData)}, str("cd")),
+			[]byte(`{"v":21.5}`))),
+		prototest.S2C(packet(0x40, be16(3), []byte{0x10})),
+		prototest.C2S(packet(0x30, str(""), props([]byte{byte(PropTopicAlias)}, be16(1)), []byte(`{"v":21.6}`)),
+			packet(0xe0, []byte{0x04}, props([]byte{byte(PropReasonString)}, str("bye")))),
+	)
+
+	var lines []string
+	for _, pkt := range *packets {
+		lines = append(lines, pkt.String())
+		assert.NoError(t, pkt.Error)
+		assert.Equal(t, Version5, pkt.Version)
+	}
+	assert.Equal(t, []string{
+		`> CONNECT v5 client="" keepalive=30 clean {SessionExpiryInterval: 3600, ReceiveMaximum: 20}`,
+		`< CONNACK Success {AssignedClientIdentifier: "auto-1", TopicAliasMaximum: 10}`,
+		`> SUBSCRIBE id=1 sensors/#:1 {SubscriptionIdentifier: 300}`,
+		`< SUBACK id=1 [GrantedQoS1]`,
+		`> PUBLISH sensors/temp qos=1 id=3 10B {TopicAlias: 1, ContentType: "application/json", "unit": "C", CorrelationData: 2B}`,
+		`< PUBACK id=3 NoMatchingSubscribers`,
+		`> PUBLISH sensors/temp qos=0 10B {TopicAlias: 1}`,
+		`> DISCONNECT DisconnectWithWillMessage {ReasonString: "bye"}`,
+	}, lines)
+
+	if assert.Len(t, *packets, 8) {
+		assert.Equal(t, "", (*packets)[0].ClientID)
+		assert.Equal(t, "auto-1", (*packets)[1].ClientID)
+		assert.Equal(t, "auto-1", (*packets)[7].ClientID)
+		assert.Equal(t, []Subscription{{Topic: "sensors/#", QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2}},
+			(*packets)[2].Subscriptions)
+		pub := (*packets)[4]
+		assert.Equal(t, []UserProperty{{Name: "unit", Value: "C"}}, pub.Properties.User())
+		n, ok := pub.Properties.GetUint(PropTopicAlias)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(1), n)
+		assert.Equal(t, "application/json", pub.Properties.GetString(PropContentType))
+		v, ok := pub.Properties.Get(PropCorrelationData)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("cd"), v)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	config := Config{}
+	packets := collect(&config)
+	p := newProcessor(tcpdumper.StreamInfo{}, config)
+
+	prototest.Feed(t, p,
+		prototest.C2S(packet(0x36, str("a"), be16(1)),
+			packet(0x30, str("long topic")[:4]),
+			packet(0x10, str("MQTT"), []byte{5, 0}, be16(0), props([]byte{0x7f, 1}), str("c")),
+			packet(0x00)),
+	)
+	if assert.Len(t, *packets, 4) {
+		assert.EqualError(t, (*packets)[0].Error, "invalid QoS 3")
+		assert.ErrorIs(t, (*packets)[1].Error, errShortPacket)
+		assert.EqualError(t, (*packets)[2].Error, "unknown property 0x7F")
+		assert.ErrorIs(t, (*packets)[3].Error, errUnknownPacketType)
+		assert.Equal(t, `> RESERVED <unknown packet type>`, (*packets)[3].String())
+	}
+	assert.Error(t, p.ProcessTimedData([]byte{0x30}, c2s, false, false, prototest.Start))
+}
+
+func TestFramer(t *testing.T) {
+	var f packetFramer
+	msg := packet(0x30, str("t"), bytes.Repeat([]byte{1}, 300))
+	for _, n := range []int{0, 1, 2, len(msg) - 1} {
+		advance, out, err := f.Frame(msg[:n], false)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, advance)
+		assert.Nil(t, out)
+	}
+	advance, out, err := f.Frame(append(msg, 0xc0, 0), false)
+	assert.NoError(t, err)
+	assert.Equal(t, len(msg), advance)
+	assert.Equal(t, msg, out)
+
+	_, _, err = f.Frame(msg[:3], true)
+	assert.Error(t, err)
+	_, _, err = f.Frame([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, false)
+	assert.ErrorIs(t, err, tcpdumper.ErrFrameTooLarge)
+}
+
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:1883"}, nil)
+	assert.NoError(t, d.ProcessData(connect311[:12], c2s, true, false))
+	assert.NoError(t, d.ProcessData(connect311[12:], c2s, false, false))
+	assert.NoError(t, d.ProcessData(packet(0x20, []byte{0, 0}), s2c, true, false))
+	assert.NoError(t, d.ProcessData(packet(0x30, str("a/b"), []byte("hi")), c2s, false, false))
+	assert.NoError(t, d.Close())
+	assert.Equal(t, `MQTT/a:1-b:1883: > CONNECT v4 client="sensor-1" user="gw" keepalive=60 clean will=status/sensor-1
+MQTT/a:1-b:1883: < CONNACK Accepted
+MQTT/a:1-b:1883: > PUBLISH a/b qos=0 2B
+`, out.String())
+}
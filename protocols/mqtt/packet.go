@@ -0,0 +1,555 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/LubyRuffy/tcpdumper"
+)
+
+// 协议级别（CONNECT中的protocol level）
+const (
+	Version31  byte = 3 // MQTT 3.1，协议名为MQIsdp
+	Version311 byte = 4
+	Version5   byte = 5
+)
+
+var (
+	errShortPacket       = errors.New("short packet")
+	errMalformedLength   = errors.New("malformed remaining length")
+	errUnknownPacketType = errors.New("unknown packet type")
+)
+
+// PacketType 控制报文类型
+type PacketType byte
+
+// 控制报文类型
+const (
+	Connect     PacketType = 1
+	Connack     PacketType = 2
+	Publish     PacketType = 3
+	Puback      PacketType = 4
+	Pubrec      PacketType = 5
+	Pubrel      PacketType = 6
+	Pubcomp     PacketType = 7
+	Subscribe   PacketType = 8
+	Suback      PacketType = 9
+	Unsubscribe PacketType = 10
+	Unsuback    PacketType = 11
+	Pingreq     PacketType = 12
+	Pingresp    PacketType = 13
+	Disconnect  PacketType = 14
+	Auth        PacketType = 15 // 只在MQTT 5中使用
+)
+
+var packetTypeNames = [...]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+func (t PacketType) String() string {
+	if int(t) < len(packetTypeNames) {
+		return packetTypeNames[t]
+	}
+	return fmt.Sprintf("TYPE_%d", byte(t))
+}
+
+// ReasonCode MQTT 5的原因码，也用于3.x的SUBACK返回码
+type ReasonCode byte
+
+var reasonCodeNames = map[ReasonCode]string{
+	0x00: "Success",
+	0x01: "GrantedQoS1",
+	0x02: "GrantedQoS2",
+	0x04: "DisconnectWithWillMessage",
+	0x10: "NoMatchingSubscribers",
+	0x11: "NoSubscriptionExisted",
+	0x18: "ContinueAuthentication",
+	0x19: "ReAuthenticate",
+	0x80: "UnspecifiedError",
+	0x81: "MalformedPacket",
+	0x82: "ProtocolError",
+	0x83: "ImplementationSpecificError",
+	0x84: "UnsupportedProtocolVersion",
+	0x85: "ClientIdentifierNotValid",
+	0x86: "BadUserNameOrPassword",
+	0x87: "NotAuthorized",
+	0x88: "ServerUnavailable",
+	0x89: "ServerBusy",
+	0x8A: "Banned",
+	0x8B: "ServerShuttingDown",
+	0x8C: "BadAuthenticationMethod",
+	0x8D: "KeepAliveTimeout",
+	0x8E: "SessionTakenOver",
+	0x8F: "TopicFilterInvalid",
+	0x90: "TopicNameInvalid",
+	0x91: "PacketIdentifierInUse",
+	0x92: "PacketIdentifierNotFound",
+	0x93: "ReceiveMaximumExceeded",
+	0x94: "TopicAliasInvalid",
+	0x95: "PacketTooLarge",
+	0x96: "MessageRateTooHigh",
+	0x97: "QuotaExceeded",
+	0x98: "AdministrativeAction",
+	0x99: "PayloadFormatInvalid",
+	0x9A: "RetainNotSupported",
+	0x9B: "QoSNotSupported",
+	0x9C: "UseAnotherServer",
+	0x9D: "ServerMoved",
+	0x9E: "SharedSubscriptionsNotSupported",
+	0x9F: "ConnectionRateExceeded",
+	0xA0: "MaximumConnectTime",
+	0xA1: "SubscriptionIdentifiersNotSupported",
+	0xA2: "WildcardSubscriptionsNotSupported",
+}
+
+func (c ReasonCode) String() string {
+	if name, ok := reasonCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", byte(c))
+}
+
+// connackReturnCodes MQTT 3.x的CONNACK返回码
+var connackReturnCodes = map[ReasonCode]string{
+	0: "Accepted",
+	1: "UnacceptableProtocolVersion",
+	2: "IdentifierRejected",
+	3: "ServerUnavailable",
+	4: "BadUserNameOrPassword",
+	5: "NotAuthorized",
+}
+
+// PropertyID MQTT 5的属性标识符
+type PropertyID byte
+
+// MQTT 5的属性
+const (
+	PropPayloadFormatIndicator          PropertyID = 0x01
+	PropMessageExpiryInterval           PropertyID = 0x02
+	PropContentType                     PropertyID = 0x03
+	PropResponseTopic                   PropertyID = 0x08
+	PropCorrelationData                 PropertyID = 0x09
+	PropSubscriptionIdentifier          PropertyID = 0x0B
+	PropSessionExpiryInterval           PropertyID = 0x11
+	PropAssignedClientIdentifier        PropertyID = 0x12
+	PropServerKeepAlive                 PropertyID = 0x13
+	PropAuthenticationMethod            PropertyID = 0x15
+	PropAuthenticationData              PropertyID = 0x16
+	PropRequestProblemInformation       PropertyID = 0x17
+	PropWillDelayInterval               PropertyID = 0x18
+	PropRequestResponseInformation      PropertyID = 0x19
+	PropResponseInformation             PropertyID = 0x1A
+	PropServerReference                 PropertyID = 0x1C
+	PropReasonString                    PropertyID = 0x1F
+	PropReceiveMaximum                  PropertyID = 0x21
+	PropTopicAliasMaximum               PropertyID = 0x22
+	PropTopicAlias                      PropertyID = 0x23
+	PropMaximumQoS                      PropertyID = 0x24
+	PropRetainAvailable                 PropertyID = 0x25
+	PropUserProperty                    PropertyID = 0x26
+	PropMaximumPacketSize               PropertyID = 0x27
+	PropWildcardSubscriptionAvailable   PropertyID = 0x28
+	PropSubscriptionIdentifierAvailable PropertyID = 0x29
+	PropSharedSubscriptionAvailable     PropertyID = 0x2A
+)
+
+// propertyKind 属性值的编码方式
+type propertyKind byte
+
+const (
+	kindByte propertyKind = iota
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindPair
+)
+
+type propertyInfo struct {
+	name string
+	kind propertyKind
+}
+
+var properties = map[PropertyID]propertyInfo{
+	PropPayloadFormatIndicator:          {"PayloadFormatIndicator", kindByte},
+	PropMessageExpiryInterval:           {"MessageExpiryInterval", kindUint32},
+	PropContentType:                     {"ContentType", kindString},
+	PropResponseTopic:                   {"ResponseTopic", kindString},
+	PropCorrelationData:                 {"CorrelationData", kindBinary},
+	PropSubscriptionIdentifier:          {"SubscriptionIdentifier", kindVarint},
+	PropSessionExpiryInterval:           {"SessionExpiryInterval", kindUint32},
+	PropAssignedClientIdentifier:        {"AssignedClientIdentifier", kindString},
+	PropServerKeepAlive:                 {"ServerKeepAlive", kindUint16},
+	PropAuthenticationMethod:            {"AuthenticationMethod", kindString},
+	PropAuthenticationData:              {"AuthenticationData", kindBinary},
+	PropRequestProblemInformation:       {"RequestProblemInformation", kindByte},
+	PropWillDelayInterval:               {"WillDelayInterval", kindUint32},
+	PropRequestResponseInformation:      {"RequestResponseInformation", kindByte},
+	PropResponseInformation:             {"ResponseInformation", kindString},
+	PropServerReference:                 {"ServerReference", kindString},
+	PropReasonString:                    {"ReasonString", kindString},
+	PropReceiveMaximum:                  {"ReceiveMaximum", kindUint16},
+	PropTopicAliasMaximum:               {"TopicAliasMaximum", kindUint16},
+	PropTopicAlias:                      {"TopicAlias", kindUint16},
+	PropMaximumQoS:                      {"MaximumQoS", kindByte},
+	PropRetainAvailable:                 {"RetainAvailable", kindByte},
+	PropUserProperty:                    {"UserProperty", kindPair},
+	PropMaximumPacketSize:               {"MaximumPacketSize", kindUint32},
+	PropWildcardSubscriptionAvailable:   {"WildcardSubscriptionAvailable", kindByte},
+	PropSubscriptionIdentifierAvailable: {"SubscriptionIdentifierAvailable", kindByte},
+	PropSharedSubscriptionAvailable:     {"SharedSubscriptionAvailable", kindByte},
+}
+
+func (id PropertyID) String() string {
+	if info, ok := properties[id]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("Property(0x%02X)", byte(id))
+}
+
+// UserProperty 用户属性，同一个名字可以出现多次
+type UserProperty struct {
+	Name  string
+	Value string
+}
+
+// Property 一个属性，Value为uint32（字节、双字节、四字节和变长整数）、string、[]byte或 UserProperty
+type Property struct {
+	ID    PropertyID
+	Value interface{}
+}
+
+// Properties 按报文中的顺序保存的属性
+type Properties []Property
+
+// Get 返回第一个指定标识符的属性值
+func (ps Properties) Get(id PropertyID) (interface{}, bool) {
+	for _, p := range ps {
+		if p.ID == id {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// GetUint 返回数值属性的值
+func (ps Properties) GetUint(id PropertyID) (uint32, bool) {
+	v, _ := ps.Get(id)
+	n, ok := v.(uint32)
+	return n, ok
+}
+
+// GetString 返回字符串属性的值，不存在时为空
+func (ps Properties) GetString(id PropertyID) string {
+	v, _ := ps.Get(id)
+	s, _ := v.(string)
+	return s
+}
+
+// User 返回所有用户属性
+func (ps Properties) User() []UserProperty {
+	var out []UserProperty
+	for _, p := range ps {
+		if u, ok := p.Value.(UserProperty); ok {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// String 返回属性的摘要，如 {ContentType: "text/plain", TopicAlias: 3, "unit": "C"}，二进制属性只输出长度
+func (ps Properties) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, p := range ps {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		switch v := p.Value.(type) {
+		case UserProperty:
+			fmt.Fprintf(&b, "%q: %q", v.Name, v.Value)
+		case string:
+			fmt.Fprintf(&b, "%s: %q", p.ID, v)
+		case []byte:
+			fmt.Fprintf(&b, "%s: %dB", p.ID, len(v))
+		default:
+			fmt.Fprintf(&b, "%s: %v", p.ID, v)
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// byteReader 报文读取器，读取越界时ok变为false
+type byteReader struct {
+	data []byte
+	ok   bool
+	bad  error
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u8() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) u16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *byteReader) u32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// varint 变长整数，每字节7位，最多4个字节
+func (r *byteReader) varint() uint32 {
+	v, n := decodeVarint(r.data)
+	switch {
+	case !r.ok:
+		return 0
+	case n == 0:
+		r.ok = false
+		return 0
+	case n < 0:
+		r.ok, r.bad = false, errMalformedLength
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// binary 双字节长度前缀的二进制数据
+func (r *byteReader) binary() []byte {
+	return r.bytes(int(r.u16()))
+}
+
+// str 双字节长度前缀的UTF-8字符串
+func (r *byteReader) str() string {
+	return string(r.binary())
+}
+
+// properties 读取MQTT 5的属性：变长整数的长度和若干属性
+func (r *byteReader) properties() Properties {
+	sub := &byteReader{data: r.bytes(int(r.varint())), ok: r.ok}
+	if !sub.ok {
+		return nil
+	}
+	var ps Properties
+	for sub.ok && len(sub.data) > 0 {
+		id := PropertyID(sub.varint())
+		info, ok := properties[id]
+		if !ok {
+			r.ok, r.bad = false, fmt.Errorf("unknown property 0x%02X", byte(id))
+			return ps
+		}
+		var v interface{}
+		switch info.kind {
+		case kindByte:
+			v = uint32(sub.u8())
+		case kindUint16:
+			v = uint32(sub.u16())
+		case kindUint32:
+			v = sub.u32()
+		case kindVarint:
+			v = sub.varint()
+		case kindString:
+			v = sub.str()
+		case kindBinary:
+			v = append([]byte(nil), sub.binary()...)
+		case kindPair:
+			v = UserProperty{Name: sub.str(), Value: sub.str()}
+		}
+		if sub.ok {
+			ps = append(ps, Property{ID: id, Value: v})
+		}
+	}
+	if err := sub.err(); err != nil {
+		r.ok, r.bad = false, fmt.Errorf("properties: %w", err)
+	}
+	return ps
+}
+
+func (r *byteReader) err() error {
+	switch {
+	case r.bad != nil:
+		return r.bad
+	case !r.ok:
+		return errShortPacket
+	}
+	return nil
+}
+
+// decodeVarint 解析变长整数（最大256MB-1），返回值和占用的字节数；数据不足时n为0，超过4个字节时n为-1
+func decodeVarint(data []byte) (uint32, int) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		if i >= len(data) {
+			return 0, 0
+		}
+		v |= uint32(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, -1
+}
+
+// parsePacket 按协议版本解析一个完整的控制报文（含固定报头），解析失败时返回已解析的部分和错误
+func parsePacket(data []byte, version byte) (*Packet, error) {
+	if len(data) < 2 {
+		return nil, errShortPacket
+	}
+	_, n := decodeVarint(data[1:])
+	if n <= 0 {
+		return nil, errMalformedLength
+	}
+	p := &Packet{Type: PacketType(data[0] >> 4), Size: len(data), Version: version}
+	flags := data[0] & 0x0f
+	r := &byteReader{data: data[1+n:], ok: true}
+	v5 := version == Version5
+	switch p.Type {
+	case Connect:
+		name := r.str()
+		p.Version = r.u8()
+		if r.ok && !(name == "MQTT" || name == "MQIsdp") {
+			return p, fmt.Errorf("unknown protocol name %q", name)
+		}
+		v5 = p.Version == Version5
+		cf := r.u8()
+		p.CleanStart = cf&0x02 != 0
+		p.KeepAlive = r.u16()
+		if v5 {
+			p.Properties = r.properties()
+		}
+		p.ClientID = r.str()
+		if cf&0x04 != 0 {
+			w := &Will{QoS: (cf >> 3) & 0x03, Retain: cf&0x20 != 0}
+			if v5 {
+				w.Properties = r.properties()
+			}
+			w.Topic = r.str()
+			w.PayloadSize = len(r.binary())
+			p.Will = w
+		}
+		if cf&0x80 != 0 {
+			p.Username = r.str()
+		}
+		if cf&0x40 != 0 {
+			p.HasPassword = true
+			r.binary()
+		}
+	case Connack:
+		p.SessionPresent = r.u8()&0x01 != 0
+		p.ReasonCode = ReasonCode(r.u8())
+		if v5 && len(r.data) > 0 {
+			p.Properties = r.properties()
+		}
+	case Publish:
+		p.Dup, p.QoS, p.Retain = flags&0x08 != 0, (flags>>1)&0x03, flags&0x01 != 0
+		if p.QoS == 3 {
+			return p, errors.New("invalid QoS 3")
+		}
+		p.Topic = r.str()
+		if p.QoS > 0 {
+			p.PacketID = r.u16()
+		}
+		if v5 {
+			p.Properties = r.properties()
+		}
+		p.PayloadSize = len(r.data)
+	case Puback, Pubrec, Pubrel, Pubcomp:
+		p.PacketID = r.u16()
+		if v5 && len(r.data) > 0 {
+			p.ReasonCode = ReasonCode(r.u8())
+			if len(r.data) > 0 {
+				p.Properties = r.properties()
+			}
+		}
+	case Subscribe:
+		p.PacketID = r.u16()
+		if v5 {
+			p.Properties = r.properties()
+		}
+		for r.ok && len(r.data) > 0 {
+			topic := r.str()
+			opts := r.u8()
+			p.Subscriptions = append(p.Subscriptions, Subscription{
+				Topic:             topic,
+				QoS:               opts & 0x03,
+				NoLocal:           opts&0x04 != 0,
+				RetainAsPublished: opts&0x08 != 0,
+				RetainHandling:    (opts >> 4) & 0x03,
+			})
+		}
+	case Unsubscribe:
+		p.PacketID = r.u16()
+		if v5 {
+			p.Properties = r.properties()
+		}
+		for r.ok && len(r.data) > 0 {
+			p.Subscriptions = append(p.Subscriptions, Subscription{Topic: r.str()})
+		}
+	case Suback, Unsuback:
+		p.PacketID = r.u16()
+		if v5 {
+			p.Properties = r.properties()
+		}
+		for _, c := range r.data {
+			p.ReasonCodes = append(p.ReasonCodes, ReasonCode(c))
+		}
+	case Pingreq, Pingresp:
+	case Disconnect, Auth:
+		if v5 && len(r.data) > 0 {
+			p.ReasonCode = ReasonCode(r.u8())
+			if len(r.data) > 0 {
+				p.Properties = r.properties()
+			}
+		}
+	default:
+		return p, errUnknownPacketType
+	}
+	return p, r.err()
+}
+
+// packetFramer 按固定报头中的剩余长度切分控制报文
+type packetFramer struct{}
+
+func (packetFramer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	length, n := decodeVarint(data[min(len(data), 1):])
+	if n < 0 {
+		return 0, nil, fmt.Errorf("%w: %v", tcpdumper.ErrFrameTooLarge, errMalformedLength)
+	}
+	if n == 0 || len(data) < 1+n+int(length) {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	total := 1 + n + int(length)
+	return total, data[:total], nil
+}
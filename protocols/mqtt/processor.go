@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// processor MQTT处理器，每次调用必须是一个完整的控制报文，由 FramedProcessor 包装
+// 协议版本和客户端标识符来自CONNECT，MQTT 5的主题别名在每个方向上分别记录
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	version    byte
+	clientID   string
+	aliases    [2]map[uint32]string // 按方向记录的主题别名，0为客户端发出，1为服务器发出
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{streamInfo: streamInfo, config: config, version: Version311}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一个带时间戳的控制报文，没有时间戳时使用当前时间
+// 报文体无法解析时仍然回调，解析错误记录在 Packet.Error 中
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	pkt, err := parsePacket(data, p.version)
+	if pkt == nil {
+		return err
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	pkt.StreamInfo, pkt.Time, pkt.Error = p.streamInfo, ts, err
+	pkt.FromClient = dir == reassembly.TCPDirClientToServer
+
+	switch pkt.Type {
+	case Connect:
+		if pkt.FromClient {
+			p.version, p.clientID = pkt.Version, pkt.ClientID
+			p.aliases = [2]map[uint32]string{}
+		}
+	case Connack:
+		if id := pkt.Properties.GetString(PropAssignedClientIdentifier); id != "" && p.clientID == "" {
+			p.clientID = id
+		}
+	case Publish:
+		if alias, ok := pkt.Properties.GetUint(PropTopicAlias); ok {
+			p.resolveAlias(pkt, alias)
+		}
+	}
+	if pkt.Type != Connect {
+		pkt.ClientID = p.clientID
+	}
+	p.config.OnPacket(pkt)
+	return nil
+}
+
+// resolveAlias 带主题的PUBLISH设置别名，主题为空的PUBLISH使用别名对应的主题
+func (p *processor) resolveAlias(pkt *Packet, alias uint32) {
+	i := 0
+	if !pkt.FromClient {
+		i = 1
+	}
+	m := p.aliases[i]
+	if pkt.Topic != "" {
+		if m == nil {
+			m = make(map[uint32]string)
+			p.aliases[i] = m
+		}
+		m[alias] = pkt.Topic
+		return
+	}
+	pkt.Topic = m[alias]
+}
+
+func (p *processor) Close() error {
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
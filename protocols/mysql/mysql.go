@@ -0,0 +1,288 @@
+// Package mysql 提供MySQL客户端/服务器协议的检测器和处理器
+// 跟踪握手（能力标志、用户名、数据库），解析COM_QUERY、预处理语句COM_STMT_PREPARE/EXECUTE及其参数，
+// 以及结果集、OK和ERR包；每条语句以 Statement 事件的形式交给回调，包含SQL、影响行数、错误码和延迟
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "MySQL"
+
+const (
+	defaultMaxQueryLength = 4096
+	maxParamLength        = 256 // 参数中的字符串保存的最大长度
+)
+
+// Command 命令类型，客户端每个命令包的第一个字节
+type Command byte
+
+// 命令类型
+const (
+	ComQuit             Command = 0x01
+	ComInitDB           Command = 0x02
+	ComQuery            Command = 0x03
+	ComFieldList        Command = 0x04
+	ComStatistics       Command = 0x09
+	ComPing             Command = 0x0e
+	ComChangeUser       Command = 0x11
+	ComStmtPrepare      Command = 0x16
+	ComStmtExecute      Command = 0x17
+	ComStmtSendLongData Command = 0x18
+	ComStmtClose        Command = 0x19
+	ComStmtReset        Command = 0x1a
+	ComSetOption        Command = 0x1b
+	ComStmtFetch        Command = 0x1c
+	ComResetConnection  Command = 0x1f
+)
+
+var commandNames = map[Command]string{
+	ComQuit:             "COM_QUIT",
+	ComInitDB:           "COM_INIT_DB",
+	ComQuery:            "COM_QUERY",
+	ComFieldList:        "COM_FIELD_LIST",
+	ComStatistics:       "COM_STATISTICS",
+	ComPing:             "COM_PING",
+	ComChangeUser:       "COM_CHANGE_USER",
+	ComStmtPrepare:      "COM_STMT_PREPARE",
+	ComStmtExecute:      "COM_STMT_EXECUTE",
+	ComStmtSendLongData: "COM_STMT_SEND_LONG_DATA",
+	ComStmtClose:        "COM_STMT_CLOSE",
+	ComStmtReset:        "COM_STMT_RESET",
+	ComSetOption:        "COM_SET_OPTION",
+	ComStmtFetch:        "COM_STMT_FETCH",
+	ComResetConnection:  "COM_RESET_CONNECTION",
+}
+
+func (c Command) String() string {
+	if name, ok := commandNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("COM_0x%02x", byte(c))
+}
+
+// Handshake 连接的握手信息
+// 客户端请求TLS时TLS为true，此后的数据交给注册表重新识别（如TLS处理器）
+type Handshake struct {
+	StreamInfo         tcpdumper.StreamInfo
+	ServerVersion      string
+	ConnectionID       uint32
+	ServerCapabilities CapabilityFlags
+	ClientCapabilities CapabilityFlags
+	User               string
+	Database           string
+	AuthPlugin         string       // 最终使用的认证插件（包括服务器要求切换的插件）
+	TLS                bool         // 客户端发送了SSL请求
+	Error              *ServerError // 认证失败时服务器返回的错误
+	Time               time.Time    // 握手完成的时间
+}
+
+// String 返回握手的摘要，如 user=root db=test server=8.0.36 -> OK
+func (h *Handshake) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "user=%q", h.User)
+	if h.Database != "" {
+		fmt.Fprintf(&b, " db=%q", h.Database)
+	}
+	if h.ServerVersion != "" {
+		fmt.Fprintf(&b, " server=%s", h.ServerVersion)
+	}
+	if h.AuthPlugin != "" {
+		fmt.Fprintf(&b, " plugin=%s", h.AuthPlugin)
+	}
+	switch {
+	case h.TLS:
+		b.WriteString(" -> TLS")
+	case h.Error != nil:
+		fmt.Fprintf(&b, " -> %s", h.Error)
+	default:
+		b.WriteString(" -> OK")
+	}
+	return b.String()
+}
+
+// Statement 一个命令和它的响应
+// 连接关闭或下一个命令开始时仍没有完整响应的，Complete为false
+type Statement struct {
+	StreamInfo tcpdumper.StreamInfo
+	Command    Command
+	// Query COM_QUERY和COM_STMT_PREPARE的SQL，COM_STMT_EXECUTE为预处理时的SQL（没有看到预处理时为空），
+	// COM_INIT_DB为数据库名；超过 Config.MaxQueryLength 时被截断
+	Query       string
+	StatementID uint32   // COM_STMT_*的语句ID，COM_STMT_PREPARE的ID来自响应
+	Params      []string // COM_STMT_EXECUTE的参数和COM_QUERY的查询属性，字符串带引号
+	Database    string   // 执行时的当前数据库
+
+	Columns      int    // 结果集的列数，多个结果集时为最后一个
+	Rows         int    // 所有结果集的行数
+	Results      int    // 结果数（结果集和OK包），多语句和存储过程可能有多个
+	AffectedRows uint64 // 所有OK包的影响行数之和
+	LastInsertID uint64
+	Warnings     uint16
+	Error        *ServerError
+
+	Complete     bool
+	RequestTime  time.Time
+	ResponseTime time.Time // 响应最后一个包的时间
+}
+
+// Latency 从命令到响应结束的时间
+func (s *Statement) Latency() time.Duration {
+	if !s.Complete {
+		return 0
+	}
+	return s.ResponseTime.Sub(s.RequestTime)
+}
+
+// String 返回语句的摘要，如 COM_QUERY "SELECT 1" -> 1 rows (1.2ms)
+func (s *Statement) String() string {
+	var b strings.Builder
+	b.WriteString(s.Command.String())
+	if s.Command == ComStmtExecute || s.Command == ComStmtPrepare && s.Complete {
+		fmt.Fprintf(&b, " id=%d", s.StatementID)
+	}
+	if s.Query != "" {
+		fmt.Fprintf(&b, " %q", s.Query)
+	}
+	if len(s.Params) > 0 {
+		fmt.Fprintf(&b, " [%s]", strings.Join(s.Params, " "))
+	}
+	switch {
+	case !s.Complete:
+		b.WriteString(" -> <no response>")
+		return b.String()
+	case s.Error != nil:
+		fmt.Fprintf(&b, " -> %s", s.Error)
+	case s.Columns > 0:
+		fmt.Fprintf(&b, " -> %d rows", s.Rows)
+	default:
+		fmt.Fprintf(&b, " -> OK affected=%d", s.AffectedRows)
+	}
+	fmt.Fprintf(&b, " (%v)", s.Latency())
+	return b.String()
+}
+
+// Config MySQL处理器配置
+type Config struct {
+	// OnHandshake 认证完成（或客户端请求TLS）时的回调，为nil时把摘要输出到Output
+	OnHandshake func(*Handshake)
+	// OnStatement 命令的响应结束或连接关闭时的回调，为nil时把摘要输出到Output
+	OnStatement func(*Statement)
+	Output      io.Writer // 默认回调的输出，nil为标准输出
+
+	MaxQueryLength int // Statement.Query保存的最大长度，0为默认4096
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnHandshake == nil {
+		c.OnHandshake = func(h *Handshake) {
+			fmt.Fprintf(w, "MYSQL/%s: %s\n", h.StreamInfo.Ident, h)
+		}
+	}
+	if c.OnStatement == nil {
+		c.OnStatement = func(s *Statement) {
+			fmt.Fprintf(w, "MYSQL/%s: %s\n", s.StreamInfo.Ident, s)
+		}
+	}
+	if c.MaxQueryLength <= 0 {
+		c.MaxQueryLength = defaultMaxQueryLength
+	}
+	return c
+}
+
+// sqlKeywords 抓包从连接中途开始时，用于识别COM_QUERY的SQL开头
+var sqlKeywords = []string{
+	"SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "SET", "SHOW", "USE", "BEGIN", "START",
+	"COMMIT", "ROLLBACK", "CREATE", "ALTER", "DROP", "CALL", "EXPLAIN", "DESCRIBE", "WITH",
+}
+
+// Detector MySQL检测器
+// 服务器数据为协议版本10的初始握手包时置信度为90；
+// 抓包从连接中途开始时，客户端数据为以SQL关键字开头的COM_QUERY置信度为70
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建MySQL检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if len(data) < headerLen+1 || data[3] != 0 {
+		return 0
+	}
+	length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	payload := data[headerLen:min(len(data), headerLen+length)]
+	if dir == reassembly.TCPDirServerToClient {
+		return detectGreeting(payload, length)
+	}
+	if length < 2 || length > maxPayloadLen || len(payload) == 0 || Command(payload[0]) != ComQuery {
+		return 0
+	}
+	query := strings.ToUpper(strings.TrimSpace(string(payload[1:min(len(payload), 64)])))
+	for _, keyword := range sqlKeywords {
+		if strings.HasPrefix(query, keyword) {
+			return 70
+		}
+	}
+	return 0
+}
+
+// detectGreeting 检查初始握手包：协议版本10、可打印的服务器版本、至少包含连接ID和能力标志
+func detectGreeting(payload []byte, length int) int {
+	if length < 32 || length > 1024 || payload[0] != 10 {
+		return 0
+	}
+	end := bytes.IndexByte(payload[1:], 0)
+	if end < 1 || end > 64 {
+		return 0
+	}
+	for _, c := range payload[1 : 1+end] {
+		if c < 0x20 || c > 0x7e {
+			return 0
+		}
+	}
+	if len(payload) == length {
+		if _, err := parseGreeting(payload); err != nil {
+			return 0
+		}
+	}
+	return 90
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), packetFramer{})
+}
+
+// NewProcessor 创建MySQL处理器，返回的处理器会先按包头切分包
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册MySQL协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
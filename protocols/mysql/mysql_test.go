@@ -0,0 +1,317 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/internal/prototest"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// packet 加上3字节长度和序号
+func packet(seq byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append([]byte{byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16), seq}, body...)
+}
+
+func le16(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+func le32(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+func nul(s string) []byte  { return append([]byte(s), 0) }
+func lenenc(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+const testCapabilities = ClientProtocol41 | ClientSecureConnection | ClientPluginAuth | ClientConnectWithDB | ClientTransactions
+
+func greetingPacket(caps CapabilityFlags) []byte {
+	return packet(0,
+		[]byte{10}, nul("8.0.36"), le32(42), []byte("12345678"), []byte{0},
+		le16(uint16(caps)), []byte{0xff}, le16(2), le16(uint16(caps>>16)), []byte{21},
+		make([]byte, 10), []byte("123456789012\x00"), nul("caching_sha2_password"))
+}
+
+func handshakeResponsePacket(caps CapabilityFlags, user, db string) []byte {
+	return packet(1,
+		le32(uint32(caps)), le32(1<<24), []byte{0xff}, make([]byte, 23),
+		nul(user), []byte{3, 1, 2, 3}, nul(db), nul("caching_sha2_password"))
+}
+
+func okPacketData(seq byte, affected, insertID byte, status uint16) []byte {
+	return packet(seq, []byte{0, affected, insertID}, le16(status), le16(0))
+}
+
+func errPacket(seq byte, code uint16, state, msg string) []byte {
+	return packet(seq, []byte{0xff}, le16(code), []byte("#"+state), []byte(msg))
+}
+
+func eofPacket(seq byte, status uint16) []byte {
+	return packet(seq, []byte{0xfe}, le16(0), le16(status))
+}
+
+func columnDef(seq byte, name string) []byte {
+	return packet(seq, lenenc("def"), lenenc("db"), lenenc("t"), lenenc("t"), lenenc(name), lenenc(name),
+		[]byte{0x0c}, le16(33), le32(11), []byte{typeLongLong}, le16(0), []byte{0, 0, 0})
+}
+
+func query(seq byte, cmd Command, q string) []byte {
+	return packet(seq, []byte{byte(cmd)}, []byte(q))
+}
+
+func collect(config *Config) (*[]*Handshake, *[]*Statement) {
+	var handshakes []*Handshake
+	var statements []*Statement
+	config.OnHandshake = func(h *Handshake) {
+		handshakes = append(handshakes, h)
+	}
+	config.OnStatement = func(s *Statement) {
+		statements = append(statements, s)
+	}
+	return &handshakes, &statements
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	g := greetingPacket(testCapabilities)
+	assert.Equal(t, 90, d.Detect(g, s2c))
+	assert.Equal(t, 90, d.Detect(g[:20], s2c))
+	assert.Equal(t, 70, d.Detect(query(0, ComQuery, "  select 1"), c2s))
+
+	assert.Equal(t, 0, d.Detect(g, c2s))
+	assert.Equal(t, 0, d.Detect(query(0, ComQuery, "hello"), c2s))
+	assert.Equal(t, 0, d.Detect(query(1, ComQuery, "SELECT 1"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("HTTP/1.1 200 OK\r\n\r\n"), s2c))
+	bad := append([]byte(nil), g...)
+	bad[6] = 0x01
+	assert.Equal(t, 0, d.Detect(bad, s2c))
+
+	// 长度为0的包没有负载
+	empty := []byte("\x00\x00\x00\x000")
+	assert.Equal(t, 0, d.Detect(empty, c2s))
+	assert.Equal(t, 0, d.Detect(empty, s2c))
+	assert.Equal(t, 0, d.Detect(packet(0, []byte{byte(ComQuery)}), c2s))
+}
+
+func TestHandshakeAndQuery(t *testing.T) {
+	config := Config{}
+	handshakes, statements := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	caps := testCapabilities | ClientDeprecateEOF
+	prototest.Feed(t, p,
+		prototest.S2C(greetingPacket(caps)),
+		prototest.C2S(handshakeResponsePacket(caps, "root", "shop")),
+		prototest.S2C(packet(2, []byte{0x01, 0x03}), okPacketData(3, 0, 0, 2)),
+		// 结果集：列数、列定义、行、以0xfe开头的OK包（DEPRECATE_EOF）
+		prototest.C2S(query(0, ComQuery, "SELECT id FROM users")),
+		prototest.S2C(packet(1, []byte{1}), columnDef(2, "id"), packet(3, lenenc("1")), packet(4, lenenc("2")),
+			packet(5, []byte{0xfe, 0, 0}, le16(2), le16(0))),
+		prototest.C2S(query(0, ComQuery, "UPDATE users SET n=1")),
+		prototest.S2C(okPacketData(1, 2, 0, 2)),
+		prototest.C2S(query(0, ComQuery, "SELEC 1")),
+		prototest.S2C(errPacket(1, 1064, "42000", "You have an error in your SQL syntax")),
+		prototest.C2S(query(0, ComInitDB, "other")),
+		prototest.S2C(okPacketData(1, 0, 0, 2)),
+		prototest.C2S(query(0, ComPing, "")),
+		prototest.S2C(okPacketData(1, 0, 0, 2)),
+	)
+	assert.NoError(t, p.Close())
+
+	if assert.Len(t, *handshakes, 1) {
+		h := (*handshakes)[0]
+		assert.Equal(t, "8.0.36", h.ServerVersion)
+		assert.Equal(t, uint32(42), h.ConnectionID)
+		assert.Equal(t, "root", h.User)
+		assert.Equal(t, "shop", h.Database)
+		assert.True(t, h.ClientCapabilities.Has(ClientDeprecateEOF))
+		assert.Nil(t, h.Error)
+		assert.Equal(t, `user="root" db="shop" server=8.0.36 plugin=caching_sha2_password -> OK`, h.String())
+	}
+	if !assert.Len(t, *statements, 5) {
+		return
+	}
+	s := *statements
+	assert.Equal(t, ComQuery, s[0].Command)
+	assert.Equal(t, "SELECT id FROM users", s[0].Query)
+	assert.Equal(t, "shop", s[0].Database)
+	assert.Equal(t, 1, s[0].Columns)
+	assert.Equal(t, 2, s[0].Rows)
+	assert.Equal(t, 5*time.Millisecond, s[0].Latency())
+	assert.Equal(t, `COM_QUERY "SELECT id FROM users" -> 2 rows (5ms)`, s[0].String())
+	assert.Equal(t, uint64(2), s[1].AffectedRows)
+	assert.Equal(t, `COM_QUERY "UPDATE users SET n=1" -> OK affected=2 (1ms)`, s[1].String())
+	if assert.NotNil(t, s[2].Error) {
+		assert.Equal(t, uint16(1064), s[2].Error.Code)
+		assert.Equal(t, "42000", s[2].Error.SQLState)
+	}
+	assert.Equal(t, `COM_QUERY "SELEC 1" -> ERROR 1064 (42000): You have an error in your SQL syntax (1ms)`, s[2].String())
+	assert.Equal(t, `COM_INIT_DB "other" -> OK affected=0 (1ms)`, s[3].String())
+	assert.Equal(t, "other", s[4].Database)
+	assert.Equal(t, "COM_PING -> OK affected=0 (1ms)", s[4].String())
+}
+
+// 预处理语句：参数个数来自预处理响应，执行时解析二进制参数
+func TestPreparedStatement(t *testing.T) {
+	config := Config{}
+	_, statements := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	params := bytes.Join([][]byte{
+		le32(7), []byte{0}, le32(1), // 语句ID、标志、迭代次数
+		[]byte{0x04}, // NULL位图：第3个参数为NULL
+		[]byte{1},    // 绑定新的参数类型
+		{typeLongLong, 0x80}, {0xfd, 0}, {typeNull, 0}, {typeDateTime, 0},
+		binary.LittleEndian.AppendUint64(nil, uint64(0xffffffffffffffff)), lenenc("bob"),
+		{7}, le16(2024), {5, 6, 7, 8, 9},
+	}, nil)
+	prototest.Feed(t, p,
+		// 协议4.1，没有DEPRECATE_EOF：参数和列定义之后各有一个EOF包
+		prototest.C2S(query(0, ComStmtPrepare, "SELECT * FROM t WHERE a=? AND b=? AND c=? AND d=?")),
+		prototest.S2C(packet(1, []byte{0}, le32(7), le16(1), le16(4), []byte{0}, le16(0)),
+			columnDef(2, "a"), columnDef(3, "b"), columnDef(4, "c"), columnDef(5, "d"), eofPacket(6, 2),
+			columnDef(7, "x"), eofPacket(8, 2)),
+		prototest.C2S(packet(0, []byte{byte(ComStmtExecute)}, params)),
+		// 二进制结果集：列定义后有EOF包
+		prototest.S2C(packet(1, []byte{1}), columnDef(2, "x"), eofPacket(3, 2), packet(4, []byte{0, 0, 1}), eofPacket(5, 2)),
+		// 第二次执行沿用之前的参数类型
+		prototest.C2S(packet(0, []byte{byte(ComStmtExecute)}, le32(7), []byte{0}, le32(1), []byte{0x0f, 0})),
+		prototest.S2C(okPacketData(1, 0, 0, 2)),
+		prototest.C2S(packet(0, []byte{byte(ComStmtClose)}, le32(7))),
+		// 语句已关闭，不再有参数
+		prototest.C2S(packet(0, []byte{byte(ComStmtExecute)}, le32(7), []byte{0}, le32(1))),
+		prototest.S2C(errPacket(1, 1243, "HY000", "Unknown prepared statement handler")),
+	)
+	assert.NoError(t, p.Close())
+
+	if !assert.Len(t, *statements, 4) {
+		return
+	}
+	s := *statements
+	assert.Equal(t, ComStmtPrepare, s[0].Command)
+	assert.Equal(t, uint32(7), s[0].StatementID)
+	assert.True(t, s[0].Complete)
+	assert.Equal(t, 8*time.Millisecond, s[0].Latency())
+	assert.Equal(t, "SELECT * FROM t WHERE a=? AND b=? AND c=? AND d=?", s[1].Query)
+	assert.Equal(t, []string{"18446744073709551615", `"bob"`, "NULL", "2024-05-06 07:08:09"}, s[1].Params)
+	assert.Equal(t, 1, s[1].Rows)
+	assert.Equal(t, `COM_STMT_EXECUTE id=7 "SELECT * FROM t WHERE a=? AND b=? AND c=? AND d=?" [18446744073709551615 "bob" NULL 2024-05-06 07:08:09] -> 1 rows (5ms)`, s[1].String())
+	assert.Equal(t, []string{"NULL", "NULL", "NULL", "NULL"}, s[2].Params)
+	assert.Empty(t, s[3].Query)
+	assert.NotNil(t, s[3].Error)
+}
+
+// 多结果和DEPRECATE_EOF时的预处理响应
+func TestMultiResults(t *testing.T) {
+	config := Config{}
+	_, statements := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	prototest.Feed(t, p,
+		prototest.C2S(query(0, ComQuery, "CALL p()")),
+		// 结果集以带MORE_RESULTS_EXISTS的EOF结束，之后是OK包
+		prototest.S2C(packet(1, []byte{1}), columnDef(2, "a"), eofPacket(3, 2), packet(4, lenenc("x")),
+			eofPacket(5, 2|statusMoreResultsExists), okPacketData(6, 3, 0, 2)),
+		// 抓包没有看到握手，预处理响应没有最后的EOF包时在下一个命令开始时结束
+		prototest.C2S(query(0, ComStmtPrepare, "DO ?")),
+		prototest.S2C(packet(1, []byte{0}, le32(1), le16(0), le16(1), []byte{0}, le16(0)), columnDef(2, "?")),
+		prototest.C2S(query(0, ComQuery, "SELECT 1")),
+	)
+	assert.NoError(t, p.Close())
+
+	if !assert.Len(t, *statements, 3) {
+		return
+	}
+	s := *statements
+	assert.Equal(t, 2, s[0].Results)
+	assert.Equal(t, 1, s[0].Rows)
+	assert.Equal(t, uint64(3), s[0].AffectedRows)
+	assert.True(t, s[1].Complete)
+	assert.Equal(t, uint32(1), s[1].StatementID)
+	assert.False(t, s[2].Complete)
+	assert.Equal(t, `COM_QUERY "SELECT 1" -> <no response>`, s[2].String())
+}
+
+// 客户端请求TLS后交给注册表重新识别
+func TestSSLRequest(t *testing.T) {
+	config := Config{}
+	handshakes, statements := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	caps := testCapabilities | ClientSSL
+	assert.NoError(t, p.ProcessData(greetingPacket(caps), s2c, true, false))
+	ssl := packet(1, le32(uint32(caps)), le32(1<<24), []byte{0xff}, make([]byte, 23))
+	err := p.ProcessData(append(ssl, 0x16, 0x03, 0x01), c2s, true, false)
+	var ps *tcpdumper.ProtocolSwitch
+	if assert.ErrorAs(t, err, &ps) {
+		assert.Empty(t, ps.Protocol)
+		assert.Equal(t, []byte{0x16, 0x03, 0x01}, ps.ClientData)
+	}
+	if assert.Len(t, *handshakes, 1) {
+		assert.True(t, (*handshakes)[0].TLS)
+		assert.Equal(t, `user="" server=8.0.36 plugin=caching_sha2_password -> TLS`, (*handshakes)[0].String())
+	}
+	assert.Empty(t, *statements)
+}
+
+func TestAuthError(t *testing.T) {
+	config := Config{}
+	handshakes, _ := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	prototest.Feed(t, p,
+		prototest.S2C(greetingPacket(testCapabilities)),
+		prototest.C2S(handshakeResponsePacket(testCapabilities, "root", "")),
+		prototest.S2C(packet(2, []byte{0xfe}, nul("mysql_native_password"), []byte("12345678901234567890\x00"))),
+		prototest.C2S(packet(3, make([]byte, 20))),
+		prototest.S2C(errPacket(4, 1045, "28000", "Access denied for user 'root'")),
+	)
+	if assert.Len(t, *handshakes, 1) {
+		h := (*handshakes)[0]
+		assert.Equal(t, "mysql_native_password", h.AuthPlugin)
+		if assert.NotNil(t, h.Error) {
+			assert.Equal(t, uint16(1045), h.Error.Code)
+		}
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	value := func(typ byte, unsigned bool, data ...byte) string {
+		return binaryValue(newByteReader(data), paramType{typ: typ, unsigned: unsigned}, 4)
+	}
+	assert.Equal(t, "-1", value(typeTiny, false, 0xff))
+	assert.Equal(t, "255", value(typeTiny, true, 0xff))
+	assert.Equal(t, "-2", value(typeShort, false, 0xfe, 0xff))
+	assert.Equal(t, "-3", value(typeLong, false, 0xfd, 0xff, 0xff, 0xff))
+	assert.Equal(t, "1.5", value(typeDouble, false, binary.LittleEndian.AppendUint64(nil, 0x3ff8000000000000)...))
+	assert.Equal(t, "0.5", value(typeFloat, false, 0, 0, 0, 0x3f))
+	assert.Equal(t, "2024-01-02", value(typeDate, false, 4, 0xe8, 0x07, 1, 2))
+	assert.Equal(t, "2024-01-02 03:04:05.000006", value(typeDateTime, false, 11, 0xe8, 0x07, 1, 2, 3, 4, 5, 6, 0, 0, 0))
+	assert.Equal(t, "-25:02:03", value(typeTime, false, 8, 1, 1, 0, 0, 0, 1, 2, 3))
+	assert.Equal(t, `"abcd"...(6 bytes)`, value(0xfe, false, 6, 'a', 'b', 'c', 'd', 'e', 'f'))
+	assert.Equal(t, "PROTOCOL_41|SSL|0x40000000", (ClientProtocol41 | ClientSSL | 1<<30).String())
+}
+
+// 通过注册表识别并输出默认摘要
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:3306"}, nil)
+	data := append(greetingPacket(testCapabilities), okPacketData(2, 0, 0, 2)...)
+	assert.NoError(t, d.ProcessData(data[:len(data)-11], s2c, true, false))
+	assert.NoError(t, d.ProcessData(handshakeResponsePacket(testCapabilities, "app", "shop"), c2s, true, false))
+	assert.NoError(t, d.ProcessData(data[len(data)-11:], s2c, false, false))
+	assert.NoError(t, d.ProcessData(query(0, ComQuery, "DELETE FROM carts"), c2s, false, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^MYSQL/a:1-b:3306: user="app" db="shop" server=8.0.36 plugin=caching_sha2_password -> OK\n`+
+		`MYSQL/a:1-b:3306: COM_QUERY "DELETE FROM carts" -> <no response>\n$`, out.String())
+}
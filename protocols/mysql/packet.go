@@ -0,0 +1,473 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	headerLen     = 4        // 3字节小端长度和1字节序号
+	maxPayloadLen = 0xffffff // 等于该长度的包后面还有续包
+)
+
+var errShortPacket = errors.New("short packet")
+
+// CapabilityFlags 客户端和服务器的能力标志
+type CapabilityFlags uint32
+
+// 常用的能力标志
+const (
+	ClientLongPassword               CapabilityFlags = 1 << 0
+	ClientFoundRows                  CapabilityFlags = 1 << 1
+	ClientLongFlag                   CapabilityFlags = 1 << 2
+	ClientConnectWithDB              CapabilityFlags = 1 << 3
+	ClientCompress                   CapabilityFlags = 1 << 5
+	ClientLocalFiles                 CapabilityFlags = 1 << 7
+	ClientProtocol41                 CapabilityFlags = 1 << 9
+	ClientSSL                        CapabilityFlags = 1 << 11
+	ClientTransactions               CapabilityFlags = 1 << 13
+	ClientSecureConnection           CapabilityFlags = 1 << 15
+	ClientMultiStatements            CapabilityFlags = 1 << 16
+	ClientMultiResults               CapabilityFlags = 1 << 17
+	ClientPSMultiResults             CapabilityFlags = 1 << 18
+	ClientPluginAuth                 CapabilityFlags = 1 << 19
+	ClientConnectAttrs               CapabilityFlags = 1 << 20
+	ClientPluginAuthLenencClientData CapabilityFlags = 1 << 21
+	ClientSessionTrack               CapabilityFlags = 1 << 23
+	ClientDeprecateEOF               CapabilityFlags = 1 << 24
+	ClientQueryAttributes            CapabilityFlags = 1 << 27
+)
+
+var capabilityNames = []struct {
+	flag CapabilityFlags
+	name string
+}{
+	{ClientLongPassword, "LONG_PASSWORD"},
+	{ClientFoundRows, "FOUND_ROWS"},
+	{ClientLongFlag, "LONG_FLAG"},
+	{ClientConnectWithDB, "CONNECT_WITH_DB"},
+	{ClientCompress, "COMPRESS"},
+	{ClientLocalFiles, "LOCAL_FILES"},
+	{ClientProtocol41, "PROTOCOL_41"},
+	{ClientSSL, "SSL"},
+	{ClientTransactions, "TRANSACTIONS"},
+	{ClientSecureConnection, "SECURE_CONNECTION"},
+	{ClientMultiStatements, "MULTI_STATEMENTS"},
+	{ClientMultiResults, "MULTI_RESULTS"},
+	{ClientPSMultiResults, "PS_MULTI_RESULTS"},
+	{ClientPluginAuth, "PLUGIN_AUTH"},
+	{ClientConnectAttrs, "CONNECT_ATTRS"},
+	{ClientPluginAuthLenencClientData, "PLUGIN_AUTH_LENENC_CLIENT_DATA"},
+	{ClientSessionTrack, "SESSION_TRACK"},
+	{ClientDeprecateEOF, "DEPRECATE_EOF"},
+	{ClientQueryAttributes, "QUERY_ATTRIBUTES"},
+}
+
+// Has 是否包含标志
+func (f CapabilityFlags) Has(flag CapabilityFlags) bool {
+	return f&flag != 0
+}
+
+// String 返回以|分隔的标志名，未命名的标志以十六进制表示
+func (f CapabilityFlags) String() string {
+	var names []string
+	rest := f
+	for _, c := range capabilityNames {
+		if f.Has(c.flag) {
+			names = append(names, c.name)
+			rest &^= c.flag
+		}
+	}
+	if rest != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(rest)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// 服务器状态标志
+const (
+	statusMoreResultsExists = 0x0008
+	statusCursorExists      = 0x0040
+)
+
+// byteReader 包读取器，读取越界时ok变为false
+type byteReader struct {
+	data []byte
+	ok   bool
+}
+
+func newByteReader(data []byte) *byteReader {
+	return &byteReader{data: data, ok: true}
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// uint 读取n字节的小端整数
+func (r *byteReader) uint(n int) uint64 {
+	var v uint64
+	for i, b := range r.bytes(n) {
+		v |= uint64(b) << (8 * i)
+	}
+	return v
+}
+
+// lenenc 读取长度编码整数，0xfb（NULL）返回null为true
+func (r *byteReader) lenenc() (v uint64, null bool) {
+	switch b := r.u8(); b {
+	case 0xfb:
+		return 0, true
+	case 0xfc:
+		return r.uint(2), false
+	case 0xfd:
+		return r.uint(3), false
+	case 0xfe:
+		return r.uint(8), false
+	case 0xff:
+		r.ok = false
+		return 0, false
+	default:
+		return uint64(b), false
+	}
+}
+
+// lenencBytes 读取长度编码字符串
+func (r *byteReader) lenencBytes() []byte {
+	n, _ := r.lenenc()
+	if n > uint64(len(r.data)) {
+		r.ok = false
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+// nulString 读取以0结尾的字符串，没有0时读取剩余的全部数据
+func (r *byteReader) nulString() string {
+	if !r.ok {
+		return ""
+	}
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		s := string(r.data)
+		r.data = nil
+		return s
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+func (r *byteReader) err() error {
+	if !r.ok {
+		return errShortPacket
+	}
+	return nil
+}
+
+// ServerError 服务器返回的ERR包
+type ServerError struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+func (e *ServerError) Error() string {
+	if e.SQLState == "" {
+		return fmt.Sprintf("ERROR %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("ERROR %d (%s): %s", e.Code, e.SQLState, e.Message)
+}
+
+// parseError 解析ERR包（0xff开头）
+func parseError(payload []byte) (*ServerError, error) {
+	r := newByteReader(payload[1:])
+	e := &ServerError{Code: uint16(r.uint(2))}
+	if len(r.data) > 0 && r.data[0] == '#' {
+		r.bytes(1)
+		e.SQLState = string(r.bytes(5))
+	}
+	e.Message = string(r.data)
+	return e, r.err()
+}
+
+// okPacket OK包或DEPRECATE_EOF时结束结果集的0xfe包
+type okPacket struct {
+	affectedRows uint64
+	lastInsertID uint64
+	status       uint16
+	warnings     uint16
+}
+
+func parseOK(payload []byte) (okPacket, error) {
+	r := newByteReader(payload[1:])
+	var ok okPacket
+	ok.affectedRows, _ = r.lenenc()
+	ok.lastInsertID, _ = r.lenenc()
+	ok.status = uint16(r.uint(2))
+	ok.warnings = uint16(r.uint(2))
+	return ok, r.err()
+}
+
+// isEOF 是否为协议4.1的EOF包：0xfe开头，共5字节（警告数和状态）
+func isEOF(payload []byte) bool {
+	return len(payload) == 5 && payload[0] == 0xfe
+}
+
+// eofStatus EOF包中的服务器状态
+func eofStatus(payload []byte) uint16 {
+	return binary.LittleEndian.Uint16(payload[3:])
+}
+
+// greeting 服务器的初始握手包（协议版本10）
+type greeting struct {
+	serverVersion string
+	connectionID  uint32
+	capabilities  CapabilityFlags
+	authPlugin    string
+}
+
+func parseGreeting(payload []byte) (*greeting, error) {
+	r := newByteReader(payload)
+	if r.u8() != 10 {
+		return nil, errors.New("unsupported protocol version")
+	}
+	g := &greeting{serverVersion: r.nulString()}
+	g.connectionID = uint32(r.uint(4))
+	r.bytes(8 + 1) // auth-plugin-data-part-1和填充
+	g.capabilities = CapabilityFlags(r.uint(2))
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	if len(r.data) == 0 {
+		return g, nil
+	}
+	r.bytes(1) // 字符集
+	r.bytes(2) // 状态
+	g.capabilities |= CapabilityFlags(r.uint(2)) << 16
+	authDataLen := int(r.u8())
+	r.bytes(10)
+	if g.capabilities.Has(ClientSecureConnection) {
+		r.bytes(max(13, authDataLen-8))
+	}
+	if g.capabilities.Has(ClientPluginAuth) {
+		g.authPlugin = r.nulString()
+	}
+	return g, r.err()
+}
+
+// handshakeResponse 客户端的握手响应，sslRequest为true时是只有前32字节的SSL请求
+type handshakeResponse struct {
+	capabilities CapabilityFlags
+	user         string
+	database     string
+	authPlugin   string
+	sslRequest   bool
+}
+
+func parseHandshakeResponse(payload []byte) (*handshakeResponse, error) {
+	r := newByteReader(payload)
+	h := &handshakeResponse{capabilities: CapabilityFlags(r.uint(2))}
+	if !h.capabilities.Has(ClientProtocol41) {
+		// 协议3.20：2字节能力、3字节最大包长度、用户名和认证数据
+		r.bytes(3)
+		h.user = r.nulString()
+		return h, r.err()
+	}
+	h.capabilities |= CapabilityFlags(r.uint(2)) << 16
+	r.bytes(4 + 1 + 23) // 最大包长度、字符集和填充
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	if len(r.data) == 0 {
+		h.sslRequest = h.capabilities.Has(ClientSSL)
+		return h, nil
+	}
+	h.user = r.nulString()
+	switch {
+	case h.capabilities.Has(ClientPluginAuthLenencClientData):
+		r.lenencBytes()
+	case h.capabilities.Has(ClientSecureConnection):
+		r.bytes(int(r.u8()))
+	default:
+		r.nulString()
+	}
+	if h.capabilities.Has(ClientConnectWithDB) {
+		h.database = r.nulString()
+	}
+	if h.capabilities.Has(ClientPluginAuth) {
+		h.authPlugin = r.nulString()
+	}
+	return h, r.err()
+}
+
+// 列类型
+const (
+	typeDecimal    = 0x00
+	typeTiny       = 0x01
+	typeShort      = 0x02
+	typeLong       = 0x03
+	typeFloat      = 0x04
+	typeDouble     = 0x05
+	typeNull       = 0x06
+	typeTimestamp  = 0x07
+	typeLongLong   = 0x08
+	typeInt24      = 0x09
+	typeDate       = 0x0a
+	typeTime       = 0x0b
+	typeDateTime   = 0x0c
+	typeYear       = 0x0d
+	typeTimestamp2 = 0x11
+	typeDateTime2  = 0x12
+	typeTime2      = 0x13
+)
+
+// paramType 参数的类型和是否无符号
+type paramType struct {
+	typ      byte
+	unsigned bool
+}
+
+// parseParams 解析二进制协议的参数：NULL位图、new_params_bound_flag、类型（及查询属性的名字）和值
+// 没有绑定新类型时使用types，返回本次使用的类型和格式化后的参数
+func parseParams(r *byteReader, n int, names bool, types []paramType, maxLen int) ([]paramType, []string, error) {
+	nullBitmap := r.bytes((n + 7) / 8)
+	if r.u8() == 1 {
+		types = make([]paramType, n)
+		for i := range types {
+			types[i] = paramType{typ: r.u8(), unsigned: r.u8()&0x80 != 0}
+			if names {
+				r.lenencBytes()
+			}
+		}
+	}
+	if err := r.err(); err != nil {
+		return nil, nil, err
+	}
+	if len(types) != n {
+		return nil, nil, errors.New("parameter types unknown")
+	}
+	params := make([]string, n)
+	for i, t := range types {
+		if nullBitmap[i/8]&(1<<(i%8)) != 0 {
+			params[i] = "NULL"
+			continue
+		}
+		params[i] = binaryValue(r, t, maxLen)
+	}
+	return types, params, r.err()
+}
+
+// binaryValue 读取并格式化二进制协议的一个值，字符串以带引号的形式返回
+func binaryValue(r *byteReader, t paramType, maxLen int) string {
+	integer := func(size int) string {
+		v := r.uint(size)
+		if t.unsigned {
+			return strconv.FormatUint(v, 10)
+		}
+		shift := 64 - 8*size
+		return strconv.FormatInt(int64(v<<shift)>>shift, 10)
+	}
+	switch t.typ {
+	case typeNull:
+		return "NULL"
+	case typeTiny:
+		return integer(1)
+	case typeShort, typeYear:
+		return integer(2)
+	case typeLong, typeInt24:
+		return integer(4)
+	case typeLongLong:
+		return integer(8)
+	case typeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(r.uint(4)))), 'g', -1, 32)
+	case typeDouble:
+		return strconv.FormatFloat(math.Float64frombits(r.uint(8)), 'g', -1, 64)
+	case typeDate, typeDateTime, typeTimestamp, typeDateTime2, typeTimestamp2:
+		return dateTime(newByteReader(r.bytes(int(r.u8()))))
+	case typeTime, typeTime2:
+		return duration(newByteReader(r.bytes(int(r.u8()))))
+	}
+	// 其余类型（字符串、BLOB、DECIMAL、JSON等）为长度编码字符串
+	b := r.lenencBytes()
+	s := strconv.Quote(string(b[:min(len(b), maxLen)]))
+	if len(b) > maxLen {
+		s += fmt.Sprintf("...(%d bytes)", len(b))
+	}
+	return s
+}
+
+// dateTime 格式化二进制协议的日期时间，长度为0、4、7或11字节
+func dateTime(r *byteReader) string {
+	if len(r.data) == 0 {
+		return "0000-00-00 00:00:00"
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", r.uint(2), r.u8(), r.u8())
+	if len(r.data) >= 3 {
+		s += fmt.Sprintf(" %02d:%02d:%02d", r.u8(), r.u8(), r.u8())
+	}
+	if len(r.data) >= 4 {
+		s += fmt.Sprintf(".%06d", r.uint(4))
+	}
+	return s
+}
+
+// duration 格式化二进制协议的时间，长度为0、8或12字节
+func duration(r *byteReader) string {
+	if len(r.data) == 0 {
+		return "00:00:00"
+	}
+	sign := ""
+	if r.u8() == 1 {
+		sign = "-"
+	}
+	days := r.uint(4)
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, days*24+uint64(r.u8()), r.u8(), r.u8())
+	if len(r.data) >= 4 {
+		s += fmt.Sprintf(".%06d", r.uint(4))
+	}
+	return s
+}
+
+// packetFramer 按3字节小端长度切分包，每条消息包含4字节的包头
+type packetFramer struct{}
+
+func (packetFramer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < headerLen {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	n := headerLen + (int(data[0]) | int(data[1])<<8 | int(data[2])<<16)
+	if len(data) < n {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	return n, data[:n], nil
+}
@@ -0,0 +1,513 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxPrepared 每个连接记住的预处理语句数上限
+const maxPrepared = 4096
+
+// phase 连接所处的阶段
+type phase int
+
+const (
+	phaseInit    phase = iota // 等待初始握手包；抓包从中途开始时收到命令即进入命令阶段
+	phaseLogin                // 收到初始握手包，等待客户端的握手响应
+	phaseAuth                 // 等待认证结果
+	phaseCommand              // 命令阶段
+	phaseIgnore               // 压缩协议或切换到TLS之后，不再解析
+)
+
+// respState 命令响应的解析状态
+type respState int
+
+const (
+	stateIdle        respState = iota
+	stateFirst                 // 等待响应的第一个包，或多结果中的下一个结果
+	stateColumnDefs            // 读取列定义
+	stateColumnsEnd            // 列定义之后，协议4.1在没有DEPRECATE_EOF时有一个EOF包
+	stateRows                  // 读取行，直到EOF、OK或ERR
+	statePrepareDefs           // 读取预处理响应的参数和列定义
+	statePrepareEOF            // 预处理响应最后的EOF包
+	stateLocalInfile           // LOAD DATA LOCAL：客户端发送文件内容，等待OK或ERR
+)
+
+// preparedStmt 预处理语句
+type preparedStmt struct {
+	query  string
+	params int
+	types  []paramType // 最近一次执行绑定的参数类型
+}
+
+// processor MySQL处理器，每次调用必须是一个完整的包（含4字节包头），由 FramedProcessor 包装
+// MySQL是请求-响应协议，同一时间只有一个命令在等待响应
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+
+	phase        phase
+	handshake    *Handshake
+	capabilities CapabilityFlags // 握手协商的能力，没有看到握手时为0
+	database     string          // 当前数据库
+	nextDatabase string          // 命令成功后切换到的数据库
+	partial      [2][]byte       // 超过16MB的包已收到的第一部分
+
+	current  *Statement
+	state    respState
+	defs     int // 剩余的列定义数，-1表示直到EOF包
+	prepared map[uint32]*preparedStmt
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{
+		streamInfo: streamInfo,
+		config:     config,
+		prepared:   make(map[uint32]*preparedStmt),
+	}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一个带时间戳的包，没有时间戳时使用当前时间
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if p.phase == phaseIgnore || len(data) < headerLen {
+		return nil
+	}
+	seq, payload := data[3], data[headerLen:]
+
+	// 超过16MB的负载被拆成多个包，只保留第一个包的内容，足够取出SQL的开头和响应的类型
+	idx := 0
+	if dir == reassembly.TCPDirServerToClient {
+		idx = 1
+	}
+	if p.partial[idx] != nil {
+		if len(payload) == maxPayloadLen {
+			return nil
+		}
+		payload, p.partial[idx] = p.partial[idx], nil
+	} else if len(payload) == maxPayloadLen {
+		p.partial[idx] = append([]byte(nil), payload...)
+		return nil
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if dir == reassembly.TCPDirClientToServer {
+		return p.client(seq, payload, ts)
+	}
+	return p.server(seq, payload, ts)
+}
+
+// client 处理客户端的包
+func (p *processor) client(seq byte, payload []byte, ts time.Time) error {
+	switch p.phase {
+	case phaseInit:
+		if seq != 0 {
+			return nil
+		}
+		p.phase = phaseCommand
+	case phaseLogin:
+		resp, err := parseHandshakeResponse(payload)
+		if err != nil {
+			return fmt.Errorf("handshake response: %w", err)
+		}
+		h := p.handshake
+		h.ClientCapabilities = resp.capabilities
+		h.User, h.Database = resp.user, resp.database
+		if resp.authPlugin != "" {
+			h.AuthPlugin = resp.authPlugin
+		}
+		p.capabilities = resp.capabilities & h.ServerCapabilities
+		p.database = resp.database
+		if resp.sslRequest {
+			h.TLS, h.Time = true, ts
+			p.config.OnHandshake(h)
+			p.phase = phaseIgnore
+			// 之后是TLS握手，交给注册表重新识别
+			return tcpdumper.SwitchProtocol("", nil, nil)
+		}
+		p.phase = phaseAuth
+		return nil
+	case phaseAuth:
+		return nil
+	}
+	return p.command(seq, payload, ts)
+}
+
+// server 处理服务器的包
+func (p *processor) server(seq byte, payload []byte, ts time.Time) error {
+	switch p.phase {
+	case phaseInit:
+		if seq == 0 && payload[0] == 10 {
+			g, err := parseGreeting(payload)
+			if err != nil {
+				return fmt.Errorf("greeting: %w", err)
+			}
+			p.handshake = &Handshake{
+				StreamInfo:         p.streamInfo,
+				ServerVersion:      g.serverVersion,
+				ConnectionID:       g.connectionID,
+				ServerCapabilities: g.capabilities,
+				AuthPlugin:         g.authPlugin,
+			}
+			p.phase = phaseLogin
+			return nil
+		}
+		p.phase = phaseCommand
+	case phaseLogin:
+		return nil
+	case phaseAuth:
+		return p.auth(payload, ts)
+	}
+	return p.response(payload, ts)
+}
+
+// auth 处理认证阶段服务器的包：OK或ERR结束认证，0xfe为切换认证插件，0x01为认证插件的数据
+func (p *processor) auth(payload []byte, ts time.Time) error {
+	h := p.handshake
+	switch payload[0] {
+	case 0x00:
+		p.phase = phaseCommand
+		if p.capabilities.Has(ClientCompress) {
+			// 之后的包被压缩，无法解析
+			p.phase = phaseIgnore
+		}
+	case 0xff:
+		e, err := parseError(payload)
+		if err != nil {
+			return fmt.Errorf("auth error: %w", err)
+		}
+		h.Error = e
+		p.phase = phaseCommand
+	case 0xfe:
+		if plugin := newByteReader(payload[1:]).nulString(); plugin != "" {
+			h.AuthPlugin = plugin
+		}
+		return nil
+	default:
+		return nil
+	}
+	h.Time = ts
+	p.config.OnHandshake(h)
+	return nil
+}
+
+// command 处理客户端的命令包
+func (p *processor) command(seq byte, payload []byte, ts time.Time) error {
+	if p.state == stateLocalInfile || seq != 0 {
+		// LOAD DATA LOCAL的文件内容
+		return nil
+	}
+	if p.current != nil {
+		// 预处理响应最后的EOF包可能不存在（DEPRECATE_EOF），其余情况是响应不完整
+		p.finish(p.state == statePrepareEOF)
+	}
+
+	s := &Statement{StreamInfo: p.streamInfo, Command: Command(payload[0]), Database: p.database, RequestTime: ts}
+	r := newByteReader(payload[1:])
+	var err error
+	switch s.Command {
+	case ComQuery:
+		if p.capabilities.Has(ClientQueryAttributes) {
+			n, _ := r.lenenc()
+			r.lenenc() // 参数集数，总是1
+			if n > 0 {
+				if _, s.Params, err = parseParams(r, int(n), true, nil, maxParamLength); err != nil {
+					return fmt.Errorf("query attributes: %w", err)
+				}
+			}
+		}
+		s.Query = p.truncate(r.data)
+		if db, ok := useDatabase(string(r.data)); ok {
+			p.nextDatabase = db
+		}
+	case ComInitDB:
+		s.Query = p.truncate(r.data)
+		p.nextDatabase = string(r.data)
+	case ComStmtPrepare:
+		s.Query = p.truncate(r.data)
+	case ComStmtExecute:
+		err = p.execute(s, r)
+	case ComStmtClose, ComStmtSendLongData:
+		// 没有响应，不回调
+		if s.Command == ComStmtClose {
+			delete(p.prepared, uint32(r.uint(4)))
+		}
+		return nil
+	case ComStmtReset, ComStmtFetch:
+		s.StatementID = uint32(r.uint(4))
+		if stmt := p.prepared[s.StatementID]; stmt != nil {
+			s.Query = stmt.query
+		}
+	case ComChangeUser:
+		r.nulString() // 用户名
+		if p.capabilities.Has(ClientSecureConnection) {
+			r.bytes(int(r.u8()))
+		} else {
+			r.nulString()
+		}
+		p.nextDatabase = r.nulString()
+	case ComQuit:
+		return nil
+	}
+	p.current, p.state = s, stateFirst
+	return err
+}
+
+// execute 解析COM_STMT_EXECUTE的语句ID和参数，参数个数和类型来自预处理响应和之前的执行
+func (p *processor) execute(s *Statement, r *byteReader) error {
+	s.StatementID = uint32(r.uint(4))
+	flags := r.u8()
+	r.uint(4) // 迭代次数，总是1
+	stmt := p.prepared[s.StatementID]
+	if stmt == nil {
+		return nil
+	}
+	s.Query = stmt.query
+	n := stmt.params
+	attrs := p.capabilities.Has(ClientQueryAttributes)
+	if attrs && flags&0x08 != 0 {
+		// PARAMETER_COUNT_AVAILABLE：参数个数包括查询属性
+		count, _ := r.lenenc()
+		n = int(count)
+	}
+	if n == 0 {
+		return nil
+	}
+	types, params, err := parseParams(r, n, attrs, stmt.types, maxParamLength)
+	if err != nil {
+		return fmt.Errorf("execute parameters: %w", err)
+	}
+	stmt.types, s.Params = types, params
+	return nil
+}
+
+// response 处理服务器对当前命令的响应
+func (p *processor) response(payload []byte, ts time.Time) error {
+	s := p.current
+	if s == nil {
+		return nil
+	}
+	s.ResponseTime = ts
+
+	switch p.state {
+	case stateFirst, stateLocalInfile:
+		return p.first(payload)
+	case stateColumnDefs:
+		if payload[0] == 0xfe {
+			if p.defs < 0 {
+				p.finish(true)
+			}
+			return nil
+		}
+		if p.defs--; p.defs == 0 {
+			p.state = stateColumnsEnd
+		}
+	case stateColumnsEnd:
+		if isEOF(payload) {
+			if eofStatus(payload)&statusCursorExists != 0 {
+				// 打开了游标，行通过COM_STMT_FETCH获取
+				p.finish(true)
+			} else {
+				p.state = stateRows
+			}
+			return nil
+		}
+		p.state = stateRows
+		return p.row(payload)
+	case stateRows:
+		return p.row(payload)
+	case statePrepareDefs:
+		if payload[0] == 0xfe {
+			return nil
+		}
+		if p.defs--; p.defs == 0 {
+			if p.capabilities.Has(ClientDeprecateEOF) {
+				p.finish(true)
+			} else {
+				p.state = statePrepareEOF
+			}
+		}
+	case statePrepareEOF:
+		if isEOF(payload) {
+			p.finish(true)
+		}
+	}
+	return nil
+}
+
+// first 处理响应的第一个包：OK、ERR、LOCAL INFILE请求、预处理响应或结果集的列数
+func (p *processor) first(payload []byte) error {
+	s := p.current
+	switch {
+	case payload[0] == 0xff:
+		e, err := parseError(payload)
+		if err != nil {
+			return fmt.Errorf("error packet: %w", err)
+		}
+		s.Error = e
+		p.finish(true)
+	case s.Command == ComChangeUser && (payload[0] == 0xfe || payload[0] == 0x01):
+		// 切换认证插件或认证数据，等待OK或ERR
+	case s.Command == ComStmtPrepare && payload[0] == 0x00 && p.state == stateFirst:
+		return p.prepareOK(payload)
+	case payload[0] == 0x00, isEOF(payload):
+		return p.ok(payload)
+	case payload[0] == 0xfb && p.state == stateFirst:
+		p.state = stateLocalInfile
+	case s.Command == ComStatistics:
+		p.finish(true)
+	case s.Command == ComFieldList:
+		p.state, p.defs = stateColumnDefs, -1
+	default:
+		r := newByteReader(payload)
+		n, _ := r.lenenc()
+		if err := r.err(); err != nil || n == 0 {
+			return fmt.Errorf("unexpected response 0x%02x to %s", payload[0], s.Command)
+		}
+		s.Columns = int(n)
+		s.Results++
+		p.state, p.defs = stateColumnDefs, int(n)
+	}
+	return nil
+}
+
+// prepareOK 处理COM_STMT_PREPARE_OK：语句ID、列数和参数个数，之后是参数和列的定义
+func (p *processor) prepareOK(payload []byte) error {
+	s := p.current
+	r := newByteReader(payload[1:])
+	s.StatementID = uint32(r.uint(4))
+	columns := int(r.uint(2))
+	params := int(r.uint(2))
+	r.u8()
+	s.Warnings = uint16(r.uint(2))
+	if err := r.err(); err != nil {
+		return fmt.Errorf("prepare response: %w", err)
+	}
+	s.Columns = columns
+	if len(p.prepared) >= maxPrepared {
+		for id := range p.prepared {
+			delete(p.prepared, id)
+			break
+		}
+	}
+	p.prepared[s.StatementID] = &preparedStmt{query: s.Query, params: params}
+
+	if params+columns == 0 {
+		p.finish(true)
+		return nil
+	}
+	p.state, p.defs = statePrepareDefs, params+columns
+	return nil
+}
+
+// ok 处理OK包（包括COM_SET_OPTION等命令的EOF包），有更多结果时继续等待
+func (p *processor) ok(payload []byte) error {
+	s := p.current
+	var status uint16
+	if isEOF(payload) {
+		status = eofStatus(payload)
+	} else {
+		ok, err := parseOK(payload)
+		if err != nil {
+			return fmt.Errorf("ok packet: %w", err)
+		}
+		s.AffectedRows += ok.affectedRows
+		if ok.lastInsertID != 0 {
+			s.LastInsertID = ok.lastInsertID
+		}
+		s.Warnings, status = ok.warnings, ok.status
+	}
+	s.Results++
+	if status&statusMoreResultsExists != 0 {
+		p.state = stateFirst
+		return nil
+	}
+	p.finish(true)
+	return nil
+}
+
+// row 处理结果集的行，EOF、以0xfe开头的OK包或ERR包结束结果集
+func (p *processor) row(payload []byte) error {
+	s := p.current
+	switch {
+	case payload[0] == 0xff:
+		e, err := parseError(payload)
+		if err != nil {
+			return fmt.Errorf("error packet: %w", err)
+		}
+		s.Error = e
+		p.finish(true)
+	case payload[0] == 0xfe && len(payload) < maxPayloadLen:
+		var status uint16
+		if isEOF(payload) {
+			status = eofStatus(payload)
+		} else {
+			ok, err := parseOK(payload)
+			if err != nil {
+				return fmt.Errorf("ok packet: %w", err)
+			}
+			s.Warnings, status = ok.warnings, ok.status
+		}
+		if status&statusMoreResultsExists != 0 {
+			p.state = stateFirst
+		} else {
+			p.finish(true)
+		}
+	default:
+		s.Rows++
+	}
+	return nil
+}
+
+// finish 回调当前语句，complete表示收到了完整的响应
+func (p *processor) finish(complete bool) {
+	s := p.current
+	s.Complete = complete
+	if complete && s.Error == nil && p.nextDatabase != "" {
+		p.database = p.nextDatabase
+	}
+	p.nextDatabase = ""
+	p.current, p.state = nil, stateIdle
+	p.config.OnStatement(s)
+}
+
+// truncate 截断过长的SQL
+func (p *processor) truncate(query []byte) string {
+	if len(query) > p.config.MaxQueryLength {
+		query = query[:p.config.MaxQueryLength]
+	}
+	return string(query)
+}
+
+// useDatabase 识别 USE db 语句
+func useDatabase(query string) (string, bool) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(query), ";"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "USE") {
+		return "", false
+	}
+	return strings.Trim(fields[1], "`"), true
+}
+
+// Close 回调仍在等待响应的语句
+func (p *processor) Close() error {
+	if p.current != nil {
+		p.finish(p.state == statePrepareEOF)
+	}
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
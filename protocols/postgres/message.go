@@ -0,0 +1,213 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 不带类型字节的启动阶段消息的请求码
+const (
+	protocolVersion3 = 3 << 16
+	sslRequestCode   = 80877103
+	gssEncRequest    = 80877104
+	cancelRequest    = 80877102
+)
+
+var errShortMessage = errors.New("short message")
+
+// byteReader 消息读取器，读取越界时ok变为false
+type byteReader struct {
+	data []byte
+	ok   bool
+}
+
+func newByteReader(data []byte) *byteReader {
+	return &byteReader{data: data, ok: true}
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n < 0 || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) u16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *byteReader) u32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// cstring 读取以0结尾的字符串，没有0时（消息被截断）读取剩余的全部数据
+func (r *byteReader) cstring() string {
+	if !r.ok {
+		return ""
+	}
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		s := string(r.data)
+		r.data = nil
+		return s
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+func (r *byteReader) err() error {
+	if !r.ok {
+		return errShortMessage
+	}
+	return nil
+}
+
+// ServerError 服务器返回的ErrorResponse
+type ServerError struct {
+	Severity string            // 严重级别，如 ERROR、FATAL
+	Code     string            // SQLSTATE
+	Message  string            // 主要信息
+	Detail   string            // 详细信息
+	Hint     string            // 提示
+	Fields   map[string]string // 所有字段，键为字段类型字节，如 "P" 为错误位置
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Severity, e.Code, e.Message)
+}
+
+// parseError 解析ErrorResponse和NoticeResponse的字段
+func parseError(body []byte) *ServerError {
+	e := &ServerError{Fields: make(map[string]string)}
+	r := newByteReader(body)
+	for r.ok && len(r.data) > 0 {
+		code := r.u8()
+		if code == 0 {
+			break
+		}
+		value := r.cstring()
+		e.Fields[string(code)] = value
+		switch code {
+		case 'S':
+			if e.Severity == "" {
+				e.Severity = value
+			}
+		case 'V':
+			// 不随语言设置变化的严重级别
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		case 'H':
+			e.Hint = value
+		}
+	}
+	return e
+}
+
+// tagRows 从CommandComplete的标签中取出行数，如 "SELECT 5"、"INSERT 0 1"；没有行数时返回false
+func tagRows(tag string) (int64, bool) {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	switch fields[0] {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "FETCH", "MOVE", "COPY":
+		n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// 常用类型的OID
+const (
+	oidBool    = 16
+	oidBytea   = 17
+	oidName    = 19
+	oidInt8    = 20
+	oidInt2    = 21
+	oidInt4    = 23
+	oidText    = 25
+	oidOID     = 26
+	oidJSON    = 114
+	oidFloat4  = 700
+	oidFloat8  = 701
+	oidBPChar  = 1042
+	oidVarchar = 1043
+	oidUUID    = 2950
+	oidJSONB   = 3802
+)
+
+// formatParam 格式化Bind中的一个参数，文本格式和字符串类型带引号，无法解码的二进制参数以十六进制表示
+func formatParam(value []byte, binaryFormat bool, oid uint32, maxLen int) string {
+	if !binaryFormat {
+		return quote(value, maxLen)
+	}
+	switch {
+	case oid == oidBool && len(value) == 1:
+		return strconv.FormatBool(value[0] != 0)
+	case oid == oidInt2 && len(value) == 2:
+		return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10)
+	case oid == oidInt4 && len(value) == 4:
+		return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10)
+	case oid == oidOID && len(value) == 4:
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+	case oid == oidInt8 && len(value) == 8:
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10)
+	case oid == oidFloat4 && len(value) == 4:
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32)
+	case oid == oidFloat8 && len(value) == 8:
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64)
+	case oid == oidUUID && len(value) == 16:
+		h := hex.EncodeToString(value)
+		return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+	case oid == oidText || oid == oidVarchar || oid == oidBPChar || oid == oidName || oid == oidJSON:
+		return quote(value, maxLen)
+	case oid == oidJSONB && len(value) > 0 && value[0] == 1:
+		// jsonb的二进制格式是版本号1加文本
+		return quote(value[1:], maxLen)
+	}
+	s := `\x` + hex.EncodeToString(value[:min(len(value), maxLen/2)])
+	if len(value) > maxLen/2 {
+		s += fmt.Sprintf("...(%d bytes)", len(value))
+	}
+	return s
+}
+
+// quote 截断并加引号
+func quote(value []byte, maxLen int) string {
+	s := strconv.Quote(string(value[:min(len(value), maxLen)]))
+	if len(value) > maxLen {
+		s += fmt.Sprintf("...(%d bytes)", len(value))
+	}
+	return s
+}
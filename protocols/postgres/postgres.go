@@ -0,0 +1,257 @@
+// Package postgres 提供PostgreSQL前后端协议（3.0）的检测器和处理器
+// 跟踪启动消息、SSLRequest协商和认证，解析简单查询（Query）和扩展查询（Parse/Bind/Execute/Sync）；
+// 每条语句以 Statement 事件的形式交给回调，包含SQL、绑定参数（可脱敏）、CommandComplete标签、行数、错误和延迟
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "PostgreSQL"
+
+const (
+	defaultMaxQueryLength = 4096
+	maxParamLength        = 256 // 参数中的字符串保存的最大长度
+)
+
+// Startup 连接的启动和认证信息
+// 客户端请求SSL且服务器同意时TLS为true，此后的数据交给注册表重新识别（如TLS处理器）
+type Startup struct {
+	StreamInfo       tcpdumper.StreamInfo
+	ProtocolVersion  string            // 如 3.0
+	User             string            // 启动参数中的user
+	Database         string            // 没有指定时与用户名相同
+	Application      string            // application_name
+	Parameters       map[string]string // 启动消息中的全部参数
+	AuthMethod       string            // 认证方式，如 trust、password、md5、SCRAM-SHA-256
+	ServerParameters map[string]string // 认证后服务器通过ParameterStatus报告的参数，如 server_version
+	ProcessID        uint32            // BackendKeyData中的后端进程ID
+	TLS              bool              // 服务器同意了SSLRequest
+	Error            *ServerError      // 认证失败时服务器返回的错误
+	Time             time.Time         // 认证完成的时间
+}
+
+// String 返回启动信息的摘要，如 user="app" database="shop" auth=SCRAM-SHA-256 server=16.2 -> OK
+func (s *Startup) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "user=%q", s.User)
+	if s.Database != "" {
+		fmt.Fprintf(&b, " database=%q", s.Database)
+	}
+	if s.Application != "" {
+		fmt.Fprintf(&b, " application=%q", s.Application)
+	}
+	if s.AuthMethod != "" {
+		fmt.Fprintf(&b, " auth=%s", s.AuthMethod)
+	}
+	if version := s.ServerParameters["server_version"]; version != "" {
+		fmt.Fprintf(&b, " server=%s", version)
+	}
+	switch {
+	case s.TLS:
+		b.WriteString(" -> TLS")
+	case s.Error != nil:
+		fmt.Fprintf(&b, " -> %s", s.Error)
+	default:
+		b.WriteString(" -> OK")
+	}
+	return b.String()
+}
+
+// Statement 一条语句和它的响应
+// 简单查询对应一个Query消息（可能包含多条SQL），扩展查询对应一个Execute消息
+// 连接关闭时仍没有完整响应的，Complete为false
+type Statement struct {
+	StreamInfo tcpdumper.StreamInfo
+	// Query SQL，扩展查询为Parse时的SQL（没有看到Parse时为空）；超过 Config.MaxQueryLength 时被截断
+	Query     string
+	Extended  bool     // 扩展查询协议
+	Name      string   // 扩展查询的预处理语句名，空为未命名语句
+	Portal    string   // 扩展查询的门户名
+	Params    []string // 扩展查询的绑定参数，字符串带引号，NULL为 NULL
+	Tag       string   // 最后一个CommandComplete的标签，如 SELECT 5、INSERT 0 1
+	Rows      int64    // 所有结果的行数：标签中有行数时取标签，否则为DataRow的个数
+	Suspended bool     // Execute达到最大行数，门户被挂起
+	Error     *ServerError
+
+	Complete     bool
+	RequestTime  time.Time
+	ResponseTime time.Time // 响应最后一个消息的时间
+}
+
+// Latency 从请求到响应结束的时间
+func (s *Statement) Latency() time.Duration {
+	if !s.Complete {
+		return 0
+	}
+	return s.ResponseTime.Sub(s.RequestTime)
+}
+
+// String 返回语句的摘要，如 "SELECT * FROM t WHERE id = $1" [42] -> SELECT 1 (1.2ms)
+func (s *Statement) String() string {
+	var b strings.Builder
+	if s.Extended {
+		b.WriteString("EXECUTE")
+		if s.Name != "" {
+			fmt.Fprintf(&b, " %s", s.Name)
+		}
+	} else {
+		b.WriteString("QUERY")
+	}
+	if s.Query != "" {
+		fmt.Fprintf(&b, " %q", s.Query)
+	}
+	if len(s.Params) > 0 {
+		fmt.Fprintf(&b, " [%s]", strings.Join(s.Params, " "))
+	}
+	switch {
+	case !s.Complete:
+		b.WriteString(" -> <no response>")
+		return b.String()
+	case s.Error != nil:
+		fmt.Fprintf(&b, " -> %s", s.Error)
+	case s.Suspended:
+		fmt.Fprintf(&b, " -> suspended %d rows", s.Rows)
+	case s.Tag != "":
+		fmt.Fprintf(&b, " -> %s", s.Tag)
+	default:
+		b.WriteString(" -> <empty>")
+	}
+	fmt.Fprintf(&b, " (%v)", s.Latency())
+	return b.String()
+}
+
+// Config PostgreSQL处理器配置
+type Config struct {
+	// OnStartup 认证完成（或服务器同意SSL）时的回调，为nil时把摘要输出到Output
+	OnStartup func(*Startup)
+	// OnStatement 语句的响应结束或连接关闭时的回调，为nil时把摘要输出到Output
+	OnStatement func(*Statement)
+	Output      io.Writer // 默认回调的输出，nil为标准输出
+
+	MaxQueryLength int  // Statement.Query保存的最大长度，0为默认4096
+	RedactParams   bool // 为true时绑定参数的值替换为 <redacted>（NULL仍为NULL）
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnStartup == nil {
+		c.OnStartup = func(s *Startup) {
+			fmt.Fprintf(w, "POSTGRESQL/%s: %s\n", s.StreamInfo.Ident, s)
+		}
+	}
+	if c.OnStatement == nil {
+		c.OnStatement = func(s *Statement) {
+			fmt.Fprintf(w, "POSTGRESQL/%s: %s\n", s.StreamInfo.Ident, s)
+		}
+	}
+	if c.MaxQueryLength <= 0 {
+		c.MaxQueryLength = defaultMaxQueryLength
+	}
+	return c
+}
+
+// sqlKeywords 抓包从连接中途开始时，用于识别Query和Parse消息的SQL开头
+var sqlKeywords = []string{
+	"SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "SET", "SHOW", "BEGIN", "START", "COMMIT",
+	"ROLLBACK", "CREATE", "ALTER", "DROP", "CALL", "EXPLAIN", "WITH", "COPY", "VALUES", "DECLARE",
+	"FETCH", "LISTEN", "NOTIFY", "DISCARD", "DEALLOCATE",
+}
+
+// Detector PostgreSQL检测器
+// 客户端数据为包含user参数的3.x启动消息、SSLRequest或GSSENCRequest时置信度为90，CancelRequest为80；
+// 抓包从连接中途开始时，客户端数据为以SQL关键字开头的Query或Parse消息置信度为70
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建PostgreSQL检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if dir != reassembly.TCPDirClientToServer || len(data) < 8 {
+		return 0
+	}
+	if data[0] == 0 {
+		return detectStartup(data)
+	}
+
+	length := int(binary.BigEndian.Uint32(data[1:5]))
+	if length < 5 || length > 1<<30 {
+		return 0
+	}
+	body := data[5:min(len(data), 1+length)]
+	switch data[0] {
+	case 'Q':
+	case 'P':
+		// 跳过语句名
+		i := bytes.IndexByte(body, 0)
+		if i < 0 || i > 64 {
+			return 0
+		}
+		body = body[i+1:]
+	default:
+		return 0
+	}
+	query := strings.ToUpper(strings.TrimSpace(string(body[:min(len(body), 64)])))
+	for _, keyword := range sqlKeywords {
+		if strings.HasPrefix(query, keyword) {
+			return 70
+		}
+	}
+	return 0
+}
+
+// detectStartup 检查不带类型字节的启动阶段消息
+func detectStartup(data []byte) int {
+	length := int(binary.BigEndian.Uint32(data))
+	code := binary.BigEndian.Uint32(data[4:8])
+	switch {
+	case length == 8 && (code == sslRequestCode || code == gssEncRequest):
+		return 90
+	case length == 16 && code == cancelRequest:
+		return 80
+	case code>>16 != 3 || length < 8 || length > 10000:
+		return 0
+	}
+	// 启动消息必须包含user参数
+	if !bytes.Contains(data[8:min(len(data), length)], []byte("user\x00")) {
+		return 0
+	}
+	return 90
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, d.config)
+}
+
+// NewProcessor 创建PostgreSQL处理器
+// SSLRequest的响应只有一个字节、无法和普通消息区分，所以处理器自己按协商状态切分消息，而不使用 FramedProcessor
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) tcpdumper.ProtocolProcessor {
+	return newProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册PostgreSQL协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
@@ -0,0 +1,344 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/internal/prototest"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// msg 加上类型字节和4字节长度
+func msg(typ byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(binary.BigEndian.AppendUint32([]byte{typ}, uint32(len(body)+4)), body...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func cstr(s string) []byte { return append([]byte(s), 0) }
+
+// startupMessage 不带类型字节的启动阶段消息，params为交替的参数名和值
+func startupMessage(code uint32, params ...string) []byte {
+	body := be32(code)
+	for _, s := range params {
+		body = append(body, cstr(s)...)
+	}
+	if len(params) > 0 {
+		body = append(body, 0)
+	}
+	return append(be32(uint32(len(body)+4)), body...)
+}
+
+func errorResponse(severity, code, message string) []byte {
+	return msg('E', []byte("S"), cstr(severity), []byte("V"), cstr(severity),
+		[]byte("C"), cstr(code), []byte("M"), cstr(message), []byte{0})
+}
+
+func dataRow(values ...string) []byte {
+	body := be16(uint16(len(values)))
+	for _, v := range values {
+		body = append(append(body, be32(uint32(len(v)))...), v...)
+	}
+	return msg('D', body)
+}
+
+func rowDescription(name string) []byte {
+	return msg('T', be16(1), cstr(name), be32(0), be16(0), be32(oidInt4), be16(4), be32(0xffffffff), be16(0))
+}
+
+func commandComplete(tag string) []byte { return msg('C', cstr(tag)) }
+func readyForQuery(status byte) []byte  { return msg('Z', []byte{status}) }
+
+func collect(config *Config) (*[]*Startup, *[]*Statement) {
+	var startups []*Startup
+	var statements []*Statement
+	config.OnStartup = func(s *Startup) {
+		startups = append(startups, s)
+	}
+	config.OnStatement = func(s *Statement) {
+		statements = append(statements, s)
+	}
+	return &startups, &statements
+}
+
+func newTestProcessor(config Config) tcpdumper.TimedProcessor {
+	return NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config).(tcpdumper.TimedProcessor)
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	startup := startupMessage(protocolVersion3, "user", "app", "database", "shop")
+	assert.Equal(t, 90, d.Detect(startup, c2s))
+	assert.Equal(t, 90, d.Detect(startup[:16], c2s))
+	assert.Equal(t, 90, d.Detect(startupMessage(sslRequestCode), c2s))
+	assert.Equal(t, 90, d.Detect(startupMessage(gssEncRequest), c2s))
+	assert.Equal(t, 80, d.Detect(bytes.Join([][]byte{be32(16), be32(cancelRequest), be32(1), be32(2)}, nil), c2s))
+	assert.Equal(t, 70, d.Detect(msg('Q', cstr("  select 1")), c2s))
+	assert.Equal(t, 70, d.Detect(msg('P', cstr("s1"), cstr("INSERT INTO t VALUES ($1)"), be16(0)), c2s))
+
+	assert.Equal(t, 0, d.Detect(startup, s2c))
+	assert.Equal(t, 0, d.Detect(startupMessage(protocolVersion3, "database", "shop"), c2s))
+	assert.Equal(t, 0, d.Detect(startupMessage(2<<16, "user", "app"), c2s))
+	assert.Equal(t, 0, d.Detect(msg('Q', cstr("hello")), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\n\r\n"), c2s))
+}
+
+func TestStartupAndSimpleQuery(t *testing.T) {
+	config := Config{}
+	startups, statements := collect(&config)
+	p := newTestProcessor(config)
+
+	prototest.Feed(t, p,
+		prototest.C2S(startupMessage(protocolVersion3, "user", "app", "database", "shop", "application_name", "psql")),
+		prototest.S2C(msg('R', be32(10), cstr("SCRAM-SHA-256-PLUS"), cstr("SCRAM-SHA-256"), []byte{0})),
+		prototest.C2S(msg('p', cstr("SCRAM-SHA-256"), be32(4), []byte("n,,x"))),
+		prototest.S2C(msg('R', be32(11), []byte("r=abc"))),
+		prototest.C2S(msg('p', []byte("c=biws"))),
+		prototest.S2C(append(append(append(msg('R', be32(12), []byte("v=xyz")), msg('R', be32(0))...),
+			msg('S', cstr("server_version"), cstr("16.2"))...), msg('K', be32(4242), be32(1))...),
+			readyForQuery('I')),
+		prototest.C2S(msg('Q', cstr("SELECT id FROM users"))),
+		prototest.S2C(rowDescription("id"), dataRow("1"), dataRow("2"),
+			append(commandComplete("SELECT 2"), readyForQuery('I')...)),
+		prototest.C2S(msg('Q', cstr("INSERT INTO t VALUES (1); UPDATE t SET a = 1"))),
+		prototest.S2C(append(append(commandComplete("INSERT 0 1"), commandComplete("UPDATE 3")...), readyForQuery('I')...)),
+		prototest.C2S(msg('Q', cstr("SELEC 1"))),
+		prototest.S2C(append(errorResponse("ERROR", "42601", `syntax error at or near "SELEC"`), readyForQuery('I')...)),
+		prototest.C2S(msg('Q', cstr(""))),
+		prototest.S2C(append(msg('I'), readyForQuery('I')...)),
+	)
+
+	if assert.Len(t, *startups, 1) {
+		s := (*startups)[0]
+		assert.Equal(t, "3.0", s.ProtocolVersion)
+		assert.Equal(t, "psql", s.Parameters["application_name"])
+		assert.Equal(t, uint32(4242), s.ProcessID)
+		assert.Equal(t, prototest.Start.Add(6*time.Millisecond), s.Time)
+		assert.Equal(t, `user="app" database="shop" application="psql" auth=SCRAM-SHA-256 server=16.2 -> OK`, s.String())
+	}
+	if assert.Len(t, *statements, 4) {
+		s := (*statements)[0]
+		assert.Equal(t, "SELECT 2", s.Tag)
+		assert.Equal(t, int64(2), s.Rows)
+		assert.Equal(t, time.Millisecond*4, s.Latency())
+		assert.Equal(t, `QUERY "SELECT id FROM users" -> SELECT 2 (4ms)`, s.String())
+
+		s = (*statements)[1]
+		assert.Equal(t, int64(4), s.Rows)
+		assert.Equal(t, `QUERY "INSERT INTO t VALUES (1); UPDATE t SET a = 1" -> UPDATE 3 (1ms)`, s.String())
+
+		s = (*statements)[2]
+		if assert.NotNil(t, s.Error) {
+			assert.Equal(t, "42601", s.Error.Code)
+			assert.Equal(t, "ERROR", s.Error.Fields["S"])
+		}
+		assert.Equal(t, `QUERY "SELEC 1" -> ERROR 42601: syntax error at or near "SELEC" (1ms)`, s.String())
+
+		assert.Equal(t, `QUERY -> <empty> (1ms)`, (*statements)[3].String())
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	config := Config{}
+	_, statements := collect(&config)
+	p := newTestProcessor(config)
+
+	// 命名语句，第一个参数为二进制int4，第二个为文本，第三个为NULL
+	pipeline := bytes.Join([][]byte{
+		msg('P', cstr("s1"), cstr("SELECT * FROM orders WHERE id = $1 AND status = $2 AND note = $3"), be16(1), be32(oidInt4)),
+		msg('B', cstr(""), cstr("s1"), be16(2), be16(1), be16(0), be16(3),
+			be32(4), be32(42), be32(4), []byte("paid"), be32(0xffffffff), be16(0)),
+		msg('D', []byte("P"), cstr("")),
+		msg('E', cstr(""), be32(0)),
+		msg('S'),
+	}, nil)
+	prototest.Feed(t, p,
+		prototest.C2S(
+			msg('Q', cstr("SET search_path = shop")), // 抓包从连接中途开始
+		),
+		prototest.S2C(append(commandComplete("SET"), readyForQuery('I')...)),
+		prototest.C2S(pipeline),
+		prototest.S2C(bytes.Join([][]byte{msg('1'), msg('2'), rowDescription("id"), dataRow("42")}, nil),
+			append(commandComplete("SELECT 1"), readyForQuery('I')...)),
+	)
+	if assert.Len(t, *statements, 2) {
+		s := (*statements)[1]
+		assert.True(t, s.Extended)
+		assert.Equal(t, "s1", s.Name)
+		assert.Equal(t, []string{"42", `"paid"`, "NULL"}, s.Params)
+		assert.Equal(t, int64(1), s.Rows)
+		assert.Equal(t, prototest.Start.Add(2*time.Millisecond), s.RequestTime)
+		assert.Equal(t, `EXECUTE s1 "SELECT * FROM orders WHERE id = $1 AND status = $2 AND note = $3" [42 "paid" NULL] -> SELECT 1 (2ms)`, s.String())
+	}
+
+	// 重复执行命名语句，参数类型来自ParameterDescription，Execute达到最大行数时门户被挂起
+	*statements = nil
+	prototest.Feed(t, p,
+		prototest.C2S(append(msg('D', []byte("S"), cstr("s1")), msg('S')...)),
+		prototest.S2C(bytes.Join([][]byte{
+			msg('t', be16(3), be32(oidInt4), be32(oidText), be32(oidBool)),
+			rowDescription("id"),
+			readyForQuery('I'),
+		}, nil)),
+		prototest.C2S(bytes.Join([][]byte{
+			msg('B', cstr("c1"), cstr("s1"), be16(1), be16(1), be16(3),
+				be32(4), be32(7), be32(4), []byte("new!"), be32(1), []byte{1}),
+			msg('E', cstr("c1"), be32(2)),
+			msg('S'),
+		}, nil)),
+		prototest.S2C(bytes.Join([][]byte{
+			msg('2'), dataRow("1"), dataRow("2"), msg('s'),
+			readyForQuery('T'),
+		}, nil)),
+	)
+	if assert.Len(t, *statements, 1) {
+		s := (*statements)[0]
+		assert.Equal(t, "c1", s.Portal)
+		assert.True(t, s.Suspended)
+		assert.Equal(t, `EXECUTE s1 "SELECT * FROM orders WHERE id = $1 AND status = $2 AND note = $3" [7 "new!" true] -> suspended 2 rows (1ms)`, s.String())
+	}
+}
+
+func TestExtendedQueryError(t *testing.T) {
+	config := Config{RedactParams: true}
+	_, statements := collect(&config)
+	p := newTestProcessor(config)
+
+	// Parse出错时服务器忽略直到Sync的消息，其后的Execute以同一个错误结束
+	prototest.Feed(t, p,
+		prototest.C2S(bytes.Join([][]byte{
+			msg('P', cstr(""), cstr("SELECT * FROM missing WHERE id = $1"), be16(0)),
+			msg('B', cstr(""), cstr(""), be16(0), be16(1), be32(2), []byte("10"), be16(0)),
+			msg('E', cstr(""), be32(0)),
+		}, nil)),
+		prototest.S2C(errorResponse("ERROR", "42P01", `relation "missing" does not exist`)),
+		prototest.C2S(msg('E', cstr(""), be32(0)),
+			append(msg('S'), msg('P', cstr(""), cstr("UPDATE t SET v = $1"), be16(0))...),
+			msg('B', cstr(""), cstr(""), be16(0), be16(1), be32(6), []byte("secret"), be16(0)),
+			append(msg('E', cstr(""), be32(0)), msg('S')...)),
+		prototest.S2C(readyForQuery('I'),
+			bytes.Join([][]byte{msg('1'), msg('2'), commandComplete("UPDATE 5"), readyForQuery('I')}, nil)),
+	)
+	if assert.Len(t, *statements, 3) {
+		assert.Equal(t, `EXECUTE "SELECT * FROM missing WHERE id = $1" [<redacted>] -> ERROR 42P01: relation "missing" does not exist (1ms)`,
+			(*statements)[0].String())
+		assert.Equal(t, `EXECUTE "SELECT * FROM missing WHERE id = $1" [<redacted>] -> ERROR 42P01: relation "missing" does not exist (0s)`,
+			(*statements)[1].String())
+		s := (*statements)[2]
+		assert.Nil(t, s.Error)
+		assert.Equal(t, int64(5), s.Rows)
+		assert.Equal(t, `EXECUTE "UPDATE t SET v = $1" [<redacted>] -> UPDATE 5 (2ms)`, s.String())
+	}
+}
+
+func TestSSLRequest(t *testing.T) {
+	config := Config{}
+	startups, _ := collect(&config)
+	p := newTestProcessor(config)
+
+	// 服务器拒绝SSL后客户端以明文继续
+	prototest.Feed(t, p,
+		prototest.C2S(startupMessage(sslRequestCode)),
+		prototest.S2C([]byte("N")),
+		prototest.C2S(startupMessage(protocolVersion3, "user", "app")),
+		prototest.S2C(append(append(msg('R', be32(5), []byte("salt")), msg('R', be32(0))...), readyForQuery('I')...)),
+	)
+	if assert.Len(t, *startups, 1) {
+		assert.Equal(t, `user="app" database="app" auth=md5 -> OK`, (*startups)[0].String())
+	}
+
+	// 服务器同意SSL，之后的数据交给注册表重新识别
+	*startups = nil
+	p = newTestProcessor(config)
+	assert.NoError(t, p.ProcessData(startupMessage(sslRequestCode), c2s, true, false))
+	err := p.ProcessData([]byte("S\x16\x03\x03"), s2c, true, false)
+	var ps *tcpdumper.ProtocolSwitch
+	if assert.ErrorAs(t, err, &ps) {
+		assert.Empty(t, ps.Protocol)
+		assert.Empty(t, ps.ClientData)
+		assert.Equal(t, []byte{0x16, 0x03, 0x03}, ps.ServerData)
+	}
+	if assert.Len(t, *startups, 1) {
+		assert.True(t, (*startups)[0].TLS)
+		assert.Equal(t, `user="" -> TLS`, (*startups)[0].String())
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	config := Config{}
+	startups, _ := collect(&config)
+	p := newTestProcessor(config)
+	prototest.Feed(t, p,
+		prototest.C2S(startupMessage(protocolVersion3, "user", "app", "database", "shop")),
+		prototest.S2C(append(msg('R', be32(3)), errorResponse("FATAL", "28P01", `password authentication failed for user "app"`)...)),
+	)
+	if assert.Len(t, *startups, 1) {
+		assert.Equal(t, `user="app" database="shop" auth=password -> FATAL 28P01: password authentication failed for user "app"`,
+			(*startups)[0].String())
+	}
+}
+
+func TestLargeMessages(t *testing.T) {
+	config := Config{}
+	_, statements := collect(&config)
+	p := newTestProcessor(config)
+
+	// 超过上限的DataRow只读取开头，其余部分被跳过
+	big := dataRow(string(bytes.Repeat([]byte("x"), 3*maxMessageSize)))
+	prototest.Feed(t, p,
+		prototest.C2S(msg('Q', cstr("SELECT blob FROM files"))),
+		prototest.S2C(big[:maxMessageSize/2], big[maxMessageSize/2:2*maxMessageSize], big[2*maxMessageSize:],
+			append(dataRow("y"), commandComplete("SELECT 2")...), readyForQuery('I')),
+		prototest.C2S(msg('Q', cstr("SELECT 1"))),
+	)
+	assert.NoError(t, p.Close())
+	if assert.Len(t, *statements, 2) {
+		assert.Equal(t, `QUERY "SELECT blob FROM files" -> SELECT 2 (5ms)`, (*statements)[0].String())
+		assert.Equal(t, `QUERY "SELECT 1" -> <no response>`, (*statements)[1].String())
+	}
+}
+
+func TestFormatParam(t *testing.T) {
+	assert.Equal(t, `"abc"`, formatParam([]byte("abc"), false, oidInt4, 8))
+	assert.Equal(t, `"abcdefgh"...(10 bytes)`, formatParam([]byte("abcdefghij"), false, 0, 8))
+	assert.Equal(t, "-2", formatParam(be16(0xfffe), true, oidInt2, 8))
+	assert.Equal(t, "9000000000", formatParam(binary.BigEndian.AppendUint64(nil, 9e9), true, oidInt8, 8))
+	assert.Equal(t, "1.5", formatParam(binary.BigEndian.AppendUint64(nil, 0x3ff8000000000000), true, oidFloat8, 8))
+	assert.Equal(t, "00112233-4455-6677-8899-aabbccddeeff",
+		formatParam([]byte{0, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, true, oidUUID, 8))
+	assert.Equal(t, `"{\"a\":1}"`, formatParam([]byte("\x01{\"a\":1}"), true, oidJSONB, 16))
+	assert.Equal(t, `\x01020304...(5 bytes)`, formatParam([]byte{1, 2, 3, 4, 5}, true, oidBytea, 8))
+
+	n, ok := tagRows("INSERT 0 7")
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), n)
+	_, ok = tagRows("CREATE TABLE")
+	assert.False(t, ok)
+}
+
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:5432"}, nil)
+	startup := startupMessage(protocolVersion3, "user", "app", "database", "shop")
+	assert.NoError(t, d.ProcessData(startup[:10], c2s, true, false))
+	assert.NoError(t, d.ProcessData(startup[10:], c2s, false, false))
+	assert.NoError(t, d.ProcessData(append(msg('R', be32(0)), readyForQuery('I')...), s2c, true, false))
+	assert.NoError(t, d.ProcessData(msg('Q', cstr("DELETE FROM carts")), c2s, false, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^POSTGRESQL/a:1-b:5432: user="app" database="shop" auth=trust -> OK\n`+
+		`POSTGRESQL/a:1-b:5432: QUERY "DELETE FROM carts" -> <no response>\n$`, out.String())
+}
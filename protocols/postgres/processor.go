@@ -0,0 +1,593 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	maxMessageSize = 1 << 20 // 超过的消息（如大的DataRow或COPY数据）只交付开头，其余部分直接跳过
+	maxPrepared    = 4096    // 每个连接记住的预处理语句数上限
+	maxPending     = 10000   // 等待响应的消息数上限，超过时最早的语句按没有响应回调
+)
+
+// phase 连接所处的阶段
+type phase int
+
+const (
+	phaseStartup phase = iota // 等待启动消息；抓包从中途开始时收到带类型的消息即进入查询阶段
+	phaseAuth                 // 等待认证结果
+	phaseReady                // 查询阶段
+	phaseIgnore               // GSSAPI加密、切换到TLS或无法继续分帧之后，不再解析
+)
+
+// preparedStmt 预处理语句
+type preparedStmt struct {
+	query string
+	types []uint32 // 参数类型的OID，Parse时未指定的由ParameterDescription补充
+}
+
+// portal Bind创建的门户
+type portal struct {
+	name   string // 预处理语句名
+	query  string
+	params []string
+}
+
+// operation 等待服务器响应的客户端消息，服务器按顺序响应
+type operation struct {
+	kind     byte       // 客户端消息类型
+	describe string     // Describe语句（不是门户）时的语句名，用于记录ParameterDescription
+	stmt     *Statement // Query和Execute的语句
+	rows     int64      // 当前结果已收到的DataRow数
+}
+
+// processor PostgreSQL处理器
+// 启动阶段的消息没有类型字节，SSLRequest的响应只有一个字节，所以处理器按连接状态自己切分两个方向的消息
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+
+	buf  [2][]byte // 每个方向未完成的消息
+	skip [2]int    // 每个方向超长消息剩余需要跳过的字节数
+
+	phase    phase
+	awaitSSL bool // 已发送SSLRequest或GSSENCRequest，服务器的下一个字节是单字节响应
+	sasl     bool // 服务器要求SASL认证，客户端的下一个认证消息包含选择的机制
+	startup  *Startup
+
+	prepared map[string]*preparedStmt
+	portals  map[string]*portal
+	pending  []*operation
+	failed   *ServerError // 扩展查询出错且还没有收到Sync，服务器会忽略这期间的消息
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{
+		streamInfo: streamInfo,
+		config:     config,
+		prepared:   make(map[string]*preparedStmt),
+		portals:    make(map[string]*portal),
+	}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理带时间戳的数据，没有时间戳时使用当前时间
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if p.phase == phaseIgnore {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	idx := 0
+	if dir == reassembly.TCPDirServerToClient {
+		idx = 1
+	}
+	if n := min(p.skip[idx], len(data)); n > 0 {
+		p.skip[idx] -= n
+		data = data[n:]
+	}
+
+	buf := append(p.buf[idx], data...)
+	var errs []error
+	for len(buf) > 0 && p.phase != phaseIgnore {
+		typ, body, n, err := p.next(idx, buf)
+		if err != nil {
+			p.phase = phaseIgnore
+			p.buf = [2][]byte{}
+			return errors.Join(append(errs, fmt.Errorf("%s framing: %w", ProtocolName, err))...)
+		}
+		if n == 0 {
+			break
+		}
+		if n > len(buf) {
+			p.skip[idx] = n - len(buf)
+			n = len(buf)
+		}
+		buf = buf[n:]
+
+		if idx == 0 {
+			err = p.client(typ, body, ts)
+		} else {
+			err = p.server(typ, body, ts)
+		}
+		var ps *tcpdumper.ProtocolSwitch
+		if errors.As(err, &ps) {
+			// 尚未处理的数据属于新协议
+			rest := p.buf
+			rest[idx] = buf
+			p.buf = [2][]byte{}
+			return tcpdumper.SwitchProtocol(ps.Protocol, rest[0], rest[1])
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.phase == phaseIgnore {
+		p.buf = [2][]byte{}
+		return errors.Join(errs...)
+	}
+	p.buf[idx] = append(p.buf[idx][:0], buf...)
+	return errors.Join(errs...)
+}
+
+// next 切分下一个消息，返回消息类型（不带类型的启动阶段消息为0）、消息体和消息总长度，数据不足时总长度为0
+// 超过 maxMessageSize 的消息收到开头后即交付，此时总长度大于已有的数据
+func (p *processor) next(idx int, buf []byte) (byte, []byte, int, error) {
+	if idx == 1 && p.awaitSSL {
+		return buf[0], nil, 1, nil
+	}
+	typ, header := buf[0], 5
+	if idx == 0 && typ == 0 {
+		header = 4
+	}
+	if len(buf) < header {
+		return 0, nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint32(buf[header-4 : header]))
+	if length < 4 || header == 4 && length < 8 {
+		return 0, nil, 0, fmt.Errorf("invalid message length %d", length)
+	}
+	total := header - 4 + length
+	if len(buf) < total {
+		if len(buf) < maxMessageSize {
+			return 0, nil, 0, nil
+		}
+		return typ, buf[header:], total, nil
+	}
+	return typ, buf[header:total], total, nil
+}
+
+// client 处理客户端的消息
+func (p *processor) client(typ byte, body []byte, ts time.Time) error {
+	switch p.phase {
+	case phaseStartup:
+		if typ == 0 {
+			return p.startupMessage(body)
+		}
+		p.phase = phaseReady
+	case phaseAuth:
+		if typ == 'p' && p.sasl {
+			// SASLInitialResponse以客户端选择的机制名开头
+			p.sasl = false
+			p.startup.AuthMethod = newByteReader(body).cstring()
+		}
+		return nil
+	}
+	if typ == 0 {
+		return nil
+	}
+	return p.request(typ, body, ts)
+}
+
+// startupMessage 处理启动消息、SSLRequest、GSSENCRequest和CancelRequest
+func (p *processor) startupMessage(body []byte) error {
+	r := newByteReader(body)
+	code := r.u32()
+	if p.startup == nil {
+		p.startup = &Startup{
+			StreamInfo:       p.streamInfo,
+			Parameters:       make(map[string]string),
+			ServerParameters: make(map[string]string),
+		}
+	}
+	switch code {
+	case sslRequestCode, gssEncRequest:
+		p.awaitSSL = true
+		return nil
+	case cancelRequest:
+		// 取消请求使用单独的连接，服务器不响应
+		p.phase = phaseIgnore
+		return nil
+	}
+	if code>>16 != 3 {
+		p.phase = phaseIgnore
+		return fmt.Errorf("unsupported protocol version %d.%d", code>>16, code&0xffff)
+	}
+
+	s := p.startup
+	s.ProtocolVersion = fmt.Sprintf("%d.%d", code>>16, code&0xffff)
+	for r.ok && len(r.data) > 1 {
+		name := r.cstring()
+		if name == "" {
+			break
+		}
+		s.Parameters[name] = r.cstring()
+	}
+	s.User = s.Parameters["user"]
+	s.Database = s.Parameters["database"]
+	if s.Database == "" {
+		// 没有指定数据库时使用与用户同名的数据库
+		s.Database = s.User
+	}
+	s.Application = s.Parameters["application_name"]
+	p.phase = phaseAuth
+	return nil
+}
+
+// request 处理查询阶段客户端的消息
+func (p *processor) request(typ byte, body []byte, ts time.Time) error {
+	r := newByteReader(body)
+	switch typ {
+	case 'Q':
+		p.push(&operation{kind: typ, stmt: &Statement{
+			StreamInfo:  p.streamInfo,
+			Query:       p.truncate(r.cstring()),
+			RequestTime: ts,
+		}}, ts)
+	case 'P':
+		name, query := r.cstring(), r.cstring()
+		types := make([]uint32, r.u16())
+		for i := range types {
+			types[i] = r.u32()
+		}
+		if _, ok := p.prepared[name]; !ok && len(p.prepared) >= maxPrepared {
+			for old := range p.prepared {
+				delete(p.prepared, old)
+				break
+			}
+		}
+		p.prepared[name] = &preparedStmt{query: p.truncate(query), types: types}
+		p.push(&operation{kind: typ}, ts)
+	case 'B':
+		p.bind(r)
+		p.push(&operation{kind: typ}, ts)
+	case 'E':
+		s := &Statement{StreamInfo: p.streamInfo, Extended: true, Portal: r.cstring(), RequestTime: ts}
+		if po, ok := p.portals[s.Portal]; ok {
+			s.Name, s.Query, s.Params = po.name, po.query, po.params
+		}
+		p.push(&operation{kind: typ, stmt: s}, ts)
+	case 'D':
+		op := &operation{kind: typ}
+		if r.u8() == 'S' {
+			op.describe = r.cstring()
+		}
+		p.push(op, ts)
+	case 'C':
+		kind, name := r.u8(), r.cstring()
+		if kind == 'S' {
+			delete(p.prepared, name)
+		} else {
+			delete(p.portals, name)
+		}
+		p.push(&operation{kind: typ}, ts)
+	case 'S', 'F':
+		// Sync和FunctionCall的响应以ReadyForQuery结束
+		p.push(&operation{kind: typ}, ts)
+		// 'H' Flush、'd'/'c'/'f' COPY数据、'X' Terminate没有自己的响应
+	}
+	if err := r.err(); err != nil {
+		return fmt.Errorf("message %q: %w", typ, err)
+	}
+	return nil
+}
+
+// bind 处理Bind消息，创建门户并格式化参数
+func (p *processor) bind(r *byteReader) {
+	po := &portal{}
+	portalName := r.cstring()
+	po.name = r.cstring()
+	var types []uint32
+	if ps, ok := p.prepared[po.name]; ok {
+		po.query, types = ps.query, ps.types
+	}
+
+	// 格式码个数为0表示全部是文本，为1表示全部使用同一个格式
+	formats := make([]uint16, r.u16())
+	for i := range formats {
+		formats[i] = r.u16()
+	}
+	n := int(r.u16())
+	for i := 0; i < n && r.ok; i++ {
+		length := int32(r.u32())
+		if length < 0 {
+			po.params = append(po.params, "NULL")
+			continue
+		}
+		value := r.bytes(int(length))
+		if !r.ok {
+			break
+		}
+		if p.config.RedactParams {
+			po.params = append(po.params, "<redacted>")
+			continue
+		}
+		var format uint16
+		switch {
+		case len(formats) == 1:
+			format = formats[0]
+		case i < len(formats):
+			format = formats[i]
+		}
+		var oid uint32
+		if i < len(types) {
+			oid = types[i]
+		}
+		po.params = append(po.params, formatParam(value, format == 1, oid, maxParamLength))
+	}
+	p.portals[portalName] = po
+}
+
+// push 把需要响应的消息加入队列
+func (p *processor) push(op *operation, ts time.Time) {
+	if p.failed != nil {
+		if op.kind != 'S' {
+			// 出错后直到Sync前的消息都被服务器忽略
+			if op.stmt != nil {
+				op.stmt.Error = p.failed
+				p.finish(op, true, ts)
+			}
+			return
+		}
+		p.failed = nil
+	}
+	if len(p.pending) >= maxPending {
+		old := p.pending[0]
+		p.pending = p.pending[1:]
+		if old.stmt != nil {
+			p.finish(old, false, ts)
+		}
+	}
+	p.pending = append(p.pending, op)
+}
+
+// server 处理服务器的消息
+func (p *processor) server(typ byte, body []byte, ts time.Time) error {
+	if p.awaitSSL {
+		p.awaitSSL = false
+		switch typ {
+		case 'S':
+			s := p.startup
+			s.TLS, s.Time = true, ts
+			p.startup = nil
+			p.config.OnStartup(s)
+			p.phase = phaseIgnore
+			// 之后是TLS握手，交给注册表重新识别
+			return tcpdumper.SwitchProtocol("", nil, nil)
+		case 'G':
+			// GSSAPI加密，之后的数据无法解析
+			p.phase = phaseIgnore
+		}
+		// 'N'表示服务器拒绝加密，客户端接着发送明文的启动消息
+		return nil
+	}
+	if p.phase == phaseAuth {
+		return p.auth(typ, body, ts)
+	}
+	return p.response(typ, body, ts)
+}
+
+// authMethods 认证请求码对应的认证方式
+var authMethods = map[uint32]string{
+	2: "kerberos",
+	3: "password",
+	5: "md5",
+	7: "gss",
+	9: "sspi",
+}
+
+// auth 处理认证阶段服务器的消息
+func (p *processor) auth(typ byte, body []byte, ts time.Time) error {
+	s := p.startup
+	r := newByteReader(body)
+	switch typ {
+	case 'R':
+		code := r.u32()
+		switch {
+		case code == 0:
+			if s.AuthMethod == "" {
+				s.AuthMethod = "trust"
+			}
+		case code == 10:
+			// 服务器列出支持的SASL机制，实际使用的机制由客户端选择
+			s.AuthMethod = r.cstring()
+			p.sasl = true
+		case authMethods[code] != "":
+			s.AuthMethod = authMethods[code]
+		}
+	case 'S':
+		name := r.cstring()
+		s.ServerParameters[name] = r.cstring()
+	case 'K':
+		s.ProcessID = r.u32()
+	case 'E':
+		s.Error, s.Time = parseError(body), ts
+		p.startup = nil
+		p.config.OnStartup(s)
+		// 认证失败后服务器关闭连接
+		p.phase = phaseIgnore
+	case 'Z':
+		s.Time = ts
+		p.startup = nil
+		p.config.OnStartup(s)
+		p.phase = phaseReady
+	}
+	return r.err()
+}
+
+// response 处理查询阶段服务器的消息
+func (p *processor) response(typ byte, body []byte, ts time.Time) error {
+	var head *operation
+	if len(p.pending) > 0 {
+		head = p.pending[0]
+	}
+	r := newByteReader(body)
+	switch typ {
+	case '1':
+		p.pop('P')
+	case '2':
+		p.pop('B')
+	case '3':
+		p.pop('C')
+	case 't':
+		// ParameterDescription：服务器推断的参数类型，用于解码之后Bind的二进制参数
+		if head != nil && head.kind == 'D' {
+			types := make([]uint32, r.u16())
+			for i := range types {
+				types[i] = r.u32()
+			}
+			if ps, ok := p.prepared[head.describe]; ok && r.ok {
+				ps.types = types
+			}
+		}
+	case 'T', 'n':
+		// Describe的最后一个响应；简单查询中的RowDescription不需要处理
+		p.pop('D')
+	case 'D':
+		if head != nil && head.stmt != nil {
+			head.rows++
+		}
+	case 'C':
+		if head == nil || head.stmt == nil {
+			break
+		}
+		s := head.stmt
+		s.Tag = r.cstring()
+		if n, ok := tagRows(s.Tag); ok {
+			s.Rows += n
+		} else {
+			s.Rows += head.rows
+		}
+		head.rows = 0
+		if head.kind == 'E' {
+			p.pop('E')
+			p.finish(head, true, ts)
+		}
+	case 'I':
+		if head != nil && head.kind == 'E' {
+			p.pop('E')
+			p.finish(head, true, ts)
+		}
+	case 's':
+		if head != nil && head.kind == 'E' {
+			head.stmt.Suspended = true
+			p.pop('E')
+			p.finish(head, true, ts)
+		}
+	case 'E':
+		p.fail(parseError(body), ts)
+	case 'Z':
+		p.ready(r.u8(), ts)
+	}
+	return r.err()
+}
+
+// pop 队首是指定类型的消息时出队
+func (p *processor) pop(kind byte) *operation {
+	if len(p.pending) == 0 || p.pending[0].kind != kind {
+		return nil
+	}
+	op := p.pending[0]
+	p.pending = p.pending[1:]
+	return op
+}
+
+// fail 处理ErrorResponse
+func (p *processor) fail(err *ServerError, ts time.Time) {
+	if len(p.pending) == 0 {
+		// 不对应请求的错误，如管理员终止连接
+		return
+	}
+	if head := p.pending[0]; head.kind == 'Q' || head.kind == 'F' {
+		// 简单查询中出错的语句之后的语句不再执行，响应以ReadyForQuery结束
+		if head.stmt != nil && head.stmt.Error == nil {
+			head.stmt.Error = err
+		}
+		return
+	}
+
+	// 扩展查询：服务器忽略直到Sync的所有消息
+	for len(p.pending) > 0 && p.pending[0].kind != 'S' {
+		op := p.pending[0]
+		p.pending = p.pending[1:]
+		if op.stmt != nil {
+			op.stmt.Error = err
+			p.finish(op, true, ts)
+		}
+	}
+	if len(p.pending) == 0 {
+		p.failed = err
+	}
+}
+
+// ready 处理ReadyForQuery，结束队首的简单查询或Sync
+func (p *processor) ready(status byte, ts time.Time) {
+	for len(p.pending) > 0 {
+		op := p.pending[0]
+		p.pending = p.pending[1:]
+		if op.stmt != nil {
+			p.finish(op, op.kind == 'Q', ts)
+		}
+		if op.kind == 'Q' || op.kind == 'S' || op.kind == 'F' {
+			break
+		}
+	}
+	if status == 'I' {
+		// 事务结束时服务器销毁所有门户
+		clear(p.portals)
+	}
+}
+
+// finish 结束语句并回调
+func (p *processor) finish(op *operation, complete bool, ts time.Time) {
+	s := op.stmt
+	s.Rows += op.rows
+	op.rows = 0
+	s.Complete = complete
+	if complete {
+		s.ResponseTime = ts
+	}
+	p.config.OnStatement(s)
+}
+
+// truncate 截断过长的SQL
+func (p *processor) truncate(query string) string {
+	if len(query) > p.config.MaxQueryLength {
+		query = query[:p.config.MaxQueryLength]
+	}
+	return query
+}
+
+func (p *processor) Close() error {
+	for _, op := range p.pending {
+		if op.stmt != nil {
+			p.finish(op, false, time.Time{})
+		}
+	}
+	p.pending = nil
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
@@ -0,0 +1,251 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// maxPending 等待回复的命令数上限，超过时最早的命令按没有回复回调
+const maxPending = 10000
+
+// pendingCall 等待回复的命令
+type pendingCall struct {
+	call     *Call
+	confirms int // SUBSCRIBE等命令还需要的确认数，0表示直到订阅数为0
+}
+
+// processor Redis处理器，每次调用必须是一个完整的RESP值，由 FramedProcessor 包装
+// Redis按命令的顺序回复，回复与等待列表中最早的命令配对
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+	pending    []*pendingCall
+	subscribed bool // RESP2的发布订阅模式，此时服务器发送的message数组是推送
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{
+		streamInfo: streamInfo,
+		config:     config,
+	}
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一个带时间戳的RESP值，没有时间戳时使用当前时间
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if dir == reassembly.TCPDirClientToServer {
+		// 命令名和键需要完整的参数，截断在取出键之后进行
+		v, _, err := parser{build: true}.parse(data)
+		if err != nil {
+			return fmt.Errorf("parse command: %w", err)
+		}
+		return p.command(&v, ts)
+	}
+	v, _, err := parser{build: true, maxString: p.config.MaxStringLength}.parse(data)
+	if err != nil {
+		return fmt.Errorf("parse reply: %w", err)
+	}
+	p.reply(&v, ts)
+	return nil
+}
+
+// command 把命令加入等待列表
+func (p *processor) command(v *Value, ts time.Time) error {
+	if v.Type != Array && v.Type != Inline || len(v.Elems) == 0 {
+		return fmt.Errorf("unexpected %s from client", v.Type)
+	}
+	cmd := &Command{Inline: v.Type == Inline, Size: v.Size, Time: ts}
+	for i, elem := range v.Elems {
+		if elem.Type != BulkString {
+			return fmt.Errorf("unexpected %s in command", elem.Type)
+		}
+		if i == 0 {
+			cmd.Name = strings.ToUpper(elem.Str)
+		} else {
+			cmd.Args = append(cmd.Args, elem.Str)
+		}
+	}
+	cmd.Key = commandKey(cmd.Name, cmd.Args)
+	for i, arg := range cmd.Args {
+		if len(arg) > p.config.MaxStringLength {
+			cmd.Args[i] = arg[:p.config.MaxStringLength]
+		}
+	}
+
+	if len(p.pending) >= maxPending {
+		p.emit(0)
+	}
+	pc := &pendingCall{call: &Call{StreamInfo: p.streamInfo, Command: cmd}}
+	if subscribeKinds[cmd.Name] {
+		pc.confirms = len(cmd.Args)
+	}
+	p.pending = append(p.pending, pc)
+	return nil
+}
+
+// subscribeKinds 每个频道各有一个确认的命令
+var subscribeKinds = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+}
+
+// reply 处理服务器发送的值：推送消息直接回调，订阅确认与订阅命令配对，其余回复与最早的命令配对
+func (p *processor) reply(v *Value, ts time.Time) {
+	kind := pushKind(v)
+	switch kind {
+	case "message", "pmessage", "smessage":
+		if v.Type == Push || p.subscribed {
+			p.push(kind, v, ts)
+			return
+		}
+	}
+	if subscribeKinds[strings.ToUpper(kind)] && len(p.pending) > 0 && p.pending[0].call.Command.Name == strings.ToUpper(kind) {
+		p.confirm(v, ts)
+		return
+	}
+	if v.Type == Push {
+		p.push(kind, v, ts)
+		return
+	}
+
+	if len(p.pending) == 0 {
+		p.config.OnCall(&Call{StreamInfo: p.streamInfo, Reply: v, ReplyTime: ts})
+		return
+	}
+	call := p.pending[0].call
+	call.Reply, call.ReplyTime = v, ts
+	p.emit(0)
+}
+
+// confirm 处理订阅确认，确认的第三个元素是当前的订阅数
+func (p *processor) confirm(v *Value, ts time.Time) {
+	pc := p.pending[0]
+	if pc.call.Reply == nil {
+		pc.call.Reply = v
+	}
+	pc.call.ReplyTime = ts
+
+	var count int64
+	if len(v.Elems) >= 3 && v.Elems[2].Type == Integer {
+		count, _ = v.Elems[2].Int()
+	}
+	p.subscribed = count > 0
+
+	done := count == 0
+	if pc.confirms > 0 {
+		pc.confirms--
+		done = pc.confirms == 0
+	}
+	if done {
+		p.emit(0)
+	}
+}
+
+// push 回调推送消息
+func (p *processor) push(kind string, v *Value, ts time.Time) {
+	m := &PushMessage{StreamInfo: p.streamInfo, Kind: kind, Value: v, Time: ts}
+	channel := 1
+	if kind == "pmessage" {
+		channel = 2
+	}
+	switch kind {
+	case "message", "pmessage", "smessage":
+		if len(v.Elems) > channel {
+			m.Channel = v.Elems[channel].Str
+		}
+	}
+	p.config.OnPush(m)
+}
+
+// pushKind 数组或推送的第一个元素（小写），用于识别发布订阅消息
+func pushKind(v *Value) string {
+	if v.Type != Array && v.Type != Push || len(v.Elems) == 0 {
+		return ""
+	}
+	switch v.Elems[0].Type {
+	case BulkString, SimpleString, VerbatimString:
+		return strings.ToLower(v.Elems[0].Str)
+	}
+	return ""
+}
+
+// emit 回调并移除等待列表中的第i个命令
+func (p *processor) emit(i int) {
+	call := p.pending[i].call
+	p.pending = append(p.pending[:i], p.pending[i+1:]...)
+	p.config.OnCall(call)
+}
+
+// Close 回调所有仍在等待回复的命令
+func (p *processor) Close() error {
+	for len(p.pending) > 0 {
+		p.emit(0)
+	}
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
+
+// noKeyCommands 没有键的命令
+var noKeyCommands = map[string]bool{
+	"PING": true, "ECHO": true, "AUTH": true, "HELLO": true, "SELECT": true, "QUIT": true, "RESET": true,
+	"INFO": true, "CONFIG": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "DBSIZE": true,
+	"FLUSHALL": true, "FLUSHDB": true, "SAVE": true, "BGSAVE": true, "BGREWRITEAOF": true, "LASTSAVE": true,
+	"SHUTDOWN": true, "SLAVEOF": true, "REPLICAOF": true, "ROLE": true, "SLOWLOG": true, "LATENCY": true,
+	"MONITOR": true, "TIME": true, "DEBUG": true, "ACL": true, "MODULE": true, "SCRIPT": true, "FUNCTION": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true, "WAIT": true, "WAITAOF": true,
+	"SCAN": true, "KEYS": true, "RANDOMKEY": true, "SWAPDB": true, "READONLY": true, "READWRITE": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true, "PUBLISH": true, "SPUBLISH": true, "PUBSUB": true,
+}
+
+// commandKey 返回命令的第一个键，大多数命令的第一个参数是键
+func commandKey(name string, args []string) string {
+	if noKeyCommands[name] {
+		return ""
+	}
+	switch name {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		// EVAL script numkeys key [key ...] arg [arg ...]
+		if len(args) >= 3 {
+			if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+				return args[2]
+			}
+		}
+		return ""
+	case "XREAD", "XREADGROUP":
+		// XREAD ... STREAMS key [key ...] id [id ...]
+		for i, arg := range args {
+			if strings.EqualFold(arg, "STREAMS") && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		return ""
+	case "OBJECT", "MEMORY", "XINFO":
+		// OBJECT ENCODING key、MEMORY USAGE key、XINFO STREAM key
+		if len(args) >= 2 {
+			return args[1]
+		}
+		return ""
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
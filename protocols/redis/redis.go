@@ -0,0 +1,247 @@
+// Package redis 提供Redis（RESP2/RESP3）的检测器和处理器
+// 按RESP值切分流水线中的命令和回复，按顺序把回复与命令配对，
+// 每次调用以 Call 事件的形式交给回调，包含命令、键、回复类型、大小和延迟；
+// RESP3的推送消息和发布订阅模式下的消息不参与配对，以 PushMessage 事件交给回调
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "Redis"
+
+const (
+	defaultMaxStringLength = 256
+	defaultMaxMessageSize  = 64 * 1024 * 1024
+)
+
+// Command 客户端发送的命令
+type Command struct {
+	Name   string    // 命令名（大写），如 "GET"；有子命令的命令如 CLIENT SETNAME 只含第一个词
+	Args   []string  // 参数，不含命令名；超过 Config.MaxStringLength 的参数被截断
+	Key    string    // 第一个键，没有键的命令为空
+	Inline bool      // 内联命令
+	Size   int       // 编码后的字节数
+	Time   time.Time // 命令所在数据的时间
+}
+
+func (c *Command) String() string {
+	if c.Key == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Key
+}
+
+// Call 一次命令调用和它的回复
+// 抓包从连接中途开始或MONITOR等没有对应命令的回复，Command为nil；连接关闭时仍没有回复的，Reply为nil
+// SUBSCRIBE等命令对每个频道各有一个确认，Reply为第一个确认，ReplyTime为最后一个确认的时间
+type Call struct {
+	StreamInfo tcpdumper.StreamInfo
+	Command    *Command
+	Reply      *Value
+	ReplyTime  time.Time
+}
+
+// ReplyType 回复的类型，没有回复时为空
+func (c *Call) ReplyType() string {
+	if c.Reply == nil {
+		return ""
+	}
+	return c.Reply.Type.String()
+}
+
+// Latency 从命令到回复的时间
+func (c *Call) Latency() time.Duration {
+	if c.Command == nil || c.Reply == nil {
+		return 0
+	}
+	return c.ReplyTime.Sub(c.Command.Time)
+}
+
+// String 返回调用的摘要，如 GET user:1 -> bulk-string 12B (350µs)
+func (c *Call) String() string {
+	var b strings.Builder
+	if c.Command == nil {
+		b.WriteString("<no command>")
+	} else {
+		b.WriteString(c.Command.String())
+	}
+	if c.Reply == nil {
+		b.WriteString(" -> <no reply>")
+		return b.String()
+	}
+	fmt.Fprintf(&b, " -> %s %dB", c.Reply.Type, c.Reply.Size)
+	if c.Reply.IsError() {
+		fmt.Fprintf(&b, " %q", c.Reply.Str)
+	}
+	if c.Command != nil {
+		fmt.Fprintf(&b, " (%v)", c.Latency())
+	}
+	return b.String()
+}
+
+// PushMessage 服务器主动发送的消息：RESP3的推送，或RESP2发布订阅模式下的消息
+type PushMessage struct {
+	StreamInfo tcpdumper.StreamInfo
+	Kind       string // 第一个元素，如 "message"、"pmessage"、"invalidate"
+	Channel    string // 频道，message和smessage为第二个元素，pmessage为第三个元素
+	Value      *Value
+	Time       time.Time
+}
+
+func (m *PushMessage) String() string {
+	if m.Channel == "" {
+		return fmt.Sprintf("push %s %dB", m.Kind, m.Value.Size)
+	}
+	return fmt.Sprintf("push %s %s %dB", m.Kind, m.Channel, m.Value.Size)
+}
+
+// Config Redis处理器配置
+type Config struct {
+	// OnCall 收到回复或连接关闭时的回调，为nil时把摘要输出到Output
+	OnCall func(*Call)
+	// OnPush 收到推送消息时的回调，为nil时把摘要输出到Output
+	OnPush func(*PushMessage)
+	Output io.Writer // 默认回调的输出，nil为标准输出
+
+	MaxStringLength int // 命令参数和回复中保存的字符串最大长度，0为默认256，超出部分被截断
+	MaxMessageSize  int // 单个命令或回复的最大字节数，0为默认64MB，超过时停止处理该方向
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	w := c.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	if c.OnCall == nil {
+		c.OnCall = func(call *Call) {
+			fmt.Fprintf(w, "REDIS/%s: %s\n", call.StreamInfo.Ident, call)
+		}
+	}
+	if c.OnPush == nil {
+		c.OnPush = func(m *PushMessage) {
+			fmt.Fprintf(w, "REDIS/%s: %s\n", m.StreamInfo.Ident, m)
+		}
+	}
+	if c.MaxStringLength <= 0 {
+		c.MaxStringLength = defaultMaxStringLength
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaultMaxMessageSize
+	}
+	return c
+}
+
+// inlineCommands 按内联命令识别的命令，只包含不容易与其他文本协议混淆的命令
+var inlineCommands = map[string]bool{
+	"PING": true, "INFO": true, "HELLO": true, "AUTH": true, "SELECT": true,
+	"MONITOR": true, "DBSIZE": true, "ECHO": true,
+}
+
+// Detector Redis检测器
+// 客户端数据为命令名是字母的批量字符串数组，或常见的内联命令；服务器数据为以RESP类型前缀开头的完整回复
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建Redis检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if len(data) == 0 {
+		return 0
+	}
+	if dir == reassembly.TCPDirServerToClient {
+		return detectReply(data)
+	}
+	if data[0] != '*' {
+		return detectInline(data)
+	}
+	// 只检查命令名，命令的其余部分可能还没有到达
+	header, next, err := line(data, 1)
+	if err != nil {
+		return 0
+	}
+	if count, err := strconv.Atoi(string(header)); err != nil || count < 1 || count > 1024*1024 {
+		return 0
+	}
+	name, _, err := parser{build: true}.value(data, next, 0)
+	if err != nil || name.Type != BulkString || !commandName(name.Str) {
+		return 0
+	}
+	return 90
+}
+
+// detectReply 服务器数据是完整的回复时置信度为60
+func detectReply(data []byte) int {
+	switch Type(data[0]) {
+	case SimpleString, Error, Integer, BulkString, Array, Map, Push:
+	default:
+		return 0
+	}
+	if _, _, err := (parser{}).parse(data); err != nil {
+		return 0
+	}
+	return 60
+}
+
+// detectInline 识别内联命令，置信度为60
+func detectInline(data []byte) int {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i <= 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[:i]))
+	if len(fields) == 0 || !inlineCommands[strings.ToUpper(fields[0])] {
+		return 0
+	}
+	return 60
+}
+
+// commandName 命令名是1到32个字母或下划线
+func commandName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), framer{maxSize: config.MaxMessageSize})
+}
+
+// NewProcessor 创建Redis处理器，返回的处理器会先按RESP值切分命令和回复
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册Redis协议
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	registry.Register(NewDetector(config), opts...)
+}
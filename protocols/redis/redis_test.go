@@ -0,0 +1,227 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// command 把命令编码为批量字符串数组
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func collect(config *Config) (*[]*Call, *[]*PushMessage) {
+	var calls []*Call
+	var pushes []*PushMessage
+	config.OnCall = func(c *Call) {
+		calls = append(calls, c)
+	}
+	config.OnPush = func(m *PushMessage) {
+		pushes = append(pushes, m)
+	}
+	return &calls, &pushes
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	assert.Equal(t, 90, d.Detect([]byte(command("SET", "k", "v")), c2s))
+	// 只有命令名也能识别
+	assert.Equal(t, 90, d.Detect([]byte(command("GET", "key")[:13]), c2s))
+	assert.Equal(t, 60, d.Detect([]byte("PING\r\n"), c2s))
+	assert.Equal(t, 60, d.Detect([]byte("+OK\r\n"), s2c))
+	assert.Equal(t, 60, d.Detect([]byte("-ERR wrong\r\n"), s2c))
+	assert.Equal(t, 60, d.Detect([]byte("$3\r\nabc\r\n"), s2c))
+
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("QUIT\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("*1\r\n:1\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte(command("1.2", "x")), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("*x\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte("+OK"), s2c))
+	assert.Equal(t, 0, d.Detect([]byte("HTTP/1.1 200 OK\r\n"), s2c))
+}
+
+func TestCall(t *testing.T) {
+	config := Config{}
+	calls, _ := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cmd := command("get", "user:1")
+	// 逐字节输入，命令跨越多个分段
+	for i := range cmd {
+		assert.NoError(t, p.ProcessTimedData([]byte(cmd[i:i+1]), c2s, i == 0, false, ts))
+	}
+	assert.Empty(t, *calls)
+	assert.NoError(t, p.ProcessTimedData([]byte("$5\r\nalice\r\n"), s2c, true, false, ts.Add(350*time.Microsecond)))
+	if !assert.Len(t, *calls, 1) {
+		return
+	}
+
+	c := (*calls)[0]
+	assert.Equal(t, "test", c.StreamInfo.Ident)
+	assert.Equal(t, "GET", c.Command.Name)
+	assert.Equal(t, "user:1", c.Command.Key)
+	assert.Equal(t, []string{"user:1"}, c.Command.Args)
+	assert.Equal(t, len(cmd), c.Command.Size)
+	assert.Equal(t, "bulk-string", c.ReplyType())
+	assert.Equal(t, "alice", c.Reply.Str)
+	assert.Equal(t, 11, c.Reply.Size)
+	assert.Equal(t, 350*time.Microsecond, c.Latency())
+	assert.Equal(t, "GET user:1 -> bulk-string 11B (350µs)", c.String())
+	assert.NoError(t, p.Close())
+	assert.Len(t, *calls, 1)
+}
+
+// 流水线中的命令按顺序与回复配对
+func TestPipelined(t *testing.T) {
+	config := Config{MaxStringLength: 4}
+	calls, _ := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	data := command("SET", "k1", "a long value") + command("INCR", "n") + command("PING") + "EXISTS k1\r\n"
+	data += command("EVAL", "return 1", "1", "k2") + command("XREAD", "COUNT", "1", "STREAMS", "s1", "0")
+	assert.NoError(t, p.ProcessData([]byte(data), c2s, true, false))
+	replies := "+OK\r\n-WRONGTYPE Operation against a key\r\n+PONG\r\n:1\r\n:1\r\n*1\r\n*2\r\n$2\r\ns1\r\n*0\r\n"
+	assert.NoError(t, p.ProcessData([]byte(replies[:20]), s2c, true, false))
+	assert.NoError(t, p.ProcessData([]byte(replies[20:]), s2c, false, false))
+	// 没有对应命令的回复
+	assert.NoError(t, p.ProcessData([]byte("+OK\r\n"), s2c, false, false))
+	// 没有回复的命令
+	assert.NoError(t, p.ProcessData([]byte(command("DEL", "k3")), c2s, false, false))
+	assert.NoError(t, p.Close())
+
+	if !assert.Len(t, *calls, 8) {
+		return
+	}
+	c := *calls
+	assert.Equal(t, []string{"k1", "a lo"}, c[0].Command.Args)
+	assert.Regexp(t, `^SET k1 -> simple-string 5B \(.*\)$`, c[0].String())
+	assert.True(t, c[1].Reply.IsError())
+	assert.Contains(t, c[1].String(), `INCR n -> error 36B "WRONGTYPE Operation against a key"`)
+	assert.Equal(t, "PING", c[2].Command.String())
+	assert.True(t, c[3].Command.Inline)
+	assert.Equal(t, "EXISTS k1", c[3].Command.String())
+	assert.Equal(t, "integer", c[3].ReplyType())
+	assert.Equal(t, "k2", c[4].Command.Key)
+	assert.Equal(t, "s1", c[5].Command.Key)
+	assert.Equal(t, "array", c[5].ReplyType())
+	assert.Nil(t, c[6].Command)
+	assert.Equal(t, "<no command> -> simple-string 5B", c[6].String())
+	assert.Nil(t, c[7].Reply)
+	assert.Equal(t, "DEL k3 -> <no reply>", c[7].String())
+}
+
+// RESP2的发布订阅：每个频道一个确认，之后的message数组是推送
+func TestSubscribe(t *testing.T) {
+	config := Config{}
+	calls, pushes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	assert.NoError(t, p.ProcessData([]byte(command("SUBSCRIBE", "news", "sport")), c2s, true, false))
+	assert.NoError(t, p.ProcessData([]byte("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"), s2c, true, false))
+	assert.Empty(t, *calls)
+	assert.NoError(t, p.ProcessData([]byte("*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n"), s2c, false, false))
+	assert.NoError(t, p.ProcessData([]byte("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"), s2c, false, false))
+	assert.NoError(t, p.ProcessData([]byte("*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$2\r\nhi\r\n"), s2c, false, false))
+	// 没有参数的UNSUBSCRIBE直到订阅数为0
+	assert.NoError(t, p.ProcessData([]byte(command("UNSUBSCRIBE")), c2s, false, false))
+	assert.NoError(t, p.ProcessData([]byte("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n"), s2c, false, false))
+	assert.NoError(t, p.ProcessData([]byte("*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:0\r\n"), s2c, false, false))
+	// 退出订阅模式后message数组是普通回复
+	assert.NoError(t, p.ProcessData([]byte(command("LRANGE", "l", "0", "-1")), c2s, false, false))
+	assert.NoError(t, p.ProcessData([]byte("*1\r\n$7\r\nmessage\r\n"), s2c, false, false))
+	assert.NoError(t, p.Close())
+
+	if assert.Len(t, *calls, 3) {
+		assert.Equal(t, "SUBSCRIBE", (*calls)[0].Command.Name)
+		assert.Equal(t, "news", (*calls)[0].Reply.Elems[1].Str)
+		assert.Equal(t, "UNSUBSCRIBE", (*calls)[1].Command.Name)
+		assert.Equal(t, "LRANGE", (*calls)[2].Command.Name)
+	}
+	if assert.Len(t, *pushes, 2) {
+		assert.Equal(t, "push message news 38B", (*pushes)[0].String())
+		assert.Equal(t, "pmessage", (*pushes)[1].Kind)
+		assert.Equal(t, "news", (*pushes)[1].Channel)
+	}
+}
+
+// RESP3的推送不参与配对
+func TestPushRESP3(t *testing.T) {
+	config := Config{}
+	calls, pushes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+
+	assert.NoError(t, p.ProcessData([]byte(command("HELLO", "3")+command("GET", "k")+command("SUBSCRIBE", "c")), c2s, true, false))
+	replies := "%1\r\n+server\r\n+redis\r\n" +
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n" +
+		"_\r\n" +
+		">3\r\n$9\r\nsubscribe\r\n$1\r\nc\r\n:1\r\n" +
+		">3\r\n$7\r\nmessage\r\n$1\r\nc\r\n$1\r\nx\r\n"
+	assert.NoError(t, p.ProcessData([]byte(replies), s2c, true, false))
+	assert.NoError(t, p.Close())
+
+	if assert.Len(t, *calls, 3) {
+		assert.Equal(t, "map", (*calls)[0].ReplyType())
+		assert.Equal(t, "GET k", (*calls)[1].Command.String())
+		assert.Equal(t, "null", (*calls)[1].ReplyType())
+		assert.Equal(t, "push", (*calls)[2].ReplyType())
+	}
+	if assert.Len(t, *pushes, 2) {
+		assert.Equal(t, "push invalidate 32B", (*pushes)[0].String())
+		assert.Equal(t, "c", (*pushes)[1].Channel)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	config := Config{}
+	calls, _ := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	assert.Error(t, p.ProcessData([]byte("*1\r\n:1\r\n"), c2s, true, false))
+	assert.Error(t, p.ProcessData([]byte("$x\r\n"), s2c, true, false))
+	assert.NoError(t, p.Close())
+	assert.Empty(t, *calls)
+}
+
+func TestCommandKey(t *testing.T) {
+	assert.Equal(t, "", commandKey("PING", nil))
+	assert.Equal(t, "", commandKey("GET", nil))
+	assert.Equal(t, "", commandKey("PUBLISH", []string{"ch", "msg"}))
+	assert.Equal(t, "", commandKey("EVAL", []string{"return 1", "0"}))
+	assert.Equal(t, "k", commandKey("EVALSHA", []string{"abc", "2", "k", "k2"}))
+	assert.Equal(t, "k", commandKey("OBJECT", []string{"ENCODING", "k"}))
+	assert.Equal(t, "s", commandKey("XREADGROUP", []string{"GROUP", "g", "c", "streams", "s", ">"}))
+	assert.Equal(t, "k", commandKey("HSET", []string{"k", "f", "v"}))
+}
+
+// 通过注册表识别并输出默认摘要
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	registry := tcpdumper.NewProtocolRegistry()
+	Register(registry, Config{Output: &out})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "a:1-b:6379"}, nil)
+	assert.NoError(t, d.ProcessData([]byte(command("GET", "foo")), c2s, true, false))
+	assert.NoError(t, d.ProcessData([]byte("$3\r\nbar\r\n"), s2c, true, false))
+	assert.NoError(t, d.ProcessData([]byte(">2\r\n$10\r\ninvalidate\r\n_\r\n"), s2c, false, false))
+	assert.NoError(t, d.Close())
+	assert.Regexp(t, `^REDIS/a:1-b:6379: GET foo -> bulk-string 9B \(.*\)\nREDIS/a:1-b:6379: push invalidate 24B\n$`, out.String())
+}
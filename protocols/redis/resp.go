@@ -0,0 +1,271 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type RESP值的类型，取值为类型前缀字节
+type Type byte
+
+// RESP2和RESP3的类型
+const (
+	Inline         Type = 0 // 内联命令（不以类型前缀开头的一行）
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_' // RESP3
+	Boolean        Type = '#' // RESP3
+	Double         Type = ',' // RESP3
+	BigNumber      Type = '(' // RESP3
+	BulkError      Type = '!' // RESP3
+	VerbatimString Type = '=' // RESP3
+	Map            Type = '%' // RESP3
+	Set            Type = '~' // RESP3
+	Push           Type = '>' // RESP3
+	attribute      Type = '|' // RESP3，附加在下一个值上，解析时被跳过
+)
+
+var typeNames = map[Type]string{
+	Inline:         "inline",
+	SimpleString:   "simple-string",
+	Error:          "error",
+	Integer:        "integer",
+	BulkString:     "bulk-string",
+	Array:          "array",
+	Null:           "null",
+	Boolean:        "boolean",
+	Double:         "double",
+	BigNumber:      "big-number",
+	BulkError:      "bulk-error",
+	VerbatimString: "verbatim-string",
+	Map:            "map",
+	Set:            "set",
+	Push:           "push",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Type(%q)", byte(t))
+}
+
+const (
+	maxDepth      = 32        // 聚合类型的最大嵌套深度
+	maxLineLength = 64 * 1024 // 不含长度的一行（简单字符串、内联命令等）的最大长度
+)
+
+var (
+	errIncomplete = errors.New("incomplete value")
+	errProtocol   = errors.New("resp protocol error")
+)
+
+// Value 一个RESP值
+type Value struct {
+	Type      Type
+	Str       string  // 字符串、错误、数字和布尔值的文本，批量字符串超过最大长度时被截断
+	Length    int     // 字符串的实际长度
+	Truncated bool    // Str被截断
+	Nil       bool    // RESP2的空字符串（$-1）和空数组（*-1），以及RESP3的Null
+	Elems     []Value // 数组、集合、推送的元素；映射的键和值交替排列；内联命令的各个词
+	Size      int     // 编码后的字节数
+}
+
+// IsError 是否为错误回复
+func (v *Value) IsError() bool {
+	return v.Type == Error || v.Type == BulkError
+}
+
+// Int 整数的值
+func (v *Value) Int() (int64, error) {
+	return strconv.ParseInt(v.Str, 10, 64)
+}
+
+// String 返回值的简短描述，如 "OK"、(error) ERR ...、(integer) 1、array(3)
+func (v *Value) String() string {
+	switch {
+	case v.Nil:
+		return "(nil)"
+	case v.IsError():
+		return "(error) " + v.Str
+	case v.Type == Integer:
+		return "(integer) " + v.Str
+	case v.Type == Array, v.Type == Set, v.Type == Push, v.Type == Inline:
+		return fmt.Sprintf("%s(%d)", v.Type, len(v.Elems))
+	case v.Type == Map:
+		return fmt.Sprintf("map(%d)", len(v.Elems)/2)
+	case v.Type == BulkString, v.Type == VerbatimString, v.Type == SimpleString:
+		s := strconv.Quote(v.Str)
+		if v.Truncated {
+			s += fmt.Sprintf("...(%d bytes)", v.Length)
+		}
+		return s
+	}
+	return v.Str
+}
+
+// parser RESP解析器，build为false时只计算值的长度
+// maxString大于0时，批量字符串、批量错误和逐字字符串只保存前maxString字节
+type parser struct {
+	build     bool
+	maxString int
+}
+
+// parse 解析data开头的一个完整的值，返回值和消耗的字节数；数据不完整时返回errIncomplete
+func (p parser) parse(data []byte) (Value, int, error) {
+	if len(data) == 0 {
+		return Value{}, 0, errIncomplete
+	}
+	if _, ok := typeNames[Type(data[0])]; !ok && Type(data[0]) != attribute {
+		return p.inline(data)
+	}
+	return p.value(data, 0, 0)
+}
+
+// line 读取从pos开始到\r\n的一行，返回行的内容和行之后的位置
+func line(data []byte, pos int) ([]byte, int, error) {
+	i := bytes.Index(data[pos:], []byte("\r\n"))
+	if i < 0 {
+		if len(data)-pos > maxLineLength {
+			return nil, 0, fmt.Errorf("%w: line too long", errProtocol)
+		}
+		return nil, 0, errIncomplete
+	}
+	if i > maxLineLength {
+		return nil, 0, fmt.Errorf("%w: line too long", errProtocol)
+	}
+	return data[pos : pos+i], pos + i + 2, nil
+}
+
+// inline 解析内联命令
+func (p parser) inline(data []byte) (Value, int, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > maxLineLength {
+			return Value{}, 0, fmt.Errorf("%w: inline command too long", errProtocol)
+		}
+		return Value{}, 0, errIncomplete
+	}
+	v := Value{Type: Inline, Size: i + 1}
+	if p.build {
+		for _, word := range strings.Fields(string(bytes.TrimSuffix(data[:i], []byte("\r")))) {
+			v.Elems = append(v.Elems, Value{Type: BulkString, Str: word, Length: len(word)})
+		}
+	}
+	return v, i + 1, nil
+}
+
+// str 创建批量字符串值，超过最大长度时截断
+func (p parser) str(typ Type, s []byte) Value {
+	v := Value{Type: typ, Length: len(s)}
+	if p.maxString > 0 && len(s) > p.maxString {
+		s, v.Truncated = s[:p.maxString], true
+	}
+	v.Str = string(s)
+	return v
+}
+
+// value 解析从pos开始的一个值
+func (p parser) value(data []byte, pos, depth int) (Value, int, error) {
+	if depth > maxDepth {
+		return Value{}, 0, fmt.Errorf("%w: nesting too deep", errProtocol)
+	}
+	if pos >= len(data) {
+		return Value{}, 0, errIncomplete
+	}
+	typ := Type(data[pos])
+	content, next, err := line(data, pos+1)
+	if err != nil {
+		return Value{}, 0, err
+	}
+
+	var v Value
+	switch typ {
+	case SimpleString, Error, Integer, Null, Boolean, Double, BigNumber:
+		if typ == Integer {
+			if _, err := strconv.ParseInt(string(content), 10, 64); err != nil {
+				return Value{}, 0, fmt.Errorf("%w: invalid integer %q", errProtocol, content)
+			}
+		}
+		if p.build {
+			v = Value{Str: string(content), Length: len(content)}
+		}
+		v.Type, v.Nil = typ, typ == Null
+	case BulkString, BulkError, VerbatimString:
+		n, err := strconv.Atoi(string(content))
+		if err != nil || n < -1 || (n == -1 && typ != BulkString) {
+			return Value{}, 0, fmt.Errorf("%w: invalid length %q", errProtocol, content)
+		}
+		if n == -1 {
+			v = Value{Type: typ, Nil: true}
+			break
+		}
+		if len(data) < next+n+2 {
+			return Value{}, 0, errIncomplete
+		}
+		if data[next+n] != '\r' || data[next+n+1] != '\n' {
+			return Value{}, 0, fmt.Errorf("%w: missing CRLF after %s", errProtocol, typ)
+		}
+		if p.build {
+			v = p.str(typ, data[next:next+n])
+		}
+		v.Type, v.Length = typ, n
+		next += n + 2
+	case Array, Set, Push, Map, attribute:
+		n, err := strconv.Atoi(string(content))
+		if err != nil || n < -1 || (n == -1 && typ != Array) {
+			return Value{}, 0, fmt.Errorf("%w: invalid count %q", errProtocol, content)
+		}
+		v = Value{Type: typ, Nil: n == -1}
+		if typ == Map || typ == attribute {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			elem, end, err := p.value(data, next, depth+1)
+			if err != nil {
+				return Value{}, 0, err
+			}
+			if p.build {
+				v.Elems = append(v.Elems, elem)
+			}
+			next = end
+		}
+		if typ == attribute {
+			// 属性之后是真正的值
+			return p.value(data, next, depth)
+		}
+	default:
+		return Value{}, 0, fmt.Errorf("%w: unknown type %q", errProtocol, byte(typ))
+	}
+	v.Size = next - pos
+	return v, next, nil
+}
+
+// framer 按RESP值切分消息，每条消息是一个完整的命令或回复
+type framer struct {
+	maxSize int
+}
+
+func (f framer) Frame(data []byte, atEOF bool) (int, []byte, error) {
+	_, n, err := parser{}.parse(data)
+	if errors.Is(err, errIncomplete) {
+		if len(data) > f.maxSize {
+			return 0, nil, fmt.Errorf("value larger than %d bytes", f.maxSize)
+		}
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, data[:n], nil
+}
@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	p := parser{build: true, maxString: 4}
+	tests := []struct {
+		data string
+		want string
+		typ  Type
+	}{
+		{"+OK\r\n", `"OK"`, SimpleString},
+		{"-ERR unknown\r\n", "(error) ERR unknown", Error},
+		{":-12\r\n", "(integer) -12", Integer},
+		{"$5\r\nhello\r\n", `"hell"...(5 bytes)`, BulkString},
+		{"$-1\r\n", "(nil)", BulkString},
+		{"*-1\r\n", "(nil)", Array},
+		{"*2\r\n$1\r\na\r\n:1\r\n", "array(2)", Array},
+		{"_\r\n", "(nil)", Null},
+		{"#t\r\n", "t", Boolean},
+		{",3.14\r\n", "3.14", Double},
+		{"(12345678901234567890\r\n", "12345678901234567890", BigNumber},
+		{"!7\r\nERR bad\r\n", "(error) ERR ", BulkError},
+		{"=7\r\ntxt:abc\r\n", `"txt:"...(7 bytes)`, VerbatimString},
+		{"%1\r\n+k\r\n:1\r\n", "map(1)", Map},
+		{"~1\r\n+a\r\n", "set(1)", Set},
+		{">2\r\n+invalidate\r\n*1\r\n+k\r\n", "push(2)", Push},
+		{"PING  hello\r\n", "inline(2)", Inline},
+		// 属性附加在后面的值上
+		{"|1\r\n+ttl\r\n:3\r\n+OK\r\n", `"OK"`, SimpleString},
+	}
+	for _, tt := range tests {
+		v, n, err := p.parse([]byte(tt.data + "extra"))
+		if assert.NoError(t, err, tt.data) {
+			assert.Equal(t, len(tt.data), n, tt.data)
+			assert.Equal(t, tt.typ, v.Type, tt.data)
+			assert.Equal(t, tt.want, v.String(), tt.data)
+			if tt.typ != Inline && tt.data[0] != '|' {
+				assert.Equal(t, len(tt.data), v.Size, tt.data)
+			}
+		}
+	}
+
+	// 不完整的值
+	for _, data := range []string{"", "+OK", "$5\r\nhel", "*2\r\n:1\r\n", "%1\r\n+k\r\n"} {
+		_, _, err := p.parse([]byte(data))
+		assert.ErrorIs(t, err, errIncomplete, data)
+	}
+	// 格式错误
+	for _, data := range []string{":x\r\n", "$-2\r\n", "$3\r\nabcd\r\n", "~-1\r\n", "!-1\r\n"} {
+		_, _, err := p.parse([]byte(data))
+		assert.ErrorIs(t, err, errProtocol, data)
+	}
+}
+
+func TestParseNesting(t *testing.T) {
+	data := ""
+	for i := 0; i <= maxDepth+1; i++ {
+		data += "*1\r\n"
+	}
+	_, _, err := parser{}.parse([]byte(data + ":1\r\n"))
+	assert.ErrorIs(t, err, errProtocol)
+}
+
+func TestFramer(t *testing.T) {
+	f := framer{maxSize: 16}
+	data := []byte("*1\r\n$4\r\nPING\r\n*2\r\n")
+	n, msg, err := f.Frame(data, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 14, n)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", string(msg))
+
+	n, msg, err = f.Frame(data[14:], false)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Nil(t, msg)
+	_, _, err = f.Frame(data[14:], true)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// 超过最大长度仍不完整
+	_, _, err = f.Frame([]byte("$100\r\n0123456789abcdef"), false)
+	assert.Error(t, err)
+	_, _, err = f.Frame([]byte("*1\r\n@\r\n"), false)
+	assert.ErrorIs(t, err, errProtocol)
+}
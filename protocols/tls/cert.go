@@ -0,0 +1,130 @@
+package tls
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errBadCertificate = errors.New("malformed certificate message")
+
+// Certificate 握手中的一个证书
+type Certificate struct {
+	Raw        []byte            // DER编码
+	X509       *x509.Certificate // 解析后的证书，解析失败时为nil
+	ParseError error             // crypto/x509解析失败的原因
+
+	Subject      string
+	Issuer       string
+	SANs         []string // 主题备用名称：DNS名称、IP地址、邮箱和URI
+	SerialNumber string   // 十六进制
+	NotBefore    time.Time
+	NotAfter     time.Time
+	SHA1         string // DER编码的SHA1指纹（十六进制小写）
+	SHA256       string // DER编码的SHA256指纹（十六进制小写）
+}
+
+// newCertificate 解析DER编码的证书，解析失败时只有Raw、ParseError和指纹
+func newCertificate(der []byte) *Certificate {
+	sum1, sum256 := sha1.Sum(der), sha256.Sum256(der)
+	c := &Certificate{
+		Raw:    der,
+		SHA1:   hex.EncodeToString(sum1[:]),
+		SHA256: hex.EncodeToString(sum256[:]),
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		c.ParseError = err
+		return c
+	}
+	c.X509 = cert
+	c.Subject = cert.Subject.String()
+	c.Issuer = cert.Issuer.String()
+	c.SerialNumber = cert.SerialNumber.Text(16)
+	c.NotBefore, c.NotAfter = cert.NotBefore, cert.NotAfter
+	c.SANs = append(c.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		c.SANs = append(c.SANs, ip.String())
+	}
+	c.SANs = append(c.SANs, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		c.SANs = append(c.SANs, uri.String())
+	}
+	return c
+}
+
+// ValidAt 证书在给定时间是否处于有效期内
+func (c *Certificate) ValidAt(t time.Time) bool {
+	return c.X509 != nil && !t.Before(c.NotBefore) && !t.After(c.NotAfter)
+}
+
+// String 返回证书的摘要
+func (c *Certificate) String() string {
+	if c.X509 == nil {
+		return fmt.Sprintf("<unparsed: %v> sha256=%s", c.ParseError, c.SHA256)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "subject=%q issuer=%q", c.Subject, c.Issuer)
+	if len(c.SANs) > 0 {
+		fmt.Fprintf(&b, " sans=%s", strings.Join(c.SANs, ","))
+	}
+	fmt.Fprintf(&b, " valid=%s..%s sha256=%s", c.NotBefore.UTC().Format(time.DateOnly), c.NotAfter.UTC().Format(time.DateOnly), c.SHA256)
+	return b.String()
+}
+
+// parseCertificates 解析Certificate消息，TLS 1.3的消息包含请求上下文和每个证书的扩展
+func parseCertificates(body []byte, tls13 bool) ([]*Certificate, error) {
+	r := newByteReader(body)
+	if tls13 {
+		r.vector(1) // certificate_request_context
+	}
+	list := newByteReader(r.vector(3))
+	var certs []*Certificate
+	for list.ok && len(list.data) > 0 {
+		der := list.vector(3)
+		if tls13 {
+			list.vector(2) // 证书的扩展
+		}
+		if !list.ok || len(der) == 0 {
+			break
+		}
+		certs = append(certs, newCertificate(der))
+	}
+	if !r.ok || !list.ok {
+		return certs, errBadCertificate
+	}
+	return certs, nil
+}
+
+// writePEM 把证书链写入目录中以叶子证书SHA256指纹命名的PEM文件，文件已存在时跳过
+func writePEM(dir string, certs []*Certificate) error {
+	if len(certs) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, certs[0].SHA256+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,119 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	cryptotls "crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertTestCertificate 检查 testCertificate 生成的证书
+func assertTestCertificate(t *testing.T, certs []*Certificate) {
+	if !assert.Len(t, certs, 1) {
+		return
+	}
+	c := certs[0]
+	if !assert.NotNil(t, c.X509) {
+		return
+	}
+	assert.NoError(t, c.ParseError)
+	assert.Equal(t, "CN=example.com", c.Subject)
+	assert.Equal(t, "CN=example.com", c.Issuer)
+	assert.Equal(t, []string{"example.com"}, c.SANs)
+	assert.Equal(t, "1", c.SerialNumber)
+	assert.Equal(t, 2*time.Hour, c.NotAfter.Sub(c.NotBefore))
+	assert.True(t, c.ValidAt(time.Now()))
+	assert.False(t, c.ValidAt(c.NotAfter.Add(time.Second)))
+	sum := sha256.Sum256(c.Raw)
+	assert.Equal(t, hex.EncodeToString(sum[:]), c.SHA256)
+	assert.Len(t, c.SHA1, 40)
+}
+
+func TestCertificatesTLS12(t *testing.T) {
+	client, server := handshakeBytes(t, cryptotls.VersionTLS12)
+
+	var out bytes.Buffer
+	dir := filepath.Join(t.TempDir(), "certs")
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, Config{Output: &out, CertificateDir: dir})
+	assert.NoError(t, p.ProcessData(client, c2s, true, false))
+	assert.NoError(t, p.ProcessData(server, s2c, true, false))
+	assert.NoError(t, p.Close())
+	assert.Contains(t, out.String(), " certs=1\n")
+	assert.Contains(t, out.String(), `  cert[0]: subject="CN=example.com" issuer="CN=example.com" sans=example.com valid=`)
+
+	config := Config{}
+	handshakes := collect(&config)
+	p = NewProcessor(tcpdumper.StreamInfo{}, config)
+	assert.NoError(t, p.ProcessData(client, c2s, true, false))
+	assert.NoError(t, p.ProcessData(server, s2c, true, false))
+	if !assert.Len(t, *handshakes, 1) {
+		return
+	}
+	h := (*handshakes)[0]
+	assertTestCertificate(t, h.Certificates)
+	assert.Empty(t, h.ClientCertificates)
+	if len(h.Certificates) == 0 {
+		return
+	}
+	leaf := h.Certificates[0]
+
+	// PEM文件以叶子证书的指纹命名
+	data, err := os.ReadFile(filepath.Join(dir, leaf.SHA256+".pem"))
+	if assert.NoError(t, err) {
+		block, rest := pem.Decode(data)
+		if assert.NotNil(t, block) {
+			assert.Equal(t, "CERTIFICATE", block.Type)
+			assert.Equal(t, leaf.Raw, block.Bytes)
+		}
+		assert.Empty(t, rest)
+	}
+	// 已存在的文件不再写入
+	assert.NoError(t, writePEM(dir, h.Certificates))
+}
+
+// TLS 1.3的证书只有解密时才能得到
+func TestCertificatesTLS13(t *testing.T) {
+	keyLog := NewKeyLog()
+	tr := session{keyLog: keyLog, request: testRequest, response: testResponse}.run(t)
+
+	result := replay(tr, Config{})
+	if assert.Len(t, result.handshakes, 1) {
+		assert.Empty(t, result.handshakes[0].Certificates)
+	}
+	result = replay(tr, Config{KeyLog: keyLog})
+	assert.Empty(t, result.errs)
+	if assert.Len(t, result.handshakes, 1) {
+		assertTestCertificate(t, result.handshakes[0].Certificates)
+	}
+}
+
+func TestParseCertificates(t *testing.T) {
+	// 无法解析的证书保留原始数据和指纹
+	certs, err := parseCertificates([]byte{0, 0, 6, 0, 0, 3, 1, 2, 3}, false)
+	assert.NoError(t, err)
+	if assert.Len(t, certs, 1) {
+		assert.Nil(t, certs[0].X509)
+		assert.Error(t, certs[0].ParseError)
+		assert.Equal(t, []byte{1, 2, 3}, certs[0].Raw)
+		assert.Contains(t, certs[0].String(), "<unparsed: ")
+	}
+
+	// 长度超出消息
+	_, err = parseCertificates([]byte{0, 0, 6, 0, 0, 9, 1, 2, 3}, false)
+	assert.ErrorIs(t, err, errBadCertificate)
+
+	// TLS 1.3：请求上下文和每个证书的扩展
+	certs, err = parseCertificates([]byte{1, 0xaa, 0, 0, 7, 0, 0, 2, 1, 2, 0, 0}, true)
+	assert.NoError(t, err)
+	if assert.Len(t, certs, 1) {
+		assert.Equal(t, []byte{1, 2}, certs[0].Raw)
+	}
+}
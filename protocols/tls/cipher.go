@@ -0,0 +1,301 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // crypto.SHA384
+	cryptotls "crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	errUnsupportedSuite = errors.New("unsupported cipher suite for decryption")
+	errBadRecord        = errors.New("bad record")
+	errBadRecordMAC     = errors.New("record authentication failed")
+)
+
+// extEncryptThenMAC encrypt_then_mac扩展（RFC 7366），CBC密码套件先加密后计算MAC
+const extEncryptThenMAC = 22
+
+// cipherSuite 解密需要的密码套件参数
+type cipherSuite struct {
+	hash   crypto.Hash // TLS 1.2的PRF或TLS 1.3的HKDF使用的哈希
+	keyLen int
+	ivLen  int // TLS 1.3和ChaCha20为nonce长度，TLS 1.2 GCM为隐式nonce长度，CBC为块长度
+	aead   func(key []byte) (cipher.AEAD, error)
+
+	// TLS 1.2 GCM的nonce由隐式部分和记录中的8字节显式部分组成
+	explicitNonce bool
+
+	// CBC密码套件的MAC，aead为nil时使用
+	mac    func() hash.Hash
+	macLen int
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var (
+	suiteAES128GCM        = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 4, aead: aesGCM, explicitNonce: true}
+	suiteAES256GCM        = &cipherSuite{hash: crypto.SHA384, keyLen: 32, ivLen: 4, aead: aesGCM, explicitNonce: true}
+	suiteChaCha20Poly1305 = &cipherSuite{hash: crypto.SHA256, keyLen: 32, ivLen: 12, aead: chacha20poly1305.New}
+	suiteAES128CBCSHA     = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 16, mac: sha1.New, macLen: 20}
+	suiteAES256CBCSHA     = &cipherSuite{hash: crypto.SHA256, keyLen: 32, ivLen: 16, mac: sha1.New, macLen: 20}
+	suiteAES128CBCSHA256  = &cipherSuite{hash: crypto.SHA256, keyLen: 16, ivLen: 16, mac: sha256.New, macLen: 32}
+)
+
+// cipherSuites12 支持解密的TLS 1.2密码套件
+var cipherSuites12 = map[uint16]*cipherSuite{
+	cryptotls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         suiteAES128GCM,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       suiteAES128GCM,
+	cryptotls.TLS_RSA_WITH_AES_128_GCM_SHA256:               suiteAES128GCM,
+	cryptotls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         suiteAES256GCM,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       suiteAES256GCM,
+	cryptotls.TLS_RSA_WITH_AES_256_GCM_SHA384:               suiteAES256GCM,
+	cryptotls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   suiteChaCha20Poly1305,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: suiteChaCha20Poly1305,
+	cryptotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            suiteAES128CBCSHA,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          suiteAES128CBCSHA,
+	cryptotls.TLS_RSA_WITH_AES_128_CBC_SHA:                  suiteAES128CBCSHA,
+	cryptotls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            suiteAES256CBCSHA,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          suiteAES256CBCSHA,
+	cryptotls.TLS_RSA_WITH_AES_256_CBC_SHA:                  suiteAES256CBCSHA,
+	cryptotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         suiteAES128CBCSHA256,
+	cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       suiteAES128CBCSHA256,
+	cryptotls.TLS_RSA_WITH_AES_128_CBC_SHA256:               suiteAES128CBCSHA256,
+}
+
+// cipherSuites13 TLS 1.3密码套件
+var cipherSuites13 = map[uint16]*cipherSuite{
+	cryptotls.TLS_AES_128_GCM_SHA256:       {hash: crypto.SHA256, keyLen: 16, ivLen: 12, aead: aesGCM},
+	cryptotls.TLS_AES_256_GCM_SHA384:       {hash: crypto.SHA384, keyLen: 32, ivLen: 12, aead: aesGCM},
+	cryptotls.TLS_CHACHA20_POLY1305_SHA256: {hash: crypto.SHA256, keyLen: 32, ivLen: 12, aead: chacha20poly1305.New},
+}
+
+// recordCipher 一个方向的记录解密状态
+type recordCipher struct {
+	suite  *cipherSuite
+	tls13  bool
+	aead   cipher.AEAD
+	block  cipher.Block // CBC
+	macKey []byte
+	iv     []byte
+	etm    bool   // encrypt_then_mac
+	seq    uint64 // 下一条记录的序号
+	secret []byte // TLS 1.3当前的流量密钥，用于KeyUpdate
+}
+
+// prf12 TLS 1.2的PRF（RFC 5246 5）
+func prf12(h crypto.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h.New, secret)
+	a := seed
+	var out []byte
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+// newRecordCipher12 从主密钥派生一个方向的TLS 1.2密钥（RFC 5246 6.3）
+func newRecordCipher12(suite *cipherSuite, master, clientRandom, serverRandom []byte, client, etm bool) (*recordCipher, error) {
+	macLen := suite.macLen
+	n := 2 * (macLen + suite.keyLen + suite.ivLen)
+	block := prf12(suite.hash, master, "key expansion", append(append([]byte(nil), serverRandom...), clientRandom...), n)
+
+	// client_write_MAC_key, server_write_MAC_key, client_write_key, server_write_key, client_write_IV, server_write_IV
+	pick := func(offset, size int) []byte {
+		if !client {
+			offset += size
+		}
+		return block[offset : offset+size]
+	}
+	macKey := pick(0, macLen)
+	key := pick(2*macLen, suite.keyLen)
+	iv := pick(2*(macLen+suite.keyLen), suite.ivLen)
+
+	c := &recordCipher{suite: suite, macKey: macKey, iv: iv, etm: etm}
+	var err error
+	if suite.aead != nil {
+		c.aead, err = suite.aead(key)
+	} else {
+		c.block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hkdfExpandLabel TLS 1.3的HKDF-Expand-Label（RFC 8446 7.1）
+func hkdfExpandLabel(h crypto.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0) // 空的context
+	// 只有长度超过255倍哈希长度时才会出错，密钥和IV都远小于此
+	out, _ := hkdf.Expand(h.New, secret, string(info), length)
+	return out
+}
+
+// newRecordCipher13 从流量密钥派生TLS 1.3的密钥和IV（RFC 8446 7.3）
+func newRecordCipher13(suite *cipherSuite, secret []byte) (*recordCipher, error) {
+	aead, err := suite.aead(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{
+		suite:  suite,
+		tls13:  true,
+		aead:   aead,
+		iv:     hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen),
+		secret: secret,
+	}, nil
+}
+
+// update 处理KeyUpdate，派生下一代流量密钥
+func (c *recordCipher) update() (*recordCipher, error) {
+	return newRecordCipher13(c.suite, hkdfExpandLabel(c.suite.hash, c.secret, "traffic upd", c.suite.hash.Size()))
+}
+
+// nonce 隐式IV与序号异或得到的nonce
+func (c *recordCipher) nonce() []byte {
+	nonce := append([]byte(nil), c.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// additionalData TLS 1.2的附加数据：seq_num + type + version + length
+func (c *recordCipher) additionalData(header []byte, length int) []byte {
+	ad := binary.BigEndian.AppendUint64(make([]byte, 0, 13), c.seq)
+	ad = append(ad, header[:3]...)
+	return binary.BigEndian.AppendUint16(ad, uint16(length))
+}
+
+// decrypt 解密一条完整的记录，返回内容类型和明文
+func (c *recordCipher) decrypt(record []byte) (byte, []byte, error) {
+	header, payload := record[:recordHeaderLen], record[recordHeaderLen:]
+	var typ byte
+	var plaintext []byte
+	var err error
+	switch {
+	case c.tls13:
+		plaintext, err = c.aead.Open(nil, c.nonce(), payload, header)
+		if err != nil {
+			err = errBadRecordMAC
+		} else {
+			// TLSInnerPlaintext：内容 + 类型 + 填充的0
+			i := len(plaintext) - 1
+			for i >= 0 && plaintext[i] == 0 {
+				i--
+			}
+			if i < 0 {
+				return 0, nil, errBadRecord
+			}
+			typ, plaintext = plaintext[i], plaintext[:i]
+		}
+	case c.aead != nil:
+		typ = header[0]
+		var nonce []byte
+		if c.suite.explicitNonce {
+			if len(payload) < 8 {
+				return 0, nil, errBadRecord
+			}
+			nonce = append(append([]byte(nil), c.iv...), payload[:8]...)
+			payload = payload[8:]
+		} else {
+			nonce = c.nonce()
+		}
+		if len(payload) < c.aead.Overhead() {
+			return 0, nil, errBadRecord
+		}
+		plaintext, err = c.aead.Open(nil, nonce, payload, c.additionalData(header, len(payload)-c.aead.Overhead()))
+		if err != nil {
+			err = errBadRecordMAC
+		}
+	default:
+		typ = header[0]
+		plaintext, err = c.decryptCBC(header, payload)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("record %d: %w", c.seq, err)
+	}
+	c.seq++
+	return typ, plaintext, nil
+}
+
+// decryptCBC 解密CBC记录并校验MAC，记录以显式IV开头（TLS 1.1及以上）
+func (c *recordCipher) decryptCBC(header, payload []byte) ([]byte, error) {
+	macLen := c.suite.macLen
+	mac := hmac.New(c.suite.mac, c.macKey)
+	if c.etm {
+		// MAC覆盖IV和密文
+		if len(payload) < macLen {
+			return nil, errBadRecord
+		}
+		payload, tag := payload[:len(payload)-macLen], payload[len(payload)-macLen:]
+		mac.Write(c.additionalData(header, len(payload)))
+		mac.Write(payload)
+		if !hmac.Equal(mac.Sum(nil), tag) {
+			return nil, errBadRecordMAC
+		}
+		mac = nil
+	}
+
+	blockSize := c.block.BlockSize()
+	if len(payload) < 2*blockSize || len(payload)%blockSize != 0 {
+		return nil, errBadRecord
+	}
+	plaintext := make([]byte, len(payload)-blockSize)
+	cipher.NewCBCDecrypter(c.block, payload[:blockSize]).CryptBlocks(plaintext, payload[blockSize:])
+
+	padding := int(plaintext[len(plaintext)-1]) + 1
+	if padding > len(plaintext) {
+		return nil, errBadRecord
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding-1 {
+			return nil, errBadRecord
+		}
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+	if mac == nil {
+		return plaintext, nil
+	}
+
+	if len(plaintext) < macLen {
+		return nil, errBadRecord
+	}
+	plaintext, tag := plaintext[:len(plaintext)-macLen], plaintext[len(plaintext)-macLen:]
+	mac.Write(c.additionalData(header, len(plaintext)))
+	mac.Write(plaintext)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, errBadRecordMAC
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,233 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRequest  = "GET /secret HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	testResponse = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+)
+
+// decryptResult 解密测试的结果
+type decryptResult struct {
+	handshakes   []*Handshake
+	transactions []*http.Transaction
+	errs         []error
+}
+
+// replay 把会话的数据按写入顺序交给注册了TLS和HTTP的分发器
+func replay(tr *transcript, config Config) *decryptResult {
+	result := &decryptResult{}
+	config.OnHandshake = func(h *Handshake) {
+		result.handshakes = append(result.handshakes, h)
+	}
+	registry := tcpdumper.NewProtocolRegistry()
+	http.Register(registry, http.Config{CaptureBody: true, OnTransaction: func(tx *http.Transaction) {
+		result.transactions = append(result.transactions, tx)
+	}})
+	Register(registry, config)
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{Ident: "test"}, nil)
+	for _, seg := range tr.segments {
+		// 每次写入拆成两个数据块，记录跨越数据块
+		half := len(seg.data) / 2
+		for _, chunk := range [][]byte{seg.data[:half], seg.data[half:]} {
+			if err := d.ProcessData(chunk, seg.dir, false, false); err != nil {
+				result.errs = append(result.errs, err)
+			}
+		}
+	}
+	if err := d.Close(); err != nil {
+		result.errs = append(result.errs, err)
+	}
+	return result
+}
+
+// assertDecrypted 检查解密后的HTTP事务
+func assertDecrypted(t *testing.T, result *decryptResult) {
+	assert.Empty(t, result.errs)
+	if assert.Len(t, result.transactions, 1) {
+		tx := result.transactions[0]
+		if assert.NotNil(t, tx.Request) && assert.NotNil(t, tx.Response) {
+			assert.Equal(t, "/secret", tx.Request.URI)
+			assert.Equal(t, 200, tx.Response.StatusCode)
+			assert.Equal(t, "hello", string(tx.Response.Body))
+		}
+	}
+}
+
+func TestDecryptTLS13(t *testing.T) {
+	keyLog := NewKeyLog()
+	tr := session{nextProtos: []string{"http/1.1"}, keyLog: keyLog, request: testRequest, response: testResponse}.run(t)
+	assert.Equal(t, 1, keyLog.Len())
+
+	result := replay(tr, Config{KeyLog: keyLog})
+	assertDecrypted(t, result)
+	if assert.Len(t, result.handshakes, 1) {
+		h := result.handshakes[0]
+		assert.Equal(t, uint16(cryptotls.VersionTLS13), h.Version())
+		// 解密EncryptedExtensions得到服务器选择的ALPN
+		assert.Equal(t, "http/1.1", h.ALPN())
+	}
+}
+
+func TestDecryptTLS12(t *testing.T) {
+	suites := []uint16{
+		cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		cryptotls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		cryptotls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		cryptotls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		cryptotls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	}
+	for _, suite := range suites {
+		t.Run(cryptotls.CipherSuiteName(suite), func(t *testing.T) {
+			keyLog := NewKeyLog()
+			tr := session{
+				maxVersion:   cryptotls.VersionTLS12,
+				cipherSuites: []uint16{suite},
+				keyLog:       keyLog,
+				request:      testRequest,
+				response:     testResponse,
+			}.run(t)
+
+			result := replay(tr, Config{KeyLog: keyLog})
+			assertDecrypted(t, result)
+			if assert.Len(t, result.handshakes, 1) {
+				assert.Equal(t, suite, result.handshakes[0].ServerHello.CipherSuite)
+			}
+		})
+	}
+}
+
+// plainProcessor 记录收到的明文
+type plainProcessor struct {
+	data   bytes.Buffer
+	closed bool
+}
+
+func (p *plainProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	p.data.Write(data)
+	return nil
+}
+
+func (p *plainProcessor) Close() error {
+	p.closed = true
+	return nil
+}
+
+func (p *plainProcessor) GetProtocolName() string {
+	return "Plain"
+}
+
+// ALPN对应的协议已注册时跳过内容检测
+func TestDecryptALPN(t *testing.T) {
+	keyLog := NewKeyLog()
+	tr := session{nextProtos: []string{"http/1.1"}, keyLog: keyLog, request: "ping", response: "pong"}.run(t)
+
+	registry := tcpdumper.NewProtocolRegistry()
+	plain := &plainProcessor{}
+	tcpdumper.RegisterSimpleProtocol(registry, "Plain", "\xff\xff", func(tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+		return plain
+	})
+	Register(registry, Config{
+		KeyLog:        keyLog,
+		ALPNProtocols: map[string]string{"http/1.1": "Plain"},
+		OnHandshake:   func(*Handshake) {},
+	})
+
+	d := tcpdumper.NewDispatcher(registry, tcpdumper.StreamInfo{}, nil)
+	for _, seg := range tr.segments {
+		assert.NoError(t, d.ProcessData(seg.data, seg.dir, false, false))
+	}
+	assert.NoError(t, d.Close())
+	assert.Equal(t, "pingpong", plain.data.String())
+	assert.True(t, plain.closed)
+}
+
+// 密钥日志中没有的连接只解析握手
+func TestDecryptWithoutKey(t *testing.T) {
+	tr := session{request: testRequest, response: testResponse}.run(t)
+	result := replay(tr, Config{KeyLog: NewKeyLog()})
+	assert.Empty(t, result.errs)
+	assert.Empty(t, result.transactions)
+	if assert.Len(t, result.handshakes, 1) {
+		assert.Equal(t, "example.com", result.handshakes[0].ServerName())
+		assert.Empty(t, result.handshakes[0].ALPN())
+	}
+}
+
+// 密钥错误时返回解密错误，不再尝试解密该方向
+func TestDecryptWrongKey(t *testing.T) {
+	keyLog := NewKeyLog()
+	tr := session{maxVersion: cryptotls.VersionTLS12, keyLog: keyLog, request: testRequest, response: testResponse}.run(t)
+
+	wrong := NewKeyLog()
+	for random := range keyLog.secrets {
+		secret := make([]byte, 48)
+		rand.Read(secret)
+		wrong.Write([]byte(labelClientRandom + " " + random + " " + hex.EncodeToString(secret) + "\n"))
+	}
+	result := replay(tr, Config{KeyLog: wrong})
+	assert.Empty(t, result.transactions)
+	if assert.Len(t, result.errs, 2) {
+		assert.ErrorIs(t, result.errs[0], errBadRecordMAC)
+		assert.ErrorContains(t, result.errs[0], "decrypt: record 0")
+	}
+}
+
+func TestKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	k := NewKeyLog()
+	data := "# comment\n\nCLIENT_RANDOM " + random + " 0102\nCLIENT_RANDOM zz 01\nSERVER_TRAFFIC_SECRET_0 "
+	n, err := k.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, 1, k.Len())
+	clientRandom, _ := hex.DecodeString(random)
+	assert.Equal(t, []byte{1, 2}, k.secret(clientRandom, labelClientRandom))
+	assert.Nil(t, k.secret(clientRandom, labelServerTraffic))
+
+	// 不完整的行在后续写入后解析
+	k.Write([]byte(strings.ToUpper(random) + " 0304\n"))
+	assert.Equal(t, []byte{3, 4}, k.secret(clientRandom, labelServerTraffic))
+}
+
+func TestLoadKeyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	random := strings.Repeat("01", 32)
+	assert.NoError(t, os.WriteFile(path, []byte("CLIENT_RANDOM "+random+" aa\n"), 0o600))
+
+	k, err := LoadKeyLog(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientRandom, _ := hex.DecodeString(random)
+	assert.Equal(t, []byte{0xaa}, k.secret(clientRandom, labelClientRandom))
+
+	// 查找不到时重新读取变化的文件
+	other := strings.Repeat("02", 32)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if assert.NoError(t, err) {
+		f.WriteString("CLIENT_RANDOM " + other + " bb\n")
+		f.Close()
+	}
+	otherRandom, _ := hex.DecodeString(other)
+	assert.Equal(t, []byte{0xbb}, k.secret(otherRandom, labelClientRandom))
+
+	_, err = LoadKeyLog(filepath.Join(t.TempDir(), "missing.log"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,362 @@
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 握手消息类型
+const (
+	typeClientHello         = 1
+	typeServerHello         = 2
+	typeEncryptedExtensions = 8
+	typeCertificate         = 11
+	typeServerHelloDone     = 14
+	typeFinished            = 20
+	typeKeyUpdate           = 24
+)
+
+// 扩展类型
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extPointFormats        = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+var errShortHello = errors.New("malformed hello message")
+
+// ClientHello 客户端Hello中的元数据
+type ClientHello struct {
+	Version             uint16   // legacy_version
+	Random              []byte   // 32字节随机数
+	SessionID           []byte   // 会话ID
+	CipherSuites        []uint16 // 提供的密码套件，按出现顺序（含GREASE）
+	CompressionMethods  []uint8  // 压缩方法
+	Extensions          []uint16 // 扩展类型，按出现顺序（含GREASE）
+	ServerName          string   // SNI
+	ALPN                []string // 提供的应用层协议
+	SupportedVersions   []uint16 // supported_versions扩展中提供的版本
+	SupportedGroups     []uint16 // supported_groups（椭圆曲线）
+	PointFormats        []uint8  // ec_point_formats
+	SignatureAlgorithms []uint16 // signature_algorithms
+
+	JA3     string // JA3原始字符串
+	JA3Hash string // JA3指纹（JA3字符串的MD5）
+	JA4     string // JA4指纹
+}
+
+// ServerHello 服务器Hello中的元数据
+type ServerHello struct {
+	Version           uint16   // legacy_version
+	Random            []byte   // 32字节随机数
+	SessionID         []byte   // 会话ID
+	CipherSuite       uint16   // 选择的密码套件
+	CompressionMethod uint8    // 选择的压缩方法
+	Extensions        []uint16 // 扩展类型，按出现顺序
+	SelectedVersion   uint16   // supported_versions扩展中选择的版本（TLS 1.3），没有时为0
+	ALPN              string   // 选择的应用层协议（TLS 1.2及以下）
+
+	JA3S     string // JA3S原始字符串
+	JA3SHash string // JA3S指纹（JA3S字符串的MD5）
+}
+
+// byteReader 握手消息读取器，读取越界时ok变为false
+type byteReader struct {
+	data []byte
+	ok   bool
+}
+
+func newByteReader(data []byte) *byteReader {
+	return &byteReader{data: data, ok: true}
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) u16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// vector 读取长度前缀的数据，size为长度字段的字节数
+func (r *byteReader) vector(size int) []byte {
+	n := 0
+	for _, b := range r.bytes(size) {
+		n = n<<8 | int(b)
+	}
+	return r.bytes(n)
+}
+
+// u16s 把数据解析为uint16列表
+func u16s(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		values = append(values, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return values
+}
+
+// extension 一个扩展
+type extension struct {
+	typ  uint16
+	data []byte
+}
+
+// parseExtensions 解析扩展列表
+func parseExtensions(r *byteReader) ([]extension, bool) {
+	if len(r.data) == 0 {
+		// 没有扩展（如SSL 3.0）
+		return nil, r.ok
+	}
+	list := newByteReader(r.vector(2))
+	var exts []extension
+	for list.ok && len(list.data) > 0 {
+		typ := list.u16()
+		data := list.vector(2)
+		exts = append(exts, extension{typ: typ, data: data})
+	}
+	return exts, r.ok && list.ok
+}
+
+// parseClientHello 解析ClientHello消息体（不含握手消息头）
+func parseClientHello(body []byte) (*ClientHello, error) {
+	r := newByteReader(body)
+	ch := &ClientHello{
+		Version:   r.u16(),
+		Random:    r.bytes(32),
+		SessionID: r.vector(1),
+	}
+	ch.CipherSuites = u16s(r.vector(2))
+	ch.CompressionMethods = r.vector(1)
+	exts, ok := parseExtensions(r)
+	if !ok {
+		return nil, errShortHello
+	}
+
+	for _, ext := range exts {
+		ch.Extensions = append(ch.Extensions, ext.typ)
+		er := newByteReader(ext.data)
+		switch ext.typ {
+		case extServerName:
+			list := newByteReader(er.vector(2))
+			for list.ok && len(list.data) > 0 {
+				nameType, name := list.u8(), list.vector(2)
+				if nameType == 0 && list.ok {
+					ch.ServerName = string(name)
+				}
+			}
+		case extALPN:
+			list := newByteReader(er.vector(2))
+			for list.ok && len(list.data) > 0 {
+				if proto := list.vector(1); list.ok {
+					ch.ALPN = append(ch.ALPN, string(proto))
+				}
+			}
+		case extSupportedVersions:
+			ch.SupportedVersions = u16s(er.vector(1))
+		case extSupportedGroups:
+			ch.SupportedGroups = u16s(er.vector(2))
+		case extPointFormats:
+			ch.PointFormats = er.vector(1)
+		case extSignatureAlgorithms:
+			ch.SignatureAlgorithms = u16s(er.vector(2))
+		}
+	}
+
+	ch.JA3 = ja3(ch)
+	ch.JA3Hash = md5Hex(ch.JA3)
+	ch.JA4 = ja4(ch)
+	return ch, nil
+}
+
+// parseServerHello 解析ServerHello消息体（不含握手消息头）
+func parseServerHello(body []byte) (*ServerHello, error) {
+	r := newByteReader(body)
+	sh := &ServerHello{
+		Version:           r.u16(),
+		Random:            r.bytes(32),
+		SessionID:         r.vector(1),
+		CipherSuite:       r.u16(),
+		CompressionMethod: r.u8(),
+	}
+	exts, ok := parseExtensions(r)
+	if !ok {
+		return nil, errShortHello
+	}
+
+	for _, ext := range exts {
+		sh.Extensions = append(sh.Extensions, ext.typ)
+		er := newByteReader(ext.data)
+		switch ext.typ {
+		case extSupportedVersions:
+			sh.SelectedVersion = er.u16()
+		case extALPN:
+			list := newByteReader(er.vector(2))
+			sh.ALPN = string(list.vector(1))
+		}
+	}
+
+	sh.JA3S = fmt.Sprintf("%d,%d,%s", sh.Version, sh.CipherSuite, joinDecimal(sh.Extensions))
+	sh.JA3SHash = md5Hex(sh.JA3S)
+	return sh, nil
+}
+
+// parseEncryptedExtensions 解析TLS 1.3的EncryptedExtensions，返回服务器选择的ALPN
+func parseEncryptedExtensions(body []byte) (string, error) {
+	exts, ok := parseExtensions(newByteReader(body))
+	if !ok {
+		return "", errShortHello
+	}
+	for _, ext := range exts {
+		if ext.typ == extALPN {
+			list := newByteReader(newByteReader(ext.data).vector(2))
+			return string(list.vector(1)), nil
+		}
+	}
+	return "", nil
+}
+
+// isGREASE 判断是否为GREASE值（RFC 8701），计算指纹时需要忽略
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE 去掉GREASE值
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// joinDecimal 按十进制用"-"连接（JA3格式）
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// joinHex 按4位十六进制用","连接（JA4格式）
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// sha256Prefix 返回SHA256的前12个十六进制字符，空输入为全0（JA4格式）
+func sha256Prefix(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ja3 计算JA3字符串：SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func ja3(ch *ClientHello) string {
+	return fmt.Sprintf("%d,%s,%s,%s,%s", ch.Version,
+		joinDecimal(withoutGREASE(ch.CipherSuites)),
+		joinDecimal(withoutGREASE(ch.Extensions)),
+		joinDecimal(withoutGREASE(ch.SupportedGroups)),
+		joinDecimal(ch.PointFormats))
+}
+
+// ja4VersionNames JA4中的版本表示
+var ja4VersionNames = map[uint16]string{
+	0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3", 0x0002: "s2",
+	0xfeff: "d1", 0xfefd: "d2", 0xfefc: "d3",
+}
+
+// ja4 计算JA4指纹（TCP）：
+// a部分为协议、版本、SNI、密码套件数、扩展数和ALPN首尾字符，
+// b部分为排序后的密码套件的哈希，c部分为排序后的扩展（不含SNI和ALPN）加签名算法的哈希
+func ja4(ch *ClientHello) string {
+	version := ch.Version
+	if versions := withoutGREASE(ch.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	versionName, ok := ja4VersionNames[version]
+	if !ok {
+		versionName = "00"
+	}
+	sni := "i"
+	if ch.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(ch.CipherSuites)
+	exts := withoutGREASE(ch.Extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionName, sni, min(len(ciphers), 99), min(len(exts), 99), ja4ALPN(ch.ALPN))
+
+	slices.Sort(ciphers)
+	b := sha256Prefix(joinHex(ciphers))
+
+	sorted := make([]uint16, 0, len(exts))
+	for _, ext := range exts {
+		if ext != extServerName && ext != extALPN {
+			sorted = append(sorted, ext)
+		}
+	}
+	slices.Sort(sorted)
+	c := joinHex(sorted)
+	if c != "" && len(ch.SignatureAlgorithms) > 0 {
+		c += "_" + joinHex(ch.SignatureAlgorithms)
+	}
+	return a + "_" + b + "_" + sha256Prefix(c)
+}
+
+// ja4ALPN 第一个ALPN值的首尾字符，不是字母数字时使用其十六进制表示的首尾字符，没有ALPN时为"00"
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	v := alpn[0]
+	first, last := v[0], v[len(v)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(v))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
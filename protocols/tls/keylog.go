@@ -0,0 +1,130 @@
+package tls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 密钥日志中的标签（NSS Key Log Format）
+const (
+	labelClientRandom    = "CLIENT_RANDOM"                   // TLS 1.2及以下的主密钥
+	labelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET" // TLS 1.3
+	labelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// KeyLog SSLKEYLOGFILE（NSS Key Log Format）中的密钥，按ClientHello的随机数查找
+// 每行格式为 "<标签> <客户端随机数的十六进制> <密钥的十六进制>"，以#开头的行为注释。
+// KeyLog 实现了 io.Writer，可以直接作为 crypto/tls.Config.KeyLogWriter 使用；可以被多个流并发使用
+type KeyLog struct {
+	path string
+
+	mu      sync.Mutex
+	secrets map[string]map[string][]byte // 客户端随机数（十六进制小写） -> 标签 -> 密钥
+	partial []byte                       // Write收到的不完整的行
+	size    int64                        // 上次读取时文件的大小
+	modTime time.Time                    // 上次读取时文件的修改时间
+}
+
+// NewKeyLog 创建空的密钥日志，通过 Write 添加密钥
+func NewKeyLog() *KeyLog {
+	return &KeyLog{secrets: make(map[string]map[string][]byte)}
+}
+
+// LoadKeyLog 加载密钥日志文件
+// 实时抓包时文件可能在连接开始之后才写入密钥，查找不到连接的密钥时会在文件变化后重新读取
+func LoadKeyLog(path string) (*KeyLog, error) {
+	k := NewKeyLog()
+	k.path = path
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Write 解析写入的完整行，不完整的行保留到下次写入
+func (k *KeyLog) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	data := append(k.partial, p...)
+	i := bytes.LastIndexByte(data, '\n')
+	k.parse(data[:i+1])
+	k.partial = append([]byte(nil), data[i+1:]...)
+	return len(p), nil
+}
+
+// Len 已加载的连接数
+func (k *KeyLog) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.secrets)
+}
+
+// parse 解析密钥日志的内容，格式错误的行被忽略，调用者需持有k.mu
+func (k *KeyLog) parse(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 64*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			continue
+		}
+		key := hex.EncodeToString(random)
+		if k.secrets[key] == nil {
+			k.secrets[key] = make(map[string][]byte)
+		}
+		k.secrets[key][fields[0]] = secret
+	}
+}
+
+// reload 文件的大小或修改时间变化后重新读取，调用者需持有k.mu
+func (k *KeyLog) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == k.size && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	k.size, k.modTime = info.Size(), info.ModTime()
+	k.parse(data)
+	return nil
+}
+
+// secret 查找连接指定标签的密钥，没有找到时返回nil
+func (k *KeyLog) secret(clientRandom []byte, label string) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := hex.EncodeToString(clientRandom)
+	if secret := k.secrets[key][label]; secret != nil || k.path == "" {
+		return secret
+	}
+	if k.reload() != nil {
+		return nil
+	}
+	return k.secrets[key][label]
+}
@@ -0,0 +1,319 @@
+package tls
+
+import (
+	"bytes"
+	cryptotls "crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+var errHandshakeTooLarge = errors.New("handshake message too large")
+
+// helloRetryRandom HelloRetryRequest使用的ServerHello随机数（RFC 8446 4.1.3）
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// processor TLS处理器，每次调用必须是一个完整的记录，由 FramedProcessor 包装
+// 每个方向在ChangeCipherSpec（TLS 1.2）之前的握手记录是明文，其中的握手消息可能跨越多个记录，按消息头的长度重组。
+// 配置了密钥日志时，加密的记录按序号解密：握手消息继续解析，应用数据交给内部的 Dispatcher 重新识别
+type processor struct {
+	streamInfo tcpdumper.StreamInfo
+	config     Config
+
+	handshake *Handshake
+	pending   [2][]byte // 每个方向未完成的握手消息
+	encrypted [2]bool   // 该方向已发送ChangeCipherSpec（TLS 1.2），后续记录都已加密
+	broken    [2]bool   // 该方向的握手消息无法继续解析
+	done      bool      // 已回调握手事件
+
+	ciphers   [2]*recordCipher      // 每个方向的解密状态
+	noKeys    [2]bool               // 该方向没有密钥或解密失败，后续加密记录被忽略
+	plaintext *tcpdumper.Dispatcher // 解密后的应用数据的分发器
+	started   [2]bool               // 该方向是否已交付过应用数据
+}
+
+func newProcessor(streamInfo tcpdumper.StreamInfo, config Config) *processor {
+	return &processor{
+		streamInfo: streamInfo,
+		config:     config,
+		handshake:  &Handshake{StreamInfo: streamInfo},
+	}
+}
+
+// dirIndex 将方向转换为数组下标
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+func (p *processor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	return p.ProcessTimedData(data, dir, start, end, time.Time{})
+}
+
+// ProcessTimedData 处理一个带时间戳的记录，没有时间戳时使用当前时间
+func (p *processor) ProcessTimedData(data []byte, dir reassembly.TCPFlowDirection, start, end bool, ts time.Time) error {
+	if len(data) < recordHeaderLen {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	idx := dirIndex(dir)
+	var err error
+	switch typ := data[0]; {
+	case typ == recordChangeCipherSpec:
+		// TLS 1.3的ChangeCipherSpec只用于兼容中间设备，不改变加密状态
+		if p.handshake.Version() < cryptotls.VersionTLS13 {
+			p.encrypted[idx] = true
+			p.ciphers[idx], err = p.newCipher(idx)
+			p.noKeys[idx] = p.ciphers[idx] == nil
+		}
+		if dir == reassembly.TCPDirServerToClient {
+			p.finish()
+		}
+	case p.encrypted[idx] || typ == recordApplicationData:
+		err = p.encryptedRecord(dir, data, ts)
+	case typ == recordHandshake:
+		err = p.handshakeRecord(dir, data[recordHeaderLen:], ts)
+	case typ == recordAlert:
+		if dir == reassembly.TCPDirServerToClient {
+			p.finish()
+		}
+	}
+	return err
+}
+
+// newCipher 从密钥日志中查找密钥，创建一个方向的解密状态，没有密钥时返回nil
+// TLS 1.3使用握手流量密钥，服务器或客户端的Finished之后再切换到应用流量密钥
+func (p *processor) newCipher(idx int) (*recordCipher, error) {
+	ch, sh := p.handshake.ClientHello, p.handshake.ServerHello
+	if p.config.KeyLog == nil || ch == nil || sh == nil {
+		return nil, nil
+	}
+	version := p.handshake.Version()
+	if version >= cryptotls.VersionTLS13 {
+		label := labelServerHandshake
+		if idx == 0 {
+			label = labelClientHandshake
+		}
+		secret := p.config.KeyLog.secret(ch.Random, label)
+		if secret == nil {
+			return nil, nil
+		}
+		suite := cipherSuites13[sh.CipherSuite]
+		if suite == nil {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedSuite, cryptotls.CipherSuiteName(sh.CipherSuite))
+		}
+		return newRecordCipher13(suite, secret)
+	}
+
+	master := p.config.KeyLog.secret(ch.Random, labelClientRandom)
+	if master == nil {
+		return nil, nil
+	}
+	suite := cipherSuites12[sh.CipherSuite]
+	if suite == nil || version != cryptotls.VersionTLS12 {
+		return nil, fmt.Errorf("%w: %s %s", errUnsupportedSuite, VersionName(version), cryptotls.CipherSuiteName(sh.CipherSuite))
+	}
+	etm := suite.aead == nil && slices.Contains(sh.Extensions, extEncryptThenMAC)
+	return newRecordCipher12(suite, master, ch.Random, sh.Random, idx == 0, etm)
+}
+
+// encryptedRecord 解密一条记录，握手消息继续解析，应用数据交给内部的分发器
+func (p *processor) encryptedRecord(dir reassembly.TCPFlowDirection, record []byte, ts time.Time) error {
+	idx := dirIndex(dir)
+	if p.noKeys[idx] {
+		return nil
+	}
+	server := dir == reassembly.TCPDirServerToClient
+	if p.ciphers[idx] == nil {
+		if p.handshake.ServerHello == nil {
+			// 抓包从连接中途开始，或ServerHello之前客户端发送的0-RTT数据
+			return nil
+		}
+		c, err := p.newCipher(idx)
+		if c == nil {
+			p.noKeys[idx] = true
+			if server {
+				p.finish()
+			}
+			return err
+		}
+		p.ciphers[idx] = c
+	}
+
+	typ, plaintext, err := p.ciphers[idx].decrypt(record)
+	if err != nil {
+		p.ciphers[idx], p.noKeys[idx] = nil, true
+		if server {
+			p.finish()
+		}
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	switch typ {
+	case recordHandshake:
+		return p.handshakeRecord(dir, plaintext, ts)
+	case recordApplicationData:
+		return p.applicationData(dir, plaintext, ts)
+	}
+	return nil
+}
+
+// applicationData 把解密后的应用数据交给注册表识别，协商了ALPN时直接使用对应的协议
+func (p *processor) applicationData(dir reassembly.TCPFlowDirection, data []byte, ts time.Time) error {
+	if p.config.Registry == nil {
+		return nil
+	}
+	if p.plaintext == nil {
+		p.plaintext = tcpdumper.NewDispatcher(p.config.Registry, p.streamInfo, p.config.DefaultProcessor)
+		if name := p.config.ALPNProtocols[p.handshake.ALPN()]; name != "" {
+			p.plaintext.SetProtocol(name)
+		}
+	}
+	idx := dirIndex(dir)
+	start := !p.started[idx]
+	p.started[idx] = true
+	return p.plaintext.ProcessTimedData(data, dir, start, false, ts)
+}
+
+// handshakeRecord 把握手记录的内容追加到该方向的缓冲区，并处理其中所有完整的握手消息
+func (p *processor) handshakeRecord(dir reassembly.TCPFlowDirection, payload []byte, ts time.Time) error {
+	idx := dirIndex(dir)
+	if p.broken[idx] {
+		return nil
+	}
+	buf := append(p.pending[idx], payload...)
+	var errs []error
+	for len(buf) >= 4 {
+		length := int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+		if length > p.config.MaxHandshakeSize {
+			p.broken[idx] = true
+			p.pending[idx] = nil
+			return errors.Join(append(errs, fmt.Errorf("%w: %d bytes", errHandshakeTooLarge, length))...)
+		}
+		if len(buf) < 4+length {
+			break
+		}
+		// 解析结果（Random、SessionID、证书等）引用消息内容，而缓冲区会被之后的记录复用，需要拷贝
+		if err := p.message(dir, buf[0], bytes.Clone(buf[4:4+length]), ts); err != nil {
+			errs = append(errs, err)
+		}
+		buf = buf[4+length:]
+	}
+	p.pending[idx] = append(p.pending[idx][:0], buf...)
+	return errors.Join(errs...)
+}
+
+// message 处理一条完整的握手消息
+func (p *processor) message(dir reassembly.TCPFlowDirection, typ byte, body []byte, ts time.Time) error {
+	h := p.handshake
+	switch {
+	case typ == typeClientHello && dir == reassembly.TCPDirClientToServer:
+		if h.ClientHello != nil {
+			// HelloRetryRequest之后的第二个ClientHello，指纹以第一个为准
+			return nil
+		}
+		ch, err := parseClientHello(body)
+		if err != nil {
+			return fmt.Errorf("client hello: %w", err)
+		}
+		h.ClientHello, h.ClientHelloTime = ch, ts
+	case typ == typeServerHello && dir == reassembly.TCPDirServerToClient:
+		sh, err := parseServerHello(body)
+		if err != nil {
+			return fmt.Errorf("server hello: %w", err)
+		}
+		if bytes.Equal(sh.Random, helloRetryRandom) {
+			h.HelloRetry = true
+			return nil
+		}
+		h.ServerHello, h.ServerHelloTime = sh, ts
+		if h.Version() >= cryptotls.VersionTLS13 && p.config.KeyLog == nil {
+			// TLS 1.3 之后的握手消息都已加密
+			p.finish()
+		}
+	case typ == typeServerHelloDone && dir == reassembly.TCPDirServerToClient:
+		p.finish()
+	case typ == typeEncryptedExtensions && dir == reassembly.TCPDirServerToClient && h.ServerHello != nil:
+		alpn, err := parseEncryptedExtensions(body)
+		if err != nil {
+			return fmt.Errorf("encrypted extensions: %w", err)
+		}
+		h.ServerHello.ALPN = alpn
+	case typ == typeCertificate && h.ServerHello != nil:
+		certs, err := parseCertificates(body, h.Version() >= cryptotls.VersionTLS13)
+		if dir == reassembly.TCPDirClientToServer {
+			h.ClientCertificates = certs
+		} else {
+			h.Certificates = certs
+			if p.config.CertificateDir != "" {
+				if werr := writePEM(p.config.CertificateDir, certs); werr != nil {
+					err = errors.Join(err, fmt.Errorf("write certificates: %w", werr))
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("certificate: %w", err)
+		}
+	case typ == typeFinished && h.Version() >= cryptotls.VersionTLS13:
+		return p.trafficKeys(dir)
+	case typ == typeKeyUpdate && h.Version() >= cryptotls.VersionTLS13 && p.ciphers[dirIndex(dir)] != nil:
+		c, err := p.ciphers[dirIndex(dir)].update()
+		p.ciphers[dirIndex(dir)] = c
+		return err
+	}
+	return nil
+}
+
+// trafficKeys TLS 1.3中一个方向的Finished之后切换到应用流量密钥
+func (p *processor) trafficKeys(dir reassembly.TCPFlowDirection) error {
+	idx := dirIndex(dir)
+	label := labelServerTraffic
+	if dir == reassembly.TCPDirClientToServer {
+		label = labelClientTraffic
+	} else {
+		p.finish()
+	}
+	c := p.ciphers[idx]
+	if c == nil {
+		return nil
+	}
+	secret := p.config.KeyLog.secret(p.handshake.ClientHello.Random, label)
+	if secret == nil {
+		p.ciphers[idx], p.noKeys[idx] = nil, true
+		return nil
+	}
+	p.ciphers[idx], _ = newRecordCipher13(c.suite, secret)
+	return nil
+}
+
+// finish 回调握手事件，每个连接只回调一次
+func (p *processor) finish() {
+	if p.done || (p.handshake.ClientHello == nil && p.handshake.ServerHello == nil) {
+		return
+	}
+	p.done = true
+	p.config.OnHandshake(p.handshake)
+}
+
+func (p *processor) Close() error {
+	p.finish()
+	if p.plaintext != nil {
+		return p.plaintext.Close()
+	}
+	return nil
+}
+
+func (p *processor) GetProtocolName() string {
+	return ProtocolName
+}
@@ -0,0 +1,233 @@
+// Package tls 提供TLS握手元数据的检测器和处理器
+// 按记录层切分数据，重组跨越多个记录或TCP分段的握手消息，解析ClientHello和ServerHello，
+// 得到SNI、ALPN、协商的版本和密码套件，并计算JA3、JA3S和JA4指纹；每个连接的握手以 Handshake 事件交给回调。
+// TLS 1.2及以下的服务器证书链是明文，解析为 Certificate，可以写入PEM文件用于被动收集证书。
+// 提供SSLKEYLOGFILE时解密TLS 1.2/1.3的记录，解密后的应用数据交给注册表重新识别
+package tls
+
+import (
+	cryptotls "crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/google/gopacket/reassembly"
+)
+
+// ProtocolName 协议名称
+const ProtocolName = "TLS"
+
+// 记录层
+const (
+	recordHeaderLen = 5
+	maxRecordLen    = 16384 + 2048 // TLSCiphertext的最大长度
+)
+
+// 记录类型
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+const defaultMaxHandshakeSize = 256 * 1024
+
+// Handshake 一个连接的握手元数据
+// 抓包从连接中途开始时ClientHello为nil；服务器没有响应时ServerHello为nil
+type Handshake struct {
+	StreamInfo  tcpdumper.StreamInfo
+	ClientHello *ClientHello
+	ServerHello *ServerHello
+	HelloRetry  bool // 服务器发送了HelloRetryRequest，ClientHello为第一个ClientHello
+
+	// Certificates 服务器的证书链，第一个为叶子证书；TLS 1.3只有解密时才能得到
+	Certificates []*Certificate
+	// ClientCertificates 客户端证书链，服务器要求客户端认证时才有
+	ClientCertificates []*Certificate
+
+	ClientHelloTime time.Time
+	ServerHelloTime time.Time
+}
+
+// Version 协商的版本，TLS 1.3为supported_versions扩展中选择的版本，没有ServerHello时为0
+func (h *Handshake) Version() uint16 {
+	if h.ServerHello == nil {
+		return 0
+	}
+	if h.ServerHello.SelectedVersion != 0 {
+		return h.ServerHello.SelectedVersion
+	}
+	return h.ServerHello.Version
+}
+
+// ServerName 客户端请求的SNI
+func (h *Handshake) ServerName() string {
+	if h.ClientHello == nil {
+		return ""
+	}
+	return h.ClientHello.ServerName
+}
+
+// ALPN 服务器选择的应用层协议，TLS 1.3中ALPN在加密的EncryptedExtensions中，只有解密时才能得到
+func (h *Handshake) ALPN() string {
+	if h.ServerHello == nil {
+		return ""
+	}
+	return h.ServerHello.ALPN
+}
+
+// Latency 从ClientHello到ServerHello的时间
+func (h *Handshake) Latency() time.Duration {
+	if h.ClientHello == nil || h.ServerHello == nil {
+		return 0
+	}
+	return h.ServerHelloTime.Sub(h.ClientHelloTime)
+}
+
+// String 返回握手的摘要
+func (h *Handshake) String() string {
+	var parts []string
+	if ch := h.ClientHello; ch != nil {
+		if ch.ServerName != "" {
+			parts = append(parts, "sni="+ch.ServerName)
+		}
+	}
+	if sh := h.ServerHello; sh != nil {
+		parts = append(parts, "version="+VersionName(h.Version()), "cipher="+cryptotls.CipherSuiteName(sh.CipherSuite))
+		if sh.ALPN != "" {
+			parts = append(parts, "alpn="+sh.ALPN)
+		}
+	} else if ch := h.ClientHello; ch != nil && len(ch.ALPN) > 0 {
+		parts = append(parts, "alpn="+strings.Join(ch.ALPN, ","))
+	}
+	if h.ClientHello != nil {
+		parts = append(parts, "ja3="+h.ClientHello.JA3Hash, "ja4="+h.ClientHello.JA4)
+	}
+	if h.ServerHello != nil {
+		parts = append(parts, "ja3s="+h.ServerHello.JA3SHash)
+	}
+	if len(h.Certificates) > 0 {
+		parts = append(parts, fmt.Sprintf("certs=%d", len(h.Certificates)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// VersionName 返回版本名称，如 "TLS 1.3"
+func VersionName(version uint16) string {
+	return cryptotls.VersionName(version)
+}
+
+// Config TLS处理器配置
+type Config struct {
+	// OnHandshake 握手元数据完整时的回调，为nil时把摘要输出到Output
+	// TLS 1.3在ServerHello之后、TLS 1.2在ServerHelloDone或服务器开始加密之后回调，连接没有完成握手时在关闭时回调
+	OnHandshake func(*Handshake)
+	Output      io.Writer // 默认回调的输出，nil为标准输出
+
+	MaxHandshakeSize int // 单条握手消息的最大长度，0为默认256KB
+
+	// CertificateDir 不为空时把服务器证书链写入该目录，文件名为叶子证书的SHA256指纹加.pem，已存在的文件不再写入
+	CertificateDir string
+
+	// KeyLog 用于解密的密钥日志，为nil时不解密；密钥日志中没有的连接只解析握手
+	// 配置后TLS 1.3的握手事件在解密服务器的Finished之后回调，此时包含服务器选择的ALPN
+	KeyLog *KeyLog
+	// Registry 识别解密后应用数据的注册表，Register 时为nil则使用注册的注册表
+	Registry *tcpdumper.ProtocolRegistry
+	// DefaultProcessor 解密后的应用数据无法识别时使用的处理器工厂，可以为nil
+	DefaultProcessor tcpdumper.DefaultProcessorFactory
+	// ALPNProtocols ALPN到注册表中协议名称的映射，协商了ALPN且协议已注册时跳过内容检测
+	// nil为默认映射：h2为HTTP2，http/1.1为HTTP
+	ALPNProtocols map[string]string
+}
+
+// defaultALPNProtocols 默认的ALPN映射，协议名称与 protocols/http2 和 protocols/http 相同
+var defaultALPNProtocols = map[string]string{
+	"h2":       "HTTP2",
+	"http/1.1": "HTTP",
+}
+
+// withDefaults 填充默认值
+func (c Config) withDefaults() Config {
+	if c.MaxHandshakeSize <= 0 {
+		c.MaxHandshakeSize = defaultMaxHandshakeSize
+	}
+	if c.ALPNProtocols == nil {
+		c.ALPNProtocols = defaultALPNProtocols
+	}
+	if c.OnHandshake == nil {
+		w := c.Output
+		if w == nil {
+			w = os.Stdout
+		}
+		c.OnHandshake = func(h *Handshake) {
+			fmt.Fprintf(w, "TLS/%s: %s\n", h.StreamInfo.Ident, h)
+			for i, cert := range h.Certificates {
+				fmt.Fprintf(w, "  cert[%d]: %s\n", i, cert)
+			}
+		}
+	}
+	return c
+}
+
+// Detector TLS检测器，客户端数据以包含ClientHello的握手记录开头时确定为TLS，服务器数据以ServerHello开头时按较低置信度识别
+type Detector struct {
+	config Config
+}
+
+// NewDetector 创建TLS检测器
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+func (d *Detector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	if len(data) < recordHeaderLen+1 || data[0] != recordHandshake || data[1] != 3 || data[2] > 4 {
+		return 0
+	}
+	if length := int(data[3])<<8 | int(data[4]); length == 0 || length > maxRecordLen {
+		return 0
+	}
+	if dir == reassembly.TCPDirClientToServer && data[5] == typeClientHello {
+		return 100
+	}
+	if dir == reassembly.TCPDirServerToClient && data[5] == typeServerHello {
+		return 90
+	}
+	return 0
+}
+
+func (d *Detector) Name() string {
+	return ProtocolName
+}
+
+func (d *Detector) CreateProcessor(streamInfo tcpdumper.StreamInfo) tcpdumper.ProtocolProcessor {
+	return newFramedProcessor(streamInfo, d.config)
+}
+
+// recordFramer 按记录头中的长度切分记录
+var recordFramer, _ = tcpdumper.NewLengthPrefixFramer(tcpdumper.LengthPrefixConfig{
+	LengthOffset: 3,
+	LengthSize:   2,
+	MaxMessage:   maxRecordLen,
+})
+
+func newFramedProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return tcpdumper.NewFramedProcessor(newProcessor(streamInfo, config), recordFramer)
+}
+
+// NewProcessor 创建TLS处理器，返回的处理器会先把数据切分为完整的记录
+func NewProcessor(streamInfo tcpdumper.StreamInfo, config Config) *tcpdumper.FramedProcessor {
+	return newFramedProcessor(streamInfo, config.withDefaults())
+}
+
+// Register 向注册表注册TLS协议，解密后的应用数据默认也由该注册表识别
+func Register(registry *tcpdumper.ProtocolRegistry, config Config, opts ...tcpdumper.RegisterOption) {
+	if config.Registry == nil {
+		config.Registry = registry
+	}
+	registry.Register(NewDetector(config), opts...)
+}
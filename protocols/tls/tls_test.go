@@ -0,0 +1,347 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LubyRuffy/tcpdumper"
+	"github.com/LubyRuffy/tcpdumper/protocols/http"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	c2s = reassembly.TCPDirClientToServer
+	s2c = reassembly.TCPDirServerToClient
+)
+
+// segment 一次写入的数据
+type segment struct {
+	dir  reassembly.TCPFlowDirection
+	data []byte
+}
+
+// transcript 按写入顺序记录两个方向的数据
+type transcript struct {
+	mu       sync.Mutex
+	segments []segment
+}
+
+// bytes 返回一个方向的所有数据
+func (tr *transcript) bytes(dir reassembly.TCPFlowDirection) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var data []byte
+	for _, seg := range tr.segments {
+		if seg.dir == dir {
+			data = append(data, seg.data...)
+		}
+	}
+	return data
+}
+
+// recordingConn 把写入的数据记录到transcript
+type recordingConn struct {
+	net.Conn
+	dir reassembly.TCPFlowDirection
+	tr  *transcript
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.tr.mu.Lock()
+	c.tr.segments = append(c.tr.segments, segment{dir: c.dir, data: append([]byte(nil), b...)})
+	c.tr.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// testCertificate 生成自签名证书
+func testCertificate(t *testing.T) cryptotls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cryptotls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// session 一次测试用的TLS会话
+type session struct {
+	maxVersion   uint16
+	cipherSuites []uint16 // TLS 1.2的密码套件，nil为默认
+	nextProtos   []string // nil为h2和http/1.1
+	keyLog       io.Writer
+	request      string // 握手后客户端发送的数据
+	response     string // 服务器收到请求后发送的数据
+}
+
+// run 用crypto/tls完成握手并交换数据，返回双方发送的数据
+func (s session) run(t *testing.T) *transcript {
+	nextProtos := s.nextProtos
+	if nextProtos == nil {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	tr := &transcript{}
+	cc, sc := net.Pipe()
+	srv := cryptotls.Server(&recordingConn{Conn: sc, dir: s2c, tr: tr}, &cryptotls.Config{
+		Certificates: []cryptotls.Certificate{testCertificate(t)},
+		NextProtos:   nextProtos,
+		MaxVersion:   s.maxVersion,
+		CipherSuites: s.cipherSuites,
+		// net.Pipe没有缓冲，避免握手后发送的NewSessionTicket阻塞
+		SessionTicketsDisabled: true,
+	})
+	cli := cryptotls.Client(&recordingConn{Conn: cc, dir: c2s, tr: tr}, &cryptotls.Config{
+		ServerName:         "example.com",
+		NextProtos:         nextProtos,
+		InsecureSkipVerify: true,
+		MaxVersion:         s.maxVersion,
+		CipherSuites:       s.cipherSuites,
+		KeyLogWriter:       s.keyLog,
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		err := srv.Handshake()
+		if err == nil {
+			_, err = io.ReadFull(srv, make([]byte, len(s.request)))
+		}
+		if err == nil && s.response != "" {
+			_, err = srv.Write([]byte(s.response))
+		}
+		errc <- err
+	}()
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write([]byte(s.request)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(cli, make([]byte, len(s.response))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// 直接关闭底层连接，tls.Conn.Close 发送close_notify会阻塞
+	cc.Close()
+	sc.Close()
+	return tr
+}
+
+// handshakeBytes 完成一次握手，返回客户端和服务器发送的数据
+func handshakeBytes(t *testing.T, maxVersion uint16) (client, server []byte) {
+	tr := session{maxVersion: maxVersion, request: "ping"}.run(t)
+	return tr.bytes(c2s), tr.bytes(s2c)
+}
+
+func collect(config *Config) *[]*Handshake {
+	var handshakes []*Handshake
+	config.OnHandshake = func(h *Handshake) {
+		handshakes = append(handshakes, h)
+	}
+	return &handshakes
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(Config{})
+	assert.Equal(t, ProtocolName, d.Name())
+	assert.Equal(t, 100, d.Detect([]byte{0x16, 0x03, 0x01, 0x00, 0x80, 0x01}, c2s))
+	assert.Equal(t, 90, d.Detect([]byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02}, s2c))
+	assert.Equal(t, 0, d.Detect([]byte{0x16, 0x03, 0x01, 0x00, 0x80, 0x02}, c2s))
+	assert.Equal(t, 0, d.Detect([]byte{0x17, 0x03, 0x03, 0x00, 0x80, 0x01}, c2s))
+	assert.Equal(t, 0, d.Detect([]byte{0x16, 0x03, 0x01, 0x50, 0x00, 0x01}, c2s))
+	assert.Equal(t, 0, d.Detect([]byte("GET / HTTP/1.1\r\n"), c2s))
+	assert.Equal(t, 0, d.Detect([]byte{0x16, 0x03}, c2s))
+}
+
+func TestHandshakeTLS13(t *testing.T) {
+	client, server := handshakeBytes(t, 0)
+
+	config := Config{}
+	handshakes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "test"}, config)
+	// 逐字节输入，握手消息跨越多个数据块
+	for i := range client {
+		assert.NoError(t, p.ProcessData(client[i:i+1], c2s, i == 0, false))
+	}
+	assert.NoError(t, p.ProcessData(server, s2c, true, false))
+	assert.Len(t, *handshakes, 1)
+	assert.NoError(t, p.Close())
+	if !assert.Len(t, *handshakes, 1) {
+		return
+	}
+
+	h := (*handshakes)[0]
+	assert.Equal(t, "test", h.StreamInfo.Ident)
+	if !assert.NotNil(t, h.ClientHello) || !assert.NotNil(t, h.ServerHello) {
+		return
+	}
+	assert.Equal(t, "example.com", h.ServerName())
+	assert.Equal(t, []string{"h2", "http/1.1"}, h.ClientHello.ALPN)
+	assert.Contains(t, h.ClientHello.SupportedVersions, uint16(cryptotls.VersionTLS13))
+	assert.Len(t, h.ClientHello.Random, 32)
+	assert.Equal(t, uint16(cryptotls.VersionTLS13), h.Version())
+	assert.Equal(t, uint16(cryptotls.VersionTLS12), h.ServerHello.Version)
+	// TLS 1.3 选择的ALPN在加密的EncryptedExtensions中
+	assert.Empty(t, h.ALPN())
+	assert.Equal(t, "TLS 1.3", VersionName(h.Version()))
+
+	assert.Regexp(t, `^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`, h.ClientHello.JA4)
+	assert.True(t, strings.HasPrefix(h.ClientHello.JA3, "771,"))
+	assert.Equal(t, md5Hex(h.ClientHello.JA3), h.ClientHello.JA3Hash)
+	assert.Len(t, h.ServerHello.JA3SHash, 32)
+	assert.Contains(t, h.String(), "sni=example.com version=TLS 1.3 cipher=TLS_")
+	assert.Contains(t, h.String(), " ja3="+h.ClientHello.JA3Hash+" ja4="+h.ClientHello.JA4+" ja3s="+h.ServerHello.JA3SHash)
+}
+
+func TestHandshakeTLS12(t *testing.T) {
+	client, server := handshakeBytes(t, cryptotls.VersionTLS12)
+
+	config := Config{}
+	handshakes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	assert.NoError(t, p.ProcessData(client, c2s, true, false))
+	// 逐字节输入服务器数据，ServerHelloDone之后回调
+	for i := range server {
+		assert.NoError(t, p.ProcessData(server[i:i+1], s2c, i == 0, false))
+	}
+	assert.NoError(t, p.Close())
+	if !assert.Len(t, *handshakes, 1) {
+		return
+	}
+
+	h := (*handshakes)[0]
+	assert.Equal(t, uint16(cryptotls.VersionTLS12), h.Version())
+	assert.Zero(t, h.ServerHello.SelectedVersion)
+	assert.Equal(t, "h2", h.ALPN())
+	assert.Regexp(t, `^t12d\d{4}h2_`, h.ClientHello.JA4)
+	assert.Contains(t, h.String(), "version=TLS 1.2")
+}
+
+func TestClientHelloOnly(t *testing.T) {
+	client, _ := handshakeBytes(t, 0)
+
+	var out bytes.Buffer
+	p := NewProcessor(tcpdumper.StreamInfo{Ident: "a:1-b:443"}, Config{Output: &out})
+	assert.NoError(t, p.ProcessData(client, c2s, true, false))
+	assert.Empty(t, out.String())
+	assert.NoError(t, p.Close())
+	assert.Regexp(t, `^TLS/a:1-b:443: sni=example.com alpn=h2,http/1.1 ja3=[0-9a-f]{32} ja4=t13d`, out.String())
+}
+
+// ClientHello跨越多个记录时，之后同方向的握手记录不会覆盖已解析的字段
+func TestClientHelloFragmented(t *testing.T) {
+	client, _ := handshakeBytes(t, 0)
+	msg := client[5 : 5+int(client[3])<<8|int(client[4])]
+	random := append([]byte(nil), msg[6:38]...)
+	record := func(body []byte) []byte {
+		return append([]byte{0x16, 0x03, 0x01, byte(len(body) >> 8), byte(len(body))}, body...)
+	}
+	keyExchange := append([]byte{16, 0, 0, 64}, bytes.Repeat([]byte("1"), 64)...)
+
+	config := Config{}
+	handshakes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	// 每个记录只有一个字节，最后一个字节追加到缓冲区时不需要重新分配
+	for i := range msg {
+		assert.NoError(t, p.ProcessData(record(msg[i:i+1]), c2s, i == 0, false))
+	}
+	assert.NoError(t, p.ProcessData(record(keyExchange), c2s, false, false))
+	assert.NoError(t, p.Close())
+	if assert.Len(t, *handshakes, 1) && assert.NotNil(t, (*handshakes)[0].ClientHello) {
+		assert.Equal(t, random, (*handshakes)[0].ClientHello.Random)
+		assert.Equal(t, "example.com", (*handshakes)[0].ServerName())
+	}
+}
+
+func TestHandshakeTooLarge(t *testing.T) {
+	config := Config{MaxHandshakeSize: 16}
+	handshakes := collect(&config)
+	p := NewProcessor(tcpdumper.StreamInfo{}, config)
+	record := []byte{0x16, 0x03, 0x01, 0x00, 0x08, typeClientHello, 0x00, 0x01, 0x00, 0, 0, 0, 0}
+	assert.ErrorIs(t, p.ProcessData(record, c2s, true, false), errHandshakeTooLarge)
+	assert.NoError(t, p.Close())
+	assert.Empty(t, *handshakes)
+}
+
+func TestFingerprints(t *testing.T) {
+	ch := &ClientHello{
+		Version: 0x0303,
+		CipherSuites: []uint16{
+			0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+			0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions:          []uint16{0x1a1a, 0x0000, 0x0017, 0x000d, 0x0010, 0x000b, 0x000a, 0x002b},
+		ServerName:          "example.com",
+		ALPN:                []string{"h2"},
+		SupportedVersions:   []uint16{0x2a2a, 0x0304, 0x0303},
+		SupportedGroups:     []uint16{0x3a3a, 29, 23, 24},
+		PointFormats:        []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+	}
+
+	assert.Equal(t, "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-13-16-11-10-43,29-23-24,0", ja3(ch))
+	assert.Equal(t, "t13d1507h2_8daaf6152771_"+sha256Prefix("000a,000b,000d,0017,002b_0403,0804"), ja4(ch))
+
+	ch.ServerName, ch.ALPN, ch.SupportedVersions = "", nil, nil
+	ch.Extensions, ch.SignatureAlgorithms = nil, nil
+	assert.Equal(t, "t12i150000_8daaf6152771_000000000000", ja4(ch))
+}
+
+func TestGREASE(t *testing.T) {
+	assert.True(t, isGREASE(0x0a0a))
+	assert.True(t, isGREASE(0xfafa))
+	assert.False(t, isGREASE(0x0a1a))
+	assert.False(t, isGREASE(0x1301))
+	assert.Equal(t, []uint16{0x1301}, withoutGREASE([]uint16{0x2a2a, 0x1301}))
+}
+
+func TestJA4ALPN(t *testing.T) {
+	assert.Equal(t, "00", ja4ALPN(nil))
+	assert.Equal(t, "h1", ja4ALPN([]string{"http/1.1"}))
+	assert.Equal(t, "h2", ja4ALPN([]string{"h2", "http/1.1"}))
+	assert.Equal(t, "ab", ja4ALPN([]string{"\xab"}))
+}
+
+// CONNECT隧道中的TLS被重新识别并解析握手
+func TestConnectPcap(t *testing.T) {
+	dumper := tcpdumper.NewFileDumper("../../pcap_data/connect_https.pcapng")
+	http.Register(dumper.Registry(), http.Config{OnTransaction: func(*http.Transaction) {}})
+	config := Config{}
+	handshakes := collect(&config)
+	Register(dumper.Registry(), config)
+
+	assert.NoError(t, dumper.Start())
+	dumper.Wait()
+
+	if assert.Len(t, *handshakes, 1) {
+		h := (*handshakes)[0]
+		assert.Equal(t, "ip.bmh.im", h.ServerName())
+		assert.Equal(t, uint16(cryptotls.VersionTLS13), h.Version())
+		assert.Equal(t, uint16(cryptotls.TLS_AES_256_GCM_SHA384), h.ServerHello.CipherSuite)
+		assert.Equal(t, "t13d3112h2_e8f1e7e78f70_6bebaf5329ac", h.ClientHello.JA4)
+		assert.Equal(t, "0149f47eabf9a20d0893e2a44e5a6323", h.ClientHello.JA3Hash)
+	}
+}
@@ -0,0 +1,111 @@
+package tcpdumper
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+// defaultReaderBufferSize 读取器适配器每个方向默认最多缓冲的字节数
+const defaultReaderBufferSize = 1024 * 1024
+
+// ErrReaderOverflow 读取方处理过慢导致缓冲区溢出，该方向后续数据已被丢弃（即 ErrPipeOverflow）
+var ErrReaderOverflow = ErrPipeOverflow
+
+// ReaderPolicy 读取方落后（缓冲区已满）时的处理策略
+type ReaderPolicy = OverflowPolicy
+
+const (
+	// ReaderBlock 阻塞写入直到读取方消费数据（背压），读取方过慢时会拖慢整个重组器
+	ReaderBlock = OverflowBlock
+	// ReaderDropNewest 丢弃放不下的数据块，读取方会看到不连续的数据
+	ReaderDropNewest = OverflowDropNewest
+	// ReaderDropStream 丢弃该方向后续的所有数据，读取方读完已缓冲的数据后收到 ErrReaderOverflow
+	ReaderDropStream = OverflowDropStream
+)
+
+// ReaderConfig 读取器适配器配置
+type ReaderConfig struct {
+	BufferSize int          // 每个方向最多缓冲的字节数，0为默认1MB
+	Policy     ReaderPolicy // 缓冲区满时的处理策略
+}
+
+// ReaderHandler 以 io.Reader 的方式处理流的一个方向
+// 两个方向的handler分别在独立的goroutine中运行，流结束时r返回io.EOF；
+// handler返回后该方向剩余的数据被丢弃
+type ReaderHandler func(streamInfo StreamInfo, dir reassembly.TCPFlowDirection, r io.Reader)
+
+// ReaderProcessor 读取器适配器，把流的两个方向转换为阻塞的 io.Reader
+// 适用于 net/http ReadRequest、bufio 等基于 io.Reader 的解析器。
+// 每个方向的数据写入一个 BufferedPipe 交给handler，缓冲区满时按 ReaderPolicy 处理；
+// Close 在两个方向都返回io.EOF后等待handler结束
+type ReaderProcessor struct {
+	name     string
+	pipes    [2]*BufferedPipe
+	reported [2]bool // 是否已报告过该方向的溢出
+	wg       sync.WaitGroup
+}
+
+// NewReaderProcessor 创建读取器适配器并启动两个方向的handler
+func NewReaderProcessor(name string, streamInfo StreamInfo, config ReaderConfig, handler ReaderHandler) *ReaderProcessor {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultReaderBufferSize
+	}
+
+	rp := &ReaderProcessor{name: name}
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		pipe := NewBufferedPipe(config.BufferSize, config.Policy)
+		rp.pipes[i] = pipe
+
+		rp.wg.Add(1)
+		go func() {
+			defer rp.wg.Done()
+			handler(streamInfo, dir, pipe)
+			// 不再读取，剩余数据的写入会失败并被丢弃
+			pipe.CloseRead()
+		}()
+	}
+	return rp
+}
+
+func (rp *ReaderProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	idx := dirIndex(dir)
+	pipe := rp.pipes[idx]
+	_, err := pipe.Write(data)
+	if end {
+		pipe.CloseWithError(nil)
+	}
+
+	switch {
+	case errors.Is(err, ErrPipeOverflow):
+		// 只报告一次溢出，之后的数据静默丢弃
+		if rp.reported[idx] {
+			return nil
+		}
+		rp.reported[idx] = true
+		return ErrReaderOverflow
+	case errors.Is(err, ErrPipeFull), errors.Is(err, io.ErrClosedPipe):
+		// 丢弃的数据计入统计；handler已返回时不再需要数据
+		return nil
+	}
+	return err
+}
+
+func (rp *ReaderProcessor) Close() error {
+	for _, pipe := range rp.pipes {
+		pipe.CloseWithError(nil)
+	}
+	rp.wg.Wait()
+	return nil
+}
+
+func (rp *ReaderProcessor) GetProtocolName() string {
+	return rp.name
+}
+
+// Stats 获取两个方向管道的统计信息（包括被丢弃的字节数）
+func (rp *ReaderProcessor) Stats() (client, server PipeStats) {
+	return rp.pipes[0].Stats(), rp.pipes[1].Stats()
+}
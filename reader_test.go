@@ -0,0 +1,138 @@
+package tcpdumper
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试两个方向的读取器按顺序收到数据并在流结束时返回EOF
+func TestReaderProcessor(t *testing.T) {
+	var mu sync.Mutex
+	var methods, statuses []string
+	rp := NewReaderProcessor("HTTP", StreamInfo{}, ReaderConfig{}, func(streamInfo StreamInfo, dir reassembly.TCPFlowDirection, r io.Reader) {
+		br := bufio.NewReader(r)
+		for {
+			if dir == reassembly.TCPDirClientToServer {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, req.Body)
+				mu.Lock()
+				methods = append(methods, req.Method+" "+req.URL.Path)
+				mu.Unlock()
+			} else {
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				mu.Lock()
+				statuses = append(statuses, resp.Status)
+				mu.Unlock()
+			}
+		}
+	})
+
+	// 请求跨越多个数据块
+	assert.NoError(t, rp.ProcessData([]byte("GET /a HTTP/1.1\r\nHost: x\r\n"), reassembly.TCPDirClientToServer, true, false))
+	assert.NoError(t, rp.ProcessData([]byte("\r\nPOST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, rp.ProcessData([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"), reassembly.TCPDirServerToClient, true, false))
+	assert.NoError(t, rp.ProcessData([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"), reassembly.TCPDirServerToClient, false, false))
+	assert.NoError(t, rp.Close())
+
+	assert.Equal(t, []string{"GET /a", "POST /b"}, methods)
+	assert.Equal(t, []string{"200 OK", "404 Not Found"}, statuses)
+	assert.Equal(t, "HTTP", rp.GetProtocolName())
+}
+
+// newBlockedReader 创建客户端方向的读取方在release关闭前不读取的适配器，返回读到的数据和错误
+func newBlockedReader(config ReaderConfig, release chan struct{}) (*ReaderProcessor, *[]byte, *error) {
+	var data []byte
+	var readErr error
+	rp := NewReaderProcessor("Slow", StreamInfo{}, config, func(streamInfo StreamInfo, dir reassembly.TCPFlowDirection, r io.Reader) {
+		if dir != reassembly.TCPDirClientToServer {
+			io.Copy(io.Discard, r)
+			return
+		}
+		<-release
+		data, readErr = io.ReadAll(r)
+	})
+	return rp, &data, &readErr
+}
+
+// 测试阻塞策略：缓冲区满时写入等待读取方
+func TestReaderProcessorBlock(t *testing.T) {
+	release := make(chan struct{})
+	rp, data, readErr := newBlockedReader(ReaderConfig{BufferSize: 4, Policy: ReaderBlock}, release)
+
+	// 第一个数据块填满缓冲区，第二个数据块需要等待读取方
+	assert.NoError(t, rp.ProcessData([]byte("abcd"), reassembly.TCPDirClientToServer, false, false))
+	written := make(chan struct{})
+	go func() {
+		rp.ProcessData([]byte("efgh"), reassembly.TCPDirClientToServer, false, false)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write should block while the reader is behind")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-written
+	assert.NoError(t, rp.Close())
+	assert.Equal(t, "abcdefgh", string(*data))
+	assert.NoError(t, *readErr)
+}
+
+// 测试丢弃策略：缓冲区满时丢弃该方向后续数据，读取方收到 ErrReaderOverflow
+func TestReaderProcessorDropStream(t *testing.T) {
+	release := make(chan struct{})
+	rp, data, readErr := newBlockedReader(ReaderConfig{BufferSize: 4, Policy: ReaderDropStream}, release)
+
+	assert.NoError(t, rp.ProcessData([]byte("abcd"), reassembly.TCPDirClientToServer, false, false))
+	assert.ErrorIs(t, rp.ProcessData([]byte("efgh"), reassembly.TCPDirClientToServer, false, false), ErrReaderOverflow)
+	assert.NoError(t, rp.ProcessData([]byte("ijkl"), reassembly.TCPDirClientToServer, false, false))
+
+	close(release)
+	assert.NoError(t, rp.Close())
+	assert.Equal(t, "abcd", string(*data))
+	assert.ErrorIs(t, *readErr, ErrReaderOverflow)
+}
+
+// 测试handler提前返回后写入不会阻塞
+func TestReaderProcessorHandlerReturnsEarly(t *testing.T) {
+	rp := NewReaderProcessor("Early", StreamInfo{}, ReaderConfig{BufferSize: 2}, func(streamInfo StreamInfo, dir reassembly.TCPFlowDirection, r io.Reader) {})
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, rp.ProcessData([]byte("data"), reassembly.TCPDirClientToServer, false, false))
+	}
+	assert.NoError(t, rp.Close())
+}
+
+// 测试丢弃最新数据策略：放不下的数据块被丢弃并计入统计
+func TestReaderProcessorDropNewest(t *testing.T) {
+	release := make(chan struct{})
+	rp, data, readErr := newBlockedReader(ReaderConfig{BufferSize: 4, Policy: ReaderDropNewest}, release)
+
+	assert.NoError(t, rp.ProcessData([]byte("abc"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, rp.ProcessData([]byte("efgh"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, rp.ProcessData([]byte("d"), reassembly.TCPDirClientToServer, false, false))
+
+	client, _ := rp.Stats()
+	assert.Equal(t, int64(4), client.DroppedBytes)
+
+	close(release)
+	assert.NoError(t, rp.Close())
+	assert.Equal(t, "abcd", string(*data))
+	assert.NoError(t, *readErr)
+}
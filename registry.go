@@ -8,65 +8,363 @@ import (
 
 // ProtocolRegistry 协议注册表
 // 管理所有已注册的协议检测器
+// 检测器列表采用写时复制：注册、注销、替换都会生成新的列表，
+// 检测时只在读锁内获取列表快照，因此运行时修改检测器不会阻塞正在进行的检测
+// 已经识别出协议的流会继续使用原来的处理器，之后的检测使用新的检测器列表
 type ProtocolRegistry struct {
-	detectors []ProtocolDetector
+	detectors []*detectorEntry // 只读，修改时整体替换
 	mu        sync.RWMutex
+
+	// 检测配置
+	threshold    int                   // 检测阈值，得分必须大于此值
+	policy       ConflictPolicy        // 冲突处理策略
+	debugHandler DetectionDebugHandler // 调试回调，为nil时不记录得分
+}
+
+// detectorEntry 已注册的协议检测器及其注册选项
+type detectorEntry struct {
+	detector       ProtocolDetector
+	priority       int         // 优先级，用于冲突处理
+	preferredPorts []PortRange // 首选端口，命中时提高置信度
+	portBoost      int         // 命中首选端口时增加的置信度
+	fallbackPorts  []PortRange // 兜底端口，内容检测失败时按端口选择协议
+	group          string      // 分组，用于按组替换（如同一个签名文件中的所有签名）
+}
+
+// RegisterOption 注册协议检测器时的可选配置
+type RegisterOption func(*detectorEntry)
+
+// WithPriority 设置检测器优先级（默认0），数值越大优先级越高
+// 多个检测器得分相同（或使用ConflictHighestPriority策略）时，优先级高者胜出
+func WithPriority(priority int) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.priority = priority
+	}
+}
+
+// WithGroup 设置检测器所属分组，可以通过 ReplaceGroup、UnregisterGroup 整组替换或注销
+func WithGroup(group string) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.group = group
+	}
 }
 
 // NewProtocolRegistry 创建新的协议注册表
 func NewProtocolRegistry() *ProtocolRegistry {
 	return &ProtocolRegistry{
-		detectors: make([]ProtocolDetector, 0),
+		detectors: make([]*detectorEntry, 0),
+		threshold: DefaultDetectThreshold,
 	}
 }
 
 // Register 注册协议检测器
-func (pr *ProtocolRegistry) Register(detector ProtocolDetector) {
+// 可以通过 WithPriority、WithPreferredPorts、WithFallbackPorts 等选项提供优先级和端口相关的先验信息
+func (pr *ProtocolRegistry) Register(detector ProtocolDetector, opts ...RegisterOption) {
+	entry := newDetectorEntry(detector, opts)
+
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
-	pr.detectors = append(pr.detectors, detector)
+	detectors := make([]*detectorEntry, 0, len(pr.detectors)+1)
+	detectors = append(detectors, pr.detectors...)
+	pr.detectors = append(detectors, entry)
 }
 
-// DetectProtocol 检测协议，返回最匹配的协议检测器
-func (pr *ProtocolRegistry) DetectProtocol(data []byte, dir reassembly.TCPFlowDirection) ProtocolDetector {
-	if len(pr.detectors) == 0 {
-		return nil
+// newDetectorEntry 根据注册选项创建检测器条目
+func newDetectorEntry(detector ProtocolDetector, opts []RegisterOption) *detectorEntry {
+	entry := &detectorEntry{
+		detector:  detector,
+		portBoost: defaultPortBoost,
+	}
+	for _, opt := range opts {
+		opt(entry)
+	}
+	return entry
+}
+
+// Unregister 注销指定名称的所有检测器，返回注销的数量
+func (pr *ProtocolRegistry) Unregister(name string) int {
+	return pr.remove(func(entry *detectorEntry) bool {
+		return entry.detector.Name() == name
+	})
+}
+
+// UnregisterGroup 注销指定分组的所有检测器，返回注销的数量
+func (pr *ProtocolRegistry) UnregisterGroup(group string) int {
+	return pr.remove(func(entry *detectorEntry) bool {
+		return entry.group == group
+	})
+}
+
+// remove 删除满足条件的检测器
+func (pr *ProtocolRegistry) remove(match func(*detectorEntry) bool) int {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	detectors := make([]*detectorEntry, 0, len(pr.detectors))
+	for _, entry := range pr.detectors {
+		if !match(entry) {
+			detectors = append(detectors, entry)
+		}
+	}
+	removed := len(pr.detectors) - len(detectors)
+	pr.detectors = detectors
+	return removed
+}
+
+// Replace 用新的检测器替换指定名称的检测器，保持其在注册顺序中的位置
+// 同名检测器有多个时只替换第一个并注销其余的；没有找到时追加注册并返回false
+func (pr *ProtocolRegistry) Replace(name string, detector ProtocolDetector, opts ...RegisterOption) bool {
+	entry := newDetectorEntry(detector, opts)
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	replaced := false
+	detectors := make([]*detectorEntry, 0, len(pr.detectors)+1)
+	for _, old := range pr.detectors {
+		if old.detector.Name() != name {
+			detectors = append(detectors, old)
+		} else if !replaced {
+			detectors = append(detectors, entry)
+			replaced = true
+		}
+	}
+	if !replaced {
+		detectors = append(detectors, entry)
+	}
+	pr.detectors = detectors
+	return replaced
+}
+
+// ReplaceGroup 原子地用另一个注册表中的检测器替换指定分组的所有检测器
+// 新检测器追加在列表末尾并归入该分组；检测阈值等配置保持不变
+// 适用于热加载签名集合：先在临时注册表中加载并校验，再一次性替换
+func (pr *ProtocolRegistry) ReplaceGroup(group string, other *ProtocolRegistry) {
+	incoming := other.snapshot().detectors
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	detectors := make([]*detectorEntry, 0, len(pr.detectors)+len(incoming))
+	for _, entry := range pr.detectors {
+		if entry.group != group {
+			detectors = append(detectors, entry)
+		}
+	}
+	for _, entry := range incoming {
+		grouped := *entry
+		grouped.group = group
+		detectors = append(detectors, &grouped)
 	}
+	pr.detectors = detectors
+}
+
+// ReplaceAll 原子地用另一个注册表中的检测器替换所有检测器，检测阈值等配置保持不变
+func (pr *ProtocolRegistry) ReplaceAll(other *ProtocolRegistry) {
+	incoming := other.snapshot().detectors
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.detectors = incoming
+}
+
+// registrySnapshot 检测时使用的注册表快照
+type registrySnapshot struct {
+	detectors []*detectorEntry
+	threshold int
+	policy    ConflictPolicy
+}
+
+// snapshot 获取检测器列表和检测配置的快照
+func (pr *ProtocolRegistry) snapshot() registrySnapshot {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return registrySnapshot{
+		detectors: pr.detectors,
+		threshold: pr.threshold,
+		policy:    pr.policy,
+	}
+}
+
+// SetThreshold 设置检测阈值（默认50），得分必须大于阈值才会被选中
+func (pr *ProtocolRegistry) SetThreshold(threshold int) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.threshold = threshold
+}
+
+// Threshold 获取检测阈值
+func (pr *ProtocolRegistry) Threshold() int {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return pr.threshold
+}
+
+// SetConflictPolicy 设置多个检测器同时超过阈值时的冲突处理策略（默认ConflictHighestScore）
+func (pr *ProtocolRegistry) SetConflictPolicy(policy ConflictPolicy) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.policy = policy
+}
+
+// SetDebugHandler 设置协议检测调试回调，为nil时关闭调试
+// 启用后流的每次检测都会计算并回调所有检测器的得分，便于分析误识别
+func (pr *ProtocolRegistry) SetDebugHandler(handler DetectionDebugHandler) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.debugHandler = handler
+}
 
+// debug 获取调试回调
+func (pr *ProtocolRegistry) debug() DetectionDebugHandler {
 	pr.mu.RLock()
 	defer pr.mu.RUnlock()
+	return pr.debugHandler
+}
 
-	var bestDetector ProtocolDetector
-	bestConfidence := 0
+// DetectProtocol 检测协议，返回最匹配的协议检测器
+func (pr *ProtocolRegistry) DetectProtocol(data []byte, dir reassembly.TCPFlowDirection) ProtocolDetector {
+	return pr.DetectProtocolWithContext(newDataDetectContext(data, dir))
+}
 
-	for _, detector := range pr.detectors {
-		confidence := detector.Detect(data, dir)
-		if confidence > bestConfidence {
-			bestConfidence = confidence
-			bestDetector = detector
+// DetectProtocolWithContext 基于检测上下文检测协议，返回最匹配的协议检测器
+// 实现了 ContextProtocolDetector 的检测器会收到完整上下文，其余检测器只收到当前方向的数据
+// 没有检测器基于内容识别出协议时，会尝试按端口兜底（见 PortFallback）
+func (pr *ProtocolRegistry) DetectProtocolWithContext(ctx *DetectContext) ProtocolDetector {
+	if detector := pr.detectContent(ctx, nil); detector != nil {
+		return detector
+	}
+	return pr.PortFallback(ctx.StreamInfo)
+}
+
+// Explain 基于检测上下文检测协议，并返回所有检测器的得分及选择结果
+func (pr *ProtocolRegistry) Explain(ctx *DetectContext) *DetectionResult {
+	result := &DetectionResult{}
+	if detector := pr.detectContent(ctx, result); detector != nil {
+		result.Selected = detector.Name()
+	} else if detector := pr.PortFallback(ctx.StreamInfo); detector != nil {
+		result.Selected = detector.Name()
+		result.Fallback = true
+	}
+	return result
+}
+
+// detectContent 基于数据内容（及首选端口加成）检测协议
+// result不为nil时记录所有检测器的得分
+func (pr *ProtocolRegistry) detectContent(ctx *DetectContext, result *DetectionResult) ProtocolDetector {
+	snap := pr.snapshot()
+	srcPort, dstPort := ctx.StreamInfo.PortNumbers()
+
+	var best *candidate
+	for i, entry := range snap.detectors {
+		confidence := detectConfidence(entry.detector, ctx)
+		score := confidence
+		// 首选端口只作为先验证据，不会让完全不匹配的检测器被选中
+		if confidence > 0 && (portInRanges(dstPort, entry.preferredPorts) || portInRanges(srcPort, entry.preferredPorts)) {
+			score += entry.portBoost
+			if score > 100 {
+				score = 100
+			}
+		}
+
+		if result != nil {
+			result.Scores = append(result.Scores, DetectorScore{
+				Name:       entry.detector.Name(),
+				Confidence: confidence,
+				PortBoost:  score - confidence,
+				Score:      score,
+				Priority:   entry.priority,
+			})
+		}
+
+		// 只有得分大于阈值才可能被选中
+		if score <= snap.threshold {
+			continue
+		}
+		c := candidate{entry: entry, score: score, index: i}
+		if best == nil || c.better(*best, snap.policy) {
+			best = &c
 		}
 	}
 
-	// 只有置信度大于50才认为检测成功
-	if bestConfidence > 50 {
-		return bestDetector
+	if result != nil {
+		result.StreamInfo = ctx.StreamInfo
+		result.Dir = ctx.Dir
+		result.Threshold = snap.threshold
+		result.Policy = snap.policy
 	}
 
+	if best != nil {
+		return best.entry.detector
+	}
+	return nil
+}
+
+// PortFallback 按兜底端口选择协议检测器，没有命中时返回nil
+// 优先匹配目标端口，其次匹配源端口（未观察到SYN时流的方向可能是反的）；
+// 同一端口命中多个检测器时优先级高者胜出，优先级相同时先注册者胜出
+func (pr *ProtocolRegistry) PortFallback(streamInfo StreamInfo) ProtocolDetector {
+	detectors := pr.snapshot().detectors
+	srcPort, dstPort := streamInfo.PortNumbers()
+	for _, port := range []uint16{dstPort, srcPort} {
+		var best *detectorEntry
+		for _, entry := range detectors {
+			if portInRanges(port, entry.fallbackPorts) && (best == nil || entry.priority > best.priority) {
+				best = entry
+			}
+		}
+		if best != nil {
+			return best.detector
+		}
+	}
 	return nil
 }
 
+// newDataDetectContext 根据单方向数据构造检测上下文
+func newDataDetectContext(data []byte, dir reassembly.TCPFlowDirection) *DetectContext {
+	ctx := &DetectContext{Dir: dir}
+	if dir == reassembly.TCPDirClientToServer {
+		ctx.ClientData = data
+	} else {
+		ctx.ServerData = data
+	}
+	return ctx
+}
+
+// detectConfidence 调用检测器获取置信度
+func detectConfidence(detector ProtocolDetector, ctx *DetectContext) int {
+	if cd, ok := detector.(ContextProtocolDetector); ok {
+		return cd.DetectWithContext(ctx)
+	}
+	data := ctx.CurrentData()
+	if len(data) == 0 {
+		return 0
+	}
+	return detector.Detect(data, ctx.Dir)
+}
+
 // GetRegisteredProtocols 获取所有已注册的协议名称
 func (pr *ProtocolRegistry) GetRegisteredProtocols() []string {
 	pr.mu.RLock()
 	defer pr.mu.RUnlock()
 
 	protocols := make([]string, len(pr.detectors))
-	for i, detector := range pr.detectors {
-		protocols[i] = detector.Name()
+	for i, entry := range pr.detectors {
+		protocols[i] = entry.detector.Name()
 	}
 	return protocols
 }
 
+// Lookup 按名称查找检测器，有多个同名检测器时返回最先注册的，找不到时返回nil
+func (pr *ProtocolRegistry) Lookup(name string) ProtocolDetector {
+	for _, entry := range pr.snapshot().detectors {
+		if entry.detector.Name() == name {
+			return entry.detector
+		}
+	}
+	return nil
+}
+
 /*
  * 简化开发的便捷函数
  */
@@ -103,15 +401,43 @@ func (spd *SimpleProtocolDetector) CreateProcessor(streamInfo StreamInfo) Protoc
 	return spd.processorFactory(streamInfo)
 }
 
+// SimpleContextProtocolDetector 基于检测上下文的简单协议检测器实现
+type SimpleContextProtocolDetector struct {
+	SimpleProtocolDetector
+	contextDetectFunc func(*DetectContext) int
+}
+
+// NewSimpleContextProtocolDetector 创建基于检测上下文的简单协议检测器
+func NewSimpleContextProtocolDetector(
+	name string,
+	detectFunc func(*DetectContext) int,
+	processorFactory func(StreamInfo) ProtocolProcessor,
+) *SimpleContextProtocolDetector {
+	scpd := &SimpleContextProtocolDetector{contextDetectFunc: detectFunc}
+	scpd.SimpleProtocolDetector = SimpleProtocolDetector{
+		name: name,
+		detectFunc: func(data []byte, dir reassembly.TCPFlowDirection) int {
+			return detectFunc(newDataDetectContext(data, dir))
+		},
+		processorFactory: processorFactory,
+	}
+	return scpd
+}
+
+func (scpd *SimpleContextProtocolDetector) DetectWithContext(ctx *DetectContext) int {
+	return scpd.contextDetectFunc(ctx)
+}
+
 // RegisterProtocol 便捷的协议注册函数
 func RegisterProtocol(
 	registry *ProtocolRegistry,
 	name string,
 	detectFunc func([]byte, reassembly.TCPFlowDirection) int,
 	processorFactory func(StreamInfo) ProtocolProcessor,
+	opts ...RegisterOption,
 ) {
 	detector := NewSimpleProtocolDetector(name, detectFunc, processorFactory)
-	registry.Register(detector)
+	registry.Register(detector, opts...)
 }
 
 // RegisterSimpleProtocol 更简单的协议注册函数（基于字符串前缀匹配）
@@ -120,6 +446,7 @@ func RegisterSimpleProtocol(
 	name string,
 	pattern string,
 	processorFactory func(StreamInfo) ProtocolProcessor,
+	opts ...RegisterOption,
 ) {
 	detectFunc := func(data []byte, dir reassembly.TCPFlowDirection) int {
 		if len(data) < len(pattern) {
@@ -131,7 +458,7 @@ func RegisterSimpleProtocol(
 		return 0
 	}
 
-	RegisterProtocol(registry, name, detectFunc, processorFactory)
+	RegisterProtocol(registry, name, detectFunc, processorFactory, opts...)
 }
 
 // RegisterPatternProtocol 基于方向敏感模式匹配的协议注册
@@ -141,6 +468,7 @@ func RegisterPatternProtocol(
 	clientPattern string, // 客户端到服务器的模式
 	serverPattern string, // 服务器到客户端的模式
 	processorFactory func(StreamInfo) ProtocolProcessor,
+	opts ...RegisterOption,
 ) {
 	detectFunc := func(data []byte, dir reassembly.TCPFlowDirection) int {
 		var pattern string
@@ -164,5 +492,17 @@ func RegisterPatternProtocol(
 		return 0
 	}
 
-	RegisterProtocol(registry, name, detectFunc, processorFactory)
+	RegisterProtocol(registry, name, detectFunc, processorFactory, opts...)
+}
+
+// RegisterContextProtocol 注册基于检测上下文的协议
+// 检测函数可以同时查看双向的初始数据和流信息
+func RegisterContextProtocol(
+	registry *ProtocolRegistry,
+	name string,
+	detectFunc func(*DetectContext) int,
+	processorFactory func(StreamInfo) ProtocolProcessor,
+	opts ...RegisterOption,
+) {
+	registry.Register(NewSimpleContextProtocolDetector(name, detectFunc, processorFactory), opts...)
 }
@@ -0,0 +1,346 @@
+package tcpdumper
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestProcessorFactory 返回创建testProcessor的工厂函数
+func newTestProcessorFactory() func(StreamInfo) ProtocolProcessor {
+	return func(streamInfo StreamInfo) ProtocolProcessor {
+		return &testProcessor{ident: streamInfo.Ident}
+	}
+}
+
+// fixedConfidence 返回固定置信度的检测函数
+func fixedConfidence(confidence int) func([]byte, reassembly.TCPFlowDirection) int {
+	return func(data []byte, dir reassembly.TCPFlowDirection) int {
+		return confidence
+	}
+}
+
+// 测试首选端口提高置信度
+func TestPreferredPortBoost(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterProtocol(registry, "Redis", fixedConfidence(40), newTestProcessorFactory(), WithPreferredPorts(6379))
+	RegisterProtocol(registry, "Never", fixedConfidence(0), newTestProcessorFactory(), WithPreferredPortRange(6000, 7000))
+
+	ctx := &DetectContext{
+		StreamInfo: StreamInfo{SrcPort: "50000", DstPort: "6379"},
+		Dir:        reassembly.TCPDirClientToServer,
+		ClientData: []byte("*1\r\n$4\r\nPING\r\n"),
+	}
+	detector := registry.DetectProtocolWithContext(ctx)
+	assert.NotNil(t, detector)
+	assert.Equal(t, "Redis", detector.Name())
+
+	// 端口不匹配时置信度不足
+	ctx.StreamInfo.DstPort = "6380"
+	assert.Nil(t, registry.DetectProtocolWithContext(ctx))
+
+	// 未观察到SYN时方向可能是反的，源端口同样生效
+	ctx.StreamInfo = StreamInfo{SrcPort: "6379", DstPort: "50000"}
+	assert.NotNil(t, registry.DetectProtocolWithContext(ctx))
+
+	// 自定义加成
+	registry = NewProtocolRegistry()
+	RegisterProtocol(registry, "Redis", fixedConfidence(40), newTestProcessorFactory(), WithPreferredPorts(6379), WithPortBoost(5))
+	ctx.StreamInfo = StreamInfo{SrcPort: "50000", DstPort: "6379"}
+	assert.Nil(t, registry.DetectProtocolWithContext(ctx))
+}
+
+// 测试兜底端口
+func TestPortFallback(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterProtocol(registry, "HTTP", fixedConfidence(0), newTestProcessorFactory(), WithFallbackPorts(80, 8080))
+	RegisterProtocol(registry, "Ephemeral", fixedConfidence(0), newTestProcessorFactory(), WithFallbackPortRange(49152, 65535))
+
+	assert.Equal(t, "HTTP", registry.PortFallback(StreamInfo{SrcPort: "50000", DstPort: "8080"}).Name())
+	assert.Equal(t, "Ephemeral", registry.PortFallback(StreamInfo{SrcPort: "1234", DstPort: "50000"}).Name())
+	assert.Nil(t, registry.PortFallback(StreamInfo{SrcPort: "1234", DstPort: "1235"}))
+	assert.Nil(t, registry.PortFallback(StreamInfo{}))
+
+	// 内容检测成功时不使用兜底端口
+	RegisterSimpleProtocol(registry, "Echo", "ECHO", newTestProcessorFactory())
+	ctx := &DetectContext{
+		StreamInfo: StreamInfo{SrcPort: "50000", DstPort: "80"},
+		Dir:        reassembly.TCPDirClientToServer,
+		ClientData: []byte("ECHO hello"),
+	}
+	assert.Equal(t, "Echo", registry.DetectProtocolWithContext(ctx).Name())
+	ctx.ClientData = []byte("hello")
+	assert.Equal(t, "HTTP", registry.DetectProtocolWithContext(ctx).Name())
+}
+
+// 测试流在内容检测失败后按端口兜底，而不是交给默认处理器
+func TestStreamPortFallback(t *testing.T) {
+	dumper := NewSimpleDumper()
+	var processor *recordProcessor
+	dumper.RegisterProtocolDetector(NewSimpleProtocolDetector("Redis", fixedConfidence(0), func(streamInfo StreamInfo) ProtocolProcessor {
+		processor = &recordProcessor{name: "Redis"}
+		return processor
+	}), WithFallbackPorts(6379))
+	dumper.SetDefaultProcessor(func(streamInfo StreamInfo) ProtocolProcessor {
+		t.Fatal("default processor should not be used")
+		return nil
+	})
+
+	stream := newTestStream(dumper, 6379, true)
+	feed(stream, reassembly.TCPDirClientToServer, "garbage")
+	assert.Nil(t, processor) // 等待对端数据
+	feed(stream, reassembly.TCPDirServerToClient, "reply")
+	stream.ReassemblyComplete(nil)
+
+	assert.NotNil(t, processor)
+	assert.Equal(t, []string{"client->server:garbage", "server->client:reply"}, processor.chunks)
+	_, _, _, unknownFlows := dumper.GetStats()
+	assert.Equal(t, uint64(0), unknownFlows)
+}
+
+// 测试可配置的检测阈值
+func TestDetectThreshold(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterProtocol(registry, "Weak", fixedConfidence(40), newTestProcessorFactory())
+	assert.Equal(t, DefaultDetectThreshold, registry.Threshold())
+	assert.Nil(t, registry.DetectProtocol([]byte("data"), reassembly.TCPDirClientToServer))
+
+	registry.SetThreshold(30)
+	detector := registry.DetectProtocol([]byte("data"), reassembly.TCPDirClientToServer)
+	assert.NotNil(t, detector)
+	assert.Equal(t, "Weak", detector.Name())
+
+	// 得分必须严格大于阈值
+	registry.SetThreshold(40)
+	assert.Nil(t, registry.DetectProtocol([]byte("data"), reassembly.TCPDirClientToServer))
+}
+
+// 测试优先级和冲突处理策略
+func TestConflictPolicy(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterProtocol(registry, "First", fixedConfidence(80), newTestProcessorFactory())
+	RegisterProtocol(registry, "Second", fixedConfidence(80), newTestProcessorFactory())
+	RegisterProtocol(registry, "Strong", fixedConfidence(70), newTestProcessorFactory(), WithPriority(10))
+	data := []byte("data")
+
+	// 得分相同，先注册者胜出
+	assert.Equal(t, "First", registry.DetectProtocol(data, reassembly.TCPDirClientToServer).Name())
+
+	// 得分相同，优先级高者胜出
+	RegisterProtocol(registry, "Preferred", fixedConfidence(80), newTestProcessorFactory(), WithPriority(1))
+	assert.Equal(t, "Preferred", registry.DetectProtocol(data, reassembly.TCPDirClientToServer).Name())
+
+	// 按优先级选择，只考虑超过阈值的检测器
+	registry.SetConflictPolicy(ConflictHighestPriority)
+	assert.Equal(t, "Strong", registry.DetectProtocol(data, reassembly.TCPDirClientToServer).Name())
+	registry.SetThreshold(75)
+	assert.Equal(t, "Preferred", registry.DetectProtocol(data, reassembly.TCPDirClientToServer).Name())
+}
+
+// 测试检测结果解释
+func TestExplainDetection(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterProtocol(registry, "Redis", fixedConfidence(40), newTestProcessorFactory(), WithPreferredPorts(6379))
+	RegisterProtocol(registry, "Other", fixedConfidence(10), newTestProcessorFactory(), WithFallbackPorts(6380))
+
+	ctx := &DetectContext{
+		StreamInfo: StreamInfo{SrcPort: "50000", DstPort: "6379"},
+		Dir:        reassembly.TCPDirClientToServer,
+		ClientData: []byte("data"),
+	}
+	result := registry.Explain(ctx)
+	assert.Equal(t, "Redis", result.Selected)
+	assert.False(t, result.Fallback)
+	assert.Equal(t, DefaultDetectThreshold, result.Threshold)
+	assert.Equal(t, []DetectorScore{
+		{Name: "Redis", Confidence: 40, PortBoost: 20, Score: 60},
+		{Name: "Other", Confidence: 10, Score: 10},
+	}, result.Scores)
+
+	ctx.StreamInfo.DstPort = "6380"
+	result = registry.Explain(ctx)
+	assert.Equal(t, "Other", result.Selected)
+	assert.True(t, result.Fallback)
+}
+
+// 测试调试模式记录流的每次检测得分
+func TestDetectionDebug(t *testing.T) {
+	dumper := NewSimpleDumper()
+	dumper.RegisterSimpleProtocol("SSH", "SSH-", newTestProcessorFactory())
+	var results []*DetectionResult
+	dumper.SetDetectionDebug(func(result *DetectionResult) {
+		results = append(results, result)
+	})
+
+	stream := newTestStream(dumper, 22, true)
+	feed(stream, reassembly.TCPDirClientToServer, "\x00\x01")
+	feed(stream, reassembly.TCPDirServerToClient, "SSH-2.0-OpenSSH_9.6\r\n")
+	stream.ReassemblyComplete(nil)
+
+	assert.Len(t, results, 2)
+	assert.Equal(t, 1, results[0].Attempt)
+	assert.True(t, results[0].Pending)
+	assert.Equal(t, "", results[0].Selected)
+	assert.Equal(t, []DetectorScore{{Name: "SSH", Score: 0}}, results[0].Scores)
+	assert.Equal(t, 2, results[1].Attempt)
+	assert.False(t, results[1].Pending)
+	assert.Equal(t, "SSH", results[1].Selected)
+	assert.Equal(t, 95, results[1].Scores[0].Score)
+	assert.Equal(t, "22", results[1].StreamInfo.DstPort)
+}
+
+// 测试注销和替换检测器
+func TestUnregisterAndReplace(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "A", "AAAA", newTestProcessorFactory())
+	RegisterSimpleProtocol(registry, "B", "BBBB", newTestProcessorFactory())
+	RegisterSimpleProtocol(registry, "A", "aaaa", newTestProcessorFactory())
+
+	assert.Equal(t, 2, registry.Unregister("A"))
+	assert.Equal(t, 0, registry.Unregister("A"))
+	assert.Equal(t, []string{"B"}, registry.GetRegisteredProtocols())
+	assert.Nil(t, registry.DetectProtocol([]byte("AAAA"), reassembly.TCPDirClientToServer))
+
+	// 替换保持注册顺序
+	RegisterSimpleProtocol(registry, "C", "CCCC", newTestProcessorFactory())
+	replaced := registry.Replace("B", NewSimpleProtocolDetector("B", func(data []byte, dir reassembly.TCPFlowDirection) int {
+		if string(data) == "bbbb" {
+			return 90
+		}
+		return 0
+	}, newTestProcessorFactory()))
+	assert.True(t, replaced)
+	assert.Equal(t, []string{"B", "C"}, registry.GetRegisteredProtocols())
+	assert.Nil(t, registry.DetectProtocol([]byte("BBBB"), reassembly.TCPDirClientToServer))
+	assert.Equal(t, "B", registry.DetectProtocol([]byte("bbbb"), reassembly.TCPDirClientToServer).Name())
+
+	// 不存在时追加
+	assert.False(t, registry.Replace("D", NewSimpleProtocolDetector("D", fixedConfidence(0), newTestProcessorFactory())))
+	assert.Equal(t, []string{"B", "C", "D"}, registry.GetRegisteredProtocols())
+}
+
+// 测试按组替换和整体替换
+func TestReplaceGroup(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "Builtin", "BUILTIN", newTestProcessorFactory())
+	RegisterSimpleProtocol(registry, "Old1", "OLD1", newTestProcessorFactory(), WithGroup("sigs"))
+	RegisterSimpleProtocol(registry, "Old2", "OLD2", newTestProcessorFactory(), WithGroup("sigs"))
+
+	staging := NewProtocolRegistry()
+	RegisterSimpleProtocol(staging, "New", "NEW", newTestProcessorFactory(), WithPreferredPorts(1234))
+	registry.ReplaceGroup("sigs", staging)
+	assert.Equal(t, []string{"Builtin", "New"}, registry.GetRegisteredProtocols())
+
+	// 替换进来的检测器属于该分组
+	assert.Equal(t, 1, registry.UnregisterGroup("sigs"))
+	assert.Equal(t, []string{"Builtin"}, registry.GetRegisteredProtocols())
+
+	registry.SetThreshold(10)
+	registry.ReplaceAll(staging)
+	assert.Equal(t, []string{"New"}, registry.GetRegisteredProtocols())
+	assert.Equal(t, 10, registry.Threshold())
+}
+
+// 测试热加载签名文件：新流使用新签名，已识别的流保留原处理器，无效文件不影响现有签名
+func TestReloadSignatureFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures.yaml")
+	writeSignatures := func(content string) {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	writeSignatures("signatures:\n  - name: V1\n    any: [{literal: 'V1'}]\n")
+
+	dumper := NewSimpleDumper()
+	dumper.RegisterSimpleProtocol("Builtin", "BUILTIN", newTestProcessorFactory())
+	assert.NoError(t, LoadSignatureFile(dumper.Registry(), path, io.Discard))
+	assert.Equal(t, []string{"Builtin", "V1"}, dumper.GetRegisteredProtocols())
+
+	var processors []*recordProcessor
+	dumper.RegisterProtocolDetector(NewSimpleProtocolDetector("Record", func(data []byte, dir reassembly.TCPFlowDirection) int {
+		if string(data) == "RECORD" {
+			return 90
+		}
+		return 0
+	}, func(streamInfo StreamInfo) ProtocolProcessor {
+		processor := &recordProcessor{name: "Record"}
+		processors = append(processors, processor)
+		return processor
+	}))
+	stream := newTestStream(dumper, 1000, true)
+	feed(stream, reassembly.TCPDirClientToServer, "RECORD")
+
+	writeSignatures("signatures:\n  - name: V2\n    any: [{literal: 'V2'}]\n")
+	assert.NoError(t, ReloadSignatureFile(dumper.Registry(), path, io.Discard))
+	assert.Equal(t, []string{"Builtin", "Record", "V2"}, dumper.GetRegisteredProtocols())
+	assert.Equal(t, 1, dumper.UnregisterProtocol("Record"))
+
+	// 已经识别出协议的流继续使用原来的处理器
+	feed(stream, reassembly.TCPDirServerToClient, "reply")
+	stream.ReassemblyComplete(nil)
+	assert.Len(t, processors, 1)
+	assert.Equal(t, []string{"client->server:RECORD", "server->client:reply"}, processors[0].chunks)
+
+	// 无效的文件不影响现有签名
+	writeSignatures("signatures:\n  - name: V3\n    any: [{regex: '('}]\n")
+	assert.Error(t, dumper.ReloadSignatureFile(path))
+	assert.Equal(t, []string{"Builtin", "V2"}, dumper.GetRegisteredProtocols())
+}
+
+// 测试同一签名文件的不同路径写法对应同一个分组，重复加载时替换而不是追加
+func TestLoadSignatureFileSameGroup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "signatures.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("signatures:\n  - name: V1\n    any: [{literal: 'V1'}]\n"), 0o644))
+
+	registry := NewProtocolRegistry()
+	assert.NoError(t, LoadSignatureFile(registry, path, io.Discard))
+	assert.NoError(t, LoadSignatureFile(registry, path, io.Discard))
+	assert.Equal(t, []string{"V1"}, registry.GetRegisteredProtocols())
+
+	assert.NoError(t, os.WriteFile(path, []byte("signatures:\n  - name: V2\n    any: [{literal: 'V2'}]\n"), 0o644))
+	t.Chdir(dir)
+	assert.NoError(t, ReloadSignatureFile(registry, "./signatures.yaml", io.Discard))
+	assert.Equal(t, []string{"V2"}, registry.GetRegisteredProtocols())
+	abs, _ := filepath.Abs("signatures.yaml")
+	assert.Equal(t, 1, registry.UnregisterGroup(abs))
+}
+
+// 测试检测过程中并发修改注册表（配合 -race 运行）
+func TestRegistryConcurrentModification(t *testing.T) {
+	registry := NewProtocolRegistry()
+	RegisterSimpleProtocol(registry, "Stable", "STABLE", newTestProcessorFactory())
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				detector := registry.DetectProtocol([]byte("STABLE data"), reassembly.TCPDirClientToServer)
+				assert.NotNil(t, detector)
+				registry.PortFallback(StreamInfo{DstPort: "80"})
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		staging := NewProtocolRegistry()
+		RegisterSimpleProtocol(staging, "Dynamic", "DYN", newTestProcessorFactory(), WithFallbackPorts(80))
+		registry.ReplaceGroup("dynamic", staging)
+		registry.Replace("Other", NewSimpleProtocolDetector("Other", fixedConfidence(0), newTestProcessorFactory()))
+		registry.Unregister("Other")
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, []string{"Stable", "Dynamic"}, registry.GetRegisteredProtocols())
+}
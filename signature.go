@@ -0,0 +1,340 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+// defaultSignatureConfidence 签名命中时默认返回的置信度
+const defaultSignatureConfidence = 90
+
+// SignatureDirection 签名规则适用的数据方向
+type SignatureDirection int
+
+const (
+	SignatureAnyDir         SignatureDirection = iota // 任意方向
+	SignatureClientToServer                           // 客户端到服务器
+	SignatureServerToClient                           // 服务器到客户端
+)
+
+// String 返回方向名称
+func (sd SignatureDirection) String() string {
+	switch sd {
+	case SignatureAnyDir:
+		return "any"
+	case SignatureClientToServer:
+		return "client"
+	case SignatureServerToClient:
+		return "server"
+	}
+	return "unknown"
+}
+
+// matches 判断规则方向是否适用于数据方向
+func (sd SignatureDirection) matches(dir reassembly.TCPFlowDirection) bool {
+	switch sd {
+	case SignatureClientToServer:
+		return dir == reassembly.TCPDirClientToServer
+	case SignatureServerToClient:
+		return dir == reassembly.TCPDirServerToClient
+	}
+	return true
+}
+
+// SignatureRule 签名规则
+// Literal、Hex、Regex 三者必须且只能设置一个
+type SignatureRule struct {
+	Dir SignatureDirection // 规则适用的方向
+
+	Literal string // 字面字节串
+	Hex     string // 十六进制字节模式，如 "16 03 ?? 01"，"??"匹配任意字节，"0?"匹配高4位为0的字节
+	Mask    string // Hex的可选掩码，如 "ff ff 00 ff"，与Hex等长，按位与后再比较
+	Regex   string // 正则表达式，需要锚定开头时请使用 "^"
+
+	// Offset 从数据的第几个字节开始匹配
+	Offset int
+	// Depth 匹配窗口的长度（从Offset开始），0表示不限制
+	// 对于Literal和Hex：Depth为0时模式必须恰好出现在Offset处，否则在窗口内搜索
+	// 对于Regex：在窗口内执行正则匹配
+	Depth int
+}
+
+// Signature 协议签名
+type Signature struct {
+	Name       string          // 协议名称
+	Rules      []SignatureRule // 签名规则
+	RequireAll bool            // 为true时所有规则（各自使用对应方向的数据）都命中才算匹配，否则任意规则命中即可
+	Confidence int             // 命中时返回的置信度，0表示默认值90
+}
+
+// SignatureDetector 基于签名的协议检测器
+// 支持正则表达式、带通配符/掩码的十六进制字节模式、偏移量、深度以及方向限制
+type SignatureDetector struct {
+	name             string
+	rules            []*compiledRule
+	requireAll       bool
+	confidence       int
+	processorFactory func(StreamInfo) ProtocolProcessor
+}
+
+// compiledRule 编译后的签名规则
+type compiledRule struct {
+	dir     SignatureDirection
+	pattern []byte // Literal或Hex的字节值
+	mask    []byte // Hex的掩码，为nil表示精确匹配
+	regex   *regexp.Regexp
+	offset  int
+	depth   int
+}
+
+// NewSignatureDetector 根据签名创建检测器，签名无效时返回错误
+func NewSignatureDetector(sig Signature, processorFactory func(StreamInfo) ProtocolProcessor) (*SignatureDetector, error) {
+	if sig.Name == "" {
+		return nil, fmt.Errorf("signature name is empty")
+	}
+	if len(sig.Rules) == 0 {
+		return nil, fmt.Errorf("signature %q has no rules", sig.Name)
+	}
+	if processorFactory == nil {
+		return nil, fmt.Errorf("signature %q has no processor factory", sig.Name)
+	}
+	if sig.Confidence < 0 || sig.Confidence > 100 {
+		return nil, fmt.Errorf("signature %q: confidence %d out of range 0-100", sig.Name, sig.Confidence)
+	}
+
+	sd := &SignatureDetector{
+		name:             sig.Name,
+		requireAll:       sig.RequireAll,
+		confidence:       sig.Confidence,
+		processorFactory: processorFactory,
+	}
+	if sd.confidence == 0 {
+		sd.confidence = defaultSignatureConfidence
+	}
+
+	for i, rule := range sig.Rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("signature %q rule %d: %v", sig.Name, i, err)
+		}
+		sd.rules = append(sd.rules, cr)
+	}
+	return sd, nil
+}
+
+// compileRule 编译单条签名规则
+func compileRule(rule SignatureRule) (*compiledRule, error) {
+	if rule.Offset < 0 {
+		return nil, fmt.Errorf("negative offset %d", rule.Offset)
+	}
+	if rule.Depth < 0 {
+		return nil, fmt.Errorf("negative depth %d", rule.Depth)
+	}
+	if rule.Dir < SignatureAnyDir || rule.Dir > SignatureServerToClient {
+		return nil, fmt.Errorf("invalid direction %d", rule.Dir)
+	}
+
+	cr := &compiledRule{dir: rule.Dir, offset: rule.Offset, depth: rule.Depth}
+
+	kinds := 0
+	if rule.Literal != "" {
+		kinds++
+		cr.pattern = []byte(rule.Literal)
+	}
+	if rule.Hex != "" {
+		kinds++
+		var err error
+		cr.pattern, cr.mask, err = ParseHexPattern(rule.Hex)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Mask != "" {
+			mask, wildcard, err := ParseHexPattern(rule.Mask)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mask: %v", err)
+			}
+			if wildcard != nil {
+				return nil, fmt.Errorf("invalid mask: wildcards are not allowed")
+			}
+			if len(mask) != len(cr.pattern) {
+				return nil, fmt.Errorf("mask length %d does not match pattern length %d", len(mask), len(cr.pattern))
+			}
+			if cr.mask == nil {
+				cr.mask = mask
+			} else {
+				for i := range mask {
+					cr.mask[i] &= mask[i]
+				}
+			}
+		}
+	} else if rule.Mask != "" {
+		return nil, fmt.Errorf("mask requires a hex pattern")
+	}
+	if rule.Regex != "" {
+		kinds++
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		cr.regex = re
+	}
+
+	if kinds != 1 {
+		return nil, fmt.Errorf("exactly one of literal, hex or regex must be set")
+	}
+	if cr.regex == nil && rule.Depth != 0 && rule.Depth < len(cr.pattern) {
+		return nil, fmt.Errorf("depth %d is shorter than pattern length %d", rule.Depth, len(cr.pattern))
+	}
+	return cr, nil
+}
+
+// ParseHexPattern 解析十六进制字节模式
+// 字节之间可以有空格，"??"匹配任意字节，单个"?"匹配任意半字节（如"4?"）
+// 返回字节值和掩码，没有通配符时掩码为nil
+func ParseHexPattern(s string) (pattern, mask []byte, err error) {
+	s = strings.Join(strings.Fields(s), "")
+	if s == "" {
+		return nil, nil, fmt.Errorf("empty hex pattern")
+	}
+	if len(s)%2 != 0 {
+		return nil, nil, fmt.Errorf("hex pattern %q has odd length", s)
+	}
+
+	pattern = make([]byte, len(s)/2)
+	mask = make([]byte, len(s)/2)
+	wildcard := false
+	for i := 0; i < len(s); i += 2 {
+		var value, m byte
+		for _, c := range []byte(s[i : i+2]) {
+			value <<= 4
+			m <<= 4
+			switch {
+			case c == '?':
+				wildcard = true
+			case c >= '0' && c <= '9':
+				value |= c - '0'
+				m |= 0xf
+			case c >= 'a' && c <= 'f':
+				value |= c - 'a' + 10
+				m |= 0xf
+			case c >= 'A' && c <= 'F':
+				value |= c - 'A' + 10
+				m |= 0xf
+			default:
+				return nil, nil, fmt.Errorf("invalid character %q in hex pattern", c)
+			}
+		}
+		pattern[i/2] = value
+		mask[i/2] = m
+	}
+
+	if !wildcard {
+		mask = nil
+	}
+	return pattern, mask, nil
+}
+
+// match 判断规则是否匹配数据
+func (cr *compiledRule) match(data []byte) bool {
+	if cr.offset >= len(data) {
+		return false
+	}
+	window := data[cr.offset:]
+	if cr.depth > 0 && cr.depth < len(window) {
+		window = window[:cr.depth]
+	}
+
+	if cr.regex != nil {
+		return cr.regex.Match(window)
+	}
+
+	if cr.depth == 0 {
+		return cr.matchAt(window)
+	}
+	if cr.mask == nil {
+		return bytes.Contains(window, cr.pattern)
+	}
+	for i := 0; i+len(cr.pattern) <= len(window); i++ {
+		if cr.matchAt(window[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAt 判断模式是否恰好出现在数据开头
+func (cr *compiledRule) matchAt(data []byte) bool {
+	if len(data) < len(cr.pattern) {
+		return false
+	}
+	if cr.mask == nil {
+		return bytes.Equal(data[:len(cr.pattern)], cr.pattern)
+	}
+	for i, b := range cr.pattern {
+		if data[i]&cr.mask[i] != b&cr.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchContext 使用检测上下文判断规则是否匹配
+// 方向限定的规则使用对应方向的数据，任意方向的规则优先使用当前方向的数据
+func (cr *compiledRule) matchContext(ctx *DetectContext) bool {
+	switch cr.dir {
+	case SignatureClientToServer:
+		return cr.match(ctx.ClientData)
+	case SignatureServerToClient:
+		return cr.match(ctx.ServerData)
+	}
+	return cr.match(ctx.CurrentData()) || cr.match(ctx.Data(ctx.Dir.Reverse()))
+}
+
+func (sd *SignatureDetector) Detect(data []byte, dir reassembly.TCPFlowDirection) int {
+	return sd.DetectWithContext(newDataDetectContext(data, dir))
+}
+
+func (sd *SignatureDetector) DetectWithContext(ctx *DetectContext) int {
+	if sd.requireAll {
+		for _, rule := range sd.rules {
+			if !rule.matchContext(ctx) {
+				return 0
+			}
+		}
+		return sd.confidence
+	}
+
+	for _, rule := range sd.rules {
+		if rule.dir.matches(ctx.Dir) && rule.match(ctx.CurrentData()) {
+			return sd.confidence
+		}
+	}
+	return 0
+}
+
+func (sd *SignatureDetector) Name() string {
+	return sd.name
+}
+
+func (sd *SignatureDetector) CreateProcessor(streamInfo StreamInfo) ProtocolProcessor {
+	return sd.processorFactory(streamInfo)
+}
+
+// RegisterSignatureProtocol 注册基于签名的协议，签名无效时返回错误
+func RegisterSignatureProtocol(
+	registry *ProtocolRegistry,
+	sig Signature,
+	processorFactory func(StreamInfo) ProtocolProcessor,
+	opts ...RegisterOption,
+) error {
+	detector, err := NewSignatureDetector(sig, processorFactory)
+	if err != nil {
+		return err
+	}
+	registry.Register(detector, opts...)
+	return nil
+}
@@ -0,0 +1,390 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SignatureConfig 签名配置文件
+//
+// YAML示例：
+//
+//	signatures:
+//	  - name: MyProto
+//	    confidence: 85
+//	    priority: 5
+//	    ports: [9000, "9100-9200"]
+//	    fallback_ports: [9000]
+//	    client:
+//	      - hex: "ca fe ?? ??"
+//	    server:
+//	      - regex: "^OK "
+//	        depth: 16
+//	    processor:
+//	      type: length_prefixed
+//	      length_size: 4
+//	      byte_order: big
+type SignatureConfig struct {
+	Signatures []SignatureSpec `yaml:"signatures" json:"signatures"`
+}
+
+// SignatureSpec 配置文件中的单个协议签名
+type SignatureSpec struct {
+	Name          string        `yaml:"name" json:"name"`
+	Confidence    int           `yaml:"confidence" json:"confidence"`         // 命中时的置信度，默认90
+	Priority      int           `yaml:"priority" json:"priority"`             // 检测器优先级
+	RequireAll    bool          `yaml:"require_all" json:"require_all"`       // 所有规则都命中才算匹配
+	Ports         []PortRange   `yaml:"ports" json:"ports"`                   // 首选端口
+	PortBoost     *int          `yaml:"port_boost" json:"port_boost"`         // 命中首选端口时增加的置信度
+	FallbackPorts []PortRange   `yaml:"fallback_ports" json:"fallback_ports"` // 兜底端口
+	Client        []RuleSpec    `yaml:"client" json:"client"`                 // 客户端到服务器方向的规则
+	Server        []RuleSpec    `yaml:"server" json:"server"`                 // 服务器到客户端方向的规则
+	Any           []RuleSpec    `yaml:"any" json:"any"`                       // 任意方向的规则
+	Processor     ProcessorSpec `yaml:"processor" json:"processor"`           // 使用的处理器
+}
+
+// RuleSpec 配置文件中的签名规则
+type RuleSpec struct {
+	Literal string `yaml:"literal" json:"literal"`
+	Hex     string `yaml:"hex" json:"hex"`
+	Mask    string `yaml:"mask" json:"mask"`
+	Regex   string `yaml:"regex" json:"regex"`
+	Offset  int    `yaml:"offset" json:"offset"`
+	Depth   int    `yaml:"depth" json:"depth"`
+}
+
+// 内置处理器类型
+const (
+	ProcessorRaw            = "raw"             // 原始数据处理器
+	ProcessorLine           = "line"            // 行处理器
+	ProcessorLengthPrefixed = "length_prefixed" // 长度前缀处理器
+)
+
+// ProcessorSpec 配置文件中的处理器配置
+type ProcessorSpec struct {
+	Type string `yaml:"type" json:"type"` // raw（默认）、line、length_prefixed
+
+	// line
+	MaxLine int `yaml:"max_line" json:"max_line"`
+
+	// length_prefixed
+	LengthOffset int    `yaml:"length_offset" json:"length_offset"`
+	LengthSize   int    `yaml:"length_size" json:"length_size"`
+	ByteOrder    string `yaml:"byte_order" json:"byte_order"` // big（默认）或little
+	LengthAdjust int    `yaml:"length_adjust" json:"length_adjust"`
+	MaxMessage   int    `yaml:"max_message" json:"max_message"`
+}
+
+// ParsePortRange 解析端口或端口范围，如 "80"、"8000-8999"
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	low, high, isRange := strings.Cut(s, "-")
+	lowPort, err := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+	if err != nil || lowPort == 0 {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return PortRange{Low: uint16(lowPort), High: uint16(lowPort)}, nil
+	}
+	highPort, err := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+	if err != nil || highPort < lowPort {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Low: uint16(lowPort), High: uint16(highPort)}, nil
+}
+
+// UnmarshalYAML 支持端口号或 "起始-结束" 形式的端口范围
+func (r *PortRange) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: port must be a number or a range string", value.Line)
+	}
+	pr, err := ParsePortRange(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+	*r = pr
+	return nil
+}
+
+// UnmarshalJSON 支持端口号或 "起始-结束" 形式的端口范围
+func (r *PortRange) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	pr, err := ParsePortRange(s)
+	if err != nil {
+		return err
+	}
+	*r = pr
+	return nil
+}
+
+// ParseSignatureConfig 解析签名配置，format为 "yaml" 或 "json"
+// 未知字段会被视为错误，避免拼写错误被静默忽略
+func ParseSignatureConfig(data []byte, format string) (*SignatureConfig, error) {
+	config := &SignatureConfig{}
+	switch strings.ToLower(format) {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("parse json: %v", err)
+		}
+	case "yaml", "yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("parse yaml: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signature config format %q", format)
+	}
+	return config, nil
+}
+
+// signatureFormat 根据文件扩展名判断配置格式
+func signatureFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return "json"
+	}
+	return "yaml"
+}
+
+// LoadSignatureFile 从YAML/JSON文件加载签名并注册到协议注册表
+// 内置处理器的输出写入output，为nil时输出到标准输出
+// 所有签名都校验通过后才会注册，任何一个签名无效时不注册任何签名
+// 加载的签名以文件的绝对路径作为分组（见 WithGroup），再次加载同一文件时替换之前加载的签名
+func LoadSignatureFile(registry *ProtocolRegistry, path string, output io.Writer) error {
+	group, err := signatureGroup(path)
+	if err != nil {
+		return err
+	}
+	config, err := readSignatureFile(path)
+	if err != nil {
+		return err
+	}
+	staging := NewProtocolRegistry()
+	if err := config.Register(staging, output); err != nil {
+		return fmt.Errorf("load signatures from %s: %v", path, err)
+	}
+	registry.ReplaceGroup(group, staging)
+	return nil
+}
+
+// ReloadSignatureFile 重新加载签名文件，原子地替换之前从该文件加载的所有签名
+// 新文件校验失败时保留原有签名并返回错误；已经识别出协议的流继续使用原来的处理器
+func ReloadSignatureFile(registry *ProtocolRegistry, path string, output io.Writer) error {
+	return LoadSignatureFile(registry, path, output)
+}
+
+// signatureGroup 返回签名文件的分组名，同一文件的不同写法（相对路径、./、..）对应同一个分组
+func signatureGroup(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("load signatures: %v", err)
+	}
+	return abs, nil
+}
+
+// readSignatureFile 读取并解析签名文件
+func readSignatureFile(path string) (*SignatureConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load signatures: %v", err)
+	}
+	config, err := ParseSignatureConfig(data, signatureFormat(path))
+	if err != nil {
+		return nil, fmt.Errorf("load signatures from %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// signatureEntry 校验通过、等待注册的签名
+type signatureEntry struct {
+	detector *SignatureDetector
+	opts     []RegisterOption
+}
+
+// build 校验配置并创建检测器，所有错误会一并返回
+func (sc *SignatureConfig) build(output io.Writer) ([]signatureEntry, error) {
+	var errs []error
+	var entries []signatureEntry
+	names := make(map[string]int)
+
+	if len(sc.Signatures) == 0 {
+		return nil, errors.New("no signatures defined")
+	}
+
+	for i, spec := range sc.Signatures {
+		where := fmt.Sprintf("signatures[%d]", i)
+		if spec.Name != "" {
+			where = fmt.Sprintf("signatures[%d] (%s)", i, spec.Name)
+			if first, ok := names[spec.Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate name, already defined by signatures[%d]", where, first))
+				continue
+			}
+			names[spec.Name] = i
+		}
+
+		entry, err := spec.build(output)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", where, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return entries, nil
+}
+
+// Register 校验配置并将所有签名注册到协议注册表，opts会附加到每个签名的注册选项之后
+// 任何一个签名无效时不注册任何签名，并返回所有错误
+func (sc *SignatureConfig) Register(registry *ProtocolRegistry, output io.Writer, opts ...RegisterOption) error {
+	entries, err := sc.build(output)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		registry.Register(entry.detector, append(entry.opts, opts...)...)
+	}
+	return nil
+}
+
+// build 校验单个签名并创建检测器
+func (spec *SignatureSpec) build(output io.Writer) (signatureEntry, error) {
+	if spec.Name == "" {
+		return signatureEntry{}, errors.New("name is required")
+	}
+
+	sig := Signature{
+		Name:       spec.Name,
+		RequireAll: spec.RequireAll,
+		Confidence: spec.Confidence,
+	}
+	for _, group := range []struct {
+		key   string
+		dir   SignatureDirection
+		rules []RuleSpec
+	}{
+		{"client", SignatureClientToServer, spec.Client},
+		{"server", SignatureServerToClient, spec.Server},
+		{"any", SignatureAnyDir, spec.Any},
+	} {
+		for j, rule := range group.rules {
+			sr := SignatureRule{
+				Dir:     group.dir,
+				Literal: rule.Literal,
+				Hex:     rule.Hex,
+				Mask:    rule.Mask,
+				Regex:   rule.Regex,
+				Offset:  rule.Offset,
+				Depth:   rule.Depth,
+			}
+			// 提前编译以便在错误信息中指出具体的规则位置
+			if _, err := compileRule(sr); err != nil {
+				return signatureEntry{}, fmt.Errorf("%s[%d]: %v", group.key, j, err)
+			}
+			sig.Rules = append(sig.Rules, sr)
+		}
+	}
+	if len(sig.Rules) == 0 {
+		return signatureEntry{}, errors.New("at least one client, server or any rule is required")
+	}
+
+	factory, err := spec.Processor.factory(spec.Name, output)
+	if err != nil {
+		return signatureEntry{}, fmt.Errorf("processor: %v", err)
+	}
+
+	detector, err := NewSignatureDetector(sig, factory)
+	if err != nil {
+		return signatureEntry{}, err
+	}
+
+	opts := []RegisterOption{WithPriority(spec.Priority)}
+	if len(spec.Ports) > 0 {
+		opts = append(opts, withPreferredPortRanges(spec.Ports))
+	}
+	if spec.PortBoost != nil {
+		if *spec.PortBoost < 0 || *spec.PortBoost > 100 {
+			return signatureEntry{}, fmt.Errorf("port_boost %d out of range 0-100", *spec.PortBoost)
+		}
+		opts = append(opts, WithPortBoost(*spec.PortBoost))
+	}
+	if len(spec.FallbackPorts) > 0 {
+		opts = append(opts, withFallbackPortRanges(spec.FallbackPorts))
+	}
+	return signatureEntry{detector: detector, opts: opts}, nil
+}
+
+// factory 根据处理器配置创建处理器工厂
+func (ps *ProcessorSpec) factory(name string, output io.Writer) (func(StreamInfo) ProtocolProcessor, error) {
+	switch ps.Type {
+	case "", ProcessorRaw:
+		return func(streamInfo StreamInfo) ProtocolProcessor {
+			return NewRawProcessor(name, streamInfo, output)
+		}, nil
+
+	case ProcessorLine:
+		if ps.MaxLine < 0 {
+			return nil, fmt.Errorf("negative max_line %d", ps.MaxLine)
+		}
+		maxLine := ps.MaxLine
+		return func(streamInfo StreamInfo) ProtocolProcessor {
+			return NewLineProcessor(name, streamInfo, output, maxLine)
+		}, nil
+
+	case ProcessorLengthPrefixed:
+		config := LengthPrefixConfig{
+			LengthOffset: ps.LengthOffset,
+			LengthSize:   ps.LengthSize,
+			LengthAdjust: ps.LengthAdjust,
+			MaxMessage:   ps.MaxMessage,
+		}
+		switch strings.ToLower(ps.ByteOrder) {
+		case "", "big":
+			config.ByteOrder = binary.BigEndian
+		case "little":
+			config.ByteOrder = binary.LittleEndian
+		default:
+			return nil, fmt.Errorf("invalid byte_order %q, must be big or little", ps.ByteOrder)
+		}
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		return func(streamInfo StreamInfo) ProtocolProcessor {
+			processor, _ := NewLengthPrefixedProcessor(name, streamInfo, output, config)
+			return processor
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown type %q, must be one of %s, %s, %s", ps.Type, ProcessorRaw, ProcessorLine, ProcessorLengthPrefixed)
+}
+
+// withPreferredPortRanges 设置多个首选端口范围
+func withPreferredPortRanges(ranges []PortRange) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.preferredPorts = append(entry.preferredPorts, ranges...)
+	}
+}
+
+// withFallbackPortRanges 设置多个兜底端口范围
+func withFallbackPortRanges(ranges []PortRange) RegisterOption {
+	return func(entry *detectorEntry) {
+		entry.fallbackPorts = append(entry.fallbackPorts, ranges...)
+	}
+}
@@ -0,0 +1,164 @@
+package tcpdumper
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSignatureYAML = `
+signatures:
+  - name: MyProto
+    confidence: 85
+    priority: 5
+    ports: [9000, "9100-9200"]
+    fallback_ports: [9000]
+    client:
+      - hex: "ca fe ?? ??"
+    processor:
+      type: length_prefixed
+      length_offset: 2
+      length_size: 2
+      byte_order: little
+  - name: Banner
+    require_all: true
+    server:
+      - regex: "^\\+OK "
+        depth: 16
+    client:
+      - literal: "USER "
+    processor:
+      type: line
+`
+
+// 测试解析YAML签名配置并注册
+func TestLoadSignatureYAML(t *testing.T) {
+	config, err := ParseSignatureConfig([]byte(testSignatureYAML), "yaml")
+	assert.NoError(t, err)
+	assert.Len(t, config.Signatures, 2)
+	assert.Equal(t, []PortRange{{9000, 9000}, {9100, 9200}}, config.Signatures[0].Ports)
+
+	registry := NewProtocolRegistry()
+	var out bytes.Buffer
+	assert.NoError(t, config.Register(registry, &out))
+	assert.Equal(t, []string{"MyProto", "Banner"}, registry.GetRegisteredProtocols())
+
+	// 十六进制签名 + 长度前缀处理器
+	detector := registry.DetectProtocol([]byte{0xca, 0xfe, 0x02, 0x00, 'h', 'i'}, reassembly.TCPDirClientToServer)
+	assert.NotNil(t, detector)
+	assert.Equal(t, "MyProto", detector.Name())
+	processor := detector.CreateProcessor(StreamInfo{Ident: "s1"})
+	assert.NoError(t, processor.ProcessData([]byte{0xca, 0xfe, 0x02, 0x00, 'h'}, reassembly.TCPDirClientToServer, true, false))
+	assert.NoError(t, processor.ProcessData([]byte{'i', 0xca}, reassembly.TCPDirClientToServer, false, false))
+	assert.Contains(t, out.String(), "MyProto/s1 [client->server]: message (6 bytes)")
+
+	// 兜底端口
+	assert.Equal(t, "MyProto", registry.PortFallback(StreamInfo{SrcPort: "40000", DstPort: "9000"}).Name())
+
+	// 双向规则 + 行处理器
+	out.Reset()
+	ctx := &DetectContext{
+		Dir:        reassembly.TCPDirClientToServer,
+		ServerData: []byte("+OK POP3 ready\r\n"),
+		ClientData: []byte("USER bob\r\n"),
+	}
+	detector = registry.DetectProtocolWithContext(ctx)
+	assert.NotNil(t, detector)
+	assert.Equal(t, "Banner", detector.Name())
+	processor = detector.CreateProcessor(StreamInfo{Ident: "s2"})
+	assert.NoError(t, processor.ProcessData(ctx.ServerData, reassembly.TCPDirServerToClient, true, false))
+	assert.NoError(t, processor.ProcessData([]byte("USER "), reassembly.TCPDirClientToServer, true, false))
+	assert.NoError(t, processor.ProcessData([]byte("bob\r\nPASS"), reassembly.TCPDirClientToServer, false, false))
+	assert.NoError(t, processor.Close())
+	assert.Equal(t, "Banner/s2 [server->client]: +OK POP3 ready\n"+
+		"Banner/s2 [client->server]: USER bob\n"+
+		"Banner/s2 [client->server]: PASS\n"+
+		"Banner/s2: Connection closed\n", out.String())
+}
+
+// 测试从JSON文件加载签名
+func TestLoadSignatureFileJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures.json")
+	err := os.WriteFile(path, []byte(`{"signatures": [{"name": "SSH", "server": [{"literal": "SSH-"}], "ports": [22]}]}`), 0o644)
+	assert.NoError(t, err)
+
+	dumper := NewSimpleDumper()
+	assert.NoError(t, dumper.LoadSignatureFile(path))
+	assert.Equal(t, []string{"SSH"}, dumper.GetRegisteredProtocols())
+}
+
+// 测试签名配置校验的错误信息
+func TestSignatureConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		config string
+		errs   []string
+	}{
+		{"unknown field", "yaml", "signatures:\n  - name: A\n    clinet: []\n", []string{"field clinet not found"}},
+		{"unknown json field", "json", `{"signatures": [{"name": "A", "confidense": 1}]}`, []string{`unknown field "confidense"`}},
+		{"empty", "yaml", "", []string{"no signatures defined"}},
+		{"bad port", "yaml", "signatures:\n  - name: A\n    ports: [70000]\n", []string{"line 3", `invalid port "70000"`}},
+		{"bad port range", "json", `{"signatures": [{"name": "A", "ports": ["200-100"]}]}`, []string{`invalid port range "200-100"`}},
+		{"unsupported format", "toml", "", []string{`unsupported signature config format "toml"`}},
+		{
+			"multiple errors", "yaml", `
+signatures:
+  - name: A
+    client:
+      - regex: "("
+  - server:
+      - literal: x
+  - name: A
+    any:
+      - literal: x
+  - name: B
+    processor:
+      type: framer
+  - name: C
+    any:
+      - literal: x
+    processor:
+      type: length_prefixed
+      length_size: 3
+  - name: D
+    any:
+      - hex: "01 02"
+        mask: "ff"
+`, []string{
+				"signatures[0] (A): client[0]: invalid regex",
+				"signatures[1]: name is required",
+				"signatures[2] (A): duplicate name, already defined by signatures[0]",
+				"signatures[3] (B): at least one client, server or any rule is required",
+				"signatures[4] (C): processor: invalid length size 3",
+				"signatures[5] (D): any[0]: mask length 1 does not match pattern length 2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewProtocolRegistry()
+			config, err := ParseSignatureConfig([]byte(tt.config), tt.format)
+			if err == nil {
+				err = config.Register(registry, nil)
+			}
+			if assert.Error(t, err) {
+				for _, msg := range tt.errs {
+					assert.Contains(t, err.Error(), msg)
+				}
+			}
+			// 配置无效时不注册任何签名
+			assert.Empty(t, registry.GetRegisteredProtocols())
+		})
+	}
+
+	err := LoadSignatureFile(NewProtocolRegistry(), filepath.Join(t.TempDir(), "missing.yaml"), nil)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "load signatures:"))
+}
@@ -0,0 +1,117 @@
+package tcpdumper
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试十六进制模式解析
+func TestParseHexPattern(t *testing.T) {
+	pattern, mask, err := ParseHexPattern("16 03 ?? 0?")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x16, 0x03, 0x00, 0x00}, pattern)
+	assert.Equal(t, []byte{0xff, 0xff, 0x00, 0xf0}, mask)
+
+	pattern, mask, err = ParseHexPattern("CAFEbabe")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xca, 0xfe, 0xba, 0xbe}, pattern)
+	assert.Nil(t, mask)
+
+	_, _, err = ParseHexPattern("123")
+	assert.Error(t, err)
+	_, _, err = ParseHexPattern("zz")
+	assert.Error(t, err)
+	_, _, err = ParseHexPattern(" ")
+	assert.Error(t, err)
+}
+
+// 测试各种签名规则的匹配
+func TestSignatureDetector(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  SignatureRule
+		data  string
+		dir   reassembly.TCPFlowDirection
+		match bool
+	}{
+		{"literal at start", SignatureRule{Literal: "SSH-"}, "SSH-2.0-Go", reassembly.TCPDirServerToClient, true},
+		{"literal not at start", SignatureRule{Literal: "SSH-"}, "xSSH-2.0", reassembly.TCPDirServerToClient, false},
+		{"literal with offset", SignatureRule{Literal: "SMB", Offset: 5}, "\x00\x00\x00\x45\xffSMBr", reassembly.TCPDirClientToServer, true},
+		{"literal within depth", SignatureRule{Literal: "HTTP/1.", Depth: 32}, "GET /index.html HTTP/1.1\r\n", reassembly.TCPDirClientToServer, true},
+		{"literal beyond depth", SignatureRule{Literal: "HTTP/1.", Depth: 10}, "GET /index.html HTTP/1.1\r\n", reassembly.TCPDirClientToServer, false},
+		{"hex wildcard", SignatureRule{Hex: "16 03 ?? ?? ?? 01"}, "\x16\x03\x01\x02\x00\x01", reassembly.TCPDirClientToServer, true},
+		{"hex nibble wildcard", SignatureRule{Hex: "4?"}, "\x47", reassembly.TCPDirClientToServer, true},
+		{"hex nibble mismatch", SignatureRule{Hex: "4?"}, "\x57", reassembly.TCPDirClientToServer, false},
+		{"hex mask", SignatureRule{Hex: "80 00", Mask: "f0 00"}, "\x8a\x55", reassembly.TCPDirClientToServer, true},
+		{"hex search in depth", SignatureRule{Hex: "ca fe ?? be", Depth: 8}, "\x00\x00\xca\xfe\xba\xbe", reassembly.TCPDirClientToServer, true},
+		{"regex anchored", SignatureRule{Regex: `^\+OK `}, "+OK POP3 ready\r\n", reassembly.TCPDirServerToClient, true},
+		{"regex with depth", SignatureRule{Regex: `(?i)user-agent:`, Depth: 16}, "GET / HTTP/1.1\r\nUser-Agent: x\r\n", reassembly.TCPDirClientToServer, false},
+		{"direction mismatch", SignatureRule{Literal: "220 ", Dir: SignatureServerToClient}, "220 ready", reassembly.TCPDirClientToServer, false},
+		{"direction match", SignatureRule{Literal: "220 ", Dir: SignatureServerToClient}, "220 ready", reassembly.TCPDirServerToClient, true},
+		{"offset beyond data", SignatureRule{Literal: "x", Offset: 10}, "short", reassembly.TCPDirClientToServer, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := NewSignatureDetector(Signature{Name: "Test", Rules: []SignatureRule{tt.rule}}, newTestProcessorFactory())
+			assert.NoError(t, err)
+			confidence := detector.Detect([]byte(tt.data), tt.dir)
+			if tt.match {
+				assert.Equal(t, defaultSignatureConfidence, confidence)
+			} else {
+				assert.Equal(t, 0, confidence)
+			}
+		})
+	}
+}
+
+// 测试需要双向规则同时命中的签名
+func TestSignatureRequireAll(t *testing.T) {
+	registry := NewProtocolRegistry()
+	err := RegisterSignatureProtocol(registry, Signature{
+		Name:       "FTP",
+		RequireAll: true,
+		Confidence: 80,
+		Rules: []SignatureRule{
+			{Dir: SignatureServerToClient, Regex: `^220[ -]`},
+			{Dir: SignatureClientToServer, Regex: `^(USER|AUTH|FEAT) `},
+		},
+	}, newTestProcessorFactory())
+	assert.NoError(t, err)
+
+	ctx := &DetectContext{Dir: reassembly.TCPDirServerToClient, ServerData: []byte("220 FTP ready\r\n")}
+	assert.Nil(t, registry.DetectProtocolWithContext(ctx))
+
+	ctx.Dir = reassembly.TCPDirClientToServer
+	ctx.ClientData = []byte("USER anonymous\r\n")
+	detector := registry.DetectProtocolWithContext(ctx)
+	assert.NotNil(t, detector)
+	assert.Equal(t, "FTP", detector.Name())
+}
+
+// 测试无效签名
+func TestInvalidSignature(t *testing.T) {
+	factory := newTestProcessorFactory()
+	invalid := []Signature{
+		{Rules: []SignatureRule{{Literal: "x"}}},
+		{Name: "NoRules"},
+		{Name: "Empty", Rules: []SignatureRule{{}}},
+		{Name: "Both", Rules: []SignatureRule{{Literal: "x", Regex: "x"}}},
+		{Name: "BadRegex", Rules: []SignatureRule{{Regex: "("}}},
+		{Name: "BadHex", Rules: []SignatureRule{{Hex: "xyz"}}},
+		{Name: "MaskLength", Rules: []SignatureRule{{Hex: "0102", Mask: "ff"}}},
+		{Name: "MaskWithoutHex", Rules: []SignatureRule{{Literal: "x", Mask: "ff"}}},
+		{Name: "ShortDepth", Rules: []SignatureRule{{Literal: "abcdef", Depth: 3}}},
+		{Name: "NegativeOffset", Rules: []SignatureRule{{Literal: "x", Offset: -1}}},
+		{Name: "Confidence", Confidence: 101, Rules: []SignatureRule{{Literal: "x"}}},
+	}
+	for _, sig := range invalid {
+		_, err := NewSignatureDetector(sig, factory)
+		assert.Error(t, err, sig.Name)
+	}
+
+	_, err := NewSignatureDetector(Signature{Name: "NoFactory", Rules: []SignatureRule{{Literal: "x"}}}, nil)
+	assert.Error(t, err)
+}
@@ -36,9 +36,10 @@ func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.T
 		net:       net,
 		transport: transport,
 		ident:     ident,
-		registry:  factory.registry,
 		factory:   factory,
 	}
+	stream.dispatcher = NewDispatcher(factory.registry, stream.streamInfo(), factory.defaultProcessorFactory)
+	stream.dispatcher.onUnknown = factory.countUnknownFlow
 
 	factory.mu.Lock()
 	factory.wg.Add(1)
@@ -47,24 +48,36 @@ func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.T
 	return stream
 }
 
+// countUnknownFlow 更新未知流统计
+func (factory *tcpStreamFactory) countUnknownFlow() {
+	if factory.dumper != nil {
+		factory.dumper.mu.Lock()
+		factory.dumper.stats.unknownFlows++
+		factory.dumper.mu.Unlock()
+	}
+}
+
 // WaitGoRoutines 等待所有TCP流处理完成
 func (factory *tcpStreamFactory) WaitGoRoutines() {
 	factory.wg.Wait()
 }
 
 // tcpStream TCP流处理器
+// 协议检测和分发由 Dispatcher 完成，tcpStream 只负责把重组后的数据交给它
 type tcpStream struct {
 	net, transport gopacket.Flow
 	ident          string
-	registry       *ProtocolRegistry
 	factory        *tcpStreamFactory
-	processor      ProtocolProcessor
-	detected       bool
-	mu             sync.Mutex
+	dispatcher     *Dispatcher
 }
 
 // Accept 接受TCP数据包
 func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	// 记录是否看到SYN，供协议检测参考
+	if tcp.SYN {
+		t.dispatcher.SetSawSYN(true)
+	}
+
 	// 简化的接受逻辑，接受所有数据包
 	return true
 }
@@ -86,58 +99,30 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 		return
 	}
 
-	// 协议检测（只在第一次有数据时进行）
-	if !t.detected && len(data) > 0 {
-		t.mu.Lock()
-		if !t.detected { // 双重检查
-			detector := t.registry.DetectProtocol(data, dir)
-
-			// 构造StreamInfo
-			srcIP, dstIP := t.net.Endpoints()
-			srcPort, dstPort := t.transport.Endpoints()
-			streamInfo := StreamInfo{
-				SrcIP:   srcIP.String(),
-				SrcPort: srcPort.String(),
-				DstIP:   dstIP.String(),
-				DstPort: dstPort.String(),
-				Ident:   t.ident,
-			}
-
-			if detector != nil {
-				t.processor = detector.CreateProcessor(streamInfo)
-				t.detected = true
-			} else {
-				// 没有匹配的协议，使用默认处理器
-				if t.factory.defaultProcessorFactory != nil {
-					t.processor = t.factory.defaultProcessorFactory(streamInfo)
-					// 更新未知流统计
-					if t.factory.dumper != nil {
-						t.factory.dumper.mu.Lock()
-						t.factory.dumper.stats.unknownFlows++
-						t.factory.dumper.mu.Unlock()
-					}
-				}
-				t.detected = true // 标记为已检测，避免重复检测
-			}
-		}
-		t.mu.Unlock()
+	if err := t.dispatcher.ProcessTimedData(data, dir, start, end, sg.CaptureInfo(0).Timestamp); err != nil {
+		// 记录错误但不中断处理
+		fmt.Printf("Error processing %s data: %v\n", t.dispatcher.GetProtocolName(), err)
 	}
+}
 
-	// 如果有协议处理器，则处理数据
-	if t.processor != nil {
-		err := t.processor.ProcessData(data, dir, start, end)
-		if err != nil {
-			// 记录错误但不中断处理
-			fmt.Printf("Error processing %s data: %v\n", t.processor.GetProtocolName(), err)
-		}
+// streamInfo 构造StreamInfo
+func (t *tcpStream) streamInfo() StreamInfo {
+	srcIP, dstIP := t.net.Endpoints()
+	srcPort, dstPort := t.transport.Endpoints()
+	return StreamInfo{
+		SrcIP:   srcIP.String(),
+		SrcPort: srcPort.String(),
+		DstIP:   dstIP.String(),
+		DstPort: dstPort.String(),
+		Ident:   t.ident,
 	}
 }
 
 // ReassemblyComplete TCP流重组完成
 func (t *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	// 关闭协议处理器
-	if t.processor != nil {
-		t.processor.Close()
+	// 流结束时仍未完成检测的数据由分发器交给兜底/默认处理器，然后关闭协议处理器
+	if err := t.dispatcher.Close(); err != nil {
+		fmt.Printf("Error processing %s data: %v\n", t.dispatcher.GetProtocolName(), err)
 	}
 
 	// 通知工厂一个流处理完成
@@ -0,0 +1,153 @@
+package tcpdumper
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeScatterGather 测试用的重组数据
+type fakeScatterGather struct {
+	data       []byte
+	dir        reassembly.TCPFlowDirection
+	start, end bool
+}
+
+func (sg *fakeScatterGather) Lengths() (int, int)     { return len(sg.data), 0 }
+func (sg *fakeScatterGather) Fetch(length int) []byte { return sg.data[:length] }
+func (sg *fakeScatterGather) KeepFrom(offset int)     {}
+func (sg *fakeScatterGather) CaptureInfo(offset int) gopacket.CaptureInfo {
+	return gopacket.CaptureInfo{}
+}
+func (sg *fakeScatterGather) Info() (reassembly.TCPFlowDirection, bool, bool, int) {
+	return sg.dir, sg.start, sg.end, 0
+}
+func (sg *fakeScatterGather) Stats() reassembly.TCPAssemblyStats {
+	return reassembly.TCPAssemblyStats{}
+}
+
+// newTestStream 创建一个 10.0.0.1:12345 -> 10.0.0.2:dstPort 的测试流
+func newTestStream(dumper *TCPDumper, dstPort uint16, syn bool) *tcpStream {
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	transportFlow := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x30, 0x39}, []byte{byte(dstPort >> 8), byte(dstPort)})
+	tcp := &layers.TCP{SYN: syn}
+	stream := dumper.factory.New(netFlow, transportFlow, tcp, nil).(*tcpStream)
+	stream.Accept(tcp, gopacket.CaptureInfo{}, reassembly.TCPDirClientToServer, 0, nil, nil)
+	return stream
+}
+
+// feed 向测试流写入一段数据
+func feed(stream *tcpStream, dir reassembly.TCPFlowDirection, data string) {
+	stream.ReassembledSG(&fakeScatterGather{data: []byte(data), dir: dir}, nil)
+}
+
+// recordProcessor 记录收到的数据的测试处理器
+type recordProcessor struct {
+	name   string
+	chunks []string
+	closed bool
+}
+
+func (rp *recordProcessor) ProcessData(data []byte, dir reassembly.TCPFlowDirection, start, end bool) error {
+	rp.chunks = append(rp.chunks, dir.String()+":"+string(data))
+	return nil
+}
+
+func (rp *recordProcessor) Close() error {
+	rp.closed = true
+	return nil
+}
+
+func (rp *recordProcessor) GetProtocolName() string {
+	return rp.name
+}
+
+// 测试服务器先发言的协议可以通过检测上下文识别
+func TestDetectServerFirstProtocol(t *testing.T) {
+	dumper := NewSimpleDumper()
+	var processor *recordProcessor
+	var gotCtx DetectContext
+	RegisterContextProtocol(dumper.registry, "SMTP", func(ctx *DetectContext) int {
+		gotCtx = *ctx
+		if ctx.Dir == reassembly.TCPDirServerToClient && strings.HasPrefix(string(ctx.ServerData), "220 ") {
+			return 90
+		}
+		return 0
+	}, func(streamInfo StreamInfo) ProtocolProcessor {
+		processor = &recordProcessor{name: "SMTP"}
+		return processor
+	})
+
+	stream := newTestStream(dumper, 25, true)
+	feed(stream, reassembly.TCPDirServerToClient, "220 mail.example.com ESMTP\r\n")
+	feed(stream, reassembly.TCPDirClientToServer, "EHLO client\r\n")
+	stream.ReassemblyComplete(nil)
+
+	assert.NotNil(t, processor)
+	assert.Equal(t, []string{
+		"server->client:220 mail.example.com ESMTP\r\n",
+		"client->server:EHLO client\r\n",
+	}, processor.chunks)
+	assert.True(t, processor.closed)
+	assert.True(t, gotCtx.SawSYN)
+	assert.Equal(t, "25", gotCtx.StreamInfo.DstPort)
+}
+
+// 测试需要对端响应才能确认的协议：第一次检测失败时缓存数据，等对端数据到达后再检测
+func TestDetectWithPeerReply(t *testing.T) {
+	dumper := NewSimpleDumper()
+	var processor *recordProcessor
+	RegisterContextProtocol(dumper.registry, "Echo", func(ctx *DetectContext) int {
+		if len(ctx.ClientData) > 0 && string(ctx.ClientData) == string(ctx.ServerData) {
+			return 80
+		}
+		return 0
+	}, func(streamInfo StreamInfo) ProtocolProcessor {
+		processor = &recordProcessor{name: "Echo"}
+		return processor
+	})
+
+	stream := newTestStream(dumper, 7, false)
+	feed(stream, reassembly.TCPDirClientToServer, "ping")
+	assert.Nil(t, processor)
+	feed(stream, reassembly.TCPDirServerToClient, "ping")
+	assert.NotNil(t, processor)
+	feed(stream, reassembly.TCPDirClientToServer, "pong")
+	stream.ReassemblyComplete(nil)
+
+	assert.Equal(t, []string{"client->server:ping", "server->client:ping", "client->server:pong"}, processor.chunks)
+}
+
+// 测试无法识别的流在对端响应后交给默认处理器，缓存的数据不会丢失
+func TestDetectFallbackToDefaultProcessor(t *testing.T) {
+	dumper := NewSimpleDumper()
+	var processor *recordProcessor
+	dumper.SetDefaultProcessor(func(streamInfo StreamInfo) ProtocolProcessor {
+		processor = &recordProcessor{name: "RAW"}
+		return processor
+	})
+
+	stream := newTestStream(dumper, 9999, true)
+	feed(stream, reassembly.TCPDirClientToServer, "hello")
+	feed(stream, reassembly.TCPDirClientToServer, "world")
+	assert.Nil(t, processor)
+	feed(stream, reassembly.TCPDirServerToClient, "ok")
+	assert.NotNil(t, processor)
+	stream.ReassemblyComplete(nil)
+
+	assert.Equal(t, []string{"client->server:hello", "client->server:world", "server->client:ok"}, processor.chunks)
+	_, _, _, unknownFlows := dumper.GetStats()
+	assert.Equal(t, uint64(1), unknownFlows)
+
+	// 只有单方向数据的流在结束时交给默认处理器
+	stream = newTestStream(dumper, 9999, true)
+	feed(stream, reassembly.TCPDirClientToServer, "one-way")
+	stream.ReassemblyComplete(nil)
+	assert.Equal(t, []string{"client->server:one-way"}, processor.chunks)
+	assert.True(t, processor.closed)
+}
@@ -0,0 +1,172 @@
+package tcpdumper
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// DefaultUDPIdleTimeout UDP流的默认空闲超时
+const DefaultUDPIdleTimeout = 30 * time.Second
+
+// udpFlowKey 按客户端到服务器方向的网络层和传输层端点标识一个UDP流
+type udpFlowKey struct {
+	net, transport gopacket.Flow
+}
+
+// udpFlow 一个UDP流
+type udpFlow struct {
+	dispatcher *Dispatcher
+	lastSeen   time.Time
+	started    [2]bool // 每个方向是否已收到过数据报
+}
+
+// udpTracker UDP流跟踪器
+// UDP没有连接，两个端点之间的数据报归为一个流：第一个数据报的发送方为客户端，
+// 但发送方端口小于1024且小于对端端口时视为服务器（抓包从响应开始）。
+// 每个数据报作为一个数据块交给流的 Dispatcher，处理器收到的数据块保持数据报的边界；
+// 流空闲超过超时时间后关闭。没有注册UDP检测器时不跟踪UDP，只在抓包goroutine中使用，不需要加锁
+type udpTracker struct {
+	registry *ProtocolRegistry
+	dumper   *TCPDumper // 用于更新统计信息
+	timeout  time.Duration
+	flows    map[udpFlowKey]*udpFlow
+
+	now        time.Time // 最新的数据报时间
+	lastExpire time.Time // 上次清理空闲流的时间
+}
+
+func newUDPTracker(registry *ProtocolRegistry, dumper *TCPDumper, timeout time.Duration) *udpTracker {
+	if timeout <= 0 {
+		timeout = DefaultUDPIdleTimeout
+	}
+	return &udpTracker{
+		registry: registry,
+		dumper:   dumper,
+		timeout:  timeout,
+		flows:    make(map[udpFlowKey]*udpFlow),
+	}
+}
+
+// enabled 是否注册了UDP检测器
+func (ut *udpTracker) enabled() bool {
+	return len(ut.registry.snapshot().detectors) > 0
+}
+
+// datagram 把一个数据报交给所属的流，ts 为抓包时间
+// 每隔半个超时时间按数据报的时间清理空闲流，读取pcap文件时超时也以文件中的时间计算
+func (ut *udpTracker) datagram(netFlow gopacket.Flow, udp *layers.UDP, ts time.Time) {
+	if ts.After(ut.now) {
+		ut.now = ts
+	}
+	if ut.lastExpire.IsZero() {
+		ut.lastExpire = ut.now
+	} else if ut.now.Sub(ut.lastExpire) >= ut.timeout/2 {
+		ut.expire(ut.now.Add(-ut.timeout))
+		ut.lastExpire = ut.now
+	}
+
+	key := udpFlowKey{net: netFlow, transport: udp.TransportFlow()}
+	dir := reassembly.TCPDirClientToServer
+	flow := ut.flows[key]
+	if flow == nil {
+		reverse := udpFlowKey{net: key.net.Reverse(), transport: key.transport.Reverse()}
+		if flow = ut.flows[reverse]; flow != nil {
+			dir = reassembly.TCPDirServerToClient
+		} else if udp.SrcPort < 1024 && udp.SrcPort < udp.DstPort {
+			key, dir = reverse, reassembly.TCPDirServerToClient
+		}
+	}
+	if flow == nil {
+		flow = ut.newFlow(key)
+		ut.flows[key] = flow
+	}
+	flow.lastSeen = ts
+
+	ut.dumper.mu.Lock()
+	ut.dumper.stats.udpDatagrams++
+	ut.dumper.mu.Unlock()
+
+	if len(udp.Payload) == 0 {
+		return
+	}
+	idx := dirIndex(dir)
+	start := !flow.started[idx]
+	flow.started[idx] = true
+	if err := flow.dispatcher.ProcessTimedData(udp.Payload, dir, start, false, ts); err != nil {
+		ut.processError(flow, err)
+	}
+}
+
+// processError 记录UDP流的处理错误
+func (ut *udpTracker) processError(flow *udpFlow, err error) {
+	log.Printf("Error processing UDP %s data: %v", flow.dispatcher.GetProtocolName(), err)
+	ut.dumper.mu.Lock()
+	ut.dumper.stats.errors++
+	ut.dumper.mu.Unlock()
+}
+
+// countUnknownFlow 更新未知流统计
+func (ut *udpTracker) countUnknownFlow() {
+	ut.dumper.mu.Lock()
+	ut.dumper.stats.unknownFlows++
+	ut.dumper.mu.Unlock()
+}
+
+// newFlow 创建UDP流，key为客户端到服务器方向
+func (ut *udpTracker) newFlow(key udpFlowKey) *udpFlow {
+	srcIP, dstIP := key.net.Endpoints()
+	srcPort, dstPort := key.transport.Endpoints()
+	streamInfo := StreamInfo{
+		SrcIP:   srcIP.String(),
+		SrcPort: srcPort.String(),
+		DstIP:   dstIP.String(),
+		DstPort: dstPort.String(),
+		Ident:   fmt.Sprintf("%s:%s - %s:%s", srcIP, srcPort, dstIP, dstPort),
+	}
+
+	ut.dumper.mu.Lock()
+	ut.dumper.stats.udpFlows++
+	ut.dumper.mu.Unlock()
+
+	// 无法识别的UDP流与TCP一样交给默认处理器，没有设置默认处理器时数据被丢弃
+	dispatcher := NewDispatcher(ut.registry, streamInfo, ut.dumper.defaultProcessorFactory)
+	dispatcher.onUnknown = ut.countUnknownFlow
+	return &udpFlow{dispatcher: dispatcher}
+}
+
+// expire 关闭最后一个数据报早于olderThan的流
+func (ut *udpTracker) expire(olderThan time.Time) {
+	ut.closeFlows(func(flow *udpFlow) bool {
+		return flow.lastSeen.Before(olderThan)
+	})
+}
+
+// flushAll 关闭所有流
+func (ut *udpTracker) flushAll() {
+	ut.closeFlows(func(*udpFlow) bool { return true })
+}
+
+// closeFlows 按最后活动时间的顺序关闭满足条件的流
+func (ut *udpTracker) closeFlows(match func(*udpFlow) bool) {
+	var closing []*udpFlow
+	for key, flow := range ut.flows {
+		if match(flow) {
+			closing = append(closing, flow)
+			delete(ut.flows, key)
+		}
+	}
+	sort.SliceStable(closing, func(i, j int) bool {
+		return closing[i].lastSeen.Before(closing[j].lastSeen)
+	})
+	for _, flow := range closing {
+		if err := flow.dispatcher.Close(); err != nil {
+			ut.processError(flow, err)
+		}
+	}
+}
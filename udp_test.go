@@ -0,0 +1,150 @@
+package tcpdumper
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+var udpTestTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// udpPacket 构造一个以太网/IPv4/UDP数据包
+func udpPacket(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16, payload string, ts time.Time) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = ts
+	return packet
+}
+
+// registerUDPEcho 注册以"Q:"开头的测试UDP协议，返回创建的处理器
+func registerUDPEcho(dumper *TCPDumper) *[]*recordProcessor {
+	var processors []*recordProcessor
+	RegisterContextProtocol(dumper.UDPRegistry(), "Echo", func(ctx *DetectContext) int {
+		if strings.HasPrefix(string(ctx.ClientData), "Q:") || strings.HasPrefix(string(ctx.ServerData), "R:") {
+			return 90
+		}
+		return 0
+	}, func(streamInfo StreamInfo) ProtocolProcessor {
+		p := &recordProcessor{name: streamInfo.Ident}
+		processors = append(processors, p)
+		return p
+	})
+	return &processors
+}
+
+// 每个数据报作为一个数据块交给处理器，方向以第一个数据报的发送方为客户端
+func TestUDPFlow(t *testing.T) {
+	dumper := NewSimpleDumper()
+	processors := registerUDPEcho(dumper)
+
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 9000, "Q:1", udpTestTime), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.2", 9000, "10.0.0.1", 40000, "R:1", udpTestTime), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 9000, "Q:2", udpTestTime), nil)
+	// 另一个客户端端口是另一个流
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40001, "10.0.0.2", 9000, "Q:3", udpTestTime), nil)
+	if !assert.Len(t, *processors, 2) {
+		return
+	}
+	p := (*processors)[0]
+	assert.Equal(t, "10.0.0.1:40000 - 10.0.0.2:9000", p.name)
+	assert.Equal(t, []string{"client->server:Q:1", "server->client:R:1", "client->server:Q:2"}, p.chunks)
+	assert.False(t, p.closed)
+
+	dumper.udp.flushAll()
+	assert.True(t, p.closed)
+	assert.True(t, (*processors)[1].closed)
+	datagrams, flows := dumper.GetUDPStats()
+	assert.Equal(t, uint64(4), datagrams)
+	assert.Equal(t, uint64(2), flows)
+}
+
+// 抓包从响应开始时，低端口的发送方视为服务器
+func TestUDPFlowServerFirst(t *testing.T) {
+	dumper := NewSimpleDumper()
+	processors := registerUDPEcho(dumper)
+
+	dumper.processPacket(udpPacket(t, "10.0.0.2", 53, "10.0.0.1", 40000, "R:1", udpTestTime), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 53, "Q:2", udpTestTime), nil)
+	dumper.udp.flushAll()
+	if assert.Len(t, *processors, 1) {
+		assert.Equal(t, "10.0.0.1:40000 - 10.0.0.2:53", (*processors)[0].name)
+		assert.Equal(t, []string{"server->client:R:1", "client->server:Q:2"}, (*processors)[0].chunks)
+	}
+}
+
+// 空闲超时按数据报的时间计算，每隔半个超时时间检查一次
+func TestUDPIdleTimeout(t *testing.T) {
+	dumper := NewDumper(&CaptureOptions{UDPIdleTimeout: 10 * time.Second})
+	processors := registerUDPEcho(dumper)
+
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 9000, "Q:1", udpTestTime), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40001, "10.0.0.2", 9000, "Q:2", udpTestTime.Add(8*time.Second)), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40001, "10.0.0.2", 9000, "Q:3", udpTestTime.Add(14*time.Second)), nil)
+	if !assert.Len(t, *processors, 2) {
+		return
+	}
+	assert.True(t, (*processors)[0].closed)
+	assert.False(t, (*processors)[1].closed)
+
+	// 超时关闭之后的数据报属于新的流
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 9000, "Q:4", udpTestTime.Add(15*time.Second)), nil)
+	if assert.Len(t, *processors, 3) {
+		assert.Equal(t, []string{"client->server:Q:4"}, (*processors)[2].chunks)
+	}
+	_, flows := dumper.GetUDPStats()
+	assert.Equal(t, uint64(3), flows)
+}
+
+// 没有注册UDP检测器时不跟踪UDP
+func TestUDPDisabled(t *testing.T) {
+	dumper := NewSimpleDumper()
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 53, "Q:1", udpTestTime), nil)
+	datagrams, flows := dumper.GetUDPStats()
+	assert.Zero(t, datagrams)
+	assert.Zero(t, flows)
+	assert.Empty(t, dumper.udp.flows)
+}
+
+// 无法识别的UDP流交给默认处理器并计入未知流，处理错误计入错误数
+func TestUDPUnknownFlowAndErrors(t *testing.T) {
+	dumper := NewSimpleDumper()
+	registerUDPEcho(dumper)
+	RegisterSimpleProtocol(dumper.UDPRegistry(), "Err", "E:", func(streamInfo StreamInfo) ProtocolProcessor {
+		return &errorProcessor{err: errors.New("boom")}
+	})
+	var defaults []*recordProcessor
+	dumper.SetDefaultProcessor(func(streamInfo StreamInfo) ProtocolProcessor {
+		p := &recordProcessor{name: "Default"}
+		defaults = append(defaults, p)
+		return p
+	})
+
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40000, "10.0.0.2", 9000, "X:1", udpTestTime), nil)
+	dumper.processPacket(udpPacket(t, "10.0.0.1", 40001, "10.0.0.2", 9000, "E:1", udpTestTime), nil)
+	dumper.udp.flushAll()
+	if assert.Len(t, defaults, 1) {
+		assert.Equal(t, []string{"client->server:X:1"}, defaults[0].chunks)
+		assert.True(t, defaults[0].closed)
+	}
+	_, _, errs, unknownFlows := dumper.GetStats()
+	assert.Equal(t, uint64(1), errs)
+	assert.Equal(t, uint64(1), unknownFlows)
+}